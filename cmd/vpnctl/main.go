@@ -16,11 +16,13 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"crypto/tls"
+	"net"
 	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -36,6 +38,7 @@ import (
 	"vpnctl/internal/monitor"
 	"vpnctl/internal/peersource"
 	"vpnctl/internal/pki"
+	"vpnctl/internal/relay"
 	"vpnctl/internal/store"
 	"vpnctl/internal/stunutil"
 	"vpnctl/internal/wireguard"
@@ -55,11 +58,24 @@ Usage:
   vpnctl version
   vpnctl controller init --config <path>
   vpnctl controller status --config <path>
-  vpnctl controller token create|list|revoke --config <path>
+  vpnctl controller token create|list|revoke --config <path> [--ephemeral] [--ttl <dur>] [--max-uses <n>] [--name-pattern <glob>] [--tags <t1,t2>] [--vpn-ip <ip>] [--description <text>]
+  vpnctl controller ipam list|reserve|release --config <path> [--name <node>] [--vpn-ip <addr>]
+  vpnctl controller admin-cert --config <path> --name <admin> --out <dir>
+  vpnctl controller ha-cert --config <path> --name <controller> --out <dir>
+  vpnctl controller relay-cert --config <path> --name <hub> --out <dir>
+  vpnctl controller remove-node --config <path> --name <node>
+  vpnctl controller rename-node --config <path> --name <node> --new-name <name>
+  vpnctl controller disable-node --config <path> --name <node> [--enable]
+  vpnctl controller tag-node --config <path> --name <node> --tags <tag,...>
+  vpnctl controller routes list|approve|unapprove --config <path> [--name <node> --route <cidr>]
+  vpnctl controller cert revoke --config <path> --node <name>
+  vpnctl controller ca rotate --config <path> [--grace 720h]
   vpnctl node join --config <path> [--token <bootstrap-token>]
-  vpnctl node serve --config <path>
-  vpnctl node run --config <path>
+  vpnctl node serve --config <path> [--exit-node <name>|off]
+  vpnctl node run --config <path> [--exit-node <name>|off]
   vpnctl node sync-config --config <path>
+  vpnctl node rotate-key --config <path> [--timeout 60s]
+  vpnctl relay serve --config <path>
   vpnctl direct serve --config <path> [--listen :0]
   vpnctl direct test --config <path> --peer <name>
   vpnctl discover --config <path>
@@ -120,6 +136,8 @@ func main() {
 		handleController(os.Args[2:])
 	case "node":
 		handleNode(os.Args[2:])
+	case "relay":
+		handleRelay(os.Args[2:])
 	case "direct":
 		handleDirect(os.Args[2:])
 	case "discover":
@@ -163,8 +181,28 @@ func handleController(args []string) {
 		controllerStatus(args[1:])
 	case "token":
 		controllerToken(args[1:])
+	case "ipam":
+		controllerIPAM(args[1:])
+	case "admin-cert":
+		controllerAdminCert(args[1:])
+	case "ha-cert":
+		controllerHACert(args[1:])
+	case "relay-cert":
+		controllerRelayCert(args[1:])
 	case "remove-node":
 		controllerRemoveNode(args[1:])
+	case "rename-node":
+		controllerRenameNode(args[1:])
+	case "disable-node":
+		controllerDisableNode(args[1:])
+	case "tag-node":
+		controllerTagNode(args[1:])
+	case "routes":
+		controllerRoutes(args[1:])
+	case "cert":
+		controllerCert(args[1:])
+	case "ca":
+		controllerCA(args[1:])
 	default:
 		fmt.Fprintf(os.Stderr, "unknown controller subcommand %q\n", args[0])
 		os.Exit(2)
@@ -198,6 +236,10 @@ func controllerInit(args []string) {
 	if err != nil {
 		fatal(err)
 	}
+	// A standby copies the active's CA before InitPKI would generate one.
+	if err := srv.PrepareHA(context.Background()); err != nil {
+		fatal(err)
+	}
 
 	if cfg.Controller.PKI != nil {
 		token, err := srv.InitPKI()
@@ -229,12 +271,16 @@ func controllerStatus(args []string) {
 		fatal(errors.New("controller.data_dir is required"))
 	}
 
-	regPath := filepath.Join(cfg.Controller.DataDir, "registry.yaml")
-	reg, err := store.LoadRegistry(regPath)
+	db, err := controller.OpenStore(cfg.Controller.DataDir)
+	if err != nil {
+		fatal(err)
+	}
+	defer db.Close()
+	nodes, err := db.Nodes()
 	if err != nil {
 		fatal(err)
 	}
-	if reg == nil || len(reg.Nodes) == 0 {
+	if len(nodes) == 0 {
 		fmt.Fprintln(os.Stdout, "no registered nodes")
 		return
 	}
@@ -248,7 +294,7 @@ func controllerStatus(args []string) {
 
 	fmt.Fprintf(os.Stdout, "%-12s  %-15s  %-22s  %-22s  %-10s  %-6s  %-20s  %-8s\n",
 		"NAME", "VPN_IP", "WG_ENDPOINT", "PUBLIC_ADDR", "NAT", "PORT", "LAST_SEEN", "STATUS")
-	for _, node := range reg.Nodes {
+	for _, node := range nodes {
 		lastSeen := ""
 		if !node.LastSeenAt.IsZero() {
 			lastSeen = node.LastSeenAt.UTC().Format(time.RFC3339)
@@ -258,10 +304,18 @@ func controllerStatus(args []string) {
 			wgEP = wgEndpoints[node.PubKey]
 		}
 		fmt.Fprintf(os.Stdout, "%-12s  %-15s  %-22s  %-22s  %-10s  %-6d  %-20s  %-8s\n",
-			node.Name, node.VPNIP, wgEP, node.PublicAddr, node.NATType, node.ProbePort, lastSeen, node.Status)
+			node.Name, node.VPNIP, wgEP, node.PublicAddr, node.NATType, node.ProbePort, lastSeen, nodeStatus(node))
 	}
 }
 
+// nodeStatus is the STATUS column of controller status.
+func nodeStatus(node store.NodeInfo) string {
+	if node.Disabled {
+		return "disabled"
+	}
+	return node.Status
+}
+
 func controllerToken(args []string) {
 	if len(args) == 0 {
 		fmt.Fprint(os.Stderr, "controller token subcommand required (create|list|revoke)\n")
@@ -271,45 +325,83 @@ func controllerToken(args []string) {
 	sub := args[0]
 	fs := flag.NewFlagSet("controller token "+sub, flag.ExitOnError)
 	configPath := fs.String("config", "", "path to YAML config")
+	controllerAddr := fs.String("controller", "", "controller address (default: derived from controller.listen)")
+	ephemeral := fs.Bool("ephemeral", false, "create: nodes enrolled with the token are removed once they go away")
+	ttl := fs.Duration("ttl", 0, "create: how long the token is valid (default: no expiry)")
+	maxUses := fs.Int("max-uses", 0, "create: how many nodes the token may enroll (default: unlimited)")
+	namePattern := fs.String("name-pattern", "", "create: node names the token may enroll, e.g. ci-*")
+	tags := fs.String("tags", "", "create: comma-separated admin tags for enrolled nodes")
+	vpnIP := fs.String("vpn-ip", "", "create: VPN IP for the enrolled node (implies --max-uses 1)")
+	description := fs.String("description", "", "create: what the token is for")
 	_ = fs.Parse(args[1:])
 
-	cfg, err := loadConfig(*configPath)
-	if err != nil {
-		fatal(err)
-	}
-	if cfg.Controller == nil {
-		fatal(errors.New("controller config required"))
-	}
-	config.ApplyDefaults(&cfg)
-	if cfg.Controller.DataDir == "" {
-		fatal(errors.New("controller.data_dir is required"))
-	}
-
-	tokenPath := filepath.Join(cfg.Controller.DataDir, "pki", "bootstrap-tokens.json")
-	ts, err := pki.OpenTokenStore(tokenPath)
-	if err != nil {
-		fatal(err)
-	}
+	client := controllerAdminClient(*configPath, *controllerAddr)
+	ctx := context.Background()
 
 	switch sub {
 	case "create":
-		token := ts.Create()
-		fmt.Fprintln(os.Stdout, token)
+		req := api.TokenCreateRequest{
+			Description: *description,
+			TTLSec:      int64(ttl.Seconds()),
+			MaxUses:     *maxUses,
+			NamePattern: *namePattern,
+			VPNIP:       *vpnIP,
+			Ephemeral:   *ephemeral,
+		}
+		if *tags != "" {
+			req.Tags = strings.Split(*tags, ",")
+		}
+		resp, err := client.CreateToken(ctx, req)
+		if err != nil {
+			fatal(err)
+		}
+		// The token is printed alone on stdout for scripts; it cannot be
+		// shown again.
+		fmt.Fprintf(os.Stderr, "token id: %s\n", resp.Info.ID)
+		fmt.Fprintln(os.Stdout, resp.Token)
 	case "list":
-		tokens := ts.List()
-		if len(tokens) == 0 {
-			fmt.Fprintln(os.Stdout, "no active tokens")
+		resp, err := client.ListTokens(ctx)
+		if err != nil {
+			fatal(err)
+		}
+		if len(resp.Tokens) == 0 {
+			fmt.Fprintln(os.Stdout, "no tokens")
 			return
 		}
-		for _, t := range tokens {
-			fmt.Fprintln(os.Stdout, t)
+		fmt.Fprintf(os.Stdout, "%-12s  %-8s  %-7s  %-20s  %-16s  %s\n", "ID", "STATE", "USES", "EXPIRES", "NAMES", "DESCRIPTION")
+		for _, t := range resp.Tokens {
+			uses := fmt.Sprintf("%d/-", t.Uses)
+			if t.MaxUses > 0 {
+				uses = fmt.Sprintf("%d/%d", t.Uses, t.MaxUses)
+			}
+			expires := "never"
+			if !t.ExpiresAt.IsZero() {
+				expires = t.ExpiresAt.Local().Format(time.DateTime)
+			}
+			names := t.NamePattern
+			if names == "" {
+				names = "*"
+			}
+			desc := t.Description
+			if len(t.Tags) > 0 {
+				desc += " [tags: " + strings.Join(t.Tags, ",") + "]"
+			}
+			if t.VPNIP != "" {
+				desc += " [vpn ip: " + t.VPNIP + "]"
+			}
+			if t.Ephemeral {
+				desc += " [ephemeral]"
+			}
+			fmt.Fprintf(os.Stdout, "%-12s  %-8s  %-7s  %-20s  %-16s  %s\n", t.ID, t.State, uses, expires, names, strings.TrimSpace(desc))
 		}
 	case "revoke":
 		remaining := fs.Args()
 		if len(remaining) == 0 {
-			fatal(errors.New("token value is required"))
+			fatal(errors.New("token or token id is required"))
+		}
+		if err := client.RevokeToken(ctx, api.RevokeTokenRequest{Token: remaining[0]}); err != nil {
+			fatal(err)
 		}
-		ts.Revoke(remaining[0])
 		fmt.Fprintln(os.Stdout, "token revoked")
 	default:
 		fmt.Fprintf(os.Stderr, "unknown token subcommand %q\n", sub)
@@ -317,9 +409,162 @@ func controllerToken(args []string) {
 	}
 }
 
+func controllerIPAM(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, "controller ipam subcommand required (list|reserve|release)\n")
+		os.Exit(2)
+	}
+
+	sub := args[0]
+	fs := flag.NewFlagSet("controller ipam "+sub, flag.ExitOnError)
+	configPath := fs.String("config", "", "path to YAML config")
+	controllerAddr := fs.String("controller", "", "controller address (default: derived from controller.listen)")
+	name := fs.String("name", "", "node name")
+	vpnIP := fs.String("vpn-ip", "", "VPN IP (comma-separated for dual-stack)")
+	_ = fs.Parse(args[1:])
+
+	client := controllerAdminClient(*configPath, *controllerAddr)
+	ctx := context.Background()
+
+	switch sub {
+	case "list":
+		resp, err := client.IPAM(ctx)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Fprintf(os.Stdout, "prefixes: %s\n", strings.Join(resp.Prefixes, ", "))
+		if len(resp.Reserved) > 0 {
+			fmt.Fprintf(os.Stdout, "reserved: %s\n", strings.Join(resp.Reserved, ", "))
+		}
+		if resp.ReclaimAfter != "" {
+			fmt.Fprintf(os.Stdout, "reclaim after: %s\n", resp.ReclaimAfter)
+		}
+		fmt.Fprintln(os.Stdout)
+		fmt.Fprintf(os.Stdout, "%-16s  %-32s  %-8s\n", "RESERVATION", "VPN_IP", "SOURCE")
+		for _, r := range resp.Reservations {
+			fmt.Fprintf(os.Stdout, "%-16s  %-32s  %-8s\n", r.Name, r.VPNIP, r.Source)
+		}
+		fmt.Fprintln(os.Stdout)
+		fmt.Fprintf(os.Stdout, "%-16s  %-32s  %-8s  %-20s\n", "NODE", "VPN_IP", "STATUS", "LAST_SEEN")
+		for _, a := range resp.Allocations {
+			fmt.Fprintf(os.Stdout, "%-16s  %-32s  %-8s  %-20s\n", a.Name, a.VPNIP, a.Status, a.LastSeen)
+		}
+	case "reserve":
+		if *name == "" {
+			fmt.Fprintln(os.Stderr, "error: --name is required")
+			os.Exit(2)
+		}
+		r, err := client.ReserveIP(ctx, api.ReserveIPRequest{Name: *name, VPNIP: *vpnIP})
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("reserved %s for %q\n", r.VPNIP, r.Name)
+	case "release":
+		if (*name == "") == (*vpnIP == "") {
+			fmt.Fprintln(os.Stderr, "error: exactly one of --name or --vpn-ip is required")
+			os.Exit(2)
+		}
+		if err := client.ReleaseIP(ctx, api.ReleaseIPRequest{Name: *name, VPNIP: *vpnIP}); err != nil {
+			fatal(err)
+		}
+		fmt.Fprintln(os.Stdout, "released")
+	default:
+		fmt.Fprintf(os.Stderr, "unknown ipam subcommand %q\n", sub)
+		os.Exit(2)
+	}
+}
+
+func controllerAdminCert(args []string) {
+	controllerIssueCert(args, "controller admin-cert", pki.RoleAdmin, "admin")
+}
+
+// controllerHACert issues the certificate an HA controller presents to its
+// peer. Copy the output to the other controller's controller.ha.pki_dir.
+func controllerHACert(args []string) {
+	controllerIssueCert(args, "controller ha-cert", pki.RoleHAPeer, "ha-peer")
+}
+
+// controllerRelayCert issues the certificate a relay hub fetches its peers
+// with. --name must be the hub name. Copy the output to relay.pki_dir.
+func controllerRelayCert(args []string) {
+	controllerIssueCert(args, "controller relay-cert", pki.RoleRelay, "relay")
+}
+
+// controllerIssueCert implements the *-cert commands: it signs a client
+// certificate of role and writes ca.crt, <file>.crt and <file>.key to --out.
+func controllerIssueCert(args []string, command, role, file string) {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	configPath := fs.String("config", "", "path to YAML config")
+	name := fs.String("name", "", "certificate CN")
+	out := fs.String("out", "", "directory to write ca.crt, "+file+".crt and "+file+".key")
+	expiry := fs.Duration("expiry", 365*24*time.Hour, "certificate lifetime")
+	_ = fs.Parse(args)
+
+	if *name == "" || *out == "" {
+		fmt.Fprintln(os.Stderr, "error: --name and --out are required")
+		os.Exit(2)
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fatal(err)
+	}
+	if cfg.Controller == nil || cfg.Controller.PKI == nil {
+		fatal(errors.New("controller.pki config required"))
+	}
+	config.ApplyDefaults(&cfg)
+
+	certPEM, keyPEM, err := issueCert(cfg.Controller.DataDir, *name, role, cfg.Controller.PKI.KeyAlgorithm, *expiry)
+	if err != nil {
+		fatal(err)
+	}
+	// Long-lived certificates can be revoked like node ones.
+	if err := pki.RecordIssued(filepath.Join(cfg.Controller.DataDir, "pki", "issued"), certPEM); err != nil {
+		fatal(err)
+	}
+	caPEM, err := os.ReadFile(filepath.Join(cfg.Controller.DataDir, "pki", "ca.crt"))
+	if err != nil {
+		fatal(err)
+	}
+	if err := os.MkdirAll(*out, 0o700); err != nil {
+		fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(*out, "ca.crt"), caPEM, 0o644); err != nil {
+		fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(*out, file+".crt"), certPEM, 0o644); err != nil {
+		fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(*out, file+".key"), keyPEM, 0o600); err != nil {
+		fatal(err)
+	}
+	fmt.Printf("%s certificate for %q written to %s\n", role, *name, *out)
+}
+
+// issueCert signs a fresh client certificate of role, with a key of
+// algorithm, with the CA under dataDir/pki and returns the certificate and
+// key PEM.
+func issueCert(dataDir, name, role, algorithm string, expiry time.Duration) (certPEM, keyPEM []byte, err error) {
+	pkiDir := filepath.Join(dataDir, "pki")
+	caCert, caKey, err := pki.LoadCA(filepath.Join(pkiDir, "ca.key"), filepath.Join(pkiDir, "ca.crt"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("load CA: %w", err)
+	}
+	csrPEM, keyPEM, err := pki.GenerateCSR(name, algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM, err = pki.SignCSRWithRole(caCert, caKey, csrPEM, expiry, role)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
 func controllerRemoveNode(args []string) {
 	fs := flag.NewFlagSet("controller remove-node", flag.ExitOnError)
 	configPath := fs.String("config", "", "path to YAML config")
+	controllerAddr := fs.String("controller", "", "controller address (default: derived from controller.listen)")
 	name := fs.String("name", "", "node name to remove")
 	_ = fs.Parse(args)
 
@@ -328,42 +573,222 @@ func controllerRemoveNode(args []string) {
 		os.Exit(2)
 	}
 
-	cfg, err := loadConfig(*configPath)
+	client := controllerAdminClient(*configPath, *controllerAddr)
+	if err := client.RemoveNode(context.Background(), api.RemoveNodeRequest{Name: *name}); err != nil {
+		fatal(err)
+	}
+	fmt.Printf("removed node %q\n", *name)
+}
+
+func controllerRenameNode(args []string) {
+	fs := flag.NewFlagSet("controller rename-node", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to YAML config")
+	controllerAddr := fs.String("controller", "", "controller address (default: derived from controller.listen)")
+	name := fs.String("name", "", "current node name")
+	newName := fs.String("new-name", "", "new node name")
+	_ = fs.Parse(args)
+
+	if *name == "" || *newName == "" {
+		fmt.Fprintln(os.Stderr, "error: --name and --new-name are required")
+		os.Exit(2)
+	}
+
+	client := controllerAdminClient(*configPath, *controllerAddr)
+	if err := client.RenameNode(context.Background(), api.RenameNodeRequest{Name: *name, NewName: *newName}); err != nil {
+		fatal(err)
+	}
+	fmt.Printf("renamed node %q to %q\n", *name, *newName)
+}
+
+func controllerDisableNode(args []string) {
+	fs := flag.NewFlagSet("controller disable-node", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to YAML config")
+	controllerAddr := fs.String("controller", "", "controller address (default: derived from controller.listen)")
+	name := fs.String("name", "", "node name")
+	enable := fs.Bool("enable", false, "re-enable a disabled node")
+	_ = fs.Parse(args)
+
+	if *name == "" {
+		fmt.Fprintln(os.Stderr, "error: --name is required")
+		os.Exit(2)
+	}
+
+	client := controllerAdminClient(*configPath, *controllerAddr)
+	if err := client.DisableNode(context.Background(), api.DisableNodeRequest{Name: *name, Disabled: !*enable}); err != nil {
+		fatal(err)
+	}
+	if *enable {
+		fmt.Printf("enabled node %q\n", *name)
+	} else {
+		fmt.Printf("disabled node %q\n", *name)
+	}
+}
+
+func controllerTagNode(args []string) {
+	fs := flag.NewFlagSet("controller tag-node", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to YAML config")
+	controllerAddr := fs.String("controller", "", "controller address (default: derived from controller.listen)")
+	name := fs.String("name", "", "node name")
+	tags := fs.String("tags", "", "comma-separated admin tags (empty clears them)")
+	_ = fs.Parse(args)
+
+	if *name == "" {
+		fmt.Fprintln(os.Stderr, "error: --name is required")
+		os.Exit(2)
+	}
+
+	client := controllerAdminClient(*configPath, *controllerAddr)
+	list := splitList(*tags)
+	if err := client.TagNode(context.Background(), api.TagNodeRequest{Name: *name, Tags: list}); err != nil {
+		fatal(err)
+	}
+	fmt.Printf("set admin tags of node %q to [%s]\n", *name, strings.Join(list, ", "))
+}
+
+func controllerCert(args []string) {
+	if len(args) == 0 || args[0] != "revoke" {
+		fmt.Fprint(os.Stderr, "controller cert subcommand required (revoke)\n")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("controller cert revoke", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to YAML config")
+	controllerAddr := fs.String("controller", "", "controller address (default: derived from controller.listen)")
+	node := fs.String("node", "", "node whose certificates to revoke")
+	_ = fs.Parse(args[1:])
+
+	if *node == "" {
+		fmt.Fprintln(os.Stderr, "error: --node is required")
+		os.Exit(2)
+	}
+
+	client := controllerAdminClient(*configPath, *controllerAddr)
+	resp, err := client.RevokeCert(context.Background(), api.RevokeCertRequest{Node: *node})
 	if err != nil {
 		fatal(err)
 	}
-	if cfg.Controller == nil || cfg.Controller.DataDir == "" {
-		fatal(fmt.Errorf("controller.data_dir required"))
+	fmt.Printf("revoked certificates of %q (%d added to the CRL)\n", *node, resp.Revoked)
+}
+
+func controllerCA(args []string) {
+	if len(args) == 0 || args[0] != "rotate" {
+		fmt.Fprint(os.Stderr, "controller ca subcommand required (rotate)\n")
+		os.Exit(2)
 	}
-	config.ApplyDefaults(&cfg)
 
-	regPath := filepath.Join(cfg.Controller.DataDir, "registry.yaml")
-	reg, err := store.LoadRegistry(regPath)
+	fs := flag.NewFlagSet("controller ca rotate", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to YAML config")
+	controllerAddr := fs.String("controller", "", "controller address (default: derived from controller.listen)")
+	grace := fs.Duration("grace", 30*24*time.Hour, "how long the previous CA stays trusted")
+	_ = fs.Parse(args[1:])
+
+	if *grace < time.Second {
+		fmt.Fprintln(os.Stderr, "error: --grace must be at least 1s")
+		os.Exit(2)
+	}
+
+	client := controllerAdminClient(*configPath, *controllerAddr)
+	resp, err := client.RotateCA(context.Background(), api.RotateCARequest{GraceSec: int64(grace.Seconds())})
 	if err != nil {
 		fatal(err)
 	}
+	fmt.Printf("CA rotated; the previous CA is trusted until %s\n", resp.RetireAt.Local().Format(time.RFC3339))
+}
 
-	found := false
-	filtered := make([]store.NodeInfo, 0, len(reg.Nodes))
-	for _, n := range reg.Nodes {
-		if n.Name == *name {
-			found = true
-			continue
+func controllerRoutes(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, "controller routes subcommand required (list|approve|unapprove)\n")
+		os.Exit(2)
+	}
+
+	sub := args[0]
+	fs := flag.NewFlagSet("controller routes "+sub, flag.ExitOnError)
+	configPath := fs.String("config", "", "path to YAML config")
+	controllerAddr := fs.String("controller", "", "controller address (default: derived from controller.listen)")
+	name := fs.String("name", "", "node name")
+	route := fs.String("route", "", "subnet route (CIDR)")
+	_ = fs.Parse(args[1:])
+
+	client := controllerAdminClient(*configPath, *controllerAddr)
+	ctx := context.Background()
+
+	switch sub {
+	case "list":
+		resp, err := client.Routes(ctx)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Fprintf(os.Stdout, "%-16s  %-24s  %-10s  %-8s  %s\n", "NODE", "ROUTE", "ADVERTISED", "APPROVED", "CONFLICT")
+		for _, r := range resp.Routes {
+			fmt.Fprintf(os.Stdout, "%-16s  %-24s  %-10t  %-8t  %s\n", r.Node, r.Route, r.Advertised, r.Approved, r.Conflict)
+		}
+	case "approve", "unapprove":
+		if *name == "" || *route == "" {
+			fmt.Fprintln(os.Stderr, "error: --name and --route are required")
+			os.Exit(2)
+		}
+		approve := sub == "approve"
+		if err := client.ApproveRoute(ctx, api.ApproveRouteRequest{Name: *name, Route: *route, Approve: approve}); err != nil {
+			fatal(err)
 		}
-		filtered = append(filtered, n)
+		fmt.Printf("%sd route %s of node %q\n", sub, *route, *name)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown routes subcommand %q\n", sub)
+		os.Exit(2)
 	}
+}
 
-	if !found {
-		fmt.Fprintf(os.Stderr, "node %q not found\n", *name)
-		os.Exit(1)
+// controllerAdminClient returns a client for the running controller's admin
+// endpoints. With PKI enabled it signs a short-lived admin certificate with
+// the local CA, so it must run where the controller data dir is readable.
+func controllerAdminClient(configPath, controllerAddr string) *api.Client {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fatal(err)
 	}
+	if cfg.Controller == nil {
+		fatal(errors.New("controller config required"))
+	}
+	config.ApplyDefaults(&cfg)
 
-	reg.Nodes = filtered
-	if err := store.SaveRegistry(regPath, reg); err != nil {
+	addr := controllerAddr
+	if addr == "" {
+		addr = localControllerAddr(cfg.Controller.Listen)
+	}
+	if cfg.Controller.PKI == nil {
+		return api.NewClient(normalizeBaseURL(addr))
+	}
+
+	certPEM, keyPEM, err := issueCert(cfg.Controller.DataDir, adminCertCN, pki.RoleAdmin, cfg.Controller.PKI.KeyAlgorithm, 10*time.Minute)
+	if err != nil {
+		fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		fatal(err)
+	}
+	tlsCfg, err := pki.ClientTLSConfig(filepath.Join(cfg.Controller.DataDir, "pki", "ca.crt"), "", "")
+	if err != nil {
 		fatal(err)
 	}
+	tlsCfg.Certificates = []tls.Certificate{cert}
+	return api.NewTLSClient(normalizeBootstrapURL(addr), tlsCfg)
+}
 
-	fmt.Printf("removed node %q\n", *name)
+// adminCertCN is the common name of certificates minted by controllerAdminClient.
+const adminCertCN = "vpnctl-admin"
+
+// localControllerAddr turns a listen address into one reachable from the
+// controller host, replacing wildcard hosts with loopback.
+func localControllerAddr(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
 }
 
 func handleNode(args []string) {
@@ -380,6 +805,8 @@ func handleNode(args []string) {
 		nodeRun(args[1:])
 	case "sync-config":
 		nodeSyncConfig(args[1:])
+	case "rotate-key":
+		nodeRotateKey(args[1:])
 	default:
 		fmt.Fprintf(os.Stderr, "unknown node subcommand %q\n", args[0])
 		os.Exit(2)
@@ -418,11 +845,6 @@ func nodeJoin(args []string) {
 			fatal(errors.New("node.name is required for bootstrap"))
 		}
 
-		csrPEM, keyPEM, err := pki.GenerateCSR(cfg.Node.Name)
-		if err != nil {
-			fatal(fmt.Errorf("generate CSR: %w", err))
-		}
-
 		// Use an insecure TLS client for bootstrap — we don't have the CA cert yet.
 		baseURL := normalizeBootstrapURL(cfg.Node.Controller)
 		insecureClient := api.NewTLSClient(baseURL, &tls.Config{
@@ -430,7 +852,22 @@ func nodeJoin(args []string) {
 			MinVersion:         tls.VersionTLS13,
 		})
 
+		// The node's key uses the controller's configured algorithm, or the
+		// CA's when it does not say. Controllers without /ca get the default.
 		ctx := context.Background()
+		algorithm := pki.DefaultKeyAlgorithm
+		if bundle, configured, err := insecureClient.CABundle(ctx); err == nil {
+			if configured != "" {
+				algorithm = configured
+			} else if ca, err := pki.ParseCertPEM(bundle); err == nil {
+				algorithm = pki.KeyAlgorithmOf(ca.PublicKey)
+			}
+		}
+		csrPEM, keyPEM, err := pki.GenerateCSR(cfg.Node.Name, algorithm)
+		if err != nil {
+			fatal(fmt.Errorf("generate CSR: %w", err))
+		}
+
 		resp, err := insecureClient.Bootstrap(ctx, api.BootstrapRequest{
 			Token: *token,
 			Name:  cfg.Node.Name,
@@ -471,6 +908,9 @@ func nodeJoin(args []string) {
 		}
 
 		fmt.Fprintf(os.Stdout, "bootstrap ok node_id=%s vpn_ip=%s pki_dir=%s\n", resp.NodeID, resp.VPNIP, pkiDir)
+		if resp.Ephemeral {
+			fmt.Fprintln(os.Stdout, "ephemeral node: removed from the controller when it stops or goes away")
+		}
 		return
 	}
 
@@ -481,21 +921,27 @@ func nodeJoin(args []string) {
 	client := newAPIClient(cfg.Node)
 
 	ctx := context.Background()
-	resp, err := client.Register(ctx, api.RegisterRequest{
-		Name:       cfg.Node.Name,
-		PubKey:     cfg.Node.WGPublicKey,
-		VPNIP:      cfg.Node.VPNIP,
-		Endpoint:   cfg.Node.AdvertiseWGEndpoint,
-		PublicAddr: cfg.Node.AdvertisePublicAddr,
-		NATType:    "",
-		DirectMode: cfg.Node.DirectMode,
-		ProbePort:  cfg.Node.ProbePort,
+	resp, err := agent.Register(ctx, client, api.RegisterRequest{
+		Name:        cfg.Node.Name,
+		PubKey:      cfg.Node.WGPublicKey,
+		VPNIP:       cfg.Node.VPNIP,
+		Endpoint:    cfg.Node.AdvertiseWGEndpoint,
+		PublicAddr:  cfg.Node.AdvertisePublicAddr,
+		NATType:     "",
+		DirectMode:  cfg.Node.DirectMode,
+		ProbePort:   cfg.Node.ProbePort,
+		Tags:        cfg.Node.Tags,
+		Routes:      cfg.Node.AdvertiseRoutes,
+		ExitNode:    cfg.Node.AdvertiseExitNode,
+		UseExitNode: cfg.Node.ExitNode,
 	})
 	if err != nil {
 		fatal(err)
 	}
 
-	if cfg.Node.VPNIP == "" && resp.VPNIP != "" {
+	if resp.VPNIP != "" {
+		// The controller may have added an address, e.g. an IPv6 one after
+		// vpn_cidr became dual-stack.
 		cfg.Node.VPNIP = resp.VPNIP
 	}
 	fmt.Fprintf(os.Stdout, "registered node_id=%s peers=%d vpn_ip=%s\n", resp.NodeID, len(resp.Peers), cfg.Node.VPNIP)
@@ -525,6 +971,7 @@ func nodeJoin(args []string) {
 func nodeRun(args []string) {
 	fs := flag.NewFlagSet("node run", flag.ExitOnError)
 	configPath := fs.String("config", "", "path to YAML config")
+	exitNode := fs.String("exit-node", "", "exit node to route internet traffic through (overrides node.exit_node; \"off\" disables it)")
 	_ = fs.Parse(args)
 
 	cfg, err := loadConfig(*configPath)
@@ -535,6 +982,7 @@ func nodeRun(args []string) {
 		fatal(errors.New("node config required"))
 	}
 	config.ApplyDefaults(&cfg)
+	overrideExitNode(cfg.Node, *exitNode)
 	if err := config.Validate(cfg); err != nil {
 		fatal(err)
 	}
@@ -548,14 +996,18 @@ func nodeRun(args []string) {
 	if cfg.Node.VPNIP == "" && cfg.Node.Controller != "" {
 		client := newAPIClient(cfg.Node)
 		resp, err := client.Register(ctx, api.RegisterRequest{
-			Name:       cfg.Node.Name,
-			PubKey:     cfg.Node.WGPublicKey,
-			VPNIP:      cfg.Node.VPNIP,
-			Endpoint:   cfg.Node.AdvertiseWGEndpoint,
-			PublicAddr: cfg.Node.AdvertisePublicAddr,
-			NATType:    "",
-			DirectMode: cfg.Node.DirectMode,
-			ProbePort:  cfg.Node.ProbePort,
+			Name:        cfg.Node.Name,
+			PubKey:      cfg.Node.WGPublicKey,
+			VPNIP:       cfg.Node.VPNIP,
+			Endpoint:    cfg.Node.AdvertiseWGEndpoint,
+			PublicAddr:  cfg.Node.AdvertisePublicAddr,
+			NATType:     "",
+			DirectMode:  cfg.Node.DirectMode,
+			ProbePort:   cfg.Node.ProbePort,
+			Tags:        cfg.Node.Tags,
+			Routes:      cfg.Node.AdvertiseRoutes,
+			ExitNode:    cfg.Node.AdvertiseExitNode,
+			UseExitNode: cfg.Node.ExitNode,
 		})
 		if err != nil {
 			fatal(err)
@@ -576,6 +1028,7 @@ func nodeServe(args []string) {
 	configPath := fs.String("config", "", "path to YAML config")
 	retryDelay := fs.Duration("retry-delay", 2*time.Second, "initial retry delay")
 	retryMaxDelay := fs.Duration("retry-max-delay", 30*time.Second, "max retry delay")
+	exitNode := fs.String("exit-node", "", "exit node to route internet traffic through (overrides node.exit_node; \"off\" disables it)")
 	_ = fs.Parse(args)
 
 	if *configPath == "" {
@@ -590,6 +1043,7 @@ func nodeServe(args []string) {
 		fatal(errors.New("node config required"))
 	}
 	config.ApplyDefaults(&cfg)
+	overrideExitNode(cfg.Node, *exitNode)
 	if err := config.Validate(cfg); err != nil {
 		fatal(err)
 	}
@@ -621,6 +1075,7 @@ func nodeServe(args []string) {
 			fatal(errors.New("node config required"))
 		}
 		config.ApplyDefaults(&cfg)
+		overrideExitNode(cfg.Node, *exitNode)
 
 		if err := syncConfigOnce(ctx, *configPath, &cfg); err != nil {
 			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
@@ -663,6 +1118,18 @@ func nodeServe(args []string) {
 	}
 }
 
+// overrideExitNode applies an --exit-node flag: a node name, or "off" to
+// ignore node.exit_node.
+func overrideExitNode(cfg *config.NodeConfig, value string) {
+	switch value {
+	case "":
+	case "off":
+		cfg.ExitNode = ""
+	default:
+		cfg.ExitNode = value
+	}
+}
+
 func syncConfigOnce(ctx context.Context, configPath string, cfg *config.Config) error {
 	if cfg == nil || cfg.Node == nil {
 		return errors.New("node config required")
@@ -679,20 +1146,24 @@ func syncConfigOnce(ctx context.Context, configPath string, cfg *config.Config)
 
 	updated := false
 	if cfg.Node.WGPublicKey != "" {
-		resp, err := client.Register(ctx, api.RegisterRequest{
-			Name:       cfg.Node.Name,
-			PubKey:     cfg.Node.WGPublicKey,
-			VPNIP:      cfg.Node.VPNIP,
-			Endpoint:   cfg.Node.AdvertiseWGEndpoint,
-			PublicAddr: cfg.Node.AdvertisePublicAddr,
-			NATType:    "",
-			DirectMode: cfg.Node.DirectMode,
-			ProbePort:  cfg.Node.ProbePort,
+		resp, err := agent.Register(ctx, client, api.RegisterRequest{
+			Name:        cfg.Node.Name,
+			PubKey:      cfg.Node.WGPublicKey,
+			VPNIP:       cfg.Node.VPNIP,
+			Endpoint:    cfg.Node.AdvertiseWGEndpoint,
+			PublicAddr:  cfg.Node.AdvertisePublicAddr,
+			NATType:     "",
+			DirectMode:  cfg.Node.DirectMode,
+			ProbePort:   cfg.Node.ProbePort,
+			Tags:        cfg.Node.Tags,
+			Routes:      cfg.Node.AdvertiseRoutes,
+			ExitNode:    cfg.Node.AdvertiseExitNode,
+			UseExitNode: cfg.Node.ExitNode,
 		})
 		if err != nil {
 			return err
 		}
-		if cfg.Node.VPNIP == "" && resp.VPNIP != "" {
+		if resp.VPNIP != "" && resp.VPNIP != cfg.Node.VPNIP {
 			cfg.Node.VPNIP = resp.VPNIP
 			updated = true
 		}
@@ -756,6 +1227,122 @@ func upOnce(configPath string, cfg *config.Config) error {
 	return wireguard.Up(*cfg.Node, setConf)
 }
 
+// nodeRotateKey replaces the node's WireGuard key without dropping the
+// tunnel for longer than one handshake: the new key is registered as pending,
+// switched in on the interface, and confirmed with the controller once the
+// hub has answered a handshake on it. On failure the old key is restored.
+func nodeRotateKey(args []string) {
+	fs := flag.NewFlagSet("node rotate-key", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to YAML config")
+	timeout := fs.Duration("timeout", 60*time.Second, "how long to wait for a handshake on the new key")
+	_ = fs.Parse(args)
+
+	if *configPath == "" {
+		fatal(errors.New("--config is required"))
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fatal(err)
+	}
+	if cfg.Node == nil {
+		fatal(errors.New("node config required"))
+	}
+	config.ApplyDefaults(&cfg)
+	if cfg.Node.Controller == "" {
+		fatal(errors.New("node.controller is required"))
+	}
+	if cfg.Node.WGPrivateKey == "" {
+		fatal(errors.New("wg_private_key is required"))
+	}
+	if err := fillServerConfig(cfg.Node); err != nil {
+		fatal(err)
+	}
+
+	oldPriv, oldPub := cfg.Node.WGPrivateKey, cfg.Node.WGPublicKey
+	newPriv, newPub, err := wireguard.GenerateKeyPair()
+	if err != nil {
+		fatal(err)
+	}
+
+	client := newAPIClient(cfg.Node)
+	ctx, cancel := signalContext()
+	defer cancel()
+	req := api.RotateKeyRequest{Name: cfg.Node.Name, PubKey: newPub}
+	if err := client.RotateKey(ctx, req); err != nil {
+		fatal(fmt.Errorf("register pending key: %w", err))
+	}
+
+	mgr := wireguard.DefaultManager()
+	iface := cfg.Node.WGInterface
+	rollback := func(cause error) {
+		if err := mgr.SetPrivateKey(iface, oldPriv); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to restore old key on %s: %v\n", iface, err)
+		}
+		cfg.Node.WGPrivateKey, cfg.Node.WGPublicKey = oldPriv, oldPub
+		if err := saveNodeKeys(*configPath, &cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to restore old key in config: %v\n", err)
+		}
+		fatal(cause)
+	}
+
+	switchedAt := time.Now()
+	if err := mgr.SetPrivateKey(iface, newPriv); err != nil {
+		rollback(fmt.Errorf("set new key on %s: %w", iface, err))
+	}
+	if err := waitHubHandshake(ctx, mgr, iface, cfg.Node.ServerPublicKey, switchedAt, *timeout); err != nil {
+		rollback(err)
+	}
+
+	// Persist before confirming so a crash after the controller switches
+	// over never leaves the old key on disk.
+	cfg.Node.WGPrivateKey, cfg.Node.WGPublicKey = newPriv, newPub
+	if err := saveNodeKeys(*configPath, &cfg); err != nil {
+		rollback(fmt.Errorf("save config: %w", err))
+	}
+	if err := client.ConfirmKey(ctx, req); err != nil {
+		rollback(fmt.Errorf("confirm key: %w", err))
+	}
+
+	fmt.Fprintf(os.Stdout, "rotated wireguard key pub_key=%s (retired %s)\n", newPub, oldPub)
+}
+
+// waitHubHandshake polls the interface until the hub peer completes a
+// handshake after since.
+func waitHubHandshake(ctx context.Context, mgr *wireguard.Manager, iface, hubKey string, since time.Time, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		// Handshake times have one-second resolution.
+		if hs, err := mgr.PeerHandshakes(iface); err == nil && !hs[hubKey].Before(since.Truncate(time.Second)) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("no handshake with the hub on the new key within %s", timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// saveNodeKeys writes the node's keys to the config file and the rendered
+// WireGuard config, so the next `up` or agent restart uses them.
+func saveNodeKeys(path string, cfg *config.Config) error {
+	if err := config.Save(path, *cfg); err != nil {
+		return err
+	}
+	if cfg.Node.WGConfigPath == "" || cfg.Node.VPNIP == "" {
+		return nil
+	}
+	conf, err := wireguard.RenderNode(*cfg.Node)
+	if err != nil {
+		return err
+	}
+	return wireguard.WriteConfig(cfg.Node.WGConfigPath, conf)
+}
+
 func nodeSyncConfig(args []string) {
 	fs := flag.NewFlagSet("node sync-config", flag.ExitOnError)
 	configPath := fs.String("config", "", "path to YAML config")
@@ -782,20 +1369,24 @@ func nodeSyncConfig(args []string) {
 
 	updated := false
 	if cfg.Node.WGPublicKey != "" {
-		resp, err := client.Register(ctx, api.RegisterRequest{
-			Name:       cfg.Node.Name,
-			PubKey:     cfg.Node.WGPublicKey,
-			VPNIP:      cfg.Node.VPNIP,
-			Endpoint:   "",
-			PublicAddr: "",
-			NATType:    "",
-			DirectMode: cfg.Node.DirectMode,
-			ProbePort:  cfg.Node.ProbePort,
+		resp, err := agent.Register(ctx, client, api.RegisterRequest{
+			Name:        cfg.Node.Name,
+			PubKey:      cfg.Node.WGPublicKey,
+			VPNIP:       cfg.Node.VPNIP,
+			Endpoint:    "",
+			PublicAddr:  "",
+			NATType:     "",
+			DirectMode:  cfg.Node.DirectMode,
+			ProbePort:   cfg.Node.ProbePort,
+			Tags:        cfg.Node.Tags,
+			Routes:      cfg.Node.AdvertiseRoutes,
+			ExitNode:    cfg.Node.AdvertiseExitNode,
+			UseExitNode: cfg.Node.ExitNode,
 		})
 		if err != nil {
 			fatal(err)
 		}
-		if cfg.Node.VPNIP == "" && resp.VPNIP != "" {
+		if resp.VPNIP != "" && resp.VPNIP != cfg.Node.VPNIP {
 			cfg.Node.VPNIP = resp.VPNIP
 			updated = true
 		}
@@ -899,26 +1490,51 @@ func handleDoctor(args []string) {
 		if cfg.Node.ProbePort > 0 {
 			fmt.Fprintf(os.Stdout, "probe_port=%d\n", cfg.Node.ProbePort)
 		}
-		if out, err := outputCmd("ip", "rule", "show"); err == nil && out != "" {
-			fmt.Fprintln(os.Stdout, "ip rule:")
-			fmt.Fprintln(os.Stdout, out)
+		if cfg.Node.ExitNode != "" {
+			fmt.Fprintf(os.Stdout, "exit_node=%s\n", cfg.Node.ExitNode)
+		}
+		if cfg.Node.AdvertiseExitNode {
+			fmt.Fprintln(os.Stdout, "advertise_exit_node=true")
+		}
+		policyCIDRs := addrutil.SplitList(cfg.Node.PolicyRoutingCIDR)
+		families := []string{"-4"}
+		for _, cidr := range policyCIDRs {
+			if addrutil.IsIPv6CIDR(cidr) {
+				families = append(families, "-6")
+				break
+			}
 		}
-		if config.PolicyRoutingEnabled(cfg.Node) && cfg.Node.PolicyRoutingTable > 0 {
-			out, err := outputCmd("ip", "route", "show", "table", fmt.Sprintf("%d", cfg.Node.PolicyRoutingTable))
-			if err == nil && out != "" {
-				fmt.Fprintf(os.Stdout, "ip route table %d:\n", cfg.Node.PolicyRoutingTable)
+		for _, family := range families {
+			if out, err := outputCmd("ip", family, "rule", "show"); err == nil && out != "" {
+				fmt.Fprintf(os.Stdout, "ip %s rule:\n", family)
 				fmt.Fprintln(os.Stdout, out)
-				// Heuristic warning for the most common failure: rule exists but baseline route is missing.
-				if cfg.Node.PolicyRoutingCIDR != "" && !strings.Contains(out, cfg.Node.PolicyRoutingCIDR) {
-					fmt.Fprintf(os.Stdout, "warning: policy routing table %d has no route for %s (VPN traffic may blackhole until wg up applies baseline route)\n",
-						cfg.Node.PolicyRoutingTable, cfg.Node.PolicyRoutingCIDR)
+			}
+			if !config.PolicyRoutingEnabled(cfg.Node) || cfg.Node.PolicyRoutingTable <= 0 {
+				continue
+			}
+			out, err := outputCmd("ip", family, "route", "show", "table", fmt.Sprintf("%d", cfg.Node.PolicyRoutingTable))
+			if err != nil || out == "" {
+				continue
+			}
+			fmt.Fprintf(os.Stdout, "ip %s route table %d:\n", family, cfg.Node.PolicyRoutingTable)
+			fmt.Fprintln(os.Stdout, out)
+			// Heuristic warning for the most common failure: rule exists but baseline route is missing.
+			for _, cidr := range policyCIDRs {
+				if addrutil.IsIPv6CIDR(cidr) != (family == "-6") || strings.Contains(out, cidr) {
+					continue
 				}
+				fmt.Fprintf(os.Stdout, "warning: policy routing table %d has no route for %s (VPN traffic may blackhole until wg up applies baseline route)\n",
+					cfg.Node.PolicyRoutingTable, cidr)
+			}
+			if family == "-4" && cfg.Node.ExitNode != "" && !strings.Contains(out, "default") {
+				fmt.Fprintf(os.Stdout, "warning: exit_node %q is set but policy routing table %d has no default route (is the exit node online and reachable?)\n",
+					cfg.Node.ExitNode, cfg.Node.PolicyRoutingTable)
 			}
 		}
 		if cfg.Node.ServerAllowedIPs != nil {
 			for _, cidr := range cfg.Node.ServerAllowedIPs {
 				if cidr == "0.0.0.0/0" || cidr == "::/0" {
-					fmt.Fprintf(os.Stdout, "warning: server_allowed_ips includes default route (%s) which may break host internet\n", cidr)
+					fmt.Fprintf(os.Stdout, "warning: server_allowed_ips includes default route (%s) which may break host internet (use exit_node instead)\n", cidr)
 				}
 			}
 		}
@@ -936,6 +1552,48 @@ func outputCmd(name string, args ...string) (string, error) {
 	return strings.TrimSpace(buf.String()), nil
 }
 
+func handleRelay(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, "relay subcommand required\n")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "serve":
+		relayServe(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown relay subcommand %q\n", args[0])
+		os.Exit(2)
+	}
+}
+
+func relayServe(args []string) {
+	fs := flag.NewFlagSet("relay serve", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to YAML config")
+	_ = fs.Parse(args)
+
+	if *configPath == "" {
+		fatal(errors.New("--config is required"))
+	}
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fatal(err)
+	}
+	if cfg.Relay == nil {
+		fatal(errors.New("relay config required"))
+	}
+	config.ApplyDefaults(&cfg)
+	if err := config.Validate(cfg); err != nil {
+		fatal(err)
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+	if err := relay.Run(ctx, *cfg.Relay); err != nil && !errors.Is(err, context.Canceled) {
+		fatal(err)
+	}
+}
+
 func handleDirect(args []string) {
 	if len(args) == 0 {
 		fmt.Fprint(os.Stderr, "direct subcommand required\n")
@@ -1141,7 +1799,7 @@ func handlePing(args []string) {
 			fatal(errors.New("no peers matched"))
 		}
 		for _, p := range matched {
-			peerAddr := fmt.Sprintf("%s:%d", p.VPNIP, p.ProbePort)
+			peerAddr := net.JoinHostPort(p.VPNIP, strconv.Itoa(p.ProbePort))
 			results := make([]float64, 0, *count)
 			for i := 0; i < *count; i++ {
 				rtt, err := direct.ProbePeer(ctx, ":0", peerAddr, *timeout)
@@ -1251,7 +1909,7 @@ func handlePerf(args []string) {
 		if matched == nil {
 			fatal(fmt.Errorf("peer %q not found or missing address", *peer))
 		}
-		peerAddr := fmt.Sprintf("%s:%d", matched.VPNIP, matched.ProbePort)
+		peerAddr := net.JoinHostPort(matched.VPNIP, strconv.Itoa(matched.ProbePort))
 		ctx := context.Background()
 		throughput, lossPct, err := direct.PerfProbe(ctx, ":0", peerAddr, *packetSize, *count, *timeout)
 		if err != nil {
@@ -1444,14 +2102,18 @@ func handleUp(args []string) {
 	if cfg.Node.VPNIP == "" && cfg.Node.Controller != "" {
 		client := newAPIClient(cfg.Node)
 		resp, err := client.Register(context.Background(), api.RegisterRequest{
-			Name:       cfg.Node.Name,
-			PubKey:     cfg.Node.WGPublicKey,
-			VPNIP:      cfg.Node.VPNIP,
-			Endpoint:   cfg.Node.AdvertiseWGEndpoint,
-			PublicAddr: cfg.Node.AdvertisePublicAddr,
-			NATType:    "",
-			DirectMode: cfg.Node.DirectMode,
-			ProbePort:  cfg.Node.ProbePort,
+			Name:        cfg.Node.Name,
+			PubKey:      cfg.Node.WGPublicKey,
+			VPNIP:       cfg.Node.VPNIP,
+			Endpoint:    cfg.Node.AdvertiseWGEndpoint,
+			PublicAddr:  cfg.Node.AdvertisePublicAddr,
+			NATType:     "",
+			DirectMode:  cfg.Node.DirectMode,
+			ProbePort:   cfg.Node.ProbePort,
+			Tags:        cfg.Node.Tags,
+			Routes:      cfg.Node.AdvertiseRoutes,
+			ExitNode:    cfg.Node.AdvertiseExitNode,
+			UseExitNode: cfg.Node.ExitNode,
 		})
 		if err != nil {
 			fatal(err)
@@ -1587,22 +2249,26 @@ func splitList(value string) []string {
 	return out
 }
 
+// normalizeBaseURL prefixes http:// to each entry of a comma-separated
+// controller list that has no scheme.
 func normalizeBaseURL(addr string) string {
-	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
-		return addr
+	urls := splitList(addr)
+	for i, u := range urls {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			urls[i] = "http://" + u
+		}
 	}
-	return "http://" + addr
+	return strings.Join(urls, ",")
 }
 
-// normalizeBootstrapURL ensures the controller URL uses https for bootstrap.
+// normalizeBootstrapURL ensures each controller URL in a comma-separated list
+// uses https for bootstrap.
 func normalizeBootstrapURL(addr string) string {
-	if strings.HasPrefix(addr, "https://") {
-		return addr
-	}
-	if strings.HasPrefix(addr, "http://") {
-		return "https://" + strings.TrimPrefix(addr, "http://")
+	urls := splitList(addr)
+	for i, u := range urls {
+		urls[i] = "https://" + strings.TrimPrefix(strings.TrimPrefix(u, "https://"), "http://")
 	}
-	return "https://" + addr
+	return strings.Join(urls, ",")
 }
 
 // newAPIClient creates an API client, using mTLS if PKI credentials exist.
@@ -1630,6 +2296,25 @@ func newAPIClient(cfg *config.NodeConfig) *api.Client {
 	return api.NewClient(baseURL)
 }
 
+// newAdminAPIClient is newAPIClient for admin-only endpoints. It presents
+// admin.crt/admin.key from the node's PKI dir (see `controller admin-cert`)
+// when they exist, and the node certificate otherwise.
+func newAdminAPIClient(cfg *config.NodeConfig) *api.Client {
+	if cfg.PKIDir != "" {
+		caCert := filepath.Join(cfg.PKIDir, "ca.crt")
+		adminCert := filepath.Join(cfg.PKIDir, "admin.crt")
+		adminKey := filepath.Join(cfg.PKIDir, "admin.key")
+		if fileExists(caCert) && fileExists(adminCert) && fileExists(adminKey) {
+			tlsCfg, err := pki.ClientTLSConfig(caCert, adminCert, adminKey)
+			if err != nil {
+				fatal(fmt.Errorf("admin mTLS config: %w", err))
+			}
+			return api.NewTLSClient(normalizeBootstrapURL(cfg.Controller), tlsCfg)
+		}
+	}
+	return newAPIClient(cfg)
+}
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
@@ -1658,7 +2343,7 @@ func selectProbeAddr(peer api.PeerCandidate, path string) (string, string) {
 		return "", "direct"
 	case "relay":
 		if peer.VPNIP != "" && peer.ProbePort > 0 {
-			return fmt.Sprintf("%s:%d", stripCIDR(peer.VPNIP), peer.ProbePort), "relay"
+			return net.JoinHostPort(addrutil.PrimaryIP(peer.VPNIP), strconv.Itoa(peer.ProbePort)), "relay"
 		}
 		return "", "relay"
 	default:
@@ -1666,7 +2351,7 @@ func selectProbeAddr(peer api.PeerCandidate, path string) (string, string) {
 			return addr, "direct"
 		}
 		if peer.VPNIP != "" && peer.ProbePort > 0 {
-			return fmt.Sprintf("%s:%d", stripCIDR(peer.VPNIP), peer.ProbePort), "relay"
+			return net.JoinHostPort(addrutil.PrimaryIP(peer.VPNIP), strconv.Itoa(peer.ProbePort)), "relay"
 		}
 	}
 	return "", path
@@ -1682,13 +2367,6 @@ func selectProbeAddrByName(name string, candidates []api.PeerCandidate, path str
 	return "", "", path
 }
 
-func stripCIDR(value string) string {
-	if i := strings.IndexByte(value, '/'); i >= 0 {
-		return value[:i]
-	}
-	return value
-}
-
 func filterPeers(candidates []api.PeerCandidate, peer string, all bool) []api.PeerCandidate {
 	if all {
 		return candidates
@@ -1804,7 +2482,7 @@ func fillServerConfig(node *config.NodeConfig) error {
 	}
 	if node.ServerPublicKey != "" && node.ServerEndpoint != "" && len(node.ServerAllowedIPs) > 0 {
 		if node.PolicyRoutingCIDR == "" {
-			node.PolicyRoutingCIDR = firstScopedCIDR(node.ServerAllowedIPs)
+			node.PolicyRoutingCIDR = config.PolicyCIDRs(node.ServerAllowedIPs)
 		}
 		return nil
 	}
@@ -1821,24 +2499,11 @@ func fillServerConfig(node *config.NodeConfig) error {
 	node.ServerAllowedIPs = resp.ServerAllowedIPs
 	node.ServerKeepaliveSec = resp.ServerKeepaliveSec
 	if node.PolicyRoutingCIDR == "" {
-		node.PolicyRoutingCIDR = firstScopedCIDR(node.ServerAllowedIPs)
+		node.PolicyRoutingCIDR = config.PolicyCIDRs(node.ServerAllowedIPs)
 	}
 	return nil
 }
 
-func firstScopedCIDR(values []string) string {
-	for _, value := range values {
-		if value == "" {
-			continue
-		}
-		if value == "0.0.0.0/0" || value == "::/0" {
-			continue
-		}
-		return value
-	}
-	return ""
-}
-
 func waitForSignal() {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
@@ -1914,7 +2579,7 @@ func fleetStatus(args []string) {
 		}
 		config.ApplyDefaults(&cfg)
 
-		client := newAPIClient(cfg.Node)
+		client := newAdminAPIClient(cfg.Node)
 		ctx := context.Background()
 		resp, err := client.FleetStatus(ctx)
 		if err != nil {
@@ -1982,7 +2647,7 @@ func fleetHistory(args []string) {
 		}
 		config.ApplyDefaults(&cfg)
 
-		client := newAPIClient(cfg.Node)
+		client := newAdminAPIClient(cfg.Node)
 		ctx := context.Background()
 		resp, err := client.FleetHistory(ctx, *window)
 		if err != nil {
@@ -1991,9 +2656,9 @@ func fleetHistory(args []string) {
 
 		for _, n := range resp.Nodes {
 			fmt.Printf("Node: %s\n", n.Name)
-			fmt.Printf("  %-20s  %-8s  %-8s\n", "TIME", "ONLINE%", "AVG_RTT_MS")
+			fmt.Printf("  %-20s  %-8s  %-10s  %-8s\n", "TIME", "ONLINE%", "AVG_RTT_MS", "LOSS%")
 			for _, b := range n.Buckets {
-				fmt.Printf("  %-20s  %-8.1f  %-8.2f\n", b.Time, b.OnlinePct, b.AvgRTTMs)
+				fmt.Printf("  %-20s  %-8.1f  %-10.2f  %-8.2f\n", b.Time, b.OnlinePct, b.AvgRTTMs, b.LossPct)
 			}
 		}
 		return
@@ -0,0 +1,80 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package addrutil
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// SplitList splits a comma-separated address list (e.g. a dual-stack
+// "10.7.0.2/32,fd7a::2/128" vpn_ip) into trimmed, non-empty entries.
+func SplitList(value string) []string {
+	var out []string
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// HostPrefixes turns a VPN address list into WireGuard AllowedIPs entries.
+// Bare addresses get a host mask (/32 for IPv4, /128 for IPv6); entries that
+// already carry a prefix length are kept as-is.
+func HostPrefixes(value string) []string {
+	var out []string
+	for _, entry := range SplitList(value) {
+		if strings.Contains(entry, "/") {
+			out = append(out, entry)
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			continue
+		}
+		out = append(out, netip.PrefixFrom(addr, addr.BitLen()).String())
+	}
+	return out
+}
+
+// HostAddrs returns the addresses of a VPN address list, without prefix
+// lengths. Unparseable entries are skipped.
+func HostAddrs(value string) []netip.Addr {
+	var out []netip.Addr
+	for _, entry := range SplitList(value) {
+		if p, err := netip.ParsePrefix(entry); err == nil {
+			out = append(out, p.Addr())
+			continue
+		}
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// PrimaryIP returns the address used to reach a node over the overlay: the
+// IPv4 address of a dual-stack list when there is one, otherwise the first
+// address. It returns "" when value holds no address.
+func PrimaryIP(value string) string {
+	addrs := HostAddrs(value)
+	if len(addrs) == 0 {
+		return ""
+	}
+	for _, addr := range addrs {
+		if addr.Is4() {
+			return addr.String()
+		}
+	}
+	return addrs[0].String()
+}
+
+// IsIPv6CIDR reports whether cidr is an IPv6 prefix or address.
+func IsIPv6CIDR(cidr string) bool {
+	host, _, _ := strings.Cut(cidr, "/")
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.Is6() && !addr.Is4In6()
+}
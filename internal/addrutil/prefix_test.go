@@ -0,0 +1,28 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package addrutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHostPrefixes_DualStack(t *testing.T) {
+	got := strings.Join(HostPrefixes("10.7.0.2, fd7a::2 ,10.7.0.3/32,bogus"), ",")
+	if got != "10.7.0.2/32,fd7a::2/128,10.7.0.3/32" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestPrimaryIP_PrefersIPv4(t *testing.T) {
+	if got := PrimaryIP("fd7a::2/128,10.7.0.2/32"); got != "10.7.0.2" {
+		t.Fatalf("got %q", got)
+	}
+	if got := PrimaryIP("fd7a::2/128"); got != "fd7a::2" {
+		t.Fatalf("got %q", got)
+	}
+	if got := PrimaryIP(""); got != "" {
+		t.Fatalf("got %q", got)
+	}
+}
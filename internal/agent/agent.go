@@ -5,11 +5,15 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,20 +23,29 @@ import (
 	"vpnctl/internal/direct"
 	"vpnctl/internal/metrics"
 	"vpnctl/internal/model"
-	"vpnctl/internal/pki"
 	"vpnctl/internal/stunutil"
 	"vpnctl/internal/wireguard"
 )
 
+// ErrRegistrationRejected is returned by Run when the controller refuses the
+// node's keepalive registration because its WireGuard key was rotated by
+// another process.
+var ErrRegistrationRejected = errors.New("registration rejected by controller")
+
+// ErrVPNIPTaken is returned by Run when the controller gave the node's VPN
+// IP to another node. Registering again with Register gets a new address.
+var ErrVPNIPTaken = errors.New("vpn_ip taken by another node")
+
 // Run starts the long-running node agent loop.
 func Run(ctx context.Context, cfg config.NodeConfig) error {
-	client := newClient(cfg)
+	client, creds := newClient(cfg)
 
-	nodeID, vpnIP, err := register(ctx, client, cfg)
+	nodeID, vpnIP, err := register(ctx, client, cfg, "")
 	if err != nil {
 		return err
 	}
-	if cfg.VPNIP == "" && vpnIP != "" {
+	refreshCredentials(ctx, client, cfg, creds, nodeID)
+	if vpnIP != "" {
 		cfg.VPNIP = vpnIP
 	}
 
@@ -59,15 +72,49 @@ func Run(ctx context.Context, cfg config.NodeConfig) error {
 	var publicAddr string
 	var natType string
 	activePeers := map[string]wireguard.Peer{}
-	if err := fillServerConfig(ctx, client, &cfg); err != nil {
+	hubs, err := fillServerConfig(ctx, client, &cfg)
+	if err != nil {
 		slog.Warn("server config fetch failed", "err", err)
 	}
+	setupExitNode(cfg)
+	// Subnet routes behind other nodes are added to the hub peer on top of
+	// the overlay prefixes.
+	baseAllowed := slices.Clone(cfg.ServerAllowedIPs)
+	basePolicy := cfg.PolicyRoutingCIDR
+	var routes []string
+	// With several relay hubs the node starts on its primary and fails over
+	// to its backup when health checks declare the primary dead.
+	activeHub := ""
+	if len(hubs) > 0 {
+		activeHub = hubs[0].Name
+		if err := useHub(&cfg, hubs[0], activePeers); err != nil {
+			slog.Warn("switch to primary hub failed", "hub", activeHub, "err", err)
+		}
+		if _, _, err := register(ctx, client, cfg, activeHub); err != nil {
+			slog.Warn("hub report failed", "hub", activeHub, "err", err)
+		}
+	}
+
+	// Node names resolve from the same candidate list peers come from.
+	dnsServer := startDNS(cfg)
+	defer stopDNS(cfg, dnsServer)
+	if dnsServer != nil {
+		if resp, err := client.Candidates(ctx, nodeID); err == nil {
+			candidates = resp.Peers
+		}
+		updateDNS(dnsServer, cfg, candidates)
+	}
 
 	// Health check ticker — detect dead tunnels.
 	// Must be computed AFTER fillServerConfig which populates ServerAllowedIPs and ServerProbePort.
 	// When disabled, healthC stays nil so the select case blocks forever (no-op).
 	var healthC <-chan time.Time
 	hubProbeAddr := hubProbeAddress(cfg)
+	if len(hubs) > 0 {
+		if addr := relayProbeAddress(cfg, hubs[0]); addr != "" {
+			hubProbeAddr = addr
+		}
+	}
 	if hubProbeAddr != "" && cfg.HealthCheckIntervalSec > 0 {
 		healthTicker := time.NewTicker(time.Duration(cfg.HealthCheckIntervalSec) * time.Second)
 		defer healthTicker.Stop()
@@ -78,15 +125,37 @@ func Run(ctx context.Context, cfg config.NodeConfig) error {
 	}
 	healthFailures := 0
 
+	// Controller events trigger an immediate candidates refresh; the tickers
+	// above remain the fallback when the stream is unavailable.
+	var eventsC <-chan struct{}
+	if cfg.Controller != "" {
+		ch := make(chan struct{}, 1)
+		eventsC = ch
+		go watchEvents(ctx, client, nodeID, ch)
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
+			if cfg.Controller != "" {
+				leave(client, nodeID)
+			}
 			return ctx.Err()
 		case <-keepaliveTicker.C:
-			_, _, err := register(ctx, client, cfg)
-			if err != nil {
+			_, _, err := register(ctx, client, cfg, activeHub)
+			switch {
+			case api.HasErrorCode(err, api.ErrCodePubKeyMismatch):
+				// The key was changed, e.g. by `node rotate-key`; restart
+				// from the config on disk.
+				return fmt.Errorf("%w: %v", ErrRegistrationRejected, err)
+			case api.HasErrorCode(err, api.ErrCodeVPNIPConflict):
+				// The interface holds the old address; restart so the node
+				// registers for a new one and is set up with it.
+				return fmt.Errorf("%w: %v", ErrVPNIPTaken, err)
+			case err != nil:
 				slog.Warn("keepalive register failed", "err", err)
 			}
+			refreshCredentials(ctx, client, cfg, creds, nodeID)
 		case <-stunTicker.C:
 			if cfg.DirectMode == "off" || len(cfg.STUNServers) == 0 {
 				break
@@ -115,37 +184,17 @@ func Run(ctx context.Context, cfg config.NodeConfig) error {
 				break
 			}
 			candidates = resp.Peers
+			updateDNS(dnsServer, cfg, candidates)
+			routes = applySubnetRoutes(&cfg, baseAllowed, basePolicy, routes, subnetRoutes(cfg, candidates), activePeers)
+			activePeers = syncPeers(cfg, activePeers, desiredPeers(cfg, candidates))
 		case <-directTicker.C:
+			if len(hubs) > 1 && shared != nil {
+				measureHubs(ctx, client, shared, nodeID, hubs)
+			}
 			if cfg.DirectMode == "off" {
 				break
 			}
-			desired := map[string]wireguard.Peer{}
-			allowedOwner := map[string]string{}
 			for _, peer := range candidates {
-				inject := peer.P2PReady
-				// P2P WireGuard injection needs the peer's wg endpoint (as observed by the controller).
-				// PublicAddr from STUN is for the probe socket, not wg, and must not be used for wg endpoints.
-				wgEndpoint := peer.Endpoint
-				allowedIP := normalizeHostIP(peer.VPNIP)
-				if inject && allowedIP != "" {
-					if prev, ok := allowedOwner[allowedIP]; ok && prev != peer.ID {
-						// Overlapping AllowedIPs are invalid in WireGuard. Skip duplicates so one bad/stale
-						// registry entry doesn't block all peer injection.
-						slog.Warn("skip peer injection: duplicate allowed_ip", "name", peer.Name, "id", peer.ID, "vpn_ip", peer.VPNIP, "owner", prev)
-						inject = false
-					} else {
-						allowedOwner[allowedIP] = peer.ID
-					}
-				}
-				if inject && allowedIP != "" && peer.PubKey != "" && wgEndpoint != "" {
-					desired[peer.ID] = wireguard.Peer{
-						PublicKey:    peer.PubKey,
-						Endpoint:     wgEndpoint,
-						AllowedIPs:   []string{allowedIP},
-						KeepaliveSec: directKeepalive(cfg, peer.NATType),
-					}
-				}
-
 				// Record a direct UDP reachability datapoint to the peer's probe port.
 				// Use the host from PublicAddr or (fallback) from Endpoint, and always target ProbePort.
 				if shared == nil {
@@ -201,19 +250,20 @@ func Run(ctx context.Context, cfg config.NodeConfig) error {
 					slog.Warn("submit metrics failed", "err", err)
 				}
 			}
-
-			if cfg.ServerPublicKey != "" && cfg.ServerEndpoint != "" && len(cfg.ServerAllowedIPs) > 0 {
-				if !peersEqual(activePeers, desired) {
-					peerList := peersFromMap(desired)
-					slog.Info("injecting wg peers", "count", len(peerList))
-					if err := wireguard.ApplyPeers(cfg, peerList); err != nil {
-						slog.Error("apply peers failed", "err", err)
-					} else {
-						slog.Info("wg peers injected", "count", len(peerList))
-						activePeers = desired
-					}
-				}
+			activePeers = syncPeers(cfg, activePeers, desiredPeers(cfg, candidates))
+		case <-eventsC:
+			// The fleet changed; pick up new candidates and P2P readiness
+			// now instead of waiting for the next tickers.
+			resp, err := client.Candidates(ctx, nodeID)
+			if err != nil {
+				slog.Warn("candidates fetch failed", "err", err)
+				break
 			}
+			candidates = resp.Peers
+			updateDNS(dnsServer, cfg, candidates)
+			routes = applySubnetRoutes(&cfg, baseAllowed, basePolicy, routes, subnetRoutes(cfg, candidates), activePeers)
+			// Without direct mode this still picks up exit node peers.
+			activePeers = syncPeers(cfg, activePeers, desiredPeers(cfg, candidates))
 		case <-healthC:
 			timeout := time.Duration(cfg.HealthCheckTimeoutSec) * time.Second
 			if timeout <= 0 {
@@ -234,7 +284,24 @@ func Run(ctx context.Context, cfg config.NodeConfig) error {
 				healthFailures++
 				slog.Warn("health check failed", "failures", healthFailures, "threshold", cfg.HealthCheckFailures, "hub", hubProbeAddr)
 				if healthFailures >= cfg.HealthCheckFailures {
-					return ErrTunnelDead
+					backup, ok := backupHub(hubs, activeHub)
+					if !ok {
+						return ErrTunnelDead
+					}
+					slog.Warn("relay hub dead, failing over to backup", "hub", activeHub, "backup", backup.Name)
+					if err := useHub(&cfg, backup, activePeers); err != nil {
+						slog.Error("switch to backup hub failed", "hub", backup.Name, "err", err)
+						return ErrTunnelDead
+					}
+					activeHub = backup.Name
+					if addr := relayProbeAddress(cfg, backup); addr != "" {
+						hubProbeAddr = addr
+					}
+					healthFailures = 0
+					// Have the controller route this node through the backup now.
+					if _, _, err := register(ctx, client, cfg, activeHub); err != nil {
+						slog.Warn("hub report failed", "hub", activeHub, "err", err)
+					}
 				}
 			}
 		}
@@ -261,16 +328,46 @@ func probeShared(ctx context.Context, shared *direct.Shared, servers []string, t
 	return results[0], stunutil.Classify(results), nil
 }
 
-func register(ctx context.Context, client *api.Client, cfg config.NodeConfig) (string, string, error) {
+// leave tells the controller the agent is shutting down, so an ephemeral
+// node is removed right away instead of after it goes unseen.
+func leave(client *api.Client, nodeID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Leave(ctx, api.LeaveRequest{NodeID: nodeID}); err != nil {
+		slog.Warn("leave failed", "err", err)
+	}
+}
+
+// register checks in with the controller. hub is the relay hub in use, or
+// "" when the controller manages only one.
+// Register registers a node with req. When req.VPNIP was given to another
+// node, e.g. reclaimed while the node was offline, it registers again
+// without an address and the controller allocates a new one.
+func Register(ctx context.Context, client *api.Client, req api.RegisterRequest) (api.RegisterResponse, error) {
+	resp, err := client.Register(ctx, req)
+	if req.VPNIP != "" && api.HasErrorCode(err, api.ErrCodeVPNIPConflict) {
+		slog.Warn("vpn_ip taken by another node; registering for a new one", "vpn_ip", req.VPNIP, "err", err)
+		req.VPNIP = ""
+		resp, err = client.Register(ctx, req)
+	}
+	return resp, err
+}
+
+func register(ctx context.Context, client *api.Client, cfg config.NodeConfig, hub string) (string, string, error) {
 	resp, err := client.Register(ctx, api.RegisterRequest{
-		Name:       cfg.Name,
-		PubKey:     cfg.WGPublicKey,
-		VPNIP:      cfg.VPNIP,
-		Endpoint:   cfg.AdvertiseWGEndpoint,
-		PublicAddr: cfg.AdvertisePublicAddr,
-		NATType:    "",
-		DirectMode: cfg.DirectMode,
-		ProbePort:  cfg.ProbePort,
+		Name:        cfg.Name,
+		PubKey:      cfg.WGPublicKey,
+		VPNIP:       cfg.VPNIP,
+		Endpoint:    cfg.AdvertiseWGEndpoint,
+		PublicAddr:  cfg.AdvertisePublicAddr,
+		NATType:     "",
+		DirectMode:  cfg.DirectMode,
+		ProbePort:   cfg.ProbePort,
+		Hub:         hub,
+		Tags:        cfg.Tags,
+		Routes:      cfg.AdvertiseRoutes,
+		ExitNode:    cfg.AdvertiseExitNode,
+		UseExitNode: cfg.ExitNode,
 	})
 	if err != nil {
 		return "", "", err
@@ -278,14 +375,27 @@ func register(ctx context.Context, client *api.Client, cfg config.NodeConfig) (s
 	return resp.NodeID, resp.VPNIP, nil
 }
 
+// normalizeBaseURL prefixes http:// to each entry of a comma-separated
+// controller list that has no scheme.
 func normalizeBaseURL(addr string) string {
-	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
-		return addr
+	var urls []string
+	for _, u := range strings.Split(addr, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			u = "http://" + u
+		}
+		urls = append(urls, u)
 	}
-	return "http://" + addr
+	return strings.Join(urls, ",")
 }
 
-func newClient(cfg config.NodeConfig) *api.Client {
+// newClient returns a controller client, using mTLS when the node has been
+// enrolled. The credentials are returned too so they can be replaced in
+// place; they are nil without mTLS.
+func newClient(cfg config.NodeConfig) (*api.Client, *credentials) {
 	baseURL := normalizeBaseURL(cfg.Controller)
 
 	if cfg.PKIDir != "" {
@@ -294,19 +404,17 @@ func newClient(cfg config.NodeConfig) *api.Client {
 		clientKey := filepath.Join(cfg.PKIDir, "client.key")
 
 		if fileExists(caCert) && fileExists(clientCert) && fileExists(clientKey) {
-			tlsCfg, err := pki.ClientTLSConfig(caCert, clientCert, clientKey)
+			creds, err := loadCredentials(cfg.PKIDir)
 			if err != nil {
 				slog.Warn("mTLS config failed, falling back to plain HTTP", "err", err)
-				return api.NewClient(baseURL)
+				return api.NewClient(baseURL), nil
 			}
-			if !strings.HasPrefix(baseURL, "https://") {
-				baseURL = strings.Replace(baseURL, "http://", "https://", 1)
-			}
-			return api.NewTLSClient(baseURL, tlsCfg)
+			baseURL = strings.ReplaceAll(baseURL, "http://", "https://")
+			return api.NewTLSClient(baseURL, creds.tlsConfig()), creds
 		}
 	}
 
-	return api.NewClient(baseURL)
+	return api.NewClient(baseURL), nil
 }
 
 func fileExists(path string) bool {
@@ -314,22 +422,33 @@ func fileExists(path string) bool {
 	return err == nil
 }
 
-func fillServerConfig(ctx context.Context, client *api.Client, cfg *config.NodeConfig) error {
+// fillServerConfig completes cfg's hub peer from the controller when it is
+// not configured, and returns the relay hubs when the controller manages
+// several (nil otherwise).
+func fillServerConfig(ctx context.Context, client *api.Client, cfg *config.NodeConfig) ([]api.HubPeer, error) {
 	if cfg == nil {
-		return fmt.Errorf("node config required")
+		return nil, fmt.Errorf("node config required")
 	}
 	if cfg.ServerPublicKey != "" && cfg.ServerEndpoint != "" && len(cfg.ServerAllowedIPs) > 0 {
 		if cfg.PolicyRoutingCIDR == "" {
-			cfg.PolicyRoutingCIDR = firstScopedCIDR(cfg.ServerAllowedIPs)
+			cfg.PolicyRoutingCIDR = config.PolicyCIDRs(cfg.ServerAllowedIPs)
+		}
+		if cfg.Controller == "" {
+			return nil, nil
 		}
-		return nil
+		// The hub peer is configured; only the relay hub list is needed.
+		resp, err := client.WGConfig(ctx, cfg.Name)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Hubs, nil
 	}
 	if cfg.Controller == "" {
-		return fmt.Errorf("node.controller required to fetch server config")
+		return nil, fmt.Errorf("node.controller required to fetch server config")
 	}
 	resp, err := client.WGConfig(ctx, cfg.Name)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	cfg.ServerPublicKey = resp.ServerPublicKey
 	cfg.ServerEndpoint = resp.ServerEndpoint
@@ -337,19 +456,9 @@ func fillServerConfig(ctx context.Context, client *api.Client, cfg *config.NodeC
 	cfg.ServerKeepaliveSec = resp.ServerKeepaliveSec
 	cfg.ServerProbePort = resp.ServerProbePort
 	if cfg.PolicyRoutingCIDR == "" {
-		cfg.PolicyRoutingCIDR = firstScopedCIDR(cfg.ServerAllowedIPs)
-	}
-	return nil
-}
-
-func normalizeHostIP(value string) string {
-	if value == "" {
-		return ""
-	}
-	if strings.Contains(value, "/") {
-		return value
+		cfg.PolicyRoutingCIDR = config.PolicyCIDRs(cfg.ServerAllowedIPs)
 	}
-	return value + "/32"
+	return resp.Hubs, nil
 }
 
 func directKeepalive(cfg config.NodeConfig, natType string) int {
@@ -375,6 +484,83 @@ func directKeepalive(cfg config.NodeConfig, natType string) int {
 	return cfg.KeepaliveSec
 }
 
+// desiredPeers returns the P2P WireGuard peers to inject for the given
+// candidates: P2P-ready peers with a known key, endpoint and VPN IP.
+func desiredPeers(cfg config.NodeConfig, candidates []api.PeerCandidate) map[string]wireguard.Peer {
+	desired := map[string]wireguard.Peer{}
+	allowedOwner := map[string]string{}
+	for _, peer := range candidates {
+		// The exit node and its clients always talk directly: the hub
+		// cannot relay internet traffic.
+		exit := cfg.ExitNode != "" && peer.ExitNode && (peer.Name == cfg.ExitNode || peer.ID == cfg.ExitNode)
+		if !peer.P2PReady && !exit && !peer.ExitClient {
+			continue
+		}
+		// P2P WireGuard injection needs the peer's wg endpoint (as observed by the controller).
+		// PublicAddr from STUN is for the probe socket, not wg, and must not be used for wg endpoints.
+		wgEndpoint := peer.Endpoint
+		allowedIPs := addrutil.HostPrefixes(peer.VPNIP)
+		if len(allowedIPs) == 0 {
+			continue
+		}
+		// Traffic to and from the peer's subnet routes takes the direct
+		// path too.
+		allowedIPs = append(allowedIPs, peer.Routes...)
+		if exit {
+			allowedIPs = append(allowedIPs, defaultRoutes(peer.VPNIP)...)
+		}
+		if prev := allowedIPsOwner(allowedOwner, allowedIPs, peer.ID); prev != "" {
+			// Overlapping AllowedIPs are invalid in WireGuard. Skip duplicates so one bad/stale
+			// registry entry doesn't block all peer injection.
+			slog.Warn("skip peer injection: duplicate allowed_ip", "name", peer.Name, "id", peer.ID, "vpn_ip", peer.VPNIP, "owner", prev)
+			continue
+		}
+		for _, allowedIP := range allowedIPs {
+			allowedOwner[allowedIP] = peer.ID
+		}
+		// A client behind NAT is reachable once its handshake arrives.
+		if peer.PubKey != "" && (wgEndpoint != "" || peer.ExitClient) {
+			desired[peer.ID] = wireguard.Peer{
+				PublicKey:    peer.PubKey,
+				Endpoint:     wgEndpoint,
+				AllowedIPs:   allowedIPs,
+				KeepaliveSec: directKeepalive(cfg, peer.NATType),
+			}
+		}
+	}
+	return desired
+}
+
+// allowedIPsOwner returns the ID of another peer already holding one of
+// allowedIPs, or "".
+func allowedIPsOwner(owners map[string]string, allowedIPs []string, id string) string {
+	for _, allowedIP := range allowedIPs {
+		if prev, ok := owners[allowedIP]; ok && prev != id {
+			return prev
+		}
+	}
+	return ""
+}
+
+// syncPeers applies desired to WireGuard when it differs from active and
+// returns the peer set now in effect.
+func syncPeers(cfg config.NodeConfig, active, desired map[string]wireguard.Peer) map[string]wireguard.Peer {
+	if cfg.ServerPublicKey == "" || cfg.ServerEndpoint == "" || len(cfg.ServerAllowedIPs) == 0 {
+		return active
+	}
+	if peersEqual(active, desired) {
+		return active
+	}
+	peerList := peersFromMap(desired)
+	slog.Info("injecting wg peers", "count", len(peerList))
+	if err := wireguard.ApplyPeers(cfg, peerList); err != nil {
+		slog.Error("apply peers failed", "err", err)
+		return active
+	}
+	slog.Info("wg peers injected", "count", len(peerList))
+	return desired
+}
+
 func peersEqual(a, b map[string]wireguard.Peer) bool {
 	if len(a) != len(b) {
 		return false
@@ -414,21 +600,9 @@ func stringSlicesEqual(a, b []string) bool {
 	return true
 }
 
-func firstScopedCIDR(values []string) string {
-	for _, value := range values {
-		if value == "" {
-			continue
-		}
-		if value == "0.0.0.0/0" || value == "::/0" {
-			continue
-		}
-		return value
-	}
-	return ""
-}
-
 // hubProbeAddress returns the hub VPN IP + probe port for health checks.
 // The hub VPN IP is the first usable address in ServerAllowedIPs (e.g. 10.7.0.0/24 -> 10.7.0.1).
+// IPv4 prefixes are preferred; an IPv6-only overlay probes fd7a::/64 -> [fd7a::1].
 func hubProbeAddress(cfg config.NodeConfig) string {
 	if cfg.HealthCheckIntervalSec <= 0 || cfg.HealthCheckFailures <= 0 {
 		return ""
@@ -437,17 +611,26 @@ func hubProbeAddress(cfg config.NodeConfig) string {
 	if probePort == 0 {
 		probePort = config.DefaultProbePort
 	}
+	var hubIP netip.Addr
 	for _, cidr := range cfg.ServerAllowedIPs {
 		if cidr == "" || cidr == "0.0.0.0/0" || cidr == "::/0" {
 			continue
 		}
 		prefix, err := netip.ParsePrefix(cidr)
-		if err != nil || !prefix.Addr().Is4() {
+		if err != nil {
 			continue
 		}
-		hubIP := prefix.Masked().Addr().Next()
-		return fmt.Sprintf("%s:%d", hubIP.String(), probePort)
+		if prefix.Addr().Is4() {
+			hubIP = prefix.Masked().Addr().Next()
+			break
+		}
+		if !hubIP.IsValid() {
+			hubIP = prefix.Masked().Addr().Next()
+		}
 	}
-	return ""
+	if !hubIP.IsValid() {
+		return ""
+	}
+	return net.JoinHostPort(hubIP.String(), strconv.Itoa(probePort))
 }
 
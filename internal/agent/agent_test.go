@@ -4,6 +4,10 @@
 package agent
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"vpnctl/internal/api"
@@ -51,39 +55,129 @@ func TestPeersEqual(t *testing.T) {
 	}
 }
 
-func TestPeerInjection_SkipsDuplicateAllowedIPs(t *testing.T) {
+func TestDesiredPeers_SkipsDuplicateAllowedIPs(t *testing.T) {
 	t.Parallel()
 
-	// This test is indirect: it verifies we don't panic and that duplicates
-	// don't cause unstable map states. The actual WireGuard rejection happens
-	// at apply time; skipping duplicates prevents apply from failing.
+	// The actual WireGuard rejection happens at apply time; skipping
+	// duplicates prevents apply from failing.
 	candidates := []api.PeerCandidate{
-		{ID: "a", Name: "a", PubKey: "k1", VPNIP: "10.7.0.23/32", Endpoint: "1.1.1.1:1"},
-		{ID: "b", Name: "b", PubKey: "k2", VPNIP: "10.7.0.23/32", Endpoint: "2.2.2.2:2"},
-	}
-
-	allowedOwner := map[string]string{}
-	desired := map[string]wireguard.Peer{}
-	cfg := config.NodeConfig{KeepaliveSec: 25}
-	for _, peer := range candidates {
-		wgEndpoint := peer.Endpoint
-		allowedIP := normalizeHostIP(peer.VPNIP)
-		if allowedIP != "" {
-			if prev, ok := allowedOwner[allowedIP]; ok && prev != peer.ID {
-				continue
-			}
-			allowedOwner[allowedIP] = peer.ID
-		}
-		if allowedIP != "" && peer.PubKey != "" && wgEndpoint != "" {
-			desired[peer.ID] = wireguard.Peer{
-				PublicKey:    peer.PubKey,
-				Endpoint:     wgEndpoint,
-				AllowedIPs:   []string{allowedIP},
-				KeepaliveSec: directKeepalive(cfg, peer.NATType),
-			}
-		}
+		{ID: "a", Name: "a", PubKey: "k1", VPNIP: "10.7.0.23/32", Endpoint: "1.1.1.1:1", P2PReady: true},
+		{ID: "b", Name: "b", PubKey: "k2", VPNIP: "10.7.0.23/32", Endpoint: "2.2.2.2:2", P2PReady: true},
+		{ID: "c", Name: "c", PubKey: "k3", VPNIP: "10.7.0.24/32", Endpoint: "3.3.3.3:3"},
 	}
+
+	desired := desiredPeers(config.NodeConfig{KeepaliveSec: 25}, candidates)
 	if len(desired) != 1 {
 		t.Fatalf("desired=%d", len(desired))
 	}
+	if _, ok := desired["a"]; !ok {
+		t.Fatalf("desired=%+v", desired)
+	}
+}
+
+func TestDesiredPeers_DualStackAllowedIPs(t *testing.T) {
+	t.Parallel()
+
+	candidates := []api.PeerCandidate{
+		{ID: "a", Name: "a", PubKey: "k1", VPNIP: "10.7.0.2/32,fd7a::2/128", Endpoint: "1.1.1.1:1", P2PReady: true},
+		{ID: "b", Name: "b", PubKey: "k2", VPNIP: "fd7a::3", Endpoint: "[2001:db8::3]:51820", P2PReady: true},
+		// Shares a's IPv6 address, so it must be skipped as a whole.
+		{ID: "c", Name: "c", PubKey: "k3", VPNIP: "10.7.0.4/32,fd7a::2/128", Endpoint: "3.3.3.3:3", P2PReady: true},
+	}
+
+	desired := desiredPeers(config.NodeConfig{KeepaliveSec: 25}, candidates)
+	if len(desired) != 2 {
+		t.Fatalf("desired=%+v", desired)
+	}
+	if got := desired["a"].AllowedIPs; len(got) != 2 || got[0] != "10.7.0.2/32" || got[1] != "fd7a::2/128" {
+		t.Fatalf("a allowed=%v", got)
+	}
+	if got := desired["b"].AllowedIPs; len(got) != 1 || got[0] != "fd7a::3/128" {
+		t.Fatalf("b allowed=%v", got)
+	}
+}
+
+func TestDesiredPeers_ExitNodeAndClients(t *testing.T) {
+	t.Parallel()
+
+	candidates := []api.PeerCandidate{
+		{ID: "gw", Name: "gw", PubKey: "k1", VPNIP: "10.7.0.2/32", Endpoint: "1.1.1.1:51820", ExitNode: true},
+		{ID: "other", Name: "other", PubKey: "k2", VPNIP: "10.7.0.3/32", Endpoint: "2.2.2.2:51820", ExitNode: true},
+		// A client behind NAT that uses this node as its exit node.
+		{ID: "laptop", Name: "laptop", PubKey: "k3", VPNIP: "10.7.0.4/32", ExitClient: true},
+	}
+
+	desired := desiredPeers(config.NodeConfig{KeepaliveSec: 25, ExitNode: "gw"}, candidates)
+	if len(desired) != 2 {
+		t.Fatalf("desired=%+v", desired)
+	}
+	if got := desired["gw"].AllowedIPs; len(got) != 2 || got[1] != "0.0.0.0/0" {
+		t.Fatalf("gw allowed=%v", got)
+	}
+	if p := desired["laptop"]; p.Endpoint != "" || len(p.AllowedIPs) != 1 || p.AllowedIPs[0] != "10.7.0.4/32" {
+		t.Fatalf("laptop=%+v", p)
+	}
+}
+
+func TestDNSRecords(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.NodeConfig{Name: "laptop", VPNIP: "10.7.0.4/32,fd00::4/128"}
+	candidates := []api.PeerCandidate{
+		{ID: "db", Name: "db-1", VPNIP: "10.7.0.5/32"},
+		// Not yet assigned an address.
+		{ID: "new", Name: "new"},
+	}
+
+	records := dnsRecords(cfg, candidates)
+	if len(records) != 2 {
+		t.Fatalf("records=%v", records)
+	}
+	if got := records["laptop"]; len(got) != 2 || got[1].String() != "fd00::4" {
+		t.Fatalf("laptop=%v", got)
+	}
+	if got := records["db-1"]; len(got) != 1 || got[0].String() != "10.7.0.5" {
+		t.Fatalf("db-1=%v", got)
+	}
+}
+
+func TestRegister_DropsTakenVPNIP(t *testing.T) {
+	t.Parallel()
+
+	var claimed []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req api.RegisterRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		claimed = append(claimed, req.VPNIP)
+		w.Header().Set("Content-Type", "application/json")
+		switch req.PubKey {
+		case "pub-old":
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"error":"pub_key does not match","code":"` + api.ErrCodePubKeyMismatch + `"}`))
+		default:
+			if req.VPNIP == "10.7.0.2/32" {
+				w.WriteHeader(http.StatusConflict)
+				_, _ = w.Write([]byte(`{"error":"vpn_ip belongs to another node","code":"` + api.ErrCodeVPNIPConflict + `"}`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode(api.RegisterResponse{NodeID: req.Name, VPNIP: "10.7.0.9/32"})
+		}
+	}))
+	defer srv.Close()
+	client := api.NewClient(srv.URL)
+
+	resp, err := Register(context.Background(), client, api.RegisterRequest{Name: "node-a", PubKey: "pub-a", VPNIP: "10.7.0.2/32"})
+	if err != nil || resp.VPNIP != "10.7.0.9/32" {
+		t.Fatalf("Register = %+v, %v", resp, err)
+	}
+	if len(claimed) != 2 || claimed[1] != "" {
+		t.Fatalf("claimed=%q", claimed)
+	}
+
+	// A key mismatch is not retried.
+	claimed = nil
+	_, err = Register(context.Background(), client, api.RegisterRequest{Name: "node-a", PubKey: "pub-old", VPNIP: "10.7.0.2/32"})
+	if !api.HasErrorCode(err, api.ErrCodePubKeyMismatch) || len(claimed) != 1 {
+		t.Fatalf("key mismatch: err=%v claimed=%q", err, claimed)
+	}
 }
@@ -0,0 +1,127 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"vpnctl/internal/api"
+	"vpnctl/internal/config"
+	"vpnctl/internal/pki"
+)
+
+// credentials are the node's mTLS files in pki_dir, which the agent replaces
+// while it runs: the client certificate when it renews it, and the CA bundle
+// when the controller's CA is rotated.
+type credentials struct {
+	cert  *pki.ClientCert
+	roots *pki.RootStore
+	// keyAlgorithm is the controller's pki.key_algorithm, learned with the
+	// CA bundle; empty until then.
+	keyAlgorithm string
+}
+
+func loadCredentials(pkiDir string) (*credentials, error) {
+	cert, err := pki.LoadClientCert(filepath.Join(pkiDir, "client.crt"), filepath.Join(pkiDir, "client.key"))
+	if err != nil {
+		return nil, err
+	}
+	roots, err := pki.LoadRootStore(filepath.Join(pkiDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	return &credentials{cert: cert, roots: roots}, nil
+}
+
+// tlsConfig returns a client TLS config that reads the certificate and the
+// trusted CAs on each handshake, so replacing them needs no new client.
+func (c *credentials) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:           tls.VersionTLS13,
+		GetClientCertificate: c.cert.GetClientCertificate,
+		// The chain is verified by VerifyConnection against the current
+		// CA bundle instead of a fixed RootCAs pool.
+		InsecureSkipVerify: true, //nolint:gosec // verified in VerifyConnection
+		VerifyConnection:   c.roots.VerifyConnection,
+	}
+}
+
+// refreshCredentials follows a CA rotation and renews the client
+// certificate when needed. Failures are logged and retried on the next
+// keepalive.
+func refreshCredentials(ctx context.Context, client *api.Client, cfg config.NodeConfig, creds *credentials, nodeID string) {
+	if creds == nil {
+		return
+	}
+	syncCA(ctx, client, creds)
+	renewCert(ctx, client, cfg, creds, nodeID)
+}
+
+// syncCA fetches the controller's CA bundle and stores it as ca.crt when it
+// changed. During a rotation it holds the new and the previous CA.
+func syncCA(ctx context.Context, client *api.Client, creds *credentials) {
+	bundle, algorithm, err := client.CABundle(ctx)
+	if err != nil {
+		slog.Warn("CA bundle fetch failed", "err", err)
+		return
+	}
+	creds.keyAlgorithm = algorithm
+	changed, err := creds.roots.Update(bundle)
+	if err != nil {
+		slog.Warn("CA bundle update failed", "err", err)
+		return
+	}
+	if changed {
+		slog.Info("CA bundle updated", "ca_not_after", creds.roots.Current().NotAfter)
+	}
+}
+
+// renewCert renews the node's client certificate once it is within
+// cert_renew_before_sec of expiring, or right away when it was issued by
+// a CA other than the current one. The new key pair, of the controller's
+// configured key algorithm or else the current CA's, replaces the files in
+// pki_dir and is used from the next TLS handshake. An expired certificate can only be replaced by enrolling
+// again.
+func renewCert(ctx context.Context, client *api.Client, cfg config.NodeConfig, creds *credentials, nodeID string) {
+	cert := creds.cert
+	rotated := !cert.IssuedBy(creds.roots.Current())
+	if !rotated && !cert.NeedsRenewal(time.Now(), time.Duration(cfg.CertRenewBeforeSec)*time.Second) {
+		return
+	}
+	algorithm := creds.keyAlgorithm
+	if algorithm == "" {
+		algorithm = pki.KeyAlgorithmOf(creds.roots.Current().PublicKey)
+	}
+	if err := renewCertOnce(ctx, client, cfg, cert, nodeID, algorithm); err != nil {
+		slog.Warn("client certificate renewal failed", "not_after", cert.NotAfter(), "ca_rotated", rotated, "err", err)
+		return
+	}
+	slog.Info("client certificate renewed", "not_after", cert.NotAfter(), "ca_rotated", rotated)
+}
+
+func renewCertOnce(ctx context.Context, client *api.Client, cfg config.NodeConfig, cert *pki.ClientCert, nodeID, algorithm string) error {
+	csrPEM, keyPEM, err := pki.GenerateCSR(nodeID, algorithm)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Renew(ctx, api.RenewRequest{NodeID: nodeID, CSR: string(csrPEM)})
+	if err != nil {
+		return err
+	}
+	certPath := filepath.Join(cfg.PKIDir, "client.crt")
+	keyPath := filepath.Join(cfg.PKIDir, "client.key")
+	if err := pki.SaveClientCert(certPath, keyPath, []byte(resp.ClientCert), keyPEM); err != nil {
+		return err
+	}
+	if err := cert.Reload(); err != nil {
+		return err
+	}
+	// Kept-alive connections still carry the old certificate.
+	client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"vpnctl/internal/api"
+	"vpnctl/internal/config"
+	"vpnctl/internal/pki"
+)
+
+// fakeController serves /ca and /renew from the CA in caDir, read on each
+// request, and counts renewals. /ca advertises keyAlgorithm when it is set.
+// The node in the returned pki_dir holds a certificate from that CA valid for
+// certValidity.
+func fakeController(t *testing.T, caDir string, certValidity time.Duration, keyAlgorithm string) (srv *httptest.Server, pkiDir string, renewals *atomic.Int32) {
+	t.Helper()
+	caKeyPath, caCertPath := filepath.Join(caDir, "ca.key"), filepath.Join(caDir, "ca.crt")
+	if err := pki.GenerateCA(caKeyPath, caCertPath, 24*time.Hour, pki.DefaultKeyAlgorithm); err != nil {
+		t.Fatalf("GenerateCA: %v", err)
+	}
+	srvKey, srvCert := filepath.Join(caDir, "server.key"), filepath.Join(caDir, "server.crt")
+	if err := pki.GenerateServerCert(caCertPath, caKeyPath, srvKey, srvCert, []string{"127.0.0.1"}, 24*time.Hour, ""); err != nil {
+		t.Fatalf("GenerateServerCert: %v", err)
+	}
+	caCert, caKey, err := pki.LoadCA(caKeyPath, caCertPath)
+	if err != nil {
+		t.Fatalf("LoadCA: %v", err)
+	}
+
+	csrPEM, keyPEM, err := pki.GenerateCSR("node-a", pki.DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("GenerateCSR: %v", err)
+	}
+	certPEM, err := pki.SignCSR(caCert, caKey, csrPEM, certValidity)
+	if err != nil {
+		t.Fatalf("SignCSR: %v", err)
+	}
+	pkiDir = t.TempDir()
+	caPEM, _ := os.ReadFile(caCertPath)
+	for name, data := range map[string][]byte{"ca.crt": caPEM, "client.crt": certPEM, "client.key": keyPEM} {
+		if err := os.WriteFile(filepath.Join(pkiDir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serverTLS, err := pki.ServerTLSConfig(caCertPath, srvCert, srvKey, nil)
+	if err != nil {
+		t.Fatalf("ServerTLSConfig: %v", err)
+	}
+	renewals = &atomic.Int32{}
+	srv = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ca" {
+			bundle, err := pki.CABundle(caDir)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if keyAlgorithm != "" {
+				w.Header().Set(api.KeyAlgorithmHeader, keyAlgorithm)
+			}
+			_, _ = w.Write(bundle)
+			return
+		}
+		var req api.RenewRequest
+		if r.URL.Path != "/renew" || json.NewDecoder(r.Body).Decode(&req) != nil || req.NodeID != r.TLS.PeerCertificates[0].Subject.CommonName {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		renewals.Add(1)
+		caCert, caKey, err := pki.LoadCA(caKeyPath, caCertPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		signed, err := pki.SignCSR(caCert, caKey, []byte(req.CSR), 24*time.Hour)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(api.RenewResponse{ClientCert: string(signed)})
+	}))
+	srv.TLS = serverTLS
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, pkiDir, renewals
+}
+
+func TestRenewCert_ReplacesCertificateInPlace(t *testing.T) {
+	t.Parallel()
+
+	// Enrolled with a certificate that expires within the renewal window.
+	srv, pkiDir, renewals := fakeController(t, t.TempDir(), time.Hour, "")
+
+	cfg := config.NodeConfig{Controller: srv.URL, PKIDir: pkiDir, CertRenewBeforeSec: 7200}
+	client, creds := newClient(cfg)
+	if creds == nil {
+		t.Fatal("newClient did not load the client certificate")
+	}
+	cert := creds.cert
+	renewCert(context.Background(), client, cfg, creds, "node-a")
+
+	if d := time.Until(cert.NotAfter()); d < 23*time.Hour {
+		t.Fatalf("certificate not renewed, expires in %v", d)
+	}
+	onDisk, err := pki.LoadCert(filepath.Join(pkiDir, "client.crt"))
+	if err != nil || !onDisk.NotAfter.Equal(cert.NotAfter()) {
+		t.Fatalf("client.crt not replaced: %v", err)
+	}
+
+	// Outside the window nothing is requested.
+	renewCert(context.Background(), client, cfg, creds, "node-a")
+	if n := renewals.Load(); n != 1 {
+		t.Fatalf("renew requests=%d, want 1", n)
+	}
+}
+
+func TestRefreshCredentials_FollowsCARotation(t *testing.T) {
+	t.Parallel()
+
+	caDir := t.TempDir()
+	srv, pkiDir, renewals := fakeController(t, caDir, 24*time.Hour, "")
+	cfg := config.NodeConfig{Controller: srv.URL, PKIDir: pkiDir}
+	client, creds := newClient(cfg)
+	if creds == nil {
+		t.Fatal("newClient did not load the client certificate")
+	}
+
+	// Nothing to do while the CA is unchanged and the certificate is fresh.
+	refreshCredentials(context.Background(), client, cfg, creds, "node-a")
+	if n := renewals.Load(); n != 0 {
+		t.Fatalf("renew requests=%d before rotation", n)
+	}
+
+	if err := pki.RotateCA(caDir, 48*time.Hour, time.Hour, time.Now(), pki.DefaultKeyAlgorithm); err != nil {
+		t.Fatalf("RotateCA: %v", err)
+	}
+	newCA, err := pki.LoadCert(filepath.Join(caDir, "ca.crt"))
+	if err != nil {
+		t.Fatalf("LoadCert: %v", err)
+	}
+	refreshCredentials(context.Background(), client, cfg, creds, "node-a")
+
+	if !creds.roots.Current().Equal(newCA) {
+		t.Fatal("CA bundle not updated")
+	}
+	if !creds.cert.IssuedBy(newCA) || renewals.Load() != 1 {
+		t.Fatalf("certificate not renewed under the new CA, renew requests=%d", renewals.Load())
+	}
+	bundle, _ := pki.CABundle(caDir)
+	if onDisk, _ := os.ReadFile(filepath.Join(pkiDir, "ca.crt")); string(onDisk) != string(bundle) {
+		t.Fatal("ca.crt does not hold the bundle")
+	}
+}
+
+func TestRefreshCredentials_RenewsWithConfiguredKeyAlgorithm(t *testing.T) {
+	t.Parallel()
+
+	// The CA keeps its ECDSA key while the controller asks for Ed25519.
+	srv, pkiDir, renewals := fakeController(t, t.TempDir(), time.Hour, pki.KeyEd25519)
+	cfg := config.NodeConfig{Controller: srv.URL, PKIDir: pkiDir, CertRenewBeforeSec: 7200}
+	client, creds := newClient(cfg)
+	if creds == nil {
+		t.Fatal("newClient did not load the client certificate")
+	}
+	refreshCredentials(context.Background(), client, cfg, creds, "node-a")
+
+	if n := renewals.Load(); n != 1 {
+		t.Fatalf("renew requests=%d, want 1", n)
+	}
+	if got := pki.KeyAlgorithmOf(creds.roots.Current().PublicKey); got != pki.DefaultKeyAlgorithm {
+		t.Fatalf("CA key algorithm=%s", got)
+	}
+	onDisk, err := pki.LoadCert(filepath.Join(pkiDir, "client.crt"))
+	if err != nil {
+		t.Fatalf("LoadCert: %v", err)
+	}
+	if got := pki.KeyAlgorithmOf(onDisk.PublicKey); got != pki.KeyEd25519 {
+		t.Fatalf("renewed key algorithm=%s, want %s", got, pki.KeyEd25519)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+
+	"vpnctl/internal/addrutil"
+	"vpnctl/internal/api"
+	"vpnctl/internal/config"
+	"vpnctl/internal/execx"
+	"vpnctl/internal/magicdns"
+)
+
+const resolvConfPath = "/etc/resolv.conf"
+
+// startDNS starts the node-name resolver on the node's VPN address, or
+// returns nil when cfg has no dns section or it cannot listen.
+func startDNS(cfg config.NodeConfig) *magicdns.Server {
+	if cfg.DNS == nil {
+		return nil
+	}
+	ip := addrutil.PrimaryIP(cfg.VPNIP)
+	if ip == "" {
+		slog.Warn("dns disabled: node has no VPN address")
+		return nil
+	}
+	upstreams := cfg.DNS.Upstreams
+	if len(upstreams) == 0 {
+		upstreams = magicdns.ResolvConfServers(resolvConfPath)
+	}
+	addr := net.JoinHostPort(ip, strconv.Itoa(cfg.DNS.Port))
+	srv, err := magicdns.Start(addr, cfg.DNS.Suffix, upstreams)
+	if err != nil {
+		slog.Warn("dns start failed", "addr", addr, "err", err)
+		return nil
+	}
+	slog.Info("dns resolver listening", "addr", srv.LocalAddr(), "suffix", cfg.DNS.Suffix, "upstreams", upstreams)
+
+	if cfg.DNS.SystemdResolved {
+		if err := magicdns.RegisterResolved(execx.NewOSRunner(os.Stdout, os.Stderr), cfg.WGInterface, addr, cfg.DNS.Suffix); err != nil {
+			slog.Warn("systemd-resolved registration failed", "iface", cfg.WGInterface, "err", err)
+		}
+	}
+	return srv
+}
+
+// stopDNS closes srv and drops its systemd-resolved registration.
+func stopDNS(cfg config.NodeConfig, srv *magicdns.Server) {
+	if srv == nil {
+		return
+	}
+	_ = srv.Close()
+	if cfg.DNS.SystemdResolved {
+		_ = magicdns.UnregisterResolved(execx.NewOSRunner(os.Stdout, os.Stderr), cfg.WGInterface)
+	}
+}
+
+// dnsRecords maps the node itself and each candidate to its VPN addresses.
+func dnsRecords(cfg config.NodeConfig, candidates []api.PeerCandidate) map[string][]netip.Addr {
+	records := map[string][]netip.Addr{}
+	if addrs := addrutil.HostAddrs(cfg.VPNIP); len(addrs) > 0 {
+		records[cfg.Name] = addrs
+	}
+	for _, peer := range candidates {
+		if addrs := addrutil.HostAddrs(peer.VPNIP); peer.Name != "" && len(addrs) > 0 {
+			records[peer.Name] = addrs
+		}
+	}
+	return records
+}
+
+// updateDNS replaces srv's records from candidates.
+func updateDNS(srv *magicdns.Server, cfg config.NodeConfig, candidates []api.PeerCandidate) {
+	if srv != nil {
+		srv.SetRecords(dnsRecords(cfg, candidates))
+	}
+}
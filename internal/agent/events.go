@@ -0,0 +1,51 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"vpnctl/internal/api"
+)
+
+const (
+	eventsRetryMin = time.Second
+	eventsRetryMax = time.Minute
+)
+
+// watchEvents follows the controller event stream, reconnecting with
+// exponential backoff, and signals out for every event. out is expected to be
+// buffered; signals are coalesced when the agent loop is busy.
+func watchEvents(ctx context.Context, client *api.Client, nodeID string, out chan<- struct{}) {
+	backoff := eventsRetryMin
+	for {
+		connected := false
+		err := client.Events(ctx, nodeID, func(ev api.Event) {
+			connected = true
+			slog.Debug("controller event", "type", ev.Type, "node", ev.NodeID, "peer", ev.PeerID)
+			select {
+			case out <- struct{}{}:
+			default:
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = eventsRetryMin
+		}
+		slog.Debug("event stream closed, reconnecting", "err", err, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > eventsRetryMax {
+			backoff = eventsRetryMax
+		}
+	}
+}
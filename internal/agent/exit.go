@@ -0,0 +1,42 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"log/slog"
+	"slices"
+
+	"vpnctl/internal/addrutil"
+	"vpnctl/internal/config"
+	"vpnctl/internal/wireguard"
+)
+
+// setupExitNode installs the NAT rule when cfg offers the node as exit node
+// and removes a leftover one otherwise.
+func setupExitNode(cfg config.NodeConfig) {
+	if !cfg.AdvertiseExitNode {
+		// Best effort: the node may have stopped offering egress.
+		_ = wireguard.RemoveMasquerade()
+		return
+	}
+	if err := wireguard.ApplyMasquerade(cfg.WGInterface); err != nil {
+		slog.Warn("exit node masquerade failed", "err", err)
+	}
+}
+
+// defaultRoutes returns the default route of each address family vpnIP
+// has, for the peer serving as exit node.
+func defaultRoutes(vpnIP string) []string {
+	var out []string
+	for _, a := range addrutil.HostAddrs(vpnIP) {
+		route := "0.0.0.0/0"
+		if a.Is6() {
+			route = "::/0"
+		}
+		if !slices.Contains(out, route) {
+			out = append(out, route)
+		}
+	}
+	return out
+}
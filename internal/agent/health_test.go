@@ -149,6 +149,24 @@ func TestHubProbeAddress(t *testing.T) {
 			},
 			expect: "10.7.0.1:9999",
 		},
+		{
+			name: "ipv6 only",
+			cfg: config.NodeConfig{
+				HealthCheckIntervalSec: 3,
+				HealthCheckFailures:    3,
+				ServerAllowedIPs:       []string{"fd7a:115c:a1e0::/64"},
+			},
+			expect: "[fd7a:115c:a1e0::1]:51900",
+		},
+		{
+			name: "dual stack prefers ipv4",
+			cfg: config.NodeConfig{
+				HealthCheckIntervalSec: 3,
+				HealthCheckFailures:    3,
+				ServerAllowedIPs:       []string{"fd7a:115c:a1e0::/64", "10.7.0.0/24"},
+			},
+			expect: "10.7.0.1:51900",
+		},
 	}
 
 	for _, tc := range tests {
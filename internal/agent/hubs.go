@@ -0,0 +1,81 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"vpnctl/internal/addrutil"
+	"vpnctl/internal/api"
+	"vpnctl/internal/config"
+	"vpnctl/internal/direct"
+	"vpnctl/internal/wireguard"
+)
+
+// useHub points cfg's hub peer at hub and re-applies the interface with the
+// current P2P peers. It is a no-op when hub is already in use.
+func useHub(cfg *config.NodeConfig, hub api.HubPeer, active map[string]wireguard.Peer) error {
+	if cfg.ServerPublicKey == hub.PublicKey && cfg.ServerEndpoint == hub.Endpoint {
+		return nil
+	}
+	cfg.ServerPublicKey = hub.PublicKey
+	cfg.ServerEndpoint = hub.Endpoint
+	cfg.ServerProbePort = hub.ProbePort
+	return wireguard.ApplyPeers(*cfg, peersFromMap(active))
+}
+
+// backupHub returns the hub to fail over to from current: the backup when
+// the node is on its primary, and nothing once it already failed over.
+func backupHub(hubs []api.HubPeer, current string) (api.HubPeer, bool) {
+	if len(hubs) < 2 || hubs[0].Name != current {
+		return api.HubPeer{}, false
+	}
+	return hubs[1], true
+}
+
+// relayProbeAddress returns the health check target for hub: its overlay
+// address and probe port. It is "" when health checks are off or the hub has
+// no address, in which case hubProbeAddress applies.
+func relayProbeAddress(cfg config.NodeConfig, hub api.HubPeer) string {
+	if cfg.HealthCheckIntervalSec <= 0 || cfg.HealthCheckFailures <= 0 {
+		return ""
+	}
+	ip := addrutil.PrimaryIP(hub.Address)
+	if ip == "" {
+		return ""
+	}
+	port := hub.ProbePort
+	if port == 0 {
+		port = config.DefaultProbePort
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(port))
+}
+
+// measureHubs probes every hub's public probe port and reports the RTTs, so
+// the controller can assign the node its closest hubs.
+func measureHubs(ctx context.Context, client *api.Client, shared *direct.Shared, nodeID string, hubs []api.HubPeer) {
+	req := api.HubRTTRequest{NodeID: nodeID}
+	for _, hub := range hubs {
+		addr, ok := addrutil.ProbeAddr("", hub.Endpoint, hub.ProbePort)
+		if !ok {
+			continue
+		}
+		rtt, err := shared.ProbePeer(ctx, addr, 2*time.Second)
+		res := api.HubRTT{Hub: hub.Name, Success: err == nil}
+		if err == nil {
+			res.RTTMs = float64(rtt.Microseconds()) / 1000.0
+		}
+		req.Results = append(req.Results, res)
+	}
+	if len(req.Results) == 0 {
+		return
+	}
+	if err := client.SubmitHubRTT(ctx, req); err != nil {
+		slog.Warn("hub rtt submit failed", "err", err)
+	}
+}
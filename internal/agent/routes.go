@@ -0,0 +1,52 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+
+	"vpnctl/internal/api"
+	"vpnctl/internal/config"
+	"vpnctl/internal/wireguard"
+)
+
+// subnetRoutes returns the subnet routes offered by candidates, sorted and
+// without the node's own.
+func subnetRoutes(cfg config.NodeConfig, candidates []api.PeerCandidate) []string {
+	var routes []string
+	for _, peer := range candidates {
+		for _, r := range peer.Routes {
+			if !slices.Contains(cfg.AdvertiseRoutes, r) {
+				routes = append(routes, r)
+			}
+		}
+	}
+	slices.Sort(routes)
+	return slices.Compact(routes)
+}
+
+// applySubnetRoutes sends routes through the hub peer (and the policy table,
+// when enabled) in place of applied, and returns the routes now in effect.
+// baseAllowed and basePolicy are cfg's hub AllowedIPs and policy CIDRs
+// without subnet routes.
+func applySubnetRoutes(cfg *config.NodeConfig, baseAllowed []string, basePolicy string, applied, routes []string, active map[string]wireguard.Peer) []string {
+	if slices.Equal(applied, routes) || cfg.ServerPublicKey == "" || cfg.ServerEndpoint == "" || len(baseAllowed) == 0 {
+		return applied
+	}
+	next := *cfg
+	next.ServerAllowedIPs = append(slices.Clone(baseAllowed), routes...)
+	next.PolicyRoutingCIDR = basePolicy
+	if basePolicy != "" && len(routes) > 0 {
+		next.PolicyRoutingCIDR = basePolicy + "," + strings.Join(routes, ",")
+	}
+	if err := wireguard.ApplyRoutes(*cfg, next, peersFromMap(active)); err != nil {
+		slog.Error("apply subnet routes failed", "routes", routes, "err", err)
+		return applied
+	}
+	*cfg = next
+	slog.Info("subnet routes applied", "routes", routes)
+	return routes
+}
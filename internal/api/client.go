@@ -4,38 +4,72 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
-// Client is a thin HTTP client for the controller API.
+// Client is a thin HTTP client for the controller API. It may be given
+// several controllers (active and standby); requests go to the one that
+// answered last and move on to the next when it is unreachable or reports
+// itself unavailable.
 type Client struct {
-	baseURL string
+	baseURLs []string
+	// current is the index into baseURLs of the controller that answered last.
+	current atomic.Int32
 	http    *http.Client
 }
 
-// NewClient creates a client for the given base URL (e.g. http://host:port).
+// StatusError is returned when the controller answers with a non-2xx status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	// Message is the response body, usually a JSON error object.
+	Message string
+	// Code is the error object's "code" field, one of the ErrCode
+	// constants, or empty.
+	Code string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("request failed: %s: %s", e.Status, e.Message)
+	}
+	return fmt.Sprintf("request failed: %s", e.Status)
+}
+
+// HasErrorCode reports whether err is a StatusError with the given code.
+func HasErrorCode(err error, code string) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.Code == code
+}
+
+// NewClient creates a client for the given base URL (e.g. http://host:port),
+// or for a comma-separated list of them.
 func NewClient(baseURL string) *Client {
 	return &Client{
-		baseURL: baseURL,
+		baseURLs: splitURLs(baseURL),
 		http: &http.Client{
 			Timeout: 10 * time.Second,
 		},
 	}
 }
 
-// NewTLSClient creates a client with custom TLS configuration.
+// NewTLSClient creates a client with custom TLS configuration. baseURL may be
+// a comma-separated list, as for NewClient.
 func NewTLSClient(baseURL string, tlsConfig *tls.Config) *Client {
 	return &Client{
-		baseURL: baseURL,
+		baseURLs: splitURLs(baseURL),
 		http: &http.Client{
 			Timeout:   10 * time.Second,
 			Transport: &http.Transport{TLSClientConfig: tlsConfig},
@@ -43,6 +77,19 @@ func NewTLSClient(baseURL string, tlsConfig *tls.Config) *Client {
 	}
 }
 
+func splitURLs(value string) []string {
+	var out []string
+	for _, u := range strings.Split(value, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			out = append(out, strings.TrimRight(u, "/"))
+		}
+	}
+	if len(out) == 0 {
+		out = []string{""}
+	}
+	return out
+}
+
 // Register registers a node and returns peer candidates.
 func (c *Client) Register(ctx context.Context, req RegisterRequest) (RegisterResponse, error) {
 	var resp RegisterResponse
@@ -61,6 +108,16 @@ func (c *Client) Bootstrap(ctx context.Context, req BootstrapRequest) (Bootstrap
 	return resp, nil
 }
 
+// Renew exchanges a CSR for a new client certificate, authenticated with the
+// current one.
+func (c *Client) Renew(ctx context.Context, req RenewRequest) (RenewResponse, error) {
+	var resp RenewResponse
+	if err := c.postJSON(ctx, "/renew", req, &resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
 // Candidates fetches peer candidates for a node ID.
 func (c *Client) Candidates(ctx context.Context, nodeID string) (CandidatesResponse, error) {
 	var resp CandidatesResponse
@@ -96,6 +153,26 @@ func (c *Client) WGConfig(ctx context.Context, nodeID string) (WGConfigResponse,
 	return resp, nil
 }
 
+// Leave tells the controller the node is shutting down. Ephemeral nodes are
+// removed right away.
+func (c *Client) Leave(ctx context.Context, req LeaveRequest) error {
+	return c.postJSON(ctx, "/leave", req, nil)
+}
+
+// SubmitHubRTT sends relay hub RTT measurements.
+func (c *Client) SubmitHubRTT(ctx context.Context, req HubRTTRequest) error {
+	return c.postJSON(ctx, "/hub-rtt", req, nil)
+}
+
+// RelayPeers returns the WireGuard peers the named relay hub should have.
+func (c *Client) RelayPeers(ctx context.Context, hub string) (RelayPeersResponse, error) {
+	var resp RelayPeersResponse
+	if err := c.getJSON(ctx, "/relay/peers?hub="+url.QueryEscape(hub), &resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
 // FleetStatus fetches the current status of all fleet nodes.
 func (c *Client) FleetStatus(ctx context.Context) (FleetStatusResponse, error) {
 	var resp FleetStatusResponse
@@ -114,62 +191,279 @@ func (c *Client) FleetHistory(ctx context.Context, window string) (FleetHistoryR
 	return resp, nil
 }
 
-func (c *Client) postJSON(ctx context.Context, path string, body any, out any) error {
-	payload, err := json.Marshal(body)
-	if err != nil {
-		return err
+// RemoveNode deletes a node from the controller registry.
+func (c *Client) RemoveNode(ctx context.Context, req RemoveNodeRequest) error {
+	return c.postJSON(ctx, "/admin/nodes/remove", req, nil)
+}
+
+// RenameNode changes a node's display name.
+func (c *Client) RenameNode(ctx context.Context, req RenameNodeRequest) error {
+	return c.postJSON(ctx, "/admin/nodes/rename", req, nil)
+}
+
+// TagNode replaces a node's admin tags.
+func (c *Client) TagNode(ctx context.Context, req TagNodeRequest) error {
+	return c.postJSON(ctx, "/admin/nodes/tags", req, nil)
+}
+
+// Routes lists advertised and approved subnet routes.
+func (c *Client) Routes(ctx context.Context) (RoutesResponse, error) {
+	var resp RoutesResponse
+	if err := c.getJSON(ctx, "/admin/routes", &resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// ApproveRoute approves or unapproves a node's subnet route.
+func (c *Client) ApproveRoute(ctx context.Context, req ApproveRouteRequest) error {
+	return c.postJSON(ctx, "/admin/routes/approve", req, nil)
+}
+
+// DisableNode disables or re-enables a node.
+func (c *Client) DisableNode(ctx context.Context, req DisableNodeRequest) error {
+	return c.postJSON(ctx, "/admin/nodes/disable", req, nil)
+}
+
+// ListTokens returns the active bootstrap tokens.
+func (c *Client) ListTokens(ctx context.Context) (TokenListResponse, error) {
+	var resp TokenListResponse
+	if err := c.getJSON(ctx, "/admin/tokens", &resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// CreateToken creates a bootstrap token.
+func (c *Client) CreateToken(ctx context.Context, req TokenCreateRequest) (TokenCreateResponse, error) {
+	var resp TokenCreateResponse
+	if err := c.postJSON(ctx, "/admin/tokens", req, &resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// RevokeToken revokes a bootstrap token.
+func (c *Client) RevokeToken(ctx context.Context, req RevokeTokenRequest) error {
+	return c.postJSON(ctx, "/admin/tokens/revoke", req, nil)
+}
+
+// RevokeCert revokes every client certificate issued to a node.
+func (c *Client) RevokeCert(ctx context.Context, req RevokeCertRequest) (RevokeCertResponse, error) {
+	var resp RevokeCertResponse
+	if err := c.postJSON(ctx, "/admin/certs/revoke", req, &resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// RotateCA replaces the controller's CA.
+func (c *Client) RotateCA(ctx context.Context, req RotateCARequest) (RotateCAResponse, error) {
+	var resp RotateCAResponse
+	if err := c.postJSON(ctx, "/admin/ca/rotate", req, &resp); err != nil {
+		return resp, err
 	}
+	return resp, nil
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(payload))
+// CABundle fetches the PEM certificates of the CAs the controller trusts,
+// the current one first, and the key algorithm it wants node keys to use.
+// keyAlgorithm is empty for controllers that do not send KeyAlgorithmHeader.
+func (c *Client) CABundle(ctx context.Context) (bundle []byte, keyAlgorithm string, err error) {
+	res, err := c.do(ctx, c.http, http.MethodGet, "/ca", nil, nil)
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	bundle, err = io.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return bundle, res.Header.Get(KeyAlgorithmHeader), nil
+}
+
+// IPAM returns the controller's address pool, reservations and allocations.
+func (c *Client) IPAM(ctx context.Context) (IPAMResponse, error) {
+	var resp IPAMResponse
+	if err := c.getJSON(ctx, "/admin/ipam", &resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// ReserveIP pins a node name to a VPN IP.
+func (c *Client) ReserveIP(ctx context.Context, req ReserveIPRequest) (IPReservation, error) {
+	var resp IPReservation
+	if err := c.postJSON(ctx, "/admin/ipam/reserve", req, &resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// ReleaseIP drops a reservation or frees an offline node's VPN IP.
+func (c *Client) ReleaseIP(ctx context.Context, req ReleaseIPRequest) error {
+	return c.postJSON(ctx, "/admin/ipam/release", req, nil)
+}
+
+// RotateKey registers a new WireGuard public key for a node as pending.
+func (c *Client) RotateKey(ctx context.Context, req RotateKeyRequest) error {
+	return c.postJSON(ctx, "/rotate-key", req, nil)
+}
+
+// ConfirmKey makes a node's pending WireGuard key its active one and retires
+// the previous key.
+func (c *Client) ConfirmKey(ctx context.Context, req RotateKeyRequest) error {
+	return c.postJSON(ctx, "/rotate-key/confirm", req, nil)
+}
+
+// HAStatus returns the controller's replication role.
+func (c *Client) HAStatus(ctx context.Context) (HAStatusResponse, error) {
+	var resp HAStatusResponse
+	if err := c.getJSON(ctx, "/ha/status", &resp); err != nil {
+		return resp, err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	return resp, nil
+}
+
+// HASnapshot returns the active controller's state for a standby to copy.
+func (c *Client) HASnapshot(ctx context.Context) (HASnapshot, error) {
+	var resp HASnapshot
+	if err := c.getJSON(ctx, "/ha/snapshot", &resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
 
-	res, err := c.http.Do(req)
+// Events streams fleet change events from GET /events and calls fn for each
+// one until ctx is cancelled or the connection drops. It always returns a
+// non-nil error; callers are expected to reconnect.
+func (c *Client) Events(ctx context.Context, nodeID string, fn func(Event)) error {
+	// The stream is long-lived, so reuse the transport (and its TLS config)
+	// without the per-request timeout.
+	stream := &http.Client{Transport: c.http.Transport}
+	res, err := c.do(ctx, stream, http.MethodGet, "/events?node_id="+url.QueryEscape(nodeID), nil, func(req *http.Request) {
+		req.Header.Set("Accept", "text/event-stream")
+	})
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		body, _ := io.ReadAll(res.Body)
-		msg := strings.TrimSpace(string(body))
-		if msg != "" {
-			return fmt.Errorf("request failed: %s: %s", res.Status, msg)
+	// Minimal text/event-stream parser: only "data:" lines are used, and an
+	// empty line terminates an event. Comment lines (":") are heartbeats.
+	scanner := bufio.NewScanner(res.Body)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data.Len() > 0 {
+				var ev Event
+				if err := json.Unmarshal([]byte(data.String()), &ev); err == nil {
+					fn(ev)
+				}
+				data.Reset()
+			}
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
 		}
-		return fmt.Errorf("request failed: %s", res.Status)
 	}
-
-	if out == nil {
-		return nil
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
+	return io.EOF
+}
 
-	decoder := json.NewDecoder(res.Body)
-	return decoder.Decode(out)
+// CloseIdleConnections closes kept-alive connections, so the next requests
+// make new TLS handshakes, e.g. with a renewed client certificate.
+func (c *Client) CloseIdleConnections() {
+	c.http.CloseIdleConnections()
 }
 
-func (c *Client) getJSON(ctx context.Context, path string, out any) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+func (c *Client) postJSON(ctx context.Context, path string, body any, out any) error {
+	payload, err := json.Marshal(body)
 	if err != nil {
 		return err
 	}
 
-	res, err := c.http.Do(req)
+	res, err := c.do(ctx, c.http, http.MethodPost, path, payload, func(req *http.Request) {
+		req.Header.Set("Content-Type", "application/json")
+	})
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		body, _ := io.ReadAll(res.Body)
-		msg := strings.TrimSpace(string(body))
-		if msg != "" {
-			return fmt.Errorf("request failed: %s: %s", res.Status, msg)
-		}
-		return fmt.Errorf("request failed: %s", res.Status)
+	if out == nil {
+		return nil
+	}
+
+	decoder := json.NewDecoder(res.Body)
+	return decoder.Decode(out)
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, out any) error {
+	res, err := c.do(ctx, c.http, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return err
 	}
+	defer res.Body.Close()
 
 	decoder := json.NewDecoder(res.Body)
 	return decoder.Decode(out)
 }
+
+// do sends the request to the current controller, failing over to the next
+// ones in order when a controller cannot be reached or answers 503 (e.g. a
+// standby). Other non-2xx answers are returned as *StatusError without
+// failing over. On success the caller closes the response body.
+func (c *Client) do(ctx context.Context, hc *http.Client, method, path string, payload []byte, prepare func(*http.Request)) (*http.Response, error) {
+	start := int(c.current.Load())
+	var lastErr error
+	for i := range c.baseURLs {
+		idx := (start + i) % len(c.baseURLs)
+		var body io.Reader
+		if payload != nil {
+			body = bytes.NewReader(payload)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, c.baseURLs[idx]+path, body)
+		if err != nil {
+			return nil, err
+		}
+		if prepare != nil {
+			prepare(req)
+		}
+
+		res, err := hc.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			data, _ := io.ReadAll(res.Body)
+			_ = res.Body.Close()
+			statusErr := &StatusError{StatusCode: res.StatusCode, Status: res.Status, Message: strings.TrimSpace(string(data))}
+			var body struct {
+				Code string `json:"code"`
+			}
+			if json.Unmarshal(data, &body) == nil {
+				statusErr.Code = body.Code
+			}
+			if res.StatusCode == http.StatusServiceUnavailable && len(c.baseURLs) > 1 {
+				lastErr = statusErr
+				continue
+			}
+			c.current.Store(int32(idx))
+			return nil, statusErr
+		}
+		c.current.Store(int32(idx))
+		return res, nil
+	}
+	return nil, lastErr
+}
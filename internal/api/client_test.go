@@ -37,3 +37,66 @@ func TestClient_ErrorIncludesBody(t *testing.T) {
 		t.Fatalf("error missing body: %q", got)
 	}
 }
+
+func TestClient_EventsParsesStream(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("node_id") != "a" {
+			t.Errorf("node_id=%q", r.URL.Query().Get("node_id"))
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte(": heartbeat\n\n" +
+			"event: node_joined\ndata: {\"type\":\"node_joined\",\"node_id\":\"b\"}\n\n" +
+			"event: p2p_ready_changed\ndata: {\"type\":\"p2p_ready_changed\",\"node_id\":\"a\",\"peer_id\":\"b\",\"p2p_ready\":true}\n\n"))
+	}))
+	defer s.Close()
+
+	var got []Event
+	err := NewClient(s.URL).Events(context.Background(), "a", func(ev Event) {
+		got = append(got, ev)
+	})
+	if err == nil {
+		t.Fatal("expected error when stream ends")
+	}
+	if len(got) != 2 {
+		t.Fatalf("events=%+v", got)
+	}
+	if got[0].Type != EventNodeJoined || got[0].NodeID != "b" {
+		t.Fatalf("first=%+v", got[0])
+	}
+	if got[1].Type != EventP2PReadyChanged || !got[1].P2PReady || got[1].PeerID != "b" {
+		t.Fatalf("second=%+v", got[1])
+	}
+}
+
+func TestClient_FailsOverToNextController(t *testing.T) {
+	t.Parallel()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+	standbyHits := 0
+	standby := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		standbyHits++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer standby.Close()
+	activeHits := 0
+	active := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		activeHits++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"peers":[]}`))
+	}))
+	defer active.Close()
+
+	c := NewClient(down.URL + ", " + standby.URL + "," + active.URL)
+	for i := 0; i < 2; i++ {
+		if _, err := c.Candidates(context.Background(), "a"); err != nil {
+			t.Fatalf("Candidates: %v", err)
+		}
+	}
+	// The second request goes straight to the controller that answered.
+	if standbyHits != 1 || activeHits != 2 {
+		t.Fatalf("standby hits=%d active hits=%d", standbyHits, activeHits)
+	}
+}
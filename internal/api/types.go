@@ -3,7 +3,24 @@
 
 package api
 
-import "vpnctl/internal/model"
+import (
+	"time"
+
+	"vpnctl/internal/model"
+	"vpnctl/internal/pki"
+	"vpnctl/internal/store"
+)
+
+// Error codes sent in the "code" field of an error response, for errors a
+// client handles differently from others with the same status.
+const (
+	// ErrCodePubKeyMismatch: the node registered with a WireGuard key other
+	// than the one the controller holds for it.
+	ErrCodePubKeyMismatch = "pub_key_mismatch"
+	// ErrCodeVPNIPConflict: the claimed vpn_ip belongs to or is reserved for
+	// another node. Registering without it gets a new address.
+	ErrCodeVPNIPConflict = "vpn_ip_conflict"
+)
 
 // RegisterRequest is sent by a node when joining the controller.
 type RegisterRequest struct {
@@ -15,6 +32,18 @@ type RegisterRequest struct {
 	NATType    string `json:"nat_type"`
 	DirectMode string `json:"direct_mode"`
 	ProbePort  int    `json:"probe_port"`
+	// Hub is the relay hub the node is connected through, when the
+	// controller manages several.
+	Hub string `json:"hub,omitempty"`
+	// Tags are the node's own tags, matched by the controller's ACL policy.
+	Tags []string `json:"tags,omitempty"`
+	// Routes are LAN prefixes the node offers to route for the fleet. They
+	// are used once an admin approves them.
+	Routes []string `json:"routes,omitempty"`
+	// ExitNode offers the node as internet egress for others. UseExitNode
+	// names the exit node this node sends its internet traffic through.
+	ExitNode    bool   `json:"exit_node,omitempty"`
+	UseExitNode string `json:"use_exit_node,omitempty"`
 }
 
 // PeerCandidate describes a peer for direct/relay selection.
@@ -30,6 +59,13 @@ type PeerCandidate struct {
 	// P2PReady is set by the controller when recent mutual direct probe success exists.
 	// Nodes should only inject /32 WireGuard peers when this is true to avoid blackholing relay traffic.
 	P2PReady bool `json:"p2p_ready"`
+	// Routes are the peer's approved subnet routes, reachable through it.
+	Routes []string `json:"routes,omitempty"`
+	// ExitNode is set when the peer offers internet egress, and ExitClient
+	// when the peer uses the requesting node as its exit node. Either way
+	// the two nodes need a direct tunnel regardless of P2PReady.
+	ExitNode   bool `json:"exit_node,omitempty"`
+	ExitClient bool `json:"exit_client,omitempty"`
 }
 
 // RegisterResponse returns the assigned node ID and peers list.
@@ -73,6 +109,57 @@ type WGConfigResponse struct {
 	ServerAllowedIPs   []string `json:"server_allowed_ips"`
 	ServerKeepaliveSec int      `json:"server_keepalive_sec"`
 	ServerProbePort    int      `json:"server_probe_port,omitempty"`
+	// Hubs lists every relay hub when the controller manages more than
+	// one: the node's primary first (also described by the Server* fields),
+	// then its backup, then the rest.
+	Hubs []HubPeer `json:"hubs,omitempty"`
+}
+
+// HubPeer describes a relay hub a node can connect through.
+type HubPeer struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"`
+	Endpoint  string `json:"endpoint"`
+	// Address is the hub's overlay address, the target of health checks.
+	Address   string `json:"address"`
+	ProbePort int    `json:"probe_port"`
+}
+
+// HubRTTRequest submits a node's RTT measurements towards relay hubs.
+type HubRTTRequest struct {
+	NodeID  string   `json:"node_id"`
+	Results []HubRTT `json:"results"`
+}
+
+// HubRTT is one probe of a relay hub's public probe port.
+type HubRTT struct {
+	Hub     string  `json:"hub"`
+	Success bool    `json:"success"`
+	RTTMs   float64 `json:"rtt_ms"`
+}
+
+// RelayPeersResponse is returned by GET /relay/peers: the WireGuard peers a
+// relay hub should have.
+type RelayPeersResponse struct {
+	Peers []RelayPeer `json:"peers"`
+	// ACL is set when the controller has an ACL policy; ACLRules then lists
+	// the connections the relay may forward between its peers.
+	ACL      bool      `json:"acl,omitempty"`
+	ACLRules []ACLRule `json:"acl_rules,omitempty"`
+}
+
+// ACLRule allows connections from any Src address to any Dst address.
+type ACLRule struct {
+	Src []string `json:"src"`
+	Dst []string `json:"dst"`
+}
+
+// RelayPeer is a node or another hub on a relay's interface. A node peer
+// without AllowedIPs can handshake but receives no traffic.
+type RelayPeer struct {
+	PublicKey  string   `json:"public_key"`
+	Endpoint   string   `json:"endpoint,omitempty"`
+	AllowedIPs []string `json:"allowed_ips"`
 }
 
 // FleetNodeStatus describes the current status of a single fleet node.
@@ -96,6 +183,7 @@ type FleetHistoryBucket struct {
 	Time      string  `json:"time"`
 	OnlinePct float64 `json:"online_pct"`
 	AvgRTTMs  float64 `json:"avg_rtt_ms"`
+	LossPct   float64 `json:"loss_pct"`
 }
 
 // FleetNodeHistory holds time-bucketed history for a single fleet node.
@@ -109,6 +197,10 @@ type FleetHistoryResponse struct {
 	Nodes []FleetNodeHistory `json:"nodes"`
 }
 
+// KeyAlgorithmHeader carries controller.pki.key_algorithm on GET /ca, so
+// nodes generate enrollment and renewal keys of that type.
+const KeyAlgorithmHeader = "Vpnctl-Key-Algorithm"
+
 // BootstrapRequest is sent by a node during initial enrollment.
 type BootstrapRequest struct {
 	Token string `json:"token"`
@@ -122,4 +214,246 @@ type BootstrapResponse struct {
 	ClientCert string `json:"client_cert"` // PEM
 	NodeID     string `json:"node_id"`
 	VPNIP      string `json:"vpn_ip"`
+	// Ephemeral is set when the token enrolled an ephemeral node.
+	Ephemeral bool `json:"ephemeral,omitempty"`
+}
+
+// RenewRequest is sent to POST /renew by a node whose client certificate is
+// about to expire. The CSR's common name must be the node ID.
+type RenewRequest struct {
+	NodeID string `json:"node_id"`
+	CSR    string `json:"csr"` // PEM-encoded CSR
+}
+
+// RenewResponse returns the new client certificate.
+type RenewResponse struct {
+	ClientCert string `json:"client_cert"` // PEM
+}
+
+// LeaveRequest is sent to POST /leave by an agent shutting down cleanly.
+type LeaveRequest struct {
+	NodeID string `json:"node_id"`
+}
+
+// Event types pushed on GET /events.
+const (
+	EventNodeJoined      = "node_joined"
+	EventNodeLeft        = "node_left"
+	EventEndpointChanged = "endpoint_changed"
+	EventP2PReadyChanged = "p2p_ready_changed"
+	EventRoutesChanged   = "routes_changed"
+	EventNodeRenamed     = "node_renamed"
+	// EventNodeUpdated is sent when a node's tags change, which may change
+	// the peers the ACL policy allows.
+	EventNodeUpdated = "node_updated"
+)
+
+// Event describes a fleet change streamed by the controller.
+type Event struct {
+	Type   string `json:"type"`
+	NodeID string `json:"node_id"`
+	// PeerID and P2PReady are set for p2p_ready_changed events.
+	PeerID   string `json:"peer_id,omitempty"`
+	P2PReady bool   `json:"p2p_ready,omitempty"`
+	Time     string `json:"time"`
+}
+
+// RotateKeyRequest is sent to POST /rotate-key to register a pending
+// WireGuard key, and to POST /rotate-key/confirm once it has handshaken with
+// the hub.
+type RotateKeyRequest struct {
+	Name   string `json:"name"`
+	PubKey string `json:"pub_key"`
+}
+
+// RemoveNodeRequest is sent to POST /admin/nodes/remove.
+type RemoveNodeRequest struct {
+	Name string `json:"name"`
+}
+
+// RenameNodeRequest is sent to POST /admin/nodes/rename.
+type RenameNodeRequest struct {
+	Name    string `json:"name"`
+	NewName string `json:"new_name"`
+}
+
+// TagNodeRequest is sent to POST /admin/nodes/tags. Tags replace the node's
+// admin tags; an empty list clears them.
+type TagNodeRequest struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// RouteStatus is one subnet route in GET /admin/routes. Conflict explains
+// why an unapproved route cannot be approved.
+type RouteStatus struct {
+	Node       string `json:"node"`
+	Route      string `json:"route"`
+	Advertised bool   `json:"advertised"`
+	Approved   bool   `json:"approved"`
+	Conflict   string `json:"conflict,omitempty"`
+}
+
+// RoutesResponse is returned by GET /admin/routes.
+type RoutesResponse struct {
+	Routes []RouteStatus `json:"routes"`
+}
+
+// ApproveRouteRequest is sent to POST /admin/routes/approve. Approve=false
+// withdraws the approval.
+type ApproveRouteRequest struct {
+	Name    string `json:"name"`
+	Route   string `json:"route"`
+	Approve bool   `json:"approve"`
+}
+
+// DisableNodeRequest is sent to POST /admin/nodes/disable. Disabled=false re-enables the node.
+type DisableNodeRequest struct {
+	Name     string `json:"name"`
+	Disabled bool   `json:"disabled"`
+}
+
+// TokenListResponse is returned by GET /admin/tokens.
+type TokenListResponse struct {
+	Tokens []TokenInfo `json:"tokens"`
+}
+
+// Token states in TokenInfo.
+const (
+	TokenActive  = "active"
+	TokenExpired = "expired"
+	TokenUsedUp  = "used-up"
+)
+
+// TokenInfo describes a bootstrap token without its secret.
+type TokenInfo struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description,omitempty"`
+	State       string    `json:"state"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at,omitzero"`
+	MaxUses     int       `json:"max_uses,omitempty"`
+	Uses        int       `json:"uses"`
+	NamePattern string    `json:"name_pattern,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	VPNIP       string    `json:"vpn_ip,omitempty"`
+	Ephemeral   bool      `json:"ephemeral,omitempty"`
+}
+
+// TokenCreateRequest is sent to POST /admin/tokens; an empty request makes
+// a token without limits. Nodes enrolled with an ephemeral token are removed
+// once they leave or stay unseen. Enrolled nodes get Tags as admin tags and
+// VPNIP as their address; a token with a VPN IP enrolls a single node.
+type TokenCreateRequest struct {
+	Description string   `json:"description,omitempty"`
+	TTLSec      int64    `json:"ttl_sec,omitempty"`
+	MaxUses     int      `json:"max_uses,omitempty"`
+	NamePattern string   `json:"name_pattern,omitempty"` // path.Match syntax
+	Tags        []string `json:"tags,omitempty"`
+	VPNIP       string   `json:"vpn_ip,omitempty"`
+	Ephemeral   bool     `json:"ephemeral,omitempty"`
+}
+
+// TokenCreateResponse is returned by POST /admin/tokens. The secret is not
+// stored and cannot be shown again.
+type TokenCreateResponse struct {
+	Token string    `json:"token"`
+	Info  TokenInfo `json:"info"`
+}
+
+// RevokeTokenRequest is sent to POST /admin/tokens/revoke. Token is the
+// token itself or its ID.
+type RevokeTokenRequest struct {
+	Token string `json:"token"`
+}
+
+// RevokeCertRequest is sent to POST /admin/certs/revoke.
+type RevokeCertRequest struct {
+	Node string `json:"node"`
+}
+
+// RevokeCertResponse reports how many certificates were newly revoked.
+type RevokeCertResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+// RotateCARequest is sent to POST /admin/ca/rotate. The previous CA stays
+// trusted for GraceSec seconds.
+type RotateCARequest struct {
+	GraceSec int64 `json:"grace_sec"`
+}
+
+// RotateCAResponse reports when the previous CA will be retired.
+type RotateCAResponse struct {
+	RetireAt time.Time `json:"retire_at"`
+}
+
+// IPReservation pins a node name to a VPN IP. Source is "config" or "api".
+type IPReservation struct {
+	Name   string `json:"name"`
+	VPNIP  string `json:"vpn_ip"`
+	Source string `json:"source"`
+}
+
+// IPAllocation is a VPN IP currently held by a registered node.
+type IPAllocation struct {
+	Name     string `json:"name"`
+	VPNIP    string `json:"vpn_ip"`
+	Status   string `json:"status"`
+	LastSeen string `json:"last_seen"`
+}
+
+// IPAMResponse is returned by GET /admin/ipam.
+type IPAMResponse struct {
+	Prefixes     []string        `json:"prefixes"`
+	Reserved     []string        `json:"reserved"`
+	Reservations []IPReservation `json:"reservations"`
+	Allocations  []IPAllocation  `json:"allocations"`
+	ReclaimAfter string          `json:"reclaim_after,omitempty"`
+}
+
+// ReserveIPRequest is sent to POST /admin/ipam/reserve. An empty VPNIP
+// reserves the node's current address, or the next free one.
+type ReserveIPRequest struct {
+	Name  string `json:"name"`
+	VPNIP string `json:"vpn_ip"`
+}
+
+// ReleaseIPRequest is sent to POST /admin/ipam/release with either Name (a
+// reservation) or VPNIP (a reservation or an offline node's address).
+type ReleaseIPRequest struct {
+	Name  string `json:"name,omitempty"`
+	VPNIP string `json:"vpn_ip,omitempty"`
+}
+
+// Controller replication roles reported by GET /ha/status.
+const (
+	HARoleActive  = "active"
+	HARoleStandby = "standby"
+)
+
+// HAStatusResponse is returned by GET /ha/status.
+type HAStatusResponse struct {
+	Role string `json:"role"`
+	// Epoch counts takeovers. When both controllers are active, the one
+	// with the lower epoch steps down.
+	Epoch uint64 `json:"epoch"`
+}
+
+// HASnapshot is returned by GET /ha/snapshot: everything a standby needs to
+// take over from the active controller.
+type HASnapshot struct {
+	Nodes           []store.NodeInfo      `json:"nodes"`
+	Tokens          []store.Token         `json:"tokens"`
+	CertRevocations map[string]time.Time  `json:"cert_revocations"`
+	IPReservations  []store.IPReservation `json:"ip_reservations"`
+	DirectResults   []store.DirectResult  `json:"direct_results"`
+	CACert          string                `json:"ca_cert,omitempty"` // PEM
+	CAKey           string                `json:"ca_key,omitempty"`  // PEM
+	RevokedCerts    []pki.RevokedCert     `json:"revoked_certs,omitempty"`
+	// CAPrevious and CACross are set during a CA rotation.
+	CAPrevious string `json:"ca_previous,omitempty"` // PEM
+	CACross    string `json:"ca_cross,omitempty"`    // PEM
+	// Epoch is the active's HA epoch; see HAStatusResponse.
+	Epoch uint64 `json:"epoch"`
 }
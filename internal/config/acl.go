@@ -0,0 +1,59 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ACLWildcard in a rule's from or to matches every node, tagged or not.
+const ACLWildcard = "*"
+
+// ACLPolicy lists which tagged nodes may reach which. With a policy loaded,
+// anything not allowed by a rule is denied.
+type ACLPolicy struct {
+	ACLs []ACLRule `yaml:"acls"`
+}
+
+// ACLRule lets nodes with any of the From tags open connections to nodes
+// with any of the To tags.
+type ACLRule struct {
+	From []string `yaml:"from"`
+	To   []string `yaml:"to"`
+}
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// ValidTag reports whether tag is a lowercase name of letters, digits, '-'
+// and '_'.
+func ValidTag(tag string) bool {
+	return tagPattern.MatchString(tag)
+}
+
+// LoadACLPolicy reads and validates the policy file at path.
+func LoadACLPolicy(path string) (*ACLPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy ACLPolicy
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, rule := range policy.ACLs {
+		if len(rule.From) == 0 || len(rule.To) == 0 {
+			return nil, fmt.Errorf("%s: acl %d needs from and to", path, i+1)
+		}
+		for _, tag := range append(append([]string{}, rule.From...), rule.To...) {
+			if tag != ACLWildcard && !ValidTag(tag) {
+				return nil, fmt.Errorf("%s: acl %d: invalid tag %q", path, i+1, tag)
+			}
+		}
+	}
+	return &policy, nil
+}
@@ -5,10 +5,16 @@ package config
 
 import (
 	"fmt"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"vpnctl/internal/addrutil"
 )
 
 const (
@@ -32,12 +38,24 @@ const (
 	DefaultHealthCheckIntervalSec      = 3
 	DefaultHealthCheckFailures         = 3
 	DefaultHealthCheckTimeoutSec       = 2
+	DefaultNodeStaleAfterSec           = 90
+	DefaultNodeOfflineAfterSec         = 300
+	DefaultLivenessIntervalSec         = 15
+	DefaultEphemeralRemoveAfterSec     = 600
+	DefaultReconcileIntervalSec        = 30
+	DefaultHAHeartbeatIntervalSec      = 2
+	DefaultHAFailoverAfterSec          = 10
+	DefaultHubName                     = "main"
+	DefaultRelaySyncIntervalSec        = 15
+	DefaultDNSSuffix                   = "vpn"
+	DefaultDNSPort                     = 53
 )
 
-// Config holds both controller and node settings.
+// Config holds controller, node and relay hub settings.
 type Config struct {
 	Controller *ControllerConfig `yaml:"controller,omitempty"`
 	Node       *NodeConfig       `yaml:"node,omitempty"`
+	Relay      *RelayConfig      `yaml:"relay,omitempty"`
 }
 
 // ControllerConfig is used by the controller/server process.
@@ -62,9 +80,61 @@ type ControllerConfig struct {
 	// P2PReadyMode controls when controller marks a peer-pair safe for /32 direct injection.
 	// mutual: requires recent success in both directions (safe, conservative).
 	// either: requires recent success in either direction (symmetric injection, more permissive).
-	P2PReadyMode string `yaml:"p2p_ready_mode"`
-	ProbePort    int    `yaml:"probe_port"`
-	PKI          *PKIConfig `yaml:"pki,omitempty"`
+	P2PReadyMode string      `yaml:"p2p_ready_mode"`
+	ProbePort    int         `yaml:"probe_port"`
+	PKI          *PKIConfig  `yaml:"pki,omitempty"`
+	IPAM         *IPAMConfig `yaml:"ipam,omitempty"`
+	// Node liveness: a node that hasn't checked in for NodeStaleAfterSec is marked
+	// "stale", and after NodeOfflineAfterSec "offline" (no longer handed out as a
+	// P2P candidate). LivenessIntervalSec controls how often this is evaluated.
+	NodeStaleAfterSec   int `yaml:"node_stale_after_sec"`
+	NodeOfflineAfterSec int `yaml:"node_offline_after_sec"`
+	LivenessIntervalSec int `yaml:"liveness_interval_sec"`
+	// EphemeralRemoveAfterSec is how long a node enrolled with an ephemeral
+	// token may go unseen before it is removed from the registry.
+	EphemeralRemoveAfterSec int `yaml:"ephemeral_remove_after_sec"`
+	// ReconcileIntervalSec controls how often the hub's WireGuard peers are
+	// compared against the registry and repaired (only with wg_apply).
+	ReconcileIntervalSec int `yaml:"reconcile_interval_sec"`
+	// HA pairs this controller with a standby (or active) peer.
+	HA *HAConfig `yaml:"ha,omitempty"`
+	// HubName names the controller's own WireGuard interface among the
+	// relay hubs; Hubs lists additional relays run with `vpnctl relay serve`.
+	HubName string      `yaml:"hub_name"`
+	Hubs    []HubConfig `yaml:"hubs,omitempty"`
+	// ACLFile is a policy of which node tags may reach which (see
+	// ACLPolicy). Without it every node may reach every other.
+	ACLFile string `yaml:"acl_file"`
+}
+
+// HubConfig describes a relay hub managed by the controller.
+type HubConfig struct {
+	Name      string `yaml:"name"`
+	PublicKey string `yaml:"public_key"`
+	// Endpoint is the hub's public WireGuard address (host:port). Nodes also
+	// probe its host on ProbePort to measure RTT.
+	Endpoint string `yaml:"endpoint"`
+	// Address is the hub's own overlay address(es) inside vpn_cidr, e.g.
+	// "10.7.0.250". It is never allocated to nodes.
+	Address   string `yaml:"address"`
+	ProbePort int    `yaml:"probe_port"`
+}
+
+// RelayConfig is used by `vpnctl relay serve`, a WireGuard hub whose peers
+// are managed by the controller.
+type RelayConfig struct {
+	// Name must match an entry in the controller's hubs list.
+	Name       string `yaml:"name"`
+	Controller string `yaml:"controller"`
+	// PKIDir holds ca.crt, relay.crt and relay.key (see `controller relay-cert`).
+	PKIDir          string `yaml:"pki_dir"`
+	WGInterface     string `yaml:"wg_interface"`
+	WGPort          int    `yaml:"wg_port"`
+	WGAddress       string `yaml:"wg_address"`
+	WGPrivateKey    string `yaml:"wg_private_key"`
+	MTU             int    `yaml:"mtu"`
+	ProbePort       int    `yaml:"probe_port"`
+	SyncIntervalSec int    `yaml:"sync_interval_sec"`
 }
 
 // PKIConfig controls certificate generation for mTLS.
@@ -72,10 +142,61 @@ type PKIConfig struct {
 	CAExpiry     string   `yaml:"ca_expiry"`      // e.g. "87600h" (default 10 years)
 	ServerExpiry string   `yaml:"server_expiry"`   // e.g. "8760h" (default 1 year)
 	ClientExpiry string   `yaml:"client_expiry"`   // e.g. "8760h" (default 1 year)
-	KeyAlgorithm string   `yaml:"key_algorithm"`   // e.g. "ecdsa-p256" (default)
+	KeyAlgorithm string   `yaml:"key_algorithm"`   // "ecdsa-p256" (default), "ecdsa-p384", "ed25519" or "rsa-3072"
 	ServerSANs   []string `yaml:"server_sans"`     // SANs for the server cert (IPs and hostnames clients connect to)
 }
 
+// HAConfig pairs two controllers as active and standby. The standby copies
+// the active's state and takes over when the active stops answering.
+type HAConfig struct {
+	// Role is the role to start in, "active" or "standby". A controller
+	// configured as active still starts as standby while its peer is active.
+	Role string `yaml:"role"`
+	// Peer is the other controller's address (e.g. "10.0.0.2:8443").
+	Peer string `yaml:"peer"`
+	// PKIDir holds ca.crt, ha-peer.crt and ha-peer.key used to call the
+	// peer (see `controller ha-cert`). Required with controller.pki.
+	PKIDir string `yaml:"pki_dir"`
+	// HeartbeatIntervalSec is how often the standby pulls the active's state.
+	HeartbeatIntervalSec int `yaml:"heartbeat_interval_sec"`
+	// FailoverAfterSec is how long the active may go unanswered before the
+	// standby takes over.
+	FailoverAfterSec int `yaml:"failover_after_sec"`
+}
+
+// IPAMConfig controls VPN address allocation from vpn_cidr.
+type IPAMConfig struct {
+	// Reserved lists addresses never handed out automatically, as CIDRs or
+	// "first-last" ranges (e.g. "10.7.0.1-10.7.0.19" for infrastructure).
+	Reserved []string `yaml:"reserved"`
+	// Reservations pin a node name to an address before the node first joins.
+	Reservations []IPReservation `yaml:"reservations"`
+	// ReclaimAfter frees the address of a node offline for this long, e.g.
+	// "720h". Empty disables reclaiming.
+	ReclaimAfter string `yaml:"reclaim_after"`
+}
+
+// IPReservation pins Name to VPNIP.
+type IPReservation struct {
+	Name  string `yaml:"name"`
+	VPNIP string `yaml:"vpn_ip"`
+}
+
+// DNSConfig runs a resolver on the node's VPN address that answers
+// "<node-name>.<suffix>" for the fleet and forwards other names upstream.
+type DNSConfig struct {
+	// Suffix is the domain node names are answered under (default "vpn").
+	Suffix string `yaml:"suffix"`
+	// Port is the UDP/TCP port to listen on (default 53).
+	Port int `yaml:"port"`
+	// Upstreams are resolvers ("ip" or "ip:port") for other names. When
+	// empty, the nameservers in /etc/resolv.conf at startup are used.
+	Upstreams []string `yaml:"upstreams,omitempty"`
+	// SystemdResolved registers the resolver with systemd-resolved for the
+	// suffix only, so the rest of the host's lookups are unaffected.
+	SystemdResolved bool `yaml:"systemd_resolved,omitempty"`
+}
+
 // NodeConfig is used by the agent process running on a device.
 type NodeConfig struct {
 	Name                        string   `yaml:"name"`
@@ -119,6 +240,22 @@ type NodeConfig struct {
 	HealthCheckTimeoutSec  int    `yaml:"health_check_timeout_sec"`
 	ServerProbePort        int    `yaml:"server_probe_port"`
 	PKIDir                 string `yaml:"pki_dir"` // directory for ca.crt, client.key, client.crt
+	// CertRenewBeforeSec is how long before the client certificate expires
+	// the agent renews it. 0 renews in the last third of its lifetime.
+	CertRenewBeforeSec int `yaml:"cert_renew_before_sec,omitempty"`
+	// Tags are reported to the controller and matched by its ACL policy.
+	Tags []string `yaml:"tags,omitempty"`
+	// AdvertiseRoutes are LAN prefixes behind this node offered to the
+	// fleet, e.g. "192.168.1.0/24". An admin approves them on the controller.
+	AdvertiseRoutes []string `yaml:"advertise_routes,omitempty"`
+	// AdvertiseExitNode offers this node as internet egress; the agent
+	// masquerades traffic from the overlay leaving through other interfaces.
+	AdvertiseExitNode bool `yaml:"advertise_exit_node,omitempty"`
+	// ExitNode is the name of a node offering egress to send this node's
+	// internet traffic through. It requires policy routing.
+	ExitNode string `yaml:"exit_node,omitempty"`
+	// DNS enables name resolution for node names when set.
+	DNS *DNSConfig `yaml:"dns,omitempty"`
 }
 
 // Load reads and parses a YAML config file.
@@ -154,12 +291,67 @@ func Save(path string, cfg Config) error {
 
 // Validate performs minimal validation for required fields.
 func Validate(cfg Config) error {
-	if cfg.Controller == nil && cfg.Node == nil {
-		return fmt.Errorf("config must contain controller or node section")
+	if cfg.Controller == nil && cfg.Node == nil && cfg.Relay == nil {
+		return fmt.Errorf("config must contain controller, node or relay section")
 	}
 	if cfg.Controller != nil && cfg.Controller.Listen == "" {
 		return fmt.Errorf("controller.listen is required")
 	}
+	if cfg.Controller != nil && cfg.Controller.NodeOfflineAfterSec < cfg.Controller.NodeStaleAfterSec {
+		return fmt.Errorf("controller.node_offline_after_sec must be >= node_stale_after_sec")
+	}
+	if cfg.Controller != nil && cfg.Controller.EphemeralRemoveAfterSec < 0 {
+		return fmt.Errorf("controller.ephemeral_remove_after_sec must be >= 0")
+	}
+	if cfg.Controller != nil && cfg.Controller.PKI != nil {
+		switch cfg.Controller.PKI.KeyAlgorithm {
+		case "", "ecdsa-p256", "ecdsa-p384", "ed25519", "rsa-3072":
+		default:
+			return fmt.Errorf("controller.pki.key_algorithm must be ecdsa-p256, ecdsa-p384, ed25519 or rsa-3072")
+		}
+	}
+	if cfg.Controller != nil && cfg.Controller.IPAM != nil {
+		if v := cfg.Controller.IPAM.ReclaimAfter; v != "" {
+			if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+				return fmt.Errorf("controller.ipam.reclaim_after must be a positive duration")
+			}
+		}
+		for _, r := range cfg.Controller.IPAM.Reservations {
+			if r.Name == "" || r.VPNIP == "" {
+				return fmt.Errorf("controller.ipam.reservations entries need name and vpn_ip")
+			}
+		}
+	}
+	if cfg.Controller != nil && cfg.Controller.HA != nil {
+		ha := cfg.Controller.HA
+		if ha.Role != "active" && ha.Role != "standby" {
+			return fmt.Errorf("controller.ha.role must be active or standby")
+		}
+		if ha.Peer == "" {
+			return fmt.Errorf("controller.ha.peer is required")
+		}
+		if cfg.Controller.PKI != nil && ha.PKIDir == "" {
+			return fmt.Errorf("controller.ha.pki_dir is required when pki is enabled")
+		}
+		if ha.FailoverAfterSec <= ha.HeartbeatIntervalSec {
+			return fmt.Errorf("controller.ha.failover_after_sec must be > heartbeat_interval_sec")
+		}
+	}
+	if cfg.Controller != nil {
+		if len(cfg.Controller.Hubs) > 0 && (cfg.Controller.ServerPublicKey == "" || cfg.Controller.ServerEndpoint == "") {
+			return fmt.Errorf("controller.server_public_key and server_endpoint are required with hubs")
+		}
+		names := map[string]bool{cfg.Controller.HubName: true}
+		for _, h := range cfg.Controller.Hubs {
+			if h.Name == "" || h.PublicKey == "" || h.Endpoint == "" || h.Address == "" {
+				return fmt.Errorf("controller.hubs entries need name, public_key, endpoint and address")
+			}
+			if names[h.Name] {
+				return fmt.Errorf("controller.hubs: duplicate hub name %q", h.Name)
+			}
+			names[h.Name] = true
+		}
+	}
 	if cfg.Controller != nil && cfg.Controller.WGApply {
 		if cfg.Controller.WGPrivateKey == "" {
 			return fmt.Errorf("controller.wg_private_key is required when wg_apply is true")
@@ -168,6 +360,14 @@ func Validate(cfg Config) error {
 			return fmt.Errorf("controller.wg_address is required when wg_apply is true")
 		}
 	}
+	if cfg.Relay != nil {
+		if cfg.Relay.Name == "" || cfg.Relay.Controller == "" {
+			return fmt.Errorf("relay.name and relay.controller are required")
+		}
+		if cfg.Relay.WGPrivateKey == "" || cfg.Relay.WGAddress == "" {
+			return fmt.Errorf("relay.wg_private_key and relay.wg_address are required")
+		}
+	}
 	if cfg.Node != nil && cfg.Node.Name == "" {
 		return fmt.Errorf("node.name is required")
 	}
@@ -184,6 +384,43 @@ func Validate(cfg Config) error {
 		if cfg.Node.HealthCheckTimeoutSec < 0 {
 			return fmt.Errorf("node.health_check_timeout_sec must be >= 0")
 		}
+		if cfg.Node.CertRenewBeforeSec < 0 {
+			return fmt.Errorf("node.cert_renew_before_sec must be >= 0")
+		}
+		for _, tag := range cfg.Node.Tags {
+			if !ValidTag(tag) {
+				return fmt.Errorf("node.tags: invalid tag %q", tag)
+			}
+		}
+		for _, route := range cfg.Node.AdvertiseRoutes {
+			if _, err := netip.ParsePrefix(route); err != nil {
+				return fmt.Errorf("node.advertise_routes: invalid route %q", route)
+			}
+		}
+		if cfg.Node.ExitNode != "" {
+			if !PolicyRoutingEnabled(cfg.Node) {
+				return fmt.Errorf("node.exit_node requires policy routing")
+			}
+			if cfg.Node.ExitNode == cfg.Node.Name || cfg.Node.AdvertiseExitNode {
+				return fmt.Errorf("node.exit_node cannot be set on an exit node")
+			}
+		}
+		if dns := cfg.Node.DNS; dns != nil {
+			if !ValidDNSSuffix(dns.Suffix) {
+				return fmt.Errorf("node.dns.suffix: invalid suffix %q", dns.Suffix)
+			}
+			if dns.Port < 0 || dns.Port > 65535 {
+				return fmt.Errorf("node.dns.port must be a valid port")
+			}
+			for _, u := range dns.Upstreams {
+				if _, err := netip.ParseAddr(u); err == nil {
+					continue
+				}
+				if _, err := netip.ParseAddrPort(u); err != nil {
+					return fmt.Errorf("node.dns.upstreams: invalid resolver %q", u)
+				}
+			}
+		}
 	}
 	return nil
 }
@@ -244,6 +481,37 @@ func ApplyDefaults(cfg *Config) {
 		if cfg.Controller.ProbePort == 0 {
 			cfg.Controller.ProbePort = DefaultProbePort
 		}
+		if cfg.Controller.NodeStaleAfterSec == 0 {
+			cfg.Controller.NodeStaleAfterSec = DefaultNodeStaleAfterSec
+		}
+		if cfg.Controller.NodeOfflineAfterSec == 0 {
+			cfg.Controller.NodeOfflineAfterSec = DefaultNodeOfflineAfterSec
+		}
+		if cfg.Controller.LivenessIntervalSec == 0 {
+			cfg.Controller.LivenessIntervalSec = DefaultLivenessIntervalSec
+		}
+		if cfg.Controller.EphemeralRemoveAfterSec == 0 {
+			cfg.Controller.EphemeralRemoveAfterSec = DefaultEphemeralRemoveAfterSec
+		}
+		if cfg.Controller.ReconcileIntervalSec == 0 {
+			cfg.Controller.ReconcileIntervalSec = DefaultReconcileIntervalSec
+		}
+		if cfg.Controller.HubName == "" {
+			cfg.Controller.HubName = DefaultHubName
+		}
+		for i := range cfg.Controller.Hubs {
+			if cfg.Controller.Hubs[i].ProbePort == 0 {
+				cfg.Controller.Hubs[i].ProbePort = DefaultProbePort
+			}
+		}
+		if ha := cfg.Controller.HA; ha != nil {
+			if ha.HeartbeatIntervalSec == 0 {
+				ha.HeartbeatIntervalSec = DefaultHAHeartbeatIntervalSec
+			}
+			if ha.FailoverAfterSec == 0 {
+				ha.FailoverAfterSec = DefaultHAFailoverAfterSec
+			}
+		}
 		if cfg.Controller.PKI != nil {
 			if cfg.Controller.PKI.CAExpiry == "" {
 				cfg.Controller.PKI.CAExpiry = "87600h"
@@ -260,6 +528,24 @@ func ApplyDefaults(cfg *Config) {
 		}
 	}
 
+	if cfg.Relay != nil {
+		if cfg.Relay.WGInterface == "" {
+			cfg.Relay.WGInterface = DefaultWGInterface
+		}
+		if cfg.Relay.WGPort == 0 {
+			cfg.Relay.WGPort = DefaultWGPort
+		}
+		if cfg.Relay.MTU == 0 {
+			cfg.Relay.MTU = DefaultMTU
+		}
+		if cfg.Relay.ProbePort == 0 {
+			cfg.Relay.ProbePort = DefaultProbePort
+		}
+		if cfg.Relay.SyncIntervalSec == 0 {
+			cfg.Relay.SyncIntervalSec = DefaultRelaySyncIntervalSec
+		}
+	}
+
 	if cfg.Node != nil {
 		if cfg.Node.WGInterface == "" {
 			cfg.Node.WGInterface = DefaultWGInterface
@@ -275,7 +561,7 @@ func ApplyDefaults(cfg *Config) {
 			cfg.Node.PolicyRoutingEnabled = &enabled
 		}
 		if cfg.Node.PolicyRoutingCIDR == "" {
-			cfg.Node.PolicyRoutingCIDR = firstScopedCIDR(cfg.Node.ServerAllowedIPs)
+			cfg.Node.PolicyRoutingCIDR = PolicyCIDRs(cfg.Node.ServerAllowedIPs)
 		}
 		if cfg.Node.PolicyRoutingTable == 0 {
 			cfg.Node.PolicyRoutingTable = DefaultPolicyRoutingTable
@@ -322,6 +608,14 @@ func ApplyDefaults(cfg *Config) {
 		if cfg.Node.HealthCheckTimeoutSec == 0 {
 			cfg.Node.HealthCheckTimeoutSec = DefaultHealthCheckTimeoutSec
 		}
+		if dns := cfg.Node.DNS; dns != nil {
+			if dns.Suffix == "" {
+				dns.Suffix = DefaultDNSSuffix
+			}
+			if dns.Port == 0 {
+				dns.Port = DefaultDNSPort
+			}
+		}
 	}
 }
 
@@ -336,7 +630,27 @@ func PolicyRoutingEnabled(cfg *NodeConfig) bool {
 	return *cfg.PolicyRoutingEnabled
 }
 
-func firstScopedCIDR(values []string) string {
+var dnsLabelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// ValidDNSSuffix reports whether suffix is a domain of lowercase labels,
+// e.g. "vpn" or "corp.internal".
+func ValidDNSSuffix(suffix string) bool {
+	if suffix == "" || len(suffix) > 200 {
+		return false
+	}
+	for _, label := range strings.Split(suffix, ".") {
+		if !dnsLabelPattern.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// PolicyCIDRs derives the default policy_routing_cidr from the hub's
+// AllowedIPs: the first scoped (non-default-route) CIDR of each address
+// family, comma-separated, so a dual-stack overlay gets a rule per family.
+func PolicyCIDRs(values []string) string {
+	var v4, v6 string
 	for _, value := range values {
 		if value == "" {
 			continue
@@ -344,7 +658,19 @@ func firstScopedCIDR(values []string) string {
 		if value == "0.0.0.0/0" || value == "::/0" {
 			continue
 		}
-		return value
+		if addrutil.IsIPv6CIDR(value) {
+			if v6 == "" {
+				v6 = value
+			}
+		} else if v4 == "" {
+			v4 = value
+		}
+	}
+	switch {
+	case v4 == "":
+		return v6
+	case v6 == "":
+		return v4
 	}
-	return ""
+	return v4 + "," + v6
 }
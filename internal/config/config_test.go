@@ -86,6 +86,7 @@ func TestValidate_HealthCheckNegativeValues(t *testing.T) {
 		{"negative interval", func(c *Config) { c.Node.HealthCheckIntervalSec = -1 }},
 		{"negative failures", func(c *Config) { c.Node.HealthCheckFailures = -1 }},
 		{"negative timeout", func(c *Config) { c.Node.HealthCheckTimeoutSec = -1 }},
+		{"negative cert renew window", func(c *Config) { c.Node.CertRenewBeforeSec = -1 }},
 	}
 
 	for _, tc := range tests {
@@ -116,3 +117,85 @@ func TestSave_Writes0600(t *testing.T) {
 		t.Fatalf("mode=%o", info.Mode().Perm())
 	}
 }
+
+func TestPolicyCIDRs_OnePerFamily(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		in   []string
+		want string
+	}{
+		{[]string{"0.0.0.0/0", "10.7.0.0/24", "10.8.0.0/24"}, "10.7.0.0/24"},
+		{[]string{"::/0", "fd7a::/64"}, "fd7a::/64"},
+		{[]string{"fd7a::/64", "10.7.0.0/24"}, "10.7.0.0/24,fd7a::/64"},
+		{nil, ""},
+	}
+	for _, tc := range cases {
+		if got := PolicyCIDRs(tc.in); got != tc.want {
+			t.Errorf("PolicyCIDRs(%v)=%q want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestLoadACLPolicy_RejectsInvalidRules(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	write := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		return path
+	}
+
+	policy, err := LoadACLPolicy(write("ok.yaml", "acls:\n  - from: [laptop]\n    to: [server, \"*\"]\n"))
+	if err != nil {
+		t.Fatalf("LoadACLPolicy: %v", err)
+	}
+	if len(policy.ACLs) != 1 || len(policy.ACLs[0].To) != 2 {
+		t.Fatalf("unexpected policy: %+v", policy)
+	}
+	if _, err := LoadACLPolicy(write("tag.yaml", "acls:\n  - from: [Laptop]\n    to: [server]\n")); err == nil {
+		t.Fatal("expected error for uppercase tag")
+	}
+	if _, err := LoadACLPolicy(write("empty.yaml", "acls:\n  - from: [laptop]\n")); err == nil {
+		t.Fatal("expected error for rule without to")
+	}
+}
+
+func TestValidate_DNS(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{Node: &NodeConfig{Name: "n1", Controller: "127.0.0.1:8080", DNS: &DNSConfig{}}}
+	ApplyDefaults(&cfg)
+	if cfg.Node.DNS.Suffix != DefaultDNSSuffix || cfg.Node.DNS.Port != DefaultDNSPort {
+		t.Fatalf("dns defaults=%+v", cfg.Node.DNS)
+	}
+	if err := Validate(cfg); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	for _, dns := range []DNSConfig{
+		{Suffix: "Corp..internal", Port: 53},
+		{Suffix: "-vpn", Port: 53},
+		{Suffix: "vpn", Port: 70000},
+		{Suffix: "vpn", Port: 53, Upstreams: []string{"dns.example.com"}},
+	} {
+		cfg.Node.DNS = &dns
+		if err := Validate(cfg); err == nil {
+			t.Fatalf("expected validation error for %+v", dns)
+		}
+	}
+}
+
+func TestValidate_PKIKeyAlgorithm(t *testing.T) {
+	t.Parallel()
+
+	for alg, ok := range map[string]bool{"": true, "ecdsa-p256": true, "ecdsa-p384": true, "ed25519": true, "rsa-3072": true, "rsa-2048": false, "ECDSA-P256": false} {
+		cfg := Config{Controller: &ControllerConfig{Listen: ":8443", PKI: &PKIConfig{KeyAlgorithm: alg}}}
+		if err := Validate(cfg); (err == nil) != ok {
+			t.Errorf("key_algorithm %q: err=%v", alg, err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"vpnctl/internal/api"
+	"vpnctl/internal/config"
+	"vpnctl/internal/store"
+	"vpnctl/internal/wireguard"
+)
+
+// nodeTags returns the tags n reports and the ones an admin set on it.
+func nodeTags(n store.NodeInfo) []string {
+	tags := append(slices.Clone(n.Tags), n.AdminTags...)
+	slices.Sort(tags)
+	return slices.Compact(tags)
+}
+
+// tagsMatch reports whether tags has any of patterns, or patterns has the
+// wildcard.
+func tagsMatch(tags, patterns []string) bool {
+	for _, p := range patterns {
+		if p == config.ACLWildcard || slices.Contains(tags, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedLocked reports whether the ACL policy lets from open connections to
+// to. Without a policy everything is allowed. Callers hold s.mu.
+func (s *Server) allowedLocked(from, to store.NodeInfo) bool {
+	if s.acl == nil {
+		return true
+	}
+	fromTags, toTags := nodeTags(from), nodeTags(to)
+	for _, rule := range s.acl.ACLs {
+		if tagsMatch(fromTags, rule.From) && tagsMatch(toTags, rule.To) {
+			return true
+		}
+	}
+	return false
+}
+
+// firewallRulesLocked turns the ACL policy into address rules for the hubs.
+// A node's subnet routes count as its addresses. Callers hold s.mu.
+func (s *Server) firewallRulesLocked() []wireguard.FirewallRule {
+	if s.acl == nil {
+		return nil
+	}
+	var rules []wireguard.FirewallRule
+	for _, rule := range s.acl.ACLs {
+		var src, dst []netip.Prefix
+		for _, n := range s.reg.Nodes {
+			if n.Disabled || n.VPNIP == "" {
+				continue
+			}
+			tags := nodeTags(n)
+			if tagsMatch(tags, rule.From) {
+				src = append(src, nodePrefixes(n)...)
+			}
+			if tagsMatch(tags, rule.To) {
+				dst = append(dst, nodePrefixes(n)...)
+			}
+		}
+		if len(src) > 0 && len(dst) > 0 {
+			rules = append(rules, wireguard.FirewallRule{Src: src, Dst: dst})
+		}
+	}
+	return rules
+}
+
+// syncFirewall enforces the ACL policy on traffic the hub relays between
+// nodes. It is a no-op without a policy or wg_apply.
+func (s *Server) syncFirewall() error {
+	if s.acl == nil || !s.cfg.WGApply || s.wg == nil {
+		return nil
+	}
+	s.mu.Lock()
+	rules := s.firewallRulesLocked()
+	s.mu.Unlock()
+	return s.wg.ApplyFirewall(s.cfg.WGInterface, rules)
+}
+
+// handleTagNode handles POST /admin/nodes/tags, replacing the node's admin
+// tags. The tags the node reports itself are kept.
+func (s *Server) handleTagNode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req api.TagNodeRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Name == "" {
+		writeJSONError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	for _, tag := range req.Tags {
+		if !config.ValidTag(tag) {
+			writeJSONError(w, http.StatusBadRequest, "invalid tag "+tag)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	i := s.findNodeLocked(req.Name)
+	if i < 0 {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	prev := s.reg.Nodes[i]
+	node := prev
+	node.AdminTags = slices.Clone(req.Tags)
+	if len(node.AdminTags) == 0 {
+		node.AdminTags = nil
+	}
+	if err := s.saveNodeLocked(node); err != nil {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.reg.Nodes[i] = node
+	s.publishNodeChange(prev, true, node)
+	s.mu.Unlock()
+
+	slog.Info("node admin tags changed", "node", node.Name, "tags", node.AdminTags)
+
+	if err := s.syncFirewall(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,441 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"vpnctl/internal/addrutil"
+	"vpnctl/internal/api"
+	"vpnctl/internal/config"
+	"vpnctl/internal/pki"
+	"vpnctl/internal/store"
+)
+
+// handleRemoveNode handles POST /admin/nodes/remove. The node is deleted from
+// the registry, its probe state is dropped, the hub's WireGuard peers and
+// firewall are re-applied and every client certificate issued to it so far is
+// rejected.
+func (s *Server) handleRemoveNode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req api.RemoveNodeRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Name == "" {
+		writeJSONError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	s.mu.Lock()
+	i := s.findNodeLocked(req.Name)
+	if i < 0 {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	node := s.reg.Nodes[i]
+	if err := s.removeNodeLocked(i, time.Now().UTC()); err != nil {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	autoApply := s.cfg.WGApply
+	peers := s.peersForWGLocked()
+	s.mu.Unlock()
+
+	slog.Info("node removed", "node", node.Name, "id", node.ID)
+
+	if autoApply {
+		if err := s.applyWG(peers); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if err := s.syncFirewall(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.updateMetrics()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeNodeLocked deletes the node at index i of the registry along with
+// its probe state, and rejects every client certificate issued to it before
+// now. The certificates recorded as issued also go on the revocation list,
+// so they show up in the CRL. The caller re-applies the hub's peers.
+// Callers hold s.mu.
+func (s *Server) removeNodeLocked(i int, now time.Time) error {
+	node := s.reg.Nodes[i]
+
+	// Bootstrap issues certificates with the node name as CN; a renamed node
+	// keeps its original name as ID, so cover both.
+	cns := []string{node.ID}
+	if node.Name != node.ID {
+		cns = append(cns, node.Name)
+	}
+	var certs []*x509.Certificate
+	if s.revoked != nil {
+		for _, cn := range cns {
+			issued, err := pki.IssuedCerts(s.issuedDir(), cn)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, issued...)
+		}
+	}
+	err := s.db.Update(func(tx store.Tx) error {
+		if err := tx.DeleteNode(node.ID); err != nil {
+			return err
+		}
+		for _, cn := range cns {
+			if err := tx.PutCertRevocation(cn, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.reg.Nodes = append(s.reg.Nodes[:i], s.reg.Nodes[i+1:]...)
+	delete(s.directOK, node.ID)
+	for _, peers := range s.directOK {
+		delete(peers, node.ID)
+	}
+	delete(s.links, node.ID)
+	for _, peers := range s.links {
+		delete(peers, node.ID)
+	}
+	if s.certRevocations == nil {
+		s.certRevocations = make(map[string]time.Time)
+	}
+	for _, cn := range cns {
+		s.certRevocations[cn] = now
+	}
+	s.p2pTransitionsLocked()
+	s.events.publish(api.Event{Type: api.EventNodeLeft, NodeID: node.ID})
+
+	// The revocation list goes last so a failed transaction never leaves a
+	// registered node with revoked certificates. If writing it fails, the
+	// node is already gone and the certRevocations cutoff still rejects the
+	// certificates; they are only missing from the CRL.
+	if s.revoked != nil {
+		if _, err := s.revoked.Revoke(certs, now); err != nil {
+			slog.Warn("failed to revoke node certificates", "node", node.Name, "err", err)
+		}
+	}
+	return nil
+}
+
+// handleRenameNode handles POST /admin/nodes/rename. Only the display name
+// changes; the node ID (and with it the certificate identity, probe history
+// and metrics) is kept.
+func (s *Server) handleRenameNode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req api.RenameNodeRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Name == "" || req.NewName == "" {
+		writeJSONError(w, http.StatusBadRequest, "name and new_name are required")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.findNodeLocked(req.Name)
+	if i < 0 {
+		writeJSONError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	if j := s.findNodeLocked(req.NewName); j >= 0 && j != i {
+		writeJSONError(w, http.StatusConflict, "name already in use")
+		return
+	}
+
+	node := s.reg.Nodes[i]
+	// Clients find their exit node by name or ID; a rename would silently
+	// move the ones that use the name elsewhere.
+	if node.Name != node.ID {
+		for _, n := range s.reg.Nodes {
+			if n.UseExitNode == node.Name {
+				writeJSONError(w, http.StatusConflict, "node is the exit node of "+n.Name+"; set its exit_node to "+node.ID+" first")
+				return
+			}
+		}
+	}
+	node.Name = req.NewName
+	if err := s.saveNodeLocked(node); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.reg.Nodes[i] = node
+	s.events.publish(api.Event{Type: api.EventNodeRenamed, NodeID: node.ID})
+
+	slog.Info("node renamed", "id", node.ID, "from", req.Name, "to", req.NewName)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDisableNode handles POST /admin/nodes/disable. A disabled node keeps
+// its registration and VPN IP but is taken off the hub and out of peer
+// candidates, and its agent requests are refused until it is re-enabled.
+func (s *Server) handleDisableNode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req api.DisableNodeRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Name == "" {
+		writeJSONError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	s.mu.Lock()
+	i := s.findNodeLocked(req.Name)
+	if i < 0 {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	node := s.reg.Nodes[i]
+	if node.Disabled == req.Disabled {
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	node.Disabled = req.Disabled
+	if err := s.saveNodeLocked(node); err != nil {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.reg.Nodes[i] = node
+	if node.Disabled {
+		s.events.publish(api.Event{Type: api.EventNodeLeft, NodeID: node.ID})
+	} else {
+		s.events.publish(api.Event{Type: api.EventNodeJoined, NodeID: node.ID})
+	}
+
+	autoApply := s.cfg.WGApply
+	peers := s.peersForWGLocked()
+	s.mu.Unlock()
+
+	slog.Info("node disabled state changed", "node", node.Name, "disabled", node.Disabled)
+
+	if autoApply {
+		if err := s.applyWG(peers); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if err := s.syncFirewall(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTokens handles GET (list) and POST (create) on /admin/tokens.
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request) {
+	if s.tokenStore == nil {
+		writeJSONError(w, http.StatusNotFound, "pki not enabled")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		now := time.Now()
+		tokens := []api.TokenInfo{}
+		for _, t := range s.tokenStore.List() {
+			tokens = append(tokens, tokenInfo(t, now))
+		}
+		writeJSON(w, http.StatusOK, api.TokenListResponse{Tokens: tokens})
+	case http.MethodPost:
+		// An empty body asks for a regular token, as before.
+		var req api.TokenCreateRequest
+		if err := decodeJSON(r, &req); err != nil && !errors.Is(err, io.EOF) {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		opts, err := s.tokenOptions(req)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		// Hold s.mu until the token is stored, so two requests cannot pin
+		// the same address.
+		s.mu.Lock()
+		if opts.VPNIP != "" {
+			if reason := s.vpnIPTakenLocked(opts.VPNIP); reason != "" {
+				s.mu.Unlock()
+				writeJSONError(w, http.StatusConflict, reason)
+				return
+			}
+		}
+		secret, tok, err := s.tokenStore.Issue(opts)
+		s.mu.Unlock()
+		if errors.Is(err, path.ErrBadPattern) {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		slog.Info("bootstrap token created", "id", pki.TokenID(tok.Hash), "description", tok.Description)
+		writeJSON(w, http.StatusOK, api.TokenCreateResponse{Token: secret, Info: tokenInfo(tok, time.Now())})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// tokenOptions checks a token request. A token with a VPN IP can only
+// enroll one node.
+func (s *Server) tokenOptions(req api.TokenCreateRequest) (pki.TokenOptions, error) {
+	opts := pki.TokenOptions{
+		Description: req.Description,
+		TTL:         time.Duration(req.TTLSec) * time.Second,
+		MaxUses:     req.MaxUses,
+		NamePattern: req.NamePattern,
+		Tags:        req.Tags,
+		Ephemeral:   req.Ephemeral,
+	}
+	if req.TTLSec < 0 {
+		return opts, errors.New("ttl_sec must be >= 0")
+	}
+	if req.MaxUses < 0 {
+		return opts, errors.New("max_uses must be >= 0")
+	}
+	for _, tag := range req.Tags {
+		if !config.ValidTag(tag) {
+			return opts, errors.New("invalid tag " + tag)
+		}
+	}
+	if req.VPNIP != "" {
+		opts.VPNIP = strings.Join(addrutil.HostPrefixes(req.VPNIP), ",")
+		if opts.VPNIP == "" {
+			return opts, errors.New("invalid vpn_ip")
+		}
+		inside, err := inVPNCIDR(s.cfg.VPNCIDR, opts.VPNIP)
+		if err != nil {
+			return opts, err
+		}
+		if !inside {
+			return opts, errors.New("vpn_ip is outside vpn_cidr")
+		}
+		if opts.MaxUses > 1 {
+			return opts, errors.New("a token with vpn_ip enrolls a single node; max_uses must be 1")
+		}
+		opts.MaxUses = 1
+	}
+	return opts, nil
+}
+
+// tokenInfo describes t for the admin API.
+func tokenInfo(t store.Token, now time.Time) api.TokenInfo {
+	state := api.TokenActive
+	switch {
+	case t.Expired(now):
+		state = api.TokenExpired
+	case t.UsedUp():
+		state = api.TokenUsedUp
+	}
+	return api.TokenInfo{
+		ID:          pki.TokenID(t.Hash),
+		Description: t.Description,
+		State:       state,
+		CreatedAt:   t.CreatedAt,
+		ExpiresAt:   t.ExpiresAt,
+		MaxUses:     t.MaxUses,
+		Uses:        t.Uses,
+		NamePattern: t.NamePattern,
+		Tags:        t.Tags,
+		VPNIP:       t.VPNIP,
+		Ephemeral:   t.Ephemeral,
+	}
+}
+
+// handleRevokeToken handles POST /admin/tokens/revoke.
+func (s *Server) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.tokenStore == nil {
+		writeJSONError(w, http.StatusNotFound, "pki not enabled")
+		return
+	}
+
+	var req api.RevokeTokenRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Token == "" {
+		writeJSONError(w, http.StatusBadRequest, "token is required")
+		return
+	}
+	err := s.tokenStore.Revoke(req.Token)
+	if errors.Is(err, pki.ErrTokenNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// findNodeLocked returns the index of the node with the given name, or with
+// that ID when no node has the name, or -1. Callers hold s.mu.
+func (s *Server) findNodeLocked(name string) int {
+	for i := range s.reg.Nodes {
+		if s.reg.Nodes[i].Name == name {
+			return i
+		}
+	}
+	for i := range s.reg.Nodes {
+		if s.reg.Nodes[i].ID == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// certRevoked reports whether cert was issued before its CN was revoked.
+// Certificate times have one-second resolution, so the cutoff is compared
+// at that resolution as well; a node re-enrolled right after removal is
+// accepted.
+func (s *Server) certRevoked(cert *x509.Certificate) bool {
+	s.mu.Lock()
+	before, ok := s.certRevocations[cert.Subject.CommonName]
+	s.mu.Unlock()
+	return ok && cert.NotBefore.Before(before.Truncate(time.Second))
+}
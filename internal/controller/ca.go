@@ -0,0 +1,166 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"vpnctl/internal/api"
+	"vpnctl/internal/pki"
+)
+
+// loadTLSConfig builds the server TLS config from the PKI directory. During
+// a CA rotation the previous CA is trusted for client certificates too, and
+// the cross-signed current CA is sent with the server certificate so nodes
+// that only know the previous CA still accept it.
+func (s *Server) loadTLSConfig() error {
+	cfg, err := pki.ServerTLSConfig(
+		filepath.Join(s.pkiDir, "ca.crt"),
+		filepath.Join(s.pkiDir, "server.crt"),
+		filepath.Join(s.pkiDir, "server.key"),
+		s.revoked,
+	)
+	if err != nil {
+		return err
+	}
+	// Allow /bootstrap to work without a client cert. The
+	// requireClientCert middleware enforces client certs for all
+	// other endpoints.
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+
+	if retireAt, err := pki.RotationRetireAt(s.pkiDir); err != nil {
+		return err
+	} else if !retireAt.IsZero() {
+		prev, err := pki.LoadCert(filepath.Join(s.pkiDir, pki.PreviousCAFile))
+		if err != nil {
+			return err
+		}
+		cross, err := pki.LoadCert(filepath.Join(s.pkiDir, pki.CrossCAFile))
+		if err != nil {
+			return err
+		}
+		cfg.ClientCAs.AddCert(prev)
+		cfg.Certificates[0].Certificate = append(cfg.Certificates[0].Certificate, cross.Raw)
+	}
+	s.tlsConfig.Store(cfg)
+	return nil
+}
+
+// handleRotateCA handles POST /admin/ca/rotate. A new CA, with a key of the
+// configured algorithm, replaces the current one, which stays trusted for
+// the requested grace period while nodes fetch the new bundle and renew
+// their certificates under it.
+func (s *Server) handleRotateCA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.pkiDir == "" {
+		writeJSONError(w, http.StatusNotFound, "pki not enabled")
+		return
+	}
+
+	var req api.RotateCARequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.GraceSec <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "grace_sec must be > 0")
+		return
+	}
+	caExpiry, err := time.ParseDuration(s.cfg.PKI.CAExpiry)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "invalid ca_expiry: "+err.Error())
+		return
+	}
+
+	err = pki.RotateCA(s.pkiDir, caExpiry, time.Duration(req.GraceSec)*time.Second, time.Now().UTC(), s.cfg.PKI.KeyAlgorithm)
+	if errors.Is(err, pki.ErrRotationInProgress) {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := s.issueServerCert(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := s.loadTLSConfig(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	retireAt, err := pki.RotationRetireAt(s.pkiDir)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	slog.Info("CA rotated", "retire_previous_at", retireAt)
+	writeJSON(w, http.StatusOK, api.RotateCAResponse{RetireAt: retireAt})
+}
+
+// retireCA ends a CA rotation once its grace period is over: the previous
+// CA is no longer trusted and certificates it issued are refused.
+func (s *Server) retireCA(now time.Time) error {
+	if s.pkiDir == "" {
+		return nil
+	}
+	retireAt, err := pki.RotationRetireAt(s.pkiDir)
+	if err != nil || retireAt.IsZero() || now.Before(retireAt) {
+		return err
+	}
+	if err := pki.RetireCA(s.pkiDir); err != nil {
+		return err
+	}
+	slog.Info("previous CA retired")
+	return s.loadTLSConfig()
+}
+
+// handleCA handles GET /ca: the PEM bundle of trusted CA certificates, the
+// current one first. Nodes fetch it to follow a rotation. Like the CRL it is
+// public.
+func (s *Server) handleCA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.pkiDir == "" {
+		writeJSONError(w, http.StatusNotFound, "pki not enabled")
+		return
+	}
+	bundle, err := pki.CABundle(s.pkiDir)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set(api.KeyAlgorithmHeader, s.cfg.PKI.KeyAlgorithm)
+	_, _ = w.Write(bundle)
+}
+
+// readRotation returns the PEM files of a rotation in progress for the HA
+// snapshot, or empty strings.
+func (s *Server) readRotation() (prev, cross string, err error) {
+	prevPEM, err := os.ReadFile(filepath.Join(s.pkiDir, pki.PreviousCAFile))
+	if os.IsNotExist(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	crossPEM, err := os.ReadFile(filepath.Join(s.pkiDir, pki.CrossCAFile))
+	if err != nil {
+		return "", "", err
+	}
+	return string(prevPEM), string(crossPEM), nil
+}
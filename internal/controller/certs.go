@@ -0,0 +1,208 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"crypto/x509"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"vpnctl/internal/api"
+	"vpnctl/internal/pki"
+	"vpnctl/internal/store"
+)
+
+// crlValidity is how long a downloaded CRL stays valid. It is generated on
+// each request, so clients only need to fetch it this often.
+const crlValidity = 24 * time.Hour
+
+// issuedDir is where certificates signed by the controller are recorded.
+func (s *Server) issuedDir() string {
+	return filepath.Join(s.pkiDir, "issued")
+}
+
+// handleRevokeCert handles POST /admin/certs/revoke. Every certificate
+// issued to the node so far goes on the revocation list and is refused from
+// then on; the node keeps its registration and may enroll again with a new
+// bootstrap token.
+func (s *Server) handleRevokeCert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.revoked == nil {
+		writeJSONError(w, http.StatusNotFound, "pki not enabled")
+		return
+	}
+
+	var req api.RevokeCertRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Node == "" {
+		writeJSONError(w, http.StatusBadRequest, "node is required")
+		return
+	}
+
+	now := time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Certificates carry the name the node enrolled with, which stays its
+	// ID after a rename; cover both. A node already removed from the
+	// registry can still be revoked by name.
+	cns := []string{req.Node}
+	if i := s.findNodeLocked(req.Node); i >= 0 {
+		n := s.reg.Nodes[i]
+		cns = []string{n.ID}
+		if n.Name != n.ID {
+			cns = append(cns, n.Name)
+		}
+	}
+
+	var certs []*x509.Certificate
+	for _, cn := range cns {
+		issued, err := pki.IssuedCerts(s.issuedDir(), cn)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		certs = append(certs, issued...)
+	}
+	added, err := s.revoked.Revoke(certs, now)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Certificates issued before they were recorded are caught by the
+	// common-name cutoff instead.
+	err = s.db.Update(func(tx store.Tx) error {
+		for _, cn := range cns {
+			if err := tx.PutCertRevocation(cn, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if s.certRevocations == nil {
+		s.certRevocations = make(map[string]time.Time)
+	}
+	for _, cn := range cns {
+		s.certRevocations[cn] = now
+	}
+
+	slog.Info("client certificates revoked", "node", req.Node, "certs", added)
+	writeJSON(w, http.StatusOK, api.RevokeCertResponse{Revoked: added})
+}
+
+// handleRenewCert handles POST /renew: a node presenting its current client
+// certificate exchanges a CSR for a new one before the old one expires. The
+// CSR must be for the same identity, so a node can only renew itself.
+func (s *Server) handleRenewCert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	id, ok := r.Context().Value(peerKey{}).(peerIdentity)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "pki not enabled")
+		return
+	}
+	if id.Role != pki.RoleNode {
+		writeJSONError(w, http.StatusForbidden, "node certificate required")
+		return
+	}
+
+	var req api.RenewRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.NodeID == "" || req.CSR == "" {
+		writeJSONError(w, http.StatusBadRequest, "node_id and csr are required")
+		return
+	}
+	if !authorizeNode(w, r, req.NodeID) {
+		return
+	}
+	cn, err := pki.CSRCommonName([]byte(req.CSR))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid csr: "+err.Error())
+		return
+	}
+	if cn != req.NodeID {
+		writeJSONError(w, http.StatusBadRequest, "csr common name must match node_id")
+		return
+	}
+
+	s.mu.Lock()
+	i := s.findNodeLocked(req.NodeID)
+	disabled := i >= 0 && s.reg.Nodes[i].Disabled
+	s.mu.Unlock()
+	if i < 0 {
+		writeJSONError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	if disabled {
+		writeJSONError(w, http.StatusForbidden, "node disabled")
+		return
+	}
+
+	caCert, caKey, err := pki.LoadCA(filepath.Join(s.pkiDir, "ca.key"), filepath.Join(s.pkiDir, "ca.crt"))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to load CA: "+err.Error())
+		return
+	}
+	clientExpiry, err := time.ParseDuration(s.cfg.PKI.ClientExpiry)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "invalid client_expiry: "+err.Error())
+		return
+	}
+	signedCert, err := pki.SignCSR(caCert, caKey, []byte(req.CSR), clientExpiry)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "failed to sign CSR: "+err.Error())
+		return
+	}
+	if err := pki.RecordIssued(s.issuedDir(), signedCert); err != nil {
+		slog.Warn("failed to record issued certificate", "node", req.NodeID, "err", err)
+	}
+
+	slog.Info("client certificate renewed", "node", req.NodeID)
+	writeJSON(w, http.StatusOK, api.RenewResponse{ClientCert: string(signedCert)})
+}
+
+// handleCRL handles GET /crl: the revocation list as a DER-encoded CRL
+// signed by the CA. Like the CA certificate it is public.
+func (s *Server) handleCRL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.revoked == nil {
+		writeJSONError(w, http.StatusNotFound, "pki not enabled")
+		return
+	}
+
+	caCert, caKey, err := pki.LoadCA(filepath.Join(s.pkiDir, "ca.key"), filepath.Join(s.pkiDir, "ca.crt"))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to load CA: "+err.Error())
+		return
+	}
+	der, err := pki.CreateCRL(caCert, caKey, s.revoked.Entries(), time.Now().UTC(), crlValidity)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	_, _ = w.Write(der)
+}
@@ -0,0 +1,97 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"vpnctl/internal/api"
+	"vpnctl/internal/config"
+)
+
+// ephemeralRemoveAfter returns how long an ephemeral node may go unseen
+// before it is removed.
+func (s *Server) ephemeralRemoveAfter() time.Duration {
+	if s.cfg.EphemeralRemoveAfterSec <= 0 {
+		return config.DefaultEphemeralRemoveAfterSec * time.Second
+	}
+	return time.Duration(s.cfg.EphemeralRemoveAfterSec) * time.Second
+}
+
+// removeExpiredLocked removes ephemeral nodes not seen for
+// ephemeralRemoveAfter and reports whether any were. Callers hold s.mu.
+func (s *Server) removeExpiredLocked(now time.Time) (bool, error) {
+	after := s.ephemeralRemoveAfter()
+	removed := false
+	for i := len(s.reg.Nodes) - 1; i >= 0; i-- {
+		n := s.reg.Nodes[i]
+		if !n.Ephemeral || now.Sub(n.LastSeenAt) < after {
+			continue
+		}
+		if err := s.removeNodeLocked(i, now); err != nil {
+			return removed, err
+		}
+		slog.Info("ephemeral node removed", "node", n.Name, "vpn_ip", n.VPNIP, "last_seen", n.LastSeenAt)
+		removed = true
+	}
+	return removed, nil
+}
+
+// handleLeave handles POST /leave from an agent shutting down cleanly.
+// Ephemeral nodes are removed right away; other nodes are kept.
+func (s *Server) handleLeave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req api.LeaveRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.NodeID == "" {
+		writeJSONError(w, http.StatusBadRequest, "node_id is required")
+		return
+	}
+	if !authorizeNode(w, r, req.NodeID) {
+		return
+	}
+
+	s.mu.Lock()
+	i := s.findNodeLocked(req.NodeID)
+	if i < 0 || !s.reg.Nodes[i].Ephemeral {
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	node := s.reg.Nodes[i]
+	if err := s.removeNodeLocked(i, time.Now().UTC()); err != nil {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	autoApply := s.cfg.WGApply
+	peers := s.peersForWGLocked()
+	s.mu.Unlock()
+
+	slog.Info("ephemeral node left", "node", node.Name, "vpn_ip", node.VPNIP)
+
+	if autoApply {
+		if err := s.applyWG(peers); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	// The freed address must lose the node's ACL rules before it is handed
+	// out again.
+	if err := s.syncFirewall(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.updateMetrics()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,168 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"vpnctl/internal/api"
+	"vpnctl/internal/store"
+)
+
+// eventHeartbeat keeps idle /events streams alive through proxies and NAT.
+const eventHeartbeat = 15 * time.Second
+
+// eventHub fans fleet events out to /events subscribers. Slow subscribers
+// drop events rather than block the publisher; agents treat every event as a
+// hint to refetch /candidates, so a dropped event only delays them until the
+// next one or their fallback ticker.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan api.Event]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan api.Event]struct{})}
+}
+
+func (h *eventHub) subscribe() chan api.Event {
+	ch := make(chan api.Event, 32)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan api.Event) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+func (h *eventHub) publish(ev api.Event) {
+	if h == nil {
+		return
+	}
+	if ev.Time == "" {
+		ev.Time = time.Now().UTC().Format(time.RFC3339)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// handleEvents streams fleet events as text/event-stream until the client goes away.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case ev := <-ch:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// nodeEvent returns the event, if any, implied by a node changing from prev
+// to next. existed is false for a first registration.
+func nodeEvent(prev store.NodeInfo, existed bool, next store.NodeInfo) (api.Event, bool) {
+	switch {
+	case !existed || (prev.Status == store.StatusOffline && next.Status != store.StatusOffline):
+		return api.Event{Type: api.EventNodeJoined, NodeID: next.ID}, true
+	case prev.Status != store.StatusOffline && next.Status == store.StatusOffline:
+		return api.Event{Type: api.EventNodeLeft, NodeID: next.ID}, true
+	case prev.Endpoint != next.Endpoint || prev.PublicAddr != next.PublicAddr ||
+		prev.PubKey != next.PubKey || prev.VPNIP != next.VPNIP:
+		return api.Event{Type: api.EventEndpointChanged, NodeID: next.ID}, true
+	case !slices.Equal(prev.Tags, next.Tags) || !slices.Equal(prev.AdminTags, next.AdminTags):
+		return api.Event{Type: api.EventNodeUpdated, NodeID: next.ID}, true
+	}
+	return api.Event{}, false
+}
+
+// publishNodeChange publishes the event implied by a node change, if any.
+func (s *Server) publishNodeChange(prev store.NodeInfo, existed bool, next store.NodeInfo) {
+	if ev, ok := nodeEvent(prev, existed, next); ok {
+		s.events.publish(ev)
+	}
+}
+
+// p2pTransitionsLocked recomputes P2P readiness for every pair with probe
+// history and publishes an event for each pair whose readiness flipped since
+// the last call. Callers hold s.mu.
+func (s *Server) p2pTransitionsLocked() {
+	current := map[[2]string]bool{}
+	for a, peers := range s.directOK {
+		for b := range peers {
+			k := pairKey(a, b)
+			if _, seen := current[k]; seen {
+				continue
+			}
+			if s.p2pReadyLocked(k[0], k[1]) {
+				current[k] = true
+			}
+		}
+	}
+	for k := range current {
+		if !s.readyPairs[k] {
+			s.events.publish(api.Event{Type: api.EventP2PReadyChanged, NodeID: k[0], PeerID: k[1], P2PReady: true})
+		}
+	}
+	for k := range s.readyPairs {
+		if !current[k] {
+			s.events.publish(api.Event{Type: api.EventP2PReadyChanged, NodeID: k[0], PeerID: k[1], P2PReady: false})
+		}
+	}
+	s.readyPairs = current
+}
+
+func pairKey(a, b string) [2]string {
+	if b < a {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
@@ -0,0 +1,502 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"vpnctl/internal/api"
+	"vpnctl/internal/config"
+	"vpnctl/internal/metrics"
+	"vpnctl/internal/pki"
+	"vpnctl/internal/store"
+)
+
+// PrepareHA decides whether this controller starts as active or standby and,
+// as standby, copies the active's state before InitPKI so the CA is shared
+// instead of generated. It does nothing without controller.ha.
+func (s *Server) PrepareHA(ctx context.Context) error {
+	ha := s.cfg.HA
+	if ha == nil {
+		return nil
+	}
+	peer, err := newPeerClient(s.cfg)
+	if err != nil {
+		return fmt.Errorf("ha peer client: %w", err)
+	}
+	s.peer = peer
+
+	standby := ha.Role == api.HARoleStandby
+	checkCtx, cancel := context.WithTimeout(ctx, s.haHeartbeatInterval())
+	status, err := peer.HAStatus(checkCtx)
+	cancel()
+	if err == nil {
+		s.observeEpoch(status.Epoch)
+		if status.Role == api.HARoleActive {
+			// The peer took over while we were down; it stays active.
+			standby = true
+		}
+	}
+	s.setStandby(standby)
+	if !standby {
+		slog.Info("ha: starting as active", "peer", ha.Peer)
+		return nil
+	}
+
+	slog.Info("ha: starting as standby", "peer", ha.Peer)
+	if err := s.syncFromPeer(ctx); err != nil {
+		if s.cfg.PKI != nil && !fileExists(filepath.Join(s.cfg.DataDir, "pki", "ca.crt")) {
+			return fmt.Errorf("ha: initial sync from %s failed and no CA is present yet: %w", ha.Peer, err)
+		}
+		slog.Warn("ha: initial sync failed, serving the last copied state", "peer", ha.Peer, "err", err)
+	}
+	return nil
+}
+
+// newPeerClient returns a client for the other controller. With PKI it
+// presents the ha-peer certificate from controller.ha.pki_dir.
+func newPeerClient(cfg config.ControllerConfig) (*api.Client, error) {
+	addr := cfg.HA.Peer
+	if cfg.PKI == nil {
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		return api.NewClient(addr), nil
+	}
+	addr = strings.TrimPrefix(strings.TrimPrefix(addr, "http://"), "https://")
+	dir := cfg.HA.PKIDir
+	tlsCfg, err := pki.ClientTLSConfig(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ha-peer.crt"), filepath.Join(dir, "ha-peer.key"))
+	if err != nil {
+		return nil, err
+	}
+	return api.NewTLSClient("https://"+addr, tlsCfg), nil
+}
+
+func (s *Server) setStandby(standby bool) {
+	s.standby.Store(standby)
+	if standby {
+		metrics.HAStandby.Set(1)
+	} else {
+		metrics.HAStandby.Set(0)
+	}
+}
+
+func (s *Server) haHeartbeatInterval() time.Duration {
+	return time.Duration(s.cfg.HA.HeartbeatIntervalSec) * time.Second
+}
+
+// standbyGuard answers node and admin requests with 503 while this
+// controller is standby, so clients fail over to the active one. The HA
+// endpoints, metrics and status page stay available.
+func (s *Server) standbyGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.standby.Load() && !strings.HasPrefix(r.URL.Path, "/ha/") && r.URL.Path != "/prom/metrics" && r.URL.Path != "/status" {
+			writeJSONError(w, http.StatusServiceUnavailable, "controller is standby")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleHAStatus handles GET /ha/status.
+func (s *Server) handleHAStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	role := api.HARoleActive
+	if s.standby.Load() {
+		role = api.HARoleStandby
+	}
+	writeJSON(w, http.StatusOK, api.HAStatusResponse{Role: role, Epoch: s.haEpoch.Load()})
+}
+
+// handleHASnapshot handles GET /ha/snapshot. A standby polls it both to copy
+// state and as the active's heartbeat, so a standby answers 503.
+func (s *Server) handleHASnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.standby.Load() {
+		writeJSONError(w, http.StatusServiceUnavailable, "controller is standby")
+		return
+	}
+	snap, err := s.snapshot()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, snap)
+}
+
+// snapshot collects the replicated state. The registry and revocations come
+// from memory; tokens, reservations and probe results from the database.
+func (s *Server) snapshot() (api.HASnapshot, error) {
+	snap := api.HASnapshot{Epoch: s.haEpoch.Load()}
+	s.mu.Lock()
+	snap.Nodes = append([]store.NodeInfo(nil), s.reg.Nodes...)
+	snap.CertRevocations = make(map[string]time.Time, len(s.certRevocations))
+	for cn, before := range s.certRevocations {
+		snap.CertRevocations[cn] = before
+	}
+	s.mu.Unlock()
+
+	var err error
+	if snap.Tokens, err = s.db.ListTokens(); err != nil {
+		return snap, err
+	}
+	if snap.IPReservations, err = s.db.IPReservations(); err != nil {
+		return snap, err
+	}
+	if snap.DirectResults, err = s.db.DirectResults(); err != nil {
+		return snap, err
+	}
+	if s.pkiDir != "" {
+		caCert, err := os.ReadFile(filepath.Join(s.pkiDir, "ca.crt"))
+		if err != nil {
+			return snap, err
+		}
+		caKey, err := os.ReadFile(filepath.Join(s.pkiDir, "ca.key"))
+		if err != nil {
+			return snap, err
+		}
+		snap.CACert, snap.CAKey = string(caCert), string(caKey)
+		if snap.CAPrevious, snap.CACross, err = s.readRotation(); err != nil {
+			return snap, err
+		}
+	}
+	if s.revoked != nil {
+		snap.RevokedCerts = s.revoked.Entries()
+	}
+	return snap, nil
+}
+
+// syncFromPeer pulls the active's snapshot and applies it.
+func (s *Server) syncFromPeer(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.haHeartbeatInterval())
+	defer cancel()
+	snap, err := s.peer.HASnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	if err := s.applySnapshot(snap); err != nil {
+		return err
+	}
+	s.observeEpoch(snap.Epoch)
+	s.haSynced = true
+	return nil
+}
+
+// observeEpoch raises this controller's epoch to the peer's, so a takeover
+// always moves past every epoch seen from the active.
+func (s *Server) observeEpoch(epoch uint64) {
+	for {
+		cur := s.haEpoch.Load()
+		if epoch <= cur || s.haEpoch.CompareAndSwap(cur, epoch) {
+			return
+		}
+	}
+}
+
+// applySnapshot replaces the local database and in-memory state with snap.
+func (s *Server) applySnapshot(snap api.HASnapshot) error {
+	if (snap.CACert == "") != (snap.CAKey == "") {
+		return errors.New("snapshot has an incomplete CA")
+	}
+	if snap.CACert != "" {
+		if err := s.applySnapshotCA(snap); err != nil {
+			return err
+		}
+	}
+	// Revocations are never undone, so merging keeps the lists equal.
+	if s.revoked != nil {
+		if _, err := s.revoked.Merge(snap.RevokedCerts); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keepNodes := make(map[string]bool, len(snap.Nodes))
+	for _, n := range snap.Nodes {
+		keepNodes[n.ID] = true
+	}
+	keepTokens := make(map[string]bool, len(snap.Tokens))
+	for _, t := range snap.Tokens {
+		keepTokens[t.Hash] = true
+	}
+	keepReservations := make(map[string]bool, len(snap.IPReservations))
+	for _, r := range snap.IPReservations {
+		keepReservations[r.Name] = true
+	}
+	tokens, err := s.db.ListTokens()
+	if err != nil {
+		return err
+	}
+	reservations, err := s.db.IPReservations()
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Update(func(tx store.Tx) error {
+		for _, n := range s.reg.Nodes {
+			if !keepNodes[n.ID] {
+				if err := tx.DeleteNode(n.ID); err != nil {
+					return err
+				}
+			}
+		}
+		for _, n := range snap.Nodes {
+			if err := tx.PutNode(n); err != nil {
+				return err
+			}
+		}
+		for _, t := range tokens {
+			if !keepTokens[t.Hash] {
+				if err := tx.DeleteToken(t.Hash); err != nil {
+					return err
+				}
+			}
+		}
+		for _, t := range snap.Tokens {
+			if err := tx.PutToken(t); err != nil {
+				return err
+			}
+		}
+		for _, r := range reservations {
+			if !keepReservations[r.Name] {
+				if err := tx.DeleteIPReservation(r.Name); err != nil {
+					return err
+				}
+			}
+		}
+		for _, r := range snap.IPReservations {
+			if err := tx.PutIPReservation(r); err != nil {
+				return err
+			}
+		}
+		for cn, before := range snap.CertRevocations {
+			if err := tx.PutCertRevocation(cn, before); err != nil {
+				return err
+			}
+		}
+		for _, r := range snap.DirectResults {
+			if err := tx.PutDirectResult(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	directOK, err := loadDirectOK(s.db)
+	if err != nil {
+		return err
+	}
+	revocations, err := s.db.CertRevocations()
+	if err != nil {
+		return err
+	}
+	s.reg.Nodes = append([]store.NodeInfo(nil), snap.Nodes...)
+	s.directOK = directOK
+	s.certRevocations = revocations
+	s.ipReservations = make(map[string]string, len(snap.IPReservations))
+	for _, r := range snap.IPReservations {
+		s.ipReservations[r.Name] = r.VPNIP
+	}
+	s.p2pTransitionsLocked()
+	return nil
+}
+
+// applySnapshotCA copies the active's CA, and a rotation in progress, into
+// the PKI directory. After a rotation the standby re-issues its server
+// certificate under the new CA and reloads its TLS config.
+func (s *Server) applySnapshotCA(snap api.HASnapshot) error {
+	dir := filepath.Join(s.cfg.DataDir, "pki")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create pki dir: %w", err)
+	}
+	if _, err := writeIfChanged(filepath.Join(dir, "ca.key"), []byte(snap.CAKey), 0o600); err != nil {
+		return err
+	}
+	caChanged, err := writeIfChanged(filepath.Join(dir, "ca.crt"), []byte(snap.CACert), 0o644)
+	if err != nil {
+		return err
+	}
+	rotationChanged := false
+	if snap.CAPrevious != "" {
+		for name, data := range map[string]string{pki.PreviousCAFile: snap.CAPrevious, pki.CrossCAFile: snap.CACross} {
+			changed, err := writeIfChanged(filepath.Join(dir, name), []byte(data), 0o644)
+			if err != nil {
+				return err
+			}
+			rotationChanged = rotationChanged || changed
+		}
+	} else if fileExists(filepath.Join(dir, pki.PreviousCAFile)) {
+		if err := pki.RetireCA(dir); err != nil {
+			return err
+		}
+		rotationChanged = true
+	}
+
+	// Before InitPKI there is no server certificate or TLS config yet.
+	if s.pkiDir == "" {
+		return nil
+	}
+	if caChanged {
+		if err := s.issueServerCert(); err != nil {
+			return err
+		}
+	}
+	if caChanged || rotationChanged {
+		return s.loadTLSConfig()
+	}
+	return nil
+}
+
+// writeIfChanged writes data to path unless it already holds it, and reports
+// whether it wrote.
+func writeIfChanged(path string, data []byte, perm os.FileMode) (bool, error) {
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, data) {
+		return false, nil
+	}
+	return true, os.WriteFile(path, data, perm)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// haTick runs one standby heartbeat: it syncs from the active and reports
+// whether the active has been silent for failover_after_sec, in which case
+// the caller promotes this controller.
+func (s *Server) haTick(now time.Time) bool {
+	err := s.syncFromPeer(context.Background())
+	if err == nil {
+		s.haLastHeartbeat = now
+		return false
+	}
+	metrics.HASyncErrorsTotal.Inc()
+	slog.Debug("ha: sync from active failed", "peer", s.cfg.HA.Peer, "err", err)
+	if now.Sub(s.haLastHeartbeat) < time.Duration(s.cfg.HA.FailoverAfterSec)*time.Second {
+		return false
+	}
+	if !s.haSynced {
+		slog.Warn("ha: active unreachable but no state has been copied yet, staying standby", "peer", s.cfg.HA.Peer)
+		return false
+	}
+	return true
+}
+
+// promote makes this controller active: it starts answering requests, runs
+// the liveness and reconcile loops, and brings up the hub interface with the
+// shared WireGuard identity. The epoch is raised past the silent active's,
+// so that controller steps down once the two can reach each other again.
+func (s *Server) promote() {
+	epoch := s.haEpoch.Add(1)
+	slog.Warn("ha: active controller unreachable, taking over", "peer", s.cfg.HA.Peer, "last_heartbeat", s.haLastHeartbeat, "epoch", epoch)
+	metrics.HAFailoversTotal.Inc()
+	s.setStandby(false)
+	s.startLiveness()
+	if !s.cfg.WGApply {
+		return
+	}
+	s.startReconciler()
+	s.mu.Lock()
+	peers := s.peersForWGLocked()
+	s.mu.Unlock()
+	if err := s.applyWG(peers); err != nil {
+		slog.Warn("ha: hub interface apply failed", "err", err)
+	}
+}
+
+// haPeerTookOver runs one active heartbeat: it asks the peer for its role
+// and reports whether the peer is active too and wins, in which case the
+// caller demotes this controller. The higher epoch wins; on a tie the
+// controller configured as standby yields. An unreachable peer never wins.
+func (s *Server) haPeerTookOver() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), s.haHeartbeatInterval())
+	status, err := s.peer.HAStatus(ctx)
+	cancel()
+	if err != nil || status.Role != api.HARoleActive {
+		return false
+	}
+	epoch := s.haEpoch.Load()
+	return status.Epoch > epoch || (status.Epoch == epoch && s.cfg.HA.Role == api.HARoleStandby)
+}
+
+// demote makes this controller standby again after its peer took over, e.g.
+// while a network partition kept the two apart. It stops the liveness and
+// reconcile loops and takes the hub interface down; changes made here in the
+// meantime are replaced by the peer's state on the next sync.
+func (s *Server) demote(now time.Time) {
+	slog.Warn("ha: peer took over, stepping down to standby", "peer", s.cfg.HA.Peer, "epoch", s.haEpoch.Load())
+	metrics.HADemotionsTotal.Inc()
+	s.setStandby(true)
+	s.stopLiveness()
+	s.stopReconciler()
+	s.haLastHeartbeat = now
+	// This controller's own state can be served if the peer fails before
+	// the first sync.
+	s.haSynced = true
+	if !s.cfg.WGApply {
+		return
+	}
+	if err := removeWG(s.cfg); err != nil {
+		slog.Warn("ha: hub interface removal failed", "err", err)
+	}
+}
+
+// startHA runs the HA heartbeat every interval. As standby it syncs from the
+// active and promotes this controller when the active goes silent; as active
+// it checks the peer and steps down when the peer has taken over.
+func (s *Server) startHA() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	s.haStop, s.haDone = stop, done
+	s.haLastHeartbeat = time.Now()
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(s.haHeartbeatInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				if !s.standby.Load() {
+					if s.haPeerTookOver() {
+						s.demote(now)
+					}
+				} else if s.haTick(now) {
+					s.promote()
+				}
+			}
+		}
+	}()
+}
+
+// stopHA stops the HA loop if running and waits for it to exit.
+func (s *Server) stopHA() {
+	if s.haStop != nil {
+		close(s.haStop)
+		<-s.haDone
+		s.haStop, s.haDone = nil, nil
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"time"
+
+	"vpnctl/internal/api"
+	"vpnctl/internal/model"
+	"vpnctl/internal/store"
+)
+
+const (
+	// DefaultHistoryWindow is used when GET /fleet/history has no window parameter.
+	DefaultHistoryWindow = time.Hour
+	// historyBuckets is how many buckets a history response is split into.
+	historyBuckets = 12
+	// historyRetention bounds how long per-minute aggregates are kept.
+	historyRetention = 7 * 24 * time.Hour
+	// historyPruneInterval limits how often old aggregates are deleted.
+	historyPruneInterval = time.Hour
+)
+
+// metricBuckets folds submitted samples into per-node, per-minute aggregates.
+// Samples without a NodeID are attributed to fallbackNodeID.
+func metricBuckets(fallbackNodeID string, samples []model.Metric) []store.MetricBucket {
+	type key struct {
+		node  string
+		start time.Time
+	}
+	agg := map[key]*store.MetricBucket{}
+	var order []key
+	for _, m := range samples {
+		nodeID := m.NodeID
+		if nodeID == "" {
+			nodeID = fallbackNodeID
+		}
+		if nodeID == "" {
+			continue
+		}
+		ts := m.Timestamp
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+		k := key{node: nodeID, start: ts.UTC().Truncate(time.Minute)}
+		b := agg[k]
+		if b == nil {
+			b = &store.MetricBucket{NodeID: nodeID, Start: k.start}
+			agg[k] = b
+			order = append(order, k)
+		}
+		b.Samples++
+		b.LossSum += m.LossPct
+		if m.RTTMs > 0 {
+			b.RTTSamples++
+			b.RTTSumMs += m.RTTMs
+		}
+	}
+	out := make([]store.MetricBucket, 0, len(order))
+	for _, k := range order {
+		out = append(out, *agg[k])
+	}
+	return out
+}
+
+// buildHistory splits [now-window, now) into historyBuckets buckets and
+// summarizes each node's per-minute aggregates into them. A node counts as
+// online for every minute in which it reported metrics or checked in.
+func buildHistory(nodes []store.NodeInfo, minutes []store.MetricBucket, window time.Duration, now time.Time) []api.FleetNodeHistory {
+	width := (window / historyBuckets).Truncate(time.Minute)
+	if width < time.Minute {
+		width = time.Minute
+	}
+	end := now.UTC().Truncate(time.Minute).Add(time.Minute)
+	start := end.Add(-width * historyBuckets)
+
+	byNode := map[string][]store.MetricBucket{}
+	for _, m := range minutes {
+		if m.Start.Before(start) || !m.Start.Before(end) {
+			continue
+		}
+		byNode[m.NodeID] = append(byNode[m.NodeID], m)
+	}
+
+	out := make([]api.FleetNodeHistory, 0, len(nodes))
+	for _, node := range nodes {
+		buckets := make([]api.FleetHistoryBucket, historyBuckets)
+		active := make([]int, historyBuckets)
+		samples := make([]int, historyBuckets)
+		rttSamples := make([]int, historyBuckets)
+		rttSum := make([]float64, historyBuckets)
+		lossSum := make([]float64, historyBuckets)
+
+		for _, m := range byNode[node.ID] {
+			i := int(m.Start.Sub(start) / width)
+			if i < 0 || i >= historyBuckets {
+				continue
+			}
+			active[i]++
+			samples[i] += m.Samples
+			rttSamples[i] += m.RTTSamples
+			rttSum[i] += m.RTTSumMs
+			lossSum[i] += m.LossSum
+		}
+
+		for i := range buckets {
+			bucketStart := start.Add(width * time.Duration(i))
+			b := api.FleetHistoryBucket{Time: bucketStart.Format(time.RFC3339)}
+			if total := int(width / time.Minute); total > 0 {
+				b.OnlinePct = 100 * float64(active[i]) / float64(total)
+				if b.OnlinePct > 100 {
+					b.OnlinePct = 100
+				}
+			}
+			if rttSamples[i] > 0 {
+				b.AvgRTTMs = rttSum[i] / float64(rttSamples[i])
+			}
+			if samples[i] > 0 {
+				b.LossPct = lossSum[i] / float64(samples[i])
+			}
+			buckets[i] = b
+		}
+		out = append(out, api.FleetNodeHistory{Name: node.Name, Buckets: buckets})
+	}
+	return out
+}
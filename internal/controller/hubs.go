@@ -0,0 +1,295 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"vpnctl/internal/addrutil"
+	"vpnctl/internal/api"
+	"vpnctl/internal/metrics"
+	"vpnctl/internal/store"
+	"vpnctl/internal/wireguard"
+)
+
+// hubSwitchRatio is how much faster another hub must measure, relative to a
+// node's current primary, before the node is moved to it. It keeps
+// assignments from flapping between hubs with similar RTTs.
+const hubSwitchRatio = 0.8
+
+// multiHub reports whether relay hubs besides the controller's own are
+// configured. Without them every node uses the controller's hub.
+func (s *Server) multiHub() bool {
+	return len(s.cfg.Hubs) > 0
+}
+
+// hubs returns every relay hub, the controller's own first.
+func (s *Server) hubs() []api.HubPeer {
+	var addrs []string
+	for _, addr := range addrutil.HostAddrs(s.cfg.WGAddress) {
+		addrs = append(addrs, addr.String())
+	}
+	out := []api.HubPeer{{
+		Name:      s.cfg.HubName,
+		PublicKey: s.cfg.ServerPublicKey,
+		Endpoint:  s.cfg.ServerEndpoint,
+		Address:   strings.Join(addrs, ","),
+		ProbePort: s.cfg.ProbePort,
+	}}
+	for _, h := range s.cfg.Hubs {
+		out = append(out, api.HubPeer{
+			Name:      h.Name,
+			PublicKey: h.PublicKey,
+			Endpoint:  h.Endpoint,
+			Address:   h.Address,
+			ProbePort: h.ProbePort,
+		})
+	}
+	return out
+}
+
+func (s *Server) findHub(name string) (api.HubPeer, bool) {
+	for _, h := range s.hubs() {
+		if h.Name == name {
+			return h, true
+		}
+	}
+	return api.HubPeer{}, false
+}
+
+// nodeHubLocked returns the hub n's traffic is routed through: the one it
+// last reported, else its primary, else the controller's own.
+func (s *Server) nodeHubLocked(n store.NodeInfo) string {
+	for _, name := range []string{n.ActiveHub, n.PrimaryHub} {
+		if _, ok := s.findHub(name); ok && name != "" {
+			return name
+		}
+	}
+	return s.cfg.HubName
+}
+
+// rankHubsLocked orders hubs for nodeID: those it measured by ascending RTT,
+// then the rest in config order. Callers hold s.mu.
+func (s *Server) rankHubsLocked(nodeID string) []api.HubPeer {
+	rtt := s.hubRTT[nodeID]
+	ranked := s.hubs()
+	slices.SortStableFunc(ranked, func(a, b api.HubPeer) int {
+		ra, okA := rtt[a.Name]
+		rb, okB := rtt[b.Name]
+		switch {
+		case okA && okB:
+			if ra < rb {
+				return -1
+			}
+			if ra > rb {
+				return 1
+			}
+			return 0
+		case okA:
+			return -1
+		case okB:
+			return 1
+		}
+		return 0
+	})
+	return ranked
+}
+
+// assignHubsLocked picks n's primary and backup hubs from its RTT
+// measurements. The primary only changes when it is gone or another hub is
+// clearly faster. It returns the hubs ordered primary, backup, rest. Callers
+// hold s.mu.
+func (s *Server) assignHubsLocked(n *store.NodeInfo) []api.HubPeer {
+	ranked := s.rankHubsLocked(n.ID)
+	rtt := s.hubRTT[n.ID]
+
+	primary := ""
+	if _, ok := s.findHub(n.PrimaryHub); ok {
+		primary = n.PrimaryHub
+	}
+	best := ranked[0].Name
+	if primary == "" {
+		primary = best
+	} else if bestRTT, ok := rtt[best]; ok {
+		if cur, ok := rtt[primary]; !ok || bestRTT < hubSwitchRatio*cur {
+			primary = best
+		}
+	}
+	n.PrimaryHub = primary
+
+	ordered := make([]api.HubPeer, 0, len(ranked))
+	for _, h := range ranked {
+		if h.Name == primary {
+			ordered = append(ordered, h)
+		}
+	}
+	n.BackupHub = ""
+	for _, h := range ranked {
+		if h.Name == primary {
+			continue
+		}
+		if n.BackupHub == "" {
+			n.BackupHub = h.Name
+		}
+		ordered = append(ordered, h)
+	}
+	return ordered
+}
+
+// hubPeersLocked returns the WireGuard peers of the named hub: nodes routed
+// through it, nodes assigned to it as primary or backup (without AllowedIPs,
+// so they can handshake before failing over) and, with several hubs, every
+// other hub with the addresses of the nodes routed through that hub.
+// Callers hold s.mu.
+func (s *Server) hubPeersLocked(hub string) []wireguard.Peer {
+	multi := s.multiHub()
+	peers := make([]wireguard.Peer, 0, len(s.reg.Nodes))
+	via := map[string][]string{}
+	for _, node := range s.reg.Nodes {
+		if node.PubKey == "" || node.VPNIP == "" || node.Disabled {
+			continue
+		}
+		allowed := addrutil.HostPrefixes(node.VPNIP)
+		if len(allowed) == 0 {
+			continue
+		}
+		allowed = append(allowed, activeRoutes(node)...)
+		on := s.cfg.HubName
+		if multi {
+			on = s.nodeHubLocked(node)
+		}
+		via[on] = append(via[on], allowed...)
+		switch {
+		case on == hub:
+			peers = append(peers, wireguard.Peer{
+				PublicKey:  node.PubKey,
+				AllowedIPs: allowed,
+			})
+			if node.PendingPubKey != "" {
+				// Lets the node handshake on its rotated key before confirming it.
+				peers = append(peers, wireguard.Peer{PublicKey: node.PendingPubKey})
+			}
+		case node.PrimaryHub == hub || node.BackupHub == hub:
+			peers = append(peers, wireguard.Peer{PublicKey: node.PubKey})
+		}
+	}
+	if !multi {
+		return peers
+	}
+	for _, h := range s.hubs() {
+		if h.Name == hub || h.PublicKey == "" {
+			continue
+		}
+		allowed := append(addrutil.HostPrefixes(h.Address), via[h.Name]...)
+		peers = append(peers, wireguard.Peer{
+			PublicKey:  h.PublicKey,
+			Endpoint:   h.Endpoint,
+			AllowedIPs: allowed,
+		})
+	}
+	return peers
+}
+
+// updateHubMetricsLocked refreshes the per-hub node counts. Callers hold s.mu.
+func (s *Server) updateHubMetricsLocked() {
+	if !s.multiHub() {
+		return
+	}
+	counts := map[string]int{}
+	for _, n := range s.reg.Nodes {
+		if n.Status == store.StatusOnline && !n.Disabled {
+			counts[s.nodeHubLocked(n)]++
+		}
+	}
+	for _, h := range s.hubs() {
+		metrics.HubNodes.WithLabelValues(h.Name).Set(float64(counts[h.Name]))
+	}
+}
+
+// handleHubRTT handles POST /hub-rtt with a node's relay hub measurements.
+// Failed probes drop the hub's previous measurement.
+func (s *Server) handleHubRTT(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req api.HubRTTRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.NodeID == "" {
+		writeJSONError(w, http.StatusBadRequest, "node_id is required")
+		return
+	}
+	if !authorizeNode(w, r, req.NodeID) {
+		return
+	}
+
+	s.mu.Lock()
+	m := s.hubRTT[req.NodeID]
+	if m == nil {
+		m = make(map[string]float64)
+		s.hubRTT[req.NodeID] = m
+	}
+	for _, res := range req.Results {
+		if _, ok := s.findHub(res.Hub); !ok {
+			continue
+		}
+		if res.Success {
+			m[res.Hub] = res.RTTMs
+		} else {
+			delete(m, res.Hub)
+		}
+	}
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRelayPeers handles GET /relay/peers?hub=name for `vpnctl relay serve`.
+func (s *Server) handleRelayPeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	hub := r.URL.Query().Get("hub")
+	if cn, ok := peerCN(r); ok && cn != hub {
+		writeJSONError(w, http.StatusForbidden, "hub does not match client certificate")
+		return
+	}
+	if _, ok := s.findHub(hub); !ok || hub == s.cfg.HubName {
+		writeJSONError(w, http.StatusNotFound, "unknown relay hub")
+		return
+	}
+
+	s.mu.Lock()
+	peers := s.hubPeersLocked(hub)
+	rules := s.firewallRulesLocked()
+	s.mu.Unlock()
+
+	resp := api.RelayPeersResponse{Peers: make([]api.RelayPeer, 0, len(peers)), ACL: s.acl != nil}
+	for _, rule := range rules {
+		resp.ACLRules = append(resp.ACLRules, api.ACLRule{Src: prefixStrings(rule.Src), Dst: prefixStrings(rule.Dst)})
+	}
+	for _, p := range peers {
+		resp.Peers = append(resp.Peers, api.RelayPeer{
+			PublicKey:  p.PublicKey,
+			Endpoint:   p.Endpoint,
+			AllowedIPs: p.AllowedIPs,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func prefixStrings(prefixes []netip.Prefix) []string {
+	out := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		out = append(out, p.String())
+	}
+	return out
+}
@@ -0,0 +1,113 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/netip"
+
+	"vpnctl/internal/addrutil"
+	"vpnctl/internal/pki"
+)
+
+// peerKey is the context key under which requireClientCert stores the
+// verified client certificate's identity.
+type peerKey struct{}
+
+// peerIdentity is who a verified client certificate was issued to.
+type peerIdentity struct {
+	CN   string
+	Role string // pki.RoleNode, pki.RoleAdmin, pki.RoleHAPeer or pki.RoleRelay
+}
+
+func withPeer(ctx context.Context, cert *x509.Certificate) context.Context {
+	return context.WithValue(ctx, peerKey{}, peerIdentity{CN: cert.Subject.CommonName, Role: pki.CertRole(cert)})
+}
+
+// peerCN returns the Common Name of the request's verified client
+// certificate. ok is false when mTLS is not in use.
+func peerCN(r *http.Request) (cn string, ok bool) {
+	id, ok := r.Context().Value(peerKey{}).(peerIdentity)
+	return id.CN, ok
+}
+
+// requireNode wraps an agent endpoint. It includes requireClientCert and
+// refuses relay hub and HA peer certificates, which may only call their own
+// endpoints.
+func (s *Server) requireNode(next http.HandlerFunc) http.HandlerFunc {
+	return s.requireClientCert(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := r.Context().Value(peerKey{}).(peerIdentity); ok && (id.Role == pki.RoleRelay || id.Role == pki.RoleHAPeer) {
+			writeJSONError(w, http.StatusForbidden, "node certificate required")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// requireAdmin wraps a handler that only admin certificates may call. It
+// includes requireClientCert. Without mTLS there are no roles and
+// every caller is allowed, as before.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return s.requireRole(pki.RoleAdmin, next)
+}
+
+// requireHAPeer wraps a handler that only the other HA controller may call,
+// with a certificate from `controller ha-cert`. Admin certificates are
+// refused: the replicated state includes the CA key.
+func (s *Server) requireHAPeer(next http.HandlerFunc) http.HandlerFunc {
+	return s.requireRole(pki.RoleHAPeer, next)
+}
+
+// requireRelay wraps a handler that only relay hub certificates may call,
+// with a certificate from `controller relay-cert`.
+func (s *Server) requireRelay(next http.HandlerFunc) http.HandlerFunc {
+	return s.requireRole(pki.RoleRelay, next)
+}
+
+// requireRole wraps a handler that only certificates of role may call. It
+// includes requireClientCert.
+func (s *Server) requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return s.requireClientCert(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := r.Context().Value(peerKey{}).(peerIdentity); ok && id.Role != role {
+			writeJSONError(w, http.StatusForbidden, role+" certificate required")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// authorizeNode reports whether the caller may act as nodeID, writing a 403
+// when it may not. handleBootstrap issues certificates with the node name as
+// CN, and the node ID is the name the node first registered with, so the two
+// must match. Without mTLS every caller is allowed, as before.
+func authorizeNode(w http.ResponseWriter, r *http.Request, nodeID string) bool {
+	cn, ok := peerCN(r)
+	if !ok || cn == nodeID {
+		return true
+	}
+	writeJSONError(w, http.StatusForbidden, "node_id does not match client certificate")
+	return false
+}
+
+// vpnIPOwnerLocked returns the ID of a node holding any address of vpnIP, or
+// "" if none does. Callers hold s.mu.
+func (s *Server) vpnIPOwnerLocked(vpnIP string) string {
+	want := map[netip.Addr]bool{}
+	for _, addr := range addrutil.HostAddrs(vpnIP) {
+		want[addr] = true
+	}
+	if len(want) == 0 {
+		return ""
+	}
+	for _, n := range s.reg.Nodes {
+		for _, addr := range addrutil.HostAddrs(n.VPNIP) {
+			if want[addr] {
+				return n.ID
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,643 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"vpnctl/internal/addrutil"
+	"vpnctl/internal/api"
+	"vpnctl/internal/config"
+	"vpnctl/internal/store"
+)
+
+// Reservation sources reported by GET /admin/ipam.
+const (
+	reservationFromConfig = "config"
+	reservationFromAPI    = "api"
+)
+
+// maxVPNIPScan bounds allocation scans. This controller is intended for
+// small-ish overlays (tens to low thousands of nodes).
+const maxVPNIPScan = 1_048_576
+
+// addrRange is an inclusive range of addresses kept out of allocation.
+type addrRange struct {
+	first, last netip.Addr
+}
+
+func (r addrRange) contains(addr netip.Addr) bool {
+	return r.first.Compare(addr) <= 0 && addr.Compare(r.last) <= 0
+}
+
+func (r addrRange) String() string {
+	if r.first == r.last {
+		return r.first.String()
+	}
+	return r.first.String() + "-" + r.last.String()
+}
+
+// parseAddrRange accepts "first-last", a CIDR or a single address.
+func parseAddrRange(value string) (addrRange, error) {
+	value = strings.TrimSpace(value)
+	if first, last, ok := strings.Cut(value, "-"); ok {
+		a, err := netip.ParseAddr(strings.TrimSpace(first))
+		if err != nil {
+			return addrRange{}, err
+		}
+		b, err := netip.ParseAddr(strings.TrimSpace(last))
+		if err != nil {
+			return addrRange{}, err
+		}
+		if a.Is4() != b.Is4() || b.Less(a) {
+			return addrRange{}, fmt.Errorf("invalid address range %q", value)
+		}
+		return addrRange{first: a, last: b}, nil
+	}
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		prefix = prefix.Masked()
+		return addrRange{first: prefix.Addr(), last: lastAddr(prefix)}, nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return addrRange{}, fmt.Errorf("invalid address range %q", value)
+	}
+	return addrRange{first: addr, last: addr}, nil
+}
+
+// lastAddr returns the highest address in prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Masked().Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// parseReservedRanges parses controller.ipam.reserved.
+func parseReservedRanges(cfg *config.IPAMConfig) ([]addrRange, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	ranges := make([]addrRange, 0, len(cfg.Reserved))
+	for _, value := range cfg.Reserved {
+		r, err := parseAddrRange(value)
+		if err != nil {
+			return nil, fmt.Errorf("controller.ipam.reserved: %w", err)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// addrPool is what allocation has to avoid or honor besides the prefixes
+// themselves.
+type addrPool struct {
+	// used holds addresses of other nodes and addresses reserved for other names.
+	used map[netip.Addr]bool
+	// reserved ranges are never handed out automatically.
+	reserved []addrRange
+	// pinned holds addresses reserved for the node being allocated.
+	pinned []netip.Addr
+}
+
+func (p addrPool) free(addr netip.Addr) bool {
+	if p.used[addr] {
+		return false
+	}
+	for _, r := range p.reserved {
+		if r.contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// allocateVPNIP assigns a fresh address from each prefix in cidr, avoiding
+// every address held in reg. See completeVPNIP.
+func allocateVPNIP(cidr string, reg *store.Registry) (string, error) {
+	pool := addrPool{used: map[netip.Addr]bool{}}
+	for _, node := range reg.Nodes {
+		for _, addr := range addrutil.HostAddrs(node.VPNIP) {
+			pool.used[addr] = true
+		}
+	}
+	return completeVPNIP(cidr, "", pool)
+}
+
+// completeVPNIP returns current extended with a host address from every
+// prefix of the comma-separated cidr (at most one IPv4 and one IPv6 prefix)
+// whose family current does not cover yet, e.g. "10.7.0.2/32,fd7a::2/128".
+// A node that joined before IPv6 was enabled keeps its IPv4 address and only
+// gains the new one; current is returned unchanged when nothing is missing.
+// Pinned addresses are preferred over the first free one.
+func completeVPNIP(cidr, current string, pool addrPool) (string, error) {
+	if cidr == "" {
+		return "", fmt.Errorf("vpn_cidr is required for allocation")
+	}
+	prefixes, err := parseVPNCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+
+	have4, have6 := false, false
+	for _, addr := range addrutil.HostAddrs(current) {
+		if addr.Is4() {
+			have4 = true
+		} else {
+			have6 = true
+		}
+	}
+
+	out := addrutil.SplitList(current)
+	for _, prefix := range prefixes {
+		if (prefix.Addr().Is4() && have4) || (prefix.Addr().Is6() && have6) {
+			continue
+		}
+		addr, err := pinnedOrFreeAddr(prefix, pool)
+		if err != nil {
+			return "", err
+		}
+		out = append(out, netip.PrefixFrom(addr, addr.BitLen()).String())
+	}
+	if len(out) == len(addrutil.SplitList(current)) {
+		return current, nil
+	}
+	return strings.Join(out, ","), nil
+}
+
+// parseVPNCIDR parses controller.vpn_cidr: one IPv4 and/or one IPv6 prefix.
+func parseVPNCIDR(cidr string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range addrutil.SplitList(cidr) {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range prefixes {
+			if p.Addr().Is4() == prefix.Addr().Is4() {
+				return nil, fmt.Errorf("vpn_cidr takes at most one IPv4 and one IPv6 prefix")
+			}
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func pinnedOrFreeAddr(prefix netip.Prefix, pool addrPool) (netip.Addr, error) {
+	for _, addr := range pool.pinned {
+		if prefix.Contains(addr) && !pool.used[addr] {
+			return addr, nil
+		}
+	}
+	return freeHostAddr(prefix, pool)
+}
+
+// freeHostAddr returns the first free address of prefix. The network
+// address is skipped, and for IPv4 the broadcast address as well. IPv6
+// prefixes are scanned up to maxVPNIPScan addresses from the start.
+func freeHostAddr(prefix netip.Prefix, pool addrPool) (netip.Addr, error) {
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if prefix.Addr().Is4() && hostBits > 20 {
+		// Defensive: avoid accidentally iterating millions of addresses due to misconfiguration.
+		return netip.Addr{}, fmt.Errorf("vpn_cidr %s is too large (size=%d)", prefix, 1<<uint(hostBits))
+	}
+	addr := prefix.Addr().Next()
+	for n := 0; n < maxVPNIPScan && addr.IsValid() && prefix.Contains(addr); n++ {
+		next := addr.Next()
+		if prefix.Addr().Is4() && !prefix.Contains(next) {
+			break // broadcast
+		}
+		if pool.free(addr) {
+			return addr, nil
+		}
+		addr = next
+	}
+	return netip.Addr{}, fmt.Errorf("no available vpn_ip in %s", prefix)
+}
+
+// inVPNCIDR reports whether every address of vpnIP is inside cidr.
+func inVPNCIDR(cidr, vpnIP string) (bool, error) {
+	prefixes, err := parseVPNCIDR(cidr)
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrutil.HostAddrs(vpnIP) {
+		inside := false
+		for _, p := range prefixes {
+			inside = inside || p.Contains(addr)
+		}
+		if !inside {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// reservationsLocked returns config reservations followed by API ones, by
+// name. A config entry shadows an API entry for the same name. Callers hold s.mu.
+func (s *Server) reservationsLocked() []api.IPReservation {
+	var out []api.IPReservation
+	seen := map[string]bool{}
+	if s.cfg.IPAM != nil {
+		for _, r := range s.cfg.IPAM.Reservations {
+			if seen[r.Name] {
+				continue
+			}
+			seen[r.Name] = true
+			out = append(out, api.IPReservation{
+				Name:   r.Name,
+				VPNIP:  strings.Join(addrutil.HostPrefixes(r.VPNIP), ","),
+				Source: reservationFromConfig,
+			})
+		}
+	}
+	names := make([]string, 0, len(s.ipReservations))
+	for name := range s.ipReservations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		out = append(out, api.IPReservation{Name: name, VPNIP: s.ipReservations[name], Source: reservationFromAPI})
+	}
+	return out
+}
+
+// reservationOwnerLocked returns the name of a reservation holding any
+// address of vpnIP, ignoring reservations for names. Callers hold s.mu.
+func (s *Server) reservationOwnerLocked(vpnIP string, names ...string) string {
+	want := map[netip.Addr]bool{}
+	for _, addr := range addrutil.HostAddrs(vpnIP) {
+		want[addr] = true
+	}
+	if len(want) == 0 {
+		return ""
+	}
+next:
+	for _, r := range s.reservationsLocked() {
+		for _, name := range names {
+			if r.Name == name {
+				continue next
+			}
+		}
+		for _, addr := range addrutil.HostAddrs(r.VPNIP) {
+			if want[addr] {
+				return r.Name
+			}
+		}
+	}
+	return ""
+}
+
+// assignVPNIPLocked completes current (possibly empty) for the node known as
+// name, honoring reserved ranges and reservations. Callers hold s.mu.
+func (s *Server) assignVPNIPLocked(name, current string) (string, error) {
+	pool := addrPool{used: map[netip.Addr]bool{}, reserved: s.ipamReserved}
+	for _, n := range s.reg.Nodes {
+		if n.ID == name || n.Name == name {
+			continue
+		}
+		for _, addr := range addrutil.HostAddrs(n.VPNIP) {
+			pool.used[addr] = true
+		}
+	}
+	for _, h := range s.cfg.Hubs {
+		for _, addr := range addrutil.HostAddrs(h.Address) {
+			pool.used[addr] = true
+		}
+	}
+	for _, r := range s.reservationsLocked() {
+		for _, addr := range addrutil.HostAddrs(r.VPNIP) {
+			if r.Name == name {
+				pool.pinned = append(pool.pinned, addr)
+			} else {
+				pool.used[addr] = true
+			}
+		}
+	}
+	// Addresses pinned by bootstrap tokens wait for their node.
+	for _, addr := range s.tokenVPNIPs() {
+		pool.used[addr] = true
+	}
+	return completeVPNIP(s.cfg.VPNCIDR, current, pool)
+}
+
+// tokenVPNIPs returns the addresses held for bootstrap tokens that can still
+// enroll their node.
+func (s *Server) tokenVPNIPs() []netip.Addr {
+	if s.tokenStore == nil {
+		return nil
+	}
+	now := time.Now()
+	var addrs []netip.Addr
+	for _, t := range s.tokenStore.List() {
+		if t.VPNIP != "" && !t.Expired(now) && !t.UsedUp() {
+			addrs = append(addrs, addrutil.HostAddrs(t.VPNIP)...)
+		}
+	}
+	return addrs
+}
+
+// vpnIPTakenLocked returns why vpnIP cannot be pinned to a bootstrap token:
+// a node, a reservation, a hub or another token holds one of its addresses.
+// It returns "" when vpnIP is free. Callers hold s.mu.
+func (s *Server) vpnIPTakenLocked(vpnIP string) string {
+	if owner := s.vpnIPOwnerLocked(vpnIP); owner != "" {
+		return "vpn_ip is in use by node " + owner
+	}
+	if other := s.reservationOwnerLocked(vpnIP); other != "" {
+		return "vpn_ip is reserved for " + other
+	}
+	want := map[netip.Addr]bool{}
+	for _, addr := range addrutil.HostAddrs(vpnIP) {
+		want[addr] = true
+	}
+	for _, h := range s.cfg.Hubs {
+		for _, addr := range addrutil.HostAddrs(h.Address) {
+			if want[addr] {
+				return "vpn_ip is the address of hub " + h.Name
+			}
+		}
+	}
+	for _, addr := range s.tokenVPNIPs() {
+		if want[addr] {
+			return "vpn_ip is pinned by another bootstrap token"
+		}
+	}
+	return ""
+}
+
+// reclaimAfter returns controller.ipam.reclaim_after, or 0 when reclaiming is off.
+func (s *Server) reclaimAfter() time.Duration {
+	if s.cfg.IPAM == nil || s.cfg.IPAM.ReclaimAfter == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(s.cfg.IPAM.ReclaimAfter)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// shouldReclaimLocked reports whether n's address is due to be freed:
+// offline for reclaim_after, not disabled and not pinned by a reservation.
+// Callers hold s.mu.
+func (s *Server) shouldReclaimLocked(n store.NodeInfo, now time.Time) bool {
+	after := s.reclaimAfter()
+	if after <= 0 || n.VPNIP == "" || n.Disabled || n.LastSeenAt.IsZero() {
+		return false
+	}
+	if n.Status != store.StatusOffline || now.Sub(n.LastSeenAt) < after {
+		return false
+	}
+	for _, r := range s.reservationsLocked() {
+		if r.Name == n.Name || r.Name == n.ID {
+			return false
+		}
+	}
+	return true
+}
+
+// handleIPAM handles GET /admin/ipam.
+func (s *Server) handleIPAM(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	resp := api.IPAMResponse{
+		Prefixes:     addrutil.SplitList(s.cfg.VPNCIDR),
+		Reserved:     []string{},
+		Reservations: []api.IPReservation{},
+		Allocations:  []api.IPAllocation{},
+	}
+	if s.cfg.IPAM != nil {
+		resp.ReclaimAfter = s.cfg.IPAM.ReclaimAfter
+	}
+	for _, r := range s.ipamReserved {
+		resp.Reserved = append(resp.Reserved, r.String())
+	}
+
+	s.mu.Lock()
+	resp.Reservations = append(resp.Reservations, s.reservationsLocked()...)
+	for _, n := range s.reg.Nodes {
+		if n.VPNIP == "" {
+			continue
+		}
+		lastSeen := ""
+		if !n.LastSeenAt.IsZero() {
+			lastSeen = n.LastSeenAt.UTC().Format(time.RFC3339)
+		}
+		status := n.Status
+		if n.Disabled {
+			status = "disabled"
+		}
+		resp.Allocations = append(resp.Allocations, api.IPAllocation{
+			Name:     n.Name,
+			VPNIP:    n.VPNIP,
+			Status:   status,
+			LastSeen: lastSeen,
+		})
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleIPAMReserve handles POST /admin/ipam/reserve. Without vpn_ip the
+// node's current address is pinned, or the next free one when the name has
+// none. A reservation for a node that already holds a different address
+// takes effect once that address is released or reclaimed.
+func (s *Server) handleIPAMReserve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req api.ReserveIPRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Name == "" {
+		writeJSONError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, res := range s.reservationsLocked() {
+		if res.Name == req.Name && res.Source == reservationFromConfig {
+			writeJSONError(w, http.StatusConflict, "reservation is defined in config")
+			return
+		}
+	}
+
+	vpnIP := strings.Join(addrutil.HostPrefixes(req.VPNIP), ",")
+	switch {
+	case req.VPNIP != "" && vpnIP == "":
+		writeJSONError(w, http.StatusBadRequest, "invalid vpn_ip")
+		return
+	case vpnIP == "":
+		current := ""
+		if i := s.findNodeLocked(req.Name); i >= 0 {
+			current = s.reg.Nodes[i].VPNIP
+		}
+		assigned, err := s.assignVPNIPLocked(req.Name, current)
+		if err != nil {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		vpnIP = assigned
+	default:
+		inside, err := inVPNCIDR(s.cfg.VPNCIDR, vpnIP)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !inside {
+			writeJSONError(w, http.StatusBadRequest, "vpn_ip is outside vpn_cidr")
+			return
+		}
+		nodeID := ""
+		if i := s.findNodeLocked(req.Name); i >= 0 {
+			nodeID = s.reg.Nodes[i].ID
+		}
+		if owner := s.vpnIPOwnerLocked(vpnIP); owner != "" && owner != nodeID {
+			writeJSONError(w, http.StatusConflict, "vpn_ip is in use by node "+owner)
+			return
+		}
+		if other := s.reservationOwnerLocked(vpnIP, req.Name, nodeID); other != "" {
+			writeJSONError(w, http.StatusConflict, "vpn_ip is reserved for "+other)
+			return
+		}
+	}
+
+	err := s.db.Update(func(tx store.Tx) error {
+		return tx.PutIPReservation(store.IPReservation{Name: req.Name, VPNIP: vpnIP})
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if s.ipReservations == nil {
+		s.ipReservations = make(map[string]string)
+	}
+	s.ipReservations[req.Name] = vpnIP
+
+	slog.Info("vpn ip reserved", "name", req.Name, "vpn_ip", vpnIP)
+	writeJSON(w, http.StatusOK, api.IPReservation{Name: req.Name, VPNIP: vpnIP, Source: reservationFromAPI})
+}
+
+// handleIPAMRelease handles POST /admin/ipam/release. By name it drops an
+// API reservation; by vpn_ip it drops the reservation holding the address
+// or, failing that, frees it from an offline node.
+func (s *Server) handleIPAMRelease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req api.ReleaseIPRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if (req.Name == "") == (req.VPNIP == "") {
+		writeJSONError(w, http.StatusBadRequest, "exactly one of name and vpn_ip is required")
+		return
+	}
+
+	s.mu.Lock()
+	name := req.Name
+	if name == "" {
+		name = s.reservationOwnerLocked(req.VPNIP)
+	}
+	if name != "" {
+		s.releaseReservationLocked(w, name)
+		s.mu.Unlock()
+		return
+	}
+
+	i := -1
+	if owner := s.vpnIPOwnerLocked(req.VPNIP); owner != "" {
+		for j := range s.reg.Nodes {
+			if s.reg.Nodes[j].ID == owner {
+				i = j
+				break
+			}
+		}
+	}
+	if i < 0 {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusNotFound, "vpn_ip is not allocated")
+		return
+	}
+	node := s.reg.Nodes[i]
+	if node.Status != store.StatusOffline {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusConflict, "vpn_ip is in use by "+node.Status+" node "+node.Name)
+		return
+	}
+	prev := node
+	node.VPNIP = ""
+	if err := s.saveNodeLocked(node); err != nil {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.reg.Nodes[i] = node
+	s.publishNodeChange(prev, true, node)
+
+	autoApply := s.cfg.WGApply
+	peers := s.peersForWGLocked()
+	s.mu.Unlock()
+
+	slog.Info("vpn ip released", "node", node.Name, "vpn_ip", prev.VPNIP)
+
+	if autoApply {
+		if err := s.applyWG(peers); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// releaseReservationLocked deletes the API reservation for name and writes
+// the response. Callers hold s.mu.
+func (s *Server) releaseReservationLocked(w http.ResponseWriter, name string) {
+	for _, res := range s.reservationsLocked() {
+		if res.Name != name {
+			continue
+		}
+		if res.Source == reservationFromConfig {
+			writeJSONError(w, http.StatusConflict, "reservation is defined in config")
+			return
+		}
+		err := s.db.Update(func(tx store.Tx) error {
+			return tx.DeleteIPReservation(name)
+		})
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		delete(s.ipReservations, name)
+		slog.Info("vpn ip reservation released", "name", name, "vpn_ip", res.VPNIP)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSONError(w, http.StatusNotFound, "reservation not found")
+}
@@ -0,0 +1,70 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"time"
+)
+
+// linkStat is the latest measurement a node reported towards one peer.
+type linkStat struct {
+	Path      string // direct|relay, as reported by the node
+	RTTMs     float64
+	LossPct   float64
+	UpdatedAt time.Time
+}
+
+// linkStatTTL is how long a link measurement stays relevant for /fleet/status.
+const linkStatTTL = 5 * time.Minute
+
+// recordLinkLocked stores the latest measurement from nodeID towards peerID,
+// ignoring samples older than what is already stored. Callers hold s.mu.
+func (s *Server) recordLinkLocked(nodeID, peerID string, stat linkStat) {
+	if nodeID == "" || peerID == "" {
+		return
+	}
+	if s.links == nil {
+		s.links = make(map[string]map[string]linkStat)
+	}
+	m := s.links[nodeID]
+	if m == nil {
+		m = make(map[string]linkStat)
+		s.links[nodeID] = m
+	}
+	if prev, ok := m[peerID]; ok && prev.UpdatedAt.After(stat.UpdatedAt) {
+		return
+	}
+	m[peerID] = stat
+}
+
+// nodeLinkLocked summarizes a node's current link state across its peers.
+// Path is "direct" when at least one peer pair is P2P-ready and "relay"
+// otherwise. RTT averages successful measurements; loss averages all recent
+// measurements. Callers hold s.mu.
+func (s *Server) nodeLinkLocked(nodeID string, now time.Time) (path string, rttMs, lossPct float64, ok bool) {
+	path = "relay"
+	var rttSum, lossSum float64
+	var rttN, lossN int
+	for peerID, stat := range s.links[nodeID] {
+		if now.Sub(stat.UpdatedAt) > linkStatTTL {
+			continue
+		}
+		if s.p2pReadyLocked(nodeID, peerID) {
+			path = "direct"
+		}
+		if stat.RTTMs > 0 {
+			rttSum += stat.RTTMs
+			rttN++
+		}
+		lossSum += stat.LossPct
+		lossN++
+	}
+	if lossN == 0 {
+		return path, 0, 0, false
+	}
+	if rttN > 0 {
+		rttMs = rttSum / float64(rttN)
+	}
+	return path, rttMs, lossSum / float64(lossN), true
+}
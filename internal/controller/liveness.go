@@ -0,0 +1,137 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"log/slog"
+	"time"
+
+	"vpnctl/internal/config"
+	"vpnctl/internal/store"
+)
+
+// livenessStatus returns the state a node should be in given when it was last seen.
+func livenessStatus(cfg config.ControllerConfig, lastSeen, now time.Time) string {
+	staleAfter := time.Duration(cfg.NodeStaleAfterSec) * time.Second
+	if staleAfter <= 0 {
+		staleAfter = config.DefaultNodeStaleAfterSec * time.Second
+	}
+	offlineAfter := time.Duration(cfg.NodeOfflineAfterSec) * time.Second
+	if offlineAfter <= 0 {
+		offlineAfter = config.DefaultNodeOfflineAfterSec * time.Second
+	}
+
+	if lastSeen.IsZero() {
+		return store.StatusOffline
+	}
+	age := now.Sub(lastSeen)
+	switch {
+	case age >= offlineAfter:
+		return store.StatusOffline
+	case age >= staleAfter:
+		return store.StatusStale
+	default:
+		return store.StatusOnline
+	}
+}
+
+// reapOnce removes ephemeral nodes gone for ephemeral_remove_after_sec,
+// moves nodes between online, stale and offline based on LastSeenAt, frees
+// the VPN IPs of nodes offline past controller.ipam.reclaim_after, and
+// persists the liveness changes in a single transaction.
+func (s *Server) reapOnce(now time.Time) error {
+	s.mu.Lock()
+	removed, err := s.removeExpiredLocked(now)
+	var changed []store.NodeInfo
+	reclaimed := false
+	for i := range s.reg.Nodes {
+		n := &s.reg.Nodes[i]
+		prev := *n
+		if next := livenessStatus(s.cfg, n.LastSeenAt, now); next != n.Status {
+			slog.Info("node liveness changed", "node", n.Name, "from", n.Status, "to", next, "last_seen", n.LastSeenAt)
+			n.Status = next
+		}
+		if s.shouldReclaimLocked(*n, now) {
+			slog.Info("vpn ip reclaimed", "node", n.Name, "vpn_ip", n.VPNIP, "last_seen", n.LastSeenAt)
+			n.VPNIP = ""
+			reclaimed = true
+		}
+		if n.Status == prev.Status && n.VPNIP == prev.VPNIP {
+			continue
+		}
+		changed = append(changed, *n)
+		s.publishNodeChange(prev, true, *n)
+	}
+	// Readiness also expires with time, not only on new probe results.
+	s.p2pTransitionsLocked()
+	if len(changed) > 0 {
+		updateErr := s.db.Update(func(tx store.Tx) error {
+			for _, n := range changed {
+				if err := tx.PutNode(n); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err == nil {
+			err = updateErr
+		}
+	}
+	autoApply := s.cfg.WGApply && (reclaimed || removed)
+	peers := s.peersForWGLocked()
+	s.mu.Unlock()
+
+	if len(changed) > 0 || removed {
+		s.updateMetrics()
+	}
+	if autoApply {
+		if applyErr := s.applyWG(peers); applyErr != nil && err == nil {
+			err = applyErr
+		}
+	}
+	// Freed addresses must lose their node's ACL rules before they are
+	// handed out again.
+	if removed || reclaimed {
+		if syncErr := s.syncFirewall(); syncErr != nil && err == nil {
+			err = syncErr
+		}
+	}
+	return err
+}
+
+// startLiveness runs reapOnce every LivenessIntervalSec until stopLiveness is called.
+func (s *Server) startLiveness() {
+	interval := time.Duration(s.cfg.LivenessIntervalSec) * time.Second
+	if interval <= 0 {
+		interval = config.DefaultLivenessIntervalSec * time.Second
+	}
+	stop := make(chan struct{})
+	s.livenessStop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				if err := s.reapOnce(now.UTC()); err != nil {
+					slog.Warn("liveness update failed", "err", err)
+				}
+				if err := s.retireCA(now.UTC()); err != nil {
+					slog.Warn("retire previous CA failed", "err", err)
+				}
+			}
+		}
+	}()
+}
+
+// stopLiveness stops the liveness loop if running.
+func (s *Server) stopLiveness() {
+	if s.livenessStop != nil {
+		close(s.livenessStop)
+		s.livenessStop = nil
+	}
+}
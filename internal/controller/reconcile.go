@@ -0,0 +1,164 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"log/slog"
+	"net/netip"
+	"slices"
+	"time"
+
+	"vpnctl/internal/config"
+	"vpnctl/internal/metrics"
+	"vpnctl/internal/wireguard"
+)
+
+// hubDrift is the difference between the hub's WireGuard peers and the
+// registry: peers to add, peers whose AllowedIPs to replace, and public keys
+// to remove.
+type hubDrift struct {
+	add    []wireguard.Peer
+	update []wireguard.Peer
+	remove []string
+}
+
+func (d hubDrift) empty() bool {
+	return len(d.add) == 0 && len(d.update) == 0 && len(d.remove) == 0
+}
+
+// diffHubPeers compares the desired peers with the ones on the interface.
+// AllowedIPs are compared as sets of normalized prefixes.
+func diffHubPeers(desired []wireguard.Peer, actual map[string]wireguard.Peer) hubDrift {
+	var d hubDrift
+	want := make(map[string]bool, len(desired))
+	for _, peer := range desired {
+		want[peer.PublicKey] = true
+		have, ok := actual[peer.PublicKey]
+		switch {
+		case !ok:
+			d.add = append(d.add, peer)
+		case !slices.Equal(normalizePrefixes(peer.AllowedIPs), normalizePrefixes(have.AllowedIPs)):
+			d.update = append(d.update, peer)
+		}
+	}
+	for key := range actual {
+		if !want[key] {
+			d.remove = append(d.remove, key)
+		}
+	}
+	slices.Sort(d.remove)
+	return d
+}
+
+func normalizePrefixes(values []string) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if p, err := netip.ParsePrefix(v); err == nil {
+			v = p.Masked().String()
+		}
+		out = append(out, v)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// reconcileOnce repairs drift between the hub interface and the registry,
+// e.g. after a manual `wg set`. Only differing peers are touched. A missing
+// or recreated interface (wrong private key or port) is re-applied in full.
+func (s *Server) reconcileOnce() error {
+	if !s.cfg.WGApply || s.wg == nil {
+		return nil
+	}
+	// Replacing the ACL table is atomic and idempotent, so it is simply
+	// re-applied each pass.
+	if err := s.syncFirewall(); err != nil {
+		return err
+	}
+
+	dump, err := s.wg.Dump(s.cfg.WGInterface)
+	if err != nil || dump.PrivateKey != s.cfg.WGPrivateKey || (s.cfg.WGPort > 0 && dump.ListenPort != s.cfg.WGPort) {
+		slog.Warn("hub interface out of sync, re-applying", "iface", s.cfg.WGInterface, "err", err)
+		s.mu.Lock()
+		peers := s.peersForWGLocked()
+		s.mu.Unlock()
+		metrics.HubPeerRepairsTotal.WithLabelValues("reapply").Inc()
+		return s.applyWG(peers)
+	}
+
+	// Diff and repair under mu so the changes match the registry as it is
+	// now; a handler that changes it afterwards applies its own snapshot.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	drift := diffHubPeers(s.peersForWGLocked(), dump.Peers)
+	metrics.HubPeerDrift.WithLabelValues("missing").Set(float64(len(drift.add)))
+	metrics.HubPeerDrift.WithLabelValues("mismatched").Set(float64(len(drift.update)))
+	metrics.HubPeerDrift.WithLabelValues("unexpected").Set(float64(len(drift.remove)))
+	if drift.empty() {
+		return nil
+	}
+
+	iface := s.cfg.WGInterface
+	for _, peer := range drift.add {
+		if err := s.wg.SetPeer(iface, peer); err != nil {
+			return err
+		}
+		metrics.HubPeerRepairsTotal.WithLabelValues("add").Inc()
+		slog.Info("hub peer added", "pub_key", peer.PublicKey, "allowed_ips", peer.AllowedIPs)
+	}
+	for _, peer := range drift.update {
+		if err := s.wg.SetPeer(iface, peer); err != nil {
+			return err
+		}
+		metrics.HubPeerRepairsTotal.WithLabelValues("update").Inc()
+		slog.Info("hub peer allowed ips repaired", "pub_key", peer.PublicKey, "allowed_ips", peer.AllowedIPs)
+	}
+	for _, key := range drift.remove {
+		if err := s.wg.RemovePeer(iface, key); err != nil {
+			return err
+		}
+		metrics.HubPeerRepairsTotal.WithLabelValues("remove").Inc()
+		slog.Info("hub peer removed", "pub_key", key)
+	}
+	return nil
+}
+
+// startReconciler runs reconcileOnce every ReconcileIntervalSec until
+// stopReconciler is called.
+func (s *Server) startReconciler() {
+	interval := time.Duration(s.cfg.ReconcileIntervalSec) * time.Second
+	if interval <= 0 {
+		interval = config.DefaultReconcileIntervalSec * time.Second
+	}
+	stop := make(chan struct{})
+	s.reconcileStop = stop
+
+	go func() {
+		// Enforce the ACL policy right away instead of after the first interval.
+		if err := s.syncFirewall(); err != nil {
+			slog.Warn("hub firewall apply failed", "err", err)
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := s.reconcileOnce(); err != nil {
+					metrics.HubReconcileErrorsTotal.Inc()
+					slog.Warn("hub reconcile failed", "err", err)
+				}
+			}
+		}
+	}()
+}
+
+// stopReconciler stops the reconcile loop if running.
+func (s *Server) stopReconciler() {
+	if s.reconcileStop != nil {
+		close(s.reconcileStop)
+		s.reconcileStop = nil
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"log/slog"
+	"net/http"
+
+	"vpnctl/internal/api"
+)
+
+// handleRotateKey handles POST /rotate-key. The new key is stored as pending
+// and added to the hub without AllowedIPs, so the node can handshake on it
+// while the current key keeps carrying traffic on the hub and P2P peers.
+func (s *Server) handleRotateKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req api.RotateKeyRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Name == "" || req.PubKey == "" {
+		writeJSONError(w, http.StatusBadRequest, "name and pub_key are required")
+		return
+	}
+	if !authorizeNode(w, r, req.Name) {
+		return
+	}
+
+	s.mu.Lock()
+	i, status, msg := s.rotatingNodeLocked(r, req.Name)
+	if i < 0 {
+		s.mu.Unlock()
+		writeJSONError(w, status, msg)
+		return
+	}
+	node := s.reg.Nodes[i]
+	if req.PubKey == node.PubKey {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusConflict, "pub_key is already the active key")
+		return
+	}
+	for _, n := range s.reg.Nodes {
+		if n.ID != node.ID && (n.PubKey == req.PubKey || n.PendingPubKey == req.PubKey) {
+			s.mu.Unlock()
+			writeJSONError(w, http.StatusConflict, "pub_key belongs to another node")
+			return
+		}
+	}
+	node.PendingPubKey = req.PubKey
+	if err := s.saveNodeLocked(node); err != nil {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.reg.Nodes[i] = node
+
+	autoApply := s.cfg.WGApply
+	peers := s.peersForWGLocked()
+	s.mu.Unlock()
+
+	slog.Info("node key rotation started", "node", node.Name, "pending_pub_key", node.PendingPubKey)
+
+	if autoApply {
+		if err := s.applyWG(peers); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleConfirmKey handles POST /rotate-key/confirm. When the controller
+// manages the hub interface, it checks that the hub has seen a handshake on
+// the pending key. The pending key then replaces the old one, which is
+// dropped from the hub and, through the endpoint_changed event, from P2P
+// peers.
+func (s *Server) handleConfirmKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req api.RotateKeyRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Name == "" || req.PubKey == "" {
+		writeJSONError(w, http.StatusBadRequest, "name and pub_key are required")
+		return
+	}
+	if !authorizeNode(w, r, req.Name) {
+		return
+	}
+
+	if s.cfg.WGApply && s.wg != nil {
+		handshakes, err := s.wg.PeerHandshakes(s.cfg.WGInterface)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if handshakes[req.PubKey].IsZero() {
+			writeJSONError(w, http.StatusConflict, "hub has not seen a handshake on the new key yet")
+			return
+		}
+	}
+
+	s.mu.Lock()
+	i, status, msg := s.rotatingNodeLocked(r, req.Name)
+	if i < 0 {
+		s.mu.Unlock()
+		writeJSONError(w, status, msg)
+		return
+	}
+	prev := s.reg.Nodes[i]
+	if prev.PendingPubKey == "" || prev.PendingPubKey != req.PubKey {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusConflict, "pub_key is not pending for this node")
+		return
+	}
+	node := prev
+	node.PubKey = node.PendingPubKey
+	node.PendingPubKey = ""
+	if err := s.saveNodeLocked(node); err != nil {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.reg.Nodes[i] = node
+	s.publishNodeChange(prev, true, node)
+
+	autoApply := s.cfg.WGApply
+	peers := s.peersForWGLocked()
+	s.mu.Unlock()
+
+	slog.Info("node key rotated", "node", node.Name, "pub_key", node.PubKey, "retired", prev.PubKey)
+
+	if autoApply {
+		if err := s.applyWG(peers); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rotatingNodeLocked returns the index of the node allowed to rotate its key
+// under name, or -1 with the HTTP status and message to reply with. Callers
+// hold s.mu.
+func (s *Server) rotatingNodeLocked(r *http.Request, name string) (int, int, string) {
+	i := s.findNodeLocked(name)
+	if i < 0 {
+		return -1, http.StatusNotFound, "node not found"
+	}
+	if s.reg.Nodes[i].Disabled {
+		return -1, http.StatusForbidden, "node disabled"
+	}
+	if _, authenticated := peerCN(r); authenticated && s.reg.Nodes[i].ID != name {
+		return -1, http.StatusForbidden, "name belongs to another node"
+	}
+	return i, 0, ""
+}
@@ -0,0 +1,212 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"vpnctl/internal/addrutil"
+	"vpnctl/internal/api"
+	"vpnctl/internal/store"
+)
+
+// activeRoutes returns n's subnet routes in use: approved and still
+// advertised.
+func activeRoutes(n store.NodeInfo) []string {
+	var out []string
+	for _, r := range n.ApprovedRoutes {
+		if slices.Contains(n.AdvertisedRoutes, r) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// nodePrefixes returns n's VPN addresses as host prefixes plus its active
+// subnet routes.
+func nodePrefixes(n store.NodeInfo) []netip.Prefix {
+	var out []netip.Prefix
+	for _, a := range addrutil.HostAddrs(n.VPNIP) {
+		out = append(out, netip.PrefixFrom(a, a.BitLen()))
+	}
+	for _, r := range activeRoutes(n) {
+		if p, err := netip.ParsePrefix(r); err == nil {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// normalizeRoutes parses advertised routes into masked prefix strings.
+func normalizeRoutes(values []string) ([]string, error) {
+	var out []string
+	for _, v := range values {
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %q", v)
+		}
+		if s := p.Masked().String(); !slices.Contains(out, s) {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// routeConflictLocked describes why route cannot be used by the node with
+// nodeID, or returns "". Routes must not overlap the overlay or another
+// node's approved routes. Callers hold s.mu.
+func (s *Server) routeConflictLocked(nodeID, route string) string {
+	p, err := netip.ParsePrefix(route)
+	if err != nil {
+		return "invalid route"
+	}
+	if p.Bits() == 0 {
+		return "default routes are not subnet routes (use an exit node)"
+	}
+	overlay, _ := parseVPNCIDR(s.cfg.VPNCIDR)
+	for _, h := range s.hubs() {
+		for _, a := range addrutil.HostAddrs(h.Address) {
+			overlay = append(overlay, netip.PrefixFrom(a, a.BitLen()))
+		}
+	}
+	for _, o := range overlay {
+		if o.Overlaps(p) {
+			return "overlaps the VPN address range " + o.String()
+		}
+	}
+	for _, n := range s.reg.Nodes {
+		if n.ID == nodeID {
+			continue
+		}
+		for _, r := range n.ApprovedRoutes {
+			if q, err := netip.ParsePrefix(r); err == nil && q.Overlaps(p) {
+				return fmt.Sprintf("overlaps %s of node %s", r, n.Name)
+			}
+		}
+	}
+	return ""
+}
+
+// handleRoutes handles GET /admin/routes: every advertised or approved
+// subnet route with its state.
+func (s *Server) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	resp := api.RoutesResponse{Routes: []api.RouteStatus{}}
+	s.mu.Lock()
+	for _, n := range s.reg.Nodes {
+		routes := slices.Clone(n.AdvertisedRoutes)
+		for _, route := range n.ApprovedRoutes {
+			if !slices.Contains(routes, route) {
+				routes = append(routes, route)
+			}
+		}
+		for _, route := range routes {
+			st := api.RouteStatus{
+				Node:       n.Name,
+				Route:      route,
+				Advertised: slices.Contains(n.AdvertisedRoutes, route),
+				Approved:   slices.Contains(n.ApprovedRoutes, route),
+			}
+			if !st.Approved {
+				st.Conflict = s.routeConflictLocked(n.ID, route)
+			}
+			resp.Routes = append(resp.Routes, st)
+		}
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleApproveRoute handles POST /admin/routes/approve. Only advertised,
+// conflict-free routes can be approved; withdrawing an approval always
+// succeeds.
+func (s *Server) handleApproveRoute(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req api.ApproveRouteRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Name == "" || req.Route == "" {
+		writeJSONError(w, http.StatusBadRequest, "name and route are required")
+		return
+	}
+	routes, err := normalizeRoutes([]string{req.Route})
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	route := routes[0]
+
+	s.mu.Lock()
+	i := s.findNodeLocked(req.Name)
+	if i < 0 {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	node := s.reg.Nodes[i]
+	if slices.Contains(node.ApprovedRoutes, route) == req.Approve {
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if req.Approve {
+		if !slices.Contains(node.AdvertisedRoutes, route) {
+			s.mu.Unlock()
+			writeJSONError(w, http.StatusBadRequest, "route is not advertised by the node")
+			return
+		}
+		if conflict := s.routeConflictLocked(node.ID, route); conflict != "" {
+			s.mu.Unlock()
+			writeJSONError(w, http.StatusConflict, "route "+conflict)
+			return
+		}
+		node.ApprovedRoutes = append(slices.Clone(node.ApprovedRoutes), route)
+	} else {
+		node.ApprovedRoutes = slices.DeleteFunc(slices.Clone(node.ApprovedRoutes), func(r string) bool { return r == route })
+		if len(node.ApprovedRoutes) == 0 {
+			node.ApprovedRoutes = nil
+		}
+	}
+	if err := s.saveNodeLocked(node); err != nil {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.reg.Nodes[i] = node
+	// Other nodes pick the route up from their candidates.
+	s.events.publish(api.Event{Type: api.EventRoutesChanged, NodeID: node.ID})
+
+	autoApply := s.cfg.WGApply
+	peers := s.peersForWGLocked()
+	s.mu.Unlock()
+
+	slog.Info("subnet route approval changed", "node", node.Name, "route", route, "approved", req.Approve)
+
+	if autoApply {
+		if err := s.applyWG(peers); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if err := s.syncFirewall(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -6,15 +6,17 @@ package controller
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
-	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -23,6 +25,7 @@ import (
 	"vpnctl/internal/config"
 	"vpnctl/internal/direct"
 	"vpnctl/internal/metrics"
+	"vpnctl/internal/monitor"
 	"vpnctl/internal/pki"
 	"vpnctl/internal/statuspage"
 	"vpnctl/internal/store"
@@ -31,54 +34,190 @@ import (
 
 // Server provides the controller HTTP API.
 type Server struct {
-	cfg     config.ControllerConfig
-	regPath string
-	mu      sync.Mutex
-	reg     *store.Registry
+	cfg config.ControllerConfig
+	// db is the durable copy of the registry; reg is an in-memory cache of it
+	// guarded by mu. Every mutation of reg must be written through to db.
+	db  store.Backend
+	mu  sync.Mutex
+	reg *store.Registry
 	// metricsMu serializes appends to the metrics CSV to avoid interleaved writes
 	// when multiple nodes submit samples concurrently.
 	metricsMu sync.Mutex
-	wg        *wireguard.Manager
+	// lastHistoryPrune is when old metric buckets were last deleted (guarded by metricsMu).
+	lastHistoryPrune time.Time
+	wg               *wireguard.Manager
 	// directOK tracks recent direct probe successes reported by nodes.
 	// Used to gate P2P WireGuard /32 injection so relay doesn't get blackholed.
-	directOK       map[string]map[string]time.Time // node_id -> peer_id -> last success
+	directOK map[string]map[string]time.Time // node_id -> peer_id -> last success
+	// links holds the latest measurement each node reported towards each peer,
+	// from /metrics and /direct-result. Guarded by mu.
+	links map[string]map[string]linkStat // node_id -> peer_id -> latest
+	// readyPairs is the set of P2P-ready pairs as of the last
+	// p2pTransitionsLocked call, used to detect flips. Guarded by mu.
+	readyPairs map[[2]string]bool
+	events     *eventHub
+	// certRevocations maps a client certificate CN to the time before which
+	// certificates issued to it are rejected. Guarded by mu.
+	certRevocations map[string]time.Time
+	// ipReservations maps a node name to the VPN IP reserved for it through
+	// the admin API; config reservations live in cfg.IPAM. Guarded by mu.
+	ipReservations map[string]string
+	// ipamReserved are the parsed controller.ipam.reserved ranges.
+	ipamReserved []addrRange
+	// hubRTT holds each node's latest RTT (ms) to each relay hub it could
+	// reach, from /hub-rtt. Guarded by mu.
+	hubRTT map[string]map[string]float64
+	// acl is the policy from cfg.ACLFile; nil allows all traffic.
+	acl            *config.ACLPolicy
 	probeResponder *direct.Responder
+	livenessStop   chan struct{}
+	reconcileStop  chan struct{}
 	tokenStore     *pki.TokenStore
 	pkiDir         string
+	// revoked lists client certificates revoked by serial; see certs.go.
+	revoked *pki.RevocationList
+	// tlsConfig is the server TLS config, replaced when the CA rotates.
+	tlsConfig atomic.Pointer[tls.Config]
+	// standby is set while this controller is the HA standby; see ha.go.
+	standby atomic.Bool
+	// peer is the client for the other HA controller. haSynced and
+	// haLastHeartbeat are only touched by PrepareHA and the HA loop.
+	peer            *api.Client
+	haSynced        bool
+	haLastHeartbeat time.Time
+	haStop          chan struct{}
+	haDone          chan struct{}
+	// haEpoch is raised on every takeover and learned from the active; see
+	// haPeerTookOver.
+	haEpoch atomic.Uint64
+}
+
+// OpenStore opens the controller database under dataDir, importing a legacy
+// registry.yaml the first time it is found.
+func OpenStore(dataDir string) (store.Backend, error) {
+	if dataDir != "" {
+		if err := os.MkdirAll(dataDir, 0o755); err != nil {
+			return nil, fmt.Errorf("create data dir: %w", err)
+		}
+	}
+	db, err := store.OpenSQLite(filepath.Join(dataDir, "controller.db"))
+	if err != nil {
+		return nil, err
+	}
+	n, err := store.MigrateRegistry(db, filepath.Join(dataDir, "registry.yaml"))
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("migrate registry.yaml: %w", err)
+	}
+	if n > 0 {
+		slog.Info("migrated registry.yaml into controller database", "nodes", n)
+	}
+	return db, nil
 }
 
 // NewServer constructs a controller server.
 func NewServer(cfg config.ControllerConfig) (*Server, error) {
-	regPath := filepath.Join(cfg.DataDir, "registry.yaml")
-	reg, err := store.LoadRegistry(regPath)
+	db, err := OpenStore(cfg.DataDir)
 	if err != nil {
 		return nil, err
 	}
-	// Backward/forward compatibility: older registries might not have IDs.
-	// Keep IDs stable so callers can consistently use node_id.
-	changed := false
-	for i := range reg.Nodes {
-		if reg.Nodes[i].ID == "" && reg.Nodes[i].Name != "" {
-			reg.Nodes[i].ID = reg.Nodes[i].Name
-			changed = true
-		}
-		if reg.Nodes[i].Name == "" && reg.Nodes[i].ID != "" {
-			reg.Nodes[i].Name = reg.Nodes[i].ID
-			changed = true
-		}
+	nodes, err := db.Nodes()
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	directOK, err := loadDirectOK(db)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	revocations, err := db.CertRevocations()
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	reserved, err := parseReservedRanges(cfg.IPAM)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	stored, err := db.IPReservations()
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	reservations := make(map[string]string, len(stored))
+	for _, r := range stored {
+		reservations[r.Name] = r.VPNIP
 	}
-	if changed {
-		if err := store.SaveRegistry(regPath, reg); err != nil {
+	var acl *config.ACLPolicy
+	if cfg.ACLFile != "" {
+		if acl, err = config.LoadACLPolicy(cfg.ACLFile); err != nil {
+			_ = db.Close()
 			return nil, err
 		}
 	}
-	return &Server{
-		cfg:      cfg,
-		regPath:  regPath,
-		reg:      reg,
-		wg:       wireguard.DefaultManager(),
-		directOK: make(map[string]map[string]time.Time),
-	}, nil
+	s := &Server{
+		cfg:             cfg,
+		db:              db,
+		reg:             &store.Registry{Nodes: nodes},
+		wg:              wireguard.DefaultManager(),
+		directOK:        directOK,
+		links:           make(map[string]map[string]linkStat),
+		events:          newEventHub(),
+		certRevocations: revocations,
+		ipReservations:  reservations,
+		ipamReserved:    reserved,
+		hubRTT:          make(map[string]map[string]float64),
+		acl:             acl,
+	}
+	// Seed readyPairs so restored readiness isn't reported as a transition.
+	s.mu.Lock()
+	s.p2pTransitionsLocked()
+	s.mu.Unlock()
+	return s, nil
+}
+
+// loadDirectOK rebuilds the directOK map from persisted probe results so P2P
+// readiness survives a controller restart. Stale entries are kept as-is;
+// p2pReadyLocked applies the TTL.
+func loadDirectOK(db store.Backend) (map[string]map[string]time.Time, error) {
+	results, err := db.DirectResults()
+	if err != nil {
+		return nil, err
+	}
+	directOK := make(map[string]map[string]time.Time)
+	for _, r := range results {
+		if r.LastSuccessAt.IsZero() {
+			continue
+		}
+		m := directOK[r.NodeID]
+		if m == nil {
+			m = make(map[string]time.Time)
+			directOK[r.NodeID] = m
+		}
+		m[r.PeerID] = r.LastSuccessAt
+	}
+	return directOK, nil
+}
+
+// Close releases the controller database.
+func (s *Server) Close() error {
+	s.stopHA()
+	s.StopProbeResponder()
+	s.stopLiveness()
+	s.stopReconciler()
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// saveNodeLocked writes a single node through to the database. Callers hold s.mu.
+func (s *Server) saveNodeLocked(node store.NodeInfo) error {
+	return s.db.Update(func(tx store.Tx) error {
+		return tx.PutNode(node)
+	})
 }
 
 // InitPKI initialises the PKI directory, generates the CA and server certificate
@@ -105,20 +244,20 @@ func (s *Server) InitPKI() (string, error) {
 		if err != nil {
 			return "", fmt.Errorf("parse ca_expiry: %w", err)
 		}
-		if err := pki.GenerateCA(caKeyPath, caCertPath, caExpiry); err != nil {
+		if err := pki.GenerateCA(caKeyPath, caCertPath, caExpiry, s.cfg.PKI.KeyAlgorithm); err != nil {
 			return "", fmt.Errorf("generate CA: %w", err)
 		}
-		slog.Info("generated CA certificate", "path", caCertPath)
+		slog.Info("generated CA certificate", "path", caCertPath, "key_algorithm", s.cfg.PKI.KeyAlgorithm)
+	} else if ca, err := pki.LoadCert(caCertPath); err == nil {
+		// An existing CA keeps its key; `controller ca rotate` switches it.
+		if alg := pki.KeyAlgorithmOf(ca.PublicKey); s.cfg.PKI.KeyAlgorithm != "" && alg != s.cfg.PKI.KeyAlgorithm {
+			slog.Warn("CA key algorithm differs from pki.key_algorithm; rotate the CA to switch its key", "ca", alg, "configured", s.cfg.PKI.KeyAlgorithm)
+		}
 	}
 
-	serverKeyPath := filepath.Join(pkiDir, "server.key")
 	serverCertPath := filepath.Join(pkiDir, "server.crt")
 
-	// Determine desired SANs: explicit config takes precedence; otherwise derive from listen addr.
-	desiredSANs := s.cfg.PKI.ServerSANs
-	if len(desiredSANs) == 0 {
-		desiredSANs = extractSANs(s.cfg.Listen)
-	}
+	desiredSANs := s.serverSANs()
 
 	// Generate server cert if missing, or regenerate if existing SANs don't match desired.
 	regenerate := false
@@ -132,38 +271,96 @@ func (s *Server) InitPKI() (string, error) {
 		} else if !sansEqual(pki.CertSANs(existing), desiredSANs) {
 			slog.Info("server cert SANs changed, regenerating", "existing", pki.CertSANs(existing), "desired", desiredSANs)
 			regenerate = true
+		} else if ca, err := pki.LoadCert(caCertPath); err == nil && existing.CheckSignatureFrom(ca) != nil {
+			// The CA was rotated, e.g. on the HA peer, since it was issued.
+			slog.Info("server cert not signed by the current CA, regenerating")
+			regenerate = true
 		}
 	}
 
 	if regenerate {
-		serverExpiry, err := time.ParseDuration(s.cfg.PKI.ServerExpiry)
-		if err != nil {
-			return "", fmt.Errorf("parse server_expiry: %w", err)
-		}
-		if err := pki.GenerateServerCert(caCertPath, caKeyPath, serverKeyPath, serverCertPath, desiredSANs, serverExpiry); err != nil {
-			return "", fmt.Errorf("generate server cert: %w", err)
+		if err := s.issueServerCert(); err != nil {
+			return "", err
 		}
-		slog.Info("generated server certificate", "path", serverCertPath, "sans", desiredSANs)
 	}
 
-	// Open token store.
-	tokenPath := filepath.Join(pkiDir, "bootstrap-tokens.json")
-	ts, err := pki.OpenTokenStore(tokenPath)
+	revoked, err := pki.OpenRevocationList(filepath.Join(pkiDir, "revoked.json"))
 	if err != nil {
-		return "", fmt.Errorf("open token store: %w", err)
+		return "", fmt.Errorf("load revocation list: %w", err)
+	}
+	s.revoked = revoked
+
+	// Tokens live in the controller database; import a legacy token file once.
+	if err := migrateTokens(s.db, filepath.Join(pkiDir, "bootstrap-tokens.json")); err != nil {
+		return "", fmt.Errorf("migrate bootstrap tokens: %w", err)
 	}
+	ts := pki.NewTokenStore(s.db)
 	s.tokenStore = ts
 
-	// Create initial bootstrap token if store is empty.
+	// Create initial bootstrap token if store is empty. A standby's tokens
+	// are copied from the active.
 	var bootstrapToken string
-	if len(ts.List()) == 0 {
-		bootstrapToken = ts.Create()
+	if len(ts.List()) == 0 && !s.standby.Load() {
+		bootstrapToken, _, err = ts.Issue(pki.TokenOptions{Description: "initial bootstrap token"})
+		if err != nil {
+			return "", fmt.Errorf("create initial bootstrap token: %w", err)
+		}
 		slog.Info("created initial bootstrap token")
 	}
 
 	return bootstrapToken, nil
 }
 
+// serverSANs returns the SANs for the server certificate: explicit config
+// takes precedence; otherwise they are derived from the listen address.
+func (s *Server) serverSANs() []string {
+	if len(s.cfg.PKI.ServerSANs) > 0 {
+		return s.cfg.PKI.ServerSANs
+	}
+	return extractSANs(s.cfg.Listen)
+}
+
+// issueServerCert signs a new server certificate with the current CA.
+func (s *Server) issueServerCert() error {
+	serverExpiry, err := time.ParseDuration(s.cfg.PKI.ServerExpiry)
+	if err != nil {
+		return fmt.Errorf("parse server_expiry: %w", err)
+	}
+	serverCertPath := filepath.Join(s.pkiDir, "server.crt")
+	sans := s.serverSANs()
+	if err := pki.GenerateServerCert(filepath.Join(s.pkiDir, "ca.crt"), filepath.Join(s.pkiDir, "ca.key"), filepath.Join(s.pkiDir, "server.key"), serverCertPath, sans, serverExpiry, s.cfg.PKI.KeyAlgorithm); err != nil {
+		return fmt.Errorf("generate server cert: %w", err)
+	}
+	slog.Info("generated server certificate", "path", serverCertPath, "sans", sans, "key_algorithm", s.cfg.PKI.KeyAlgorithm)
+	return nil
+}
+
+// migrateTokens imports a legacy bootstrap-tokens.json into db and renames the
+// file so the import happens only once.
+func migrateTokens(db store.Backend, path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	legacy, err := pki.OpenTokenStore(path)
+	if err != nil {
+		return err
+	}
+	tokens := legacy.List()
+	err = db.Update(func(tx store.Tx) error {
+		for _, t := range tokens {
+			if err := tx.PutToken(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("migrated bootstrap tokens into controller database", "tokens", len(tokens))
+	return os.Rename(path, path+".migrated")
+}
+
 // sansEqual returns true if both slices contain the same set of SANs (order-independent).
 func sansEqual(a, b []string) bool {
 	if len(a) != len(b) {
@@ -204,42 +401,35 @@ func (s *Server) ListenAndServe() error {
 		}
 		slog.Info("probe responder listening", "addr", addr)
 	}
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("/bootstrap", s.handleBootstrap)
-	mux.HandleFunc("/register", s.requireClientCert(s.handleRegister))
-	mux.HandleFunc("/candidates", s.requireClientCert(s.handleCandidates))
-	mux.HandleFunc("/metrics", s.requireClientCert(s.handleMetrics))
-	mux.HandleFunc("/nat-probe", s.requireClientCert(s.handleNATProbe))
-	mux.HandleFunc("/direct-result", s.requireClientCert(s.handleDirectResult))
-	mux.HandleFunc("/wg-config", s.requireClientCert(s.handleWGConfig))
-	mux.HandleFunc("/fleet/status", s.requireClientCert(s.handleFleetStatus))
-	mux.HandleFunc("/fleet/history", s.requireClientCert(s.handleFleetHistory))
-	// Prometheus metrics endpoint — no client cert required so Prometheus can scrape without mTLS.
-	mux.Handle("/prom/metrics", promhttp.Handler())
-	// Status page — simple HTML dashboard, no auth required.
-	mux.HandleFunc("/status", statuspage.Handler(s.statusPageData))
+	// On a standby, liveness and the reconciler start on promotion.
+	if !s.standby.Load() {
+		s.startLiveness()
+		if s.cfg.WGApply {
+			s.startReconciler()
+		}
+	}
+	if s.peer != nil {
+		s.startHA()
+	}
 
 	server := &http.Server{
 		Addr:              s.cfg.Listen,
-		Handler:           mux,
+		Handler:           s.routes(),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
 	if s.cfg.PKI != nil && s.pkiDir != "" {
-		tlsCfg, err := pki.ServerTLSConfig(
-			filepath.Join(s.pkiDir, "ca.crt"),
-			filepath.Join(s.pkiDir, "server.crt"),
-			filepath.Join(s.pkiDir, "server.key"),
-		)
-		if err != nil {
+		if err := s.loadTLSConfig(); err != nil {
 			return fmt.Errorf("server TLS config: %w", err)
 		}
-		// Allow /bootstrap to work without a client cert. The
-		// requireClientCert middleware enforces client certs for all
-		// other endpoints.
-		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
-		server.TLSConfig = tlsCfg
+		// Each handshake takes the current config, so a CA rotation
+		// applies without a restart.
+		server.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS13,
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return s.tlsConfig.Load(), nil
+			},
+		}
 		slog.Info("controller listening (mTLS)", "addr", s.cfg.Listen)
 		return server.ListenAndServeTLS("", "")
 	}
@@ -248,6 +438,54 @@ func (s *Server) ListenAndServe() error {
 	return server.ListenAndServe()
 }
 
+// routes returns the controller's HTTP handler.
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bootstrap", s.handleBootstrap)
+	mux.HandleFunc("/register", s.requireNode(s.handleRegister))
+	mux.HandleFunc("/candidates", s.requireNode(s.handleCandidates))
+	mux.HandleFunc("/renew", s.requireNode(s.handleRenewCert))
+	mux.HandleFunc("/metrics", s.requireNode(s.handleMetrics))
+	mux.HandleFunc("/nat-probe", s.requireNode(s.handleNATProbe))
+	mux.HandleFunc("/direct-result", s.requireNode(s.handleDirectResult))
+	mux.HandleFunc("/wg-config", s.requireNode(s.handleWGConfig))
+	mux.HandleFunc("/events", s.requireNode(s.handleEvents))
+	mux.HandleFunc("/rotate-key", s.requireNode(s.handleRotateKey))
+	mux.HandleFunc("/rotate-key/confirm", s.requireNode(s.handleConfirmKey))
+	mux.HandleFunc("/hub-rtt", s.requireNode(s.handleHubRTT))
+	mux.HandleFunc("/leave", s.requireNode(s.handleLeave))
+	// Fleet-wide views and management require an admin certificate.
+	mux.HandleFunc("/fleet/status", s.requireAdmin(s.handleFleetStatus))
+	mux.HandleFunc("/fleet/history", s.requireAdmin(s.handleFleetHistory))
+	mux.HandleFunc("/admin/nodes/remove", s.requireAdmin(s.handleRemoveNode))
+	mux.HandleFunc("/admin/nodes/rename", s.requireAdmin(s.handleRenameNode))
+	mux.HandleFunc("/admin/nodes/disable", s.requireAdmin(s.handleDisableNode))
+	mux.HandleFunc("/admin/nodes/tags", s.requireAdmin(s.handleTagNode))
+	mux.HandleFunc("/admin/routes", s.requireAdmin(s.handleRoutes))
+	mux.HandleFunc("/admin/routes/approve", s.requireAdmin(s.handleApproveRoute))
+	mux.HandleFunc("/admin/tokens", s.requireAdmin(s.handleTokens))
+	mux.HandleFunc("/admin/tokens/revoke", s.requireAdmin(s.handleRevokeToken))
+	mux.HandleFunc("/admin/certs/revoke", s.requireAdmin(s.handleRevokeCert))
+	mux.HandleFunc("/admin/ca/rotate", s.requireAdmin(s.handleRotateCA))
+	mux.HandleFunc("/admin/ipam", s.requireAdmin(s.handleIPAM))
+	mux.HandleFunc("/admin/ipam/reserve", s.requireAdmin(s.handleIPAMReserve))
+	mux.HandleFunc("/admin/ipam/release", s.requireAdmin(s.handleIPAMRelease))
+	// Relay hubs fetch their peers with a relay certificate.
+	mux.HandleFunc("/relay/peers", s.requireRelay(s.handleRelayPeers))
+	// Prometheus metrics endpoint — no client cert required so Prometheus can scrape without mTLS.
+	mux.Handle("/prom/metrics", promhttp.Handler())
+	// Trusted CA bundle and signed CRL of revoked client certificates, no
+	// auth required.
+	mux.HandleFunc("/ca", s.handleCA)
+	mux.HandleFunc("/crl", s.handleCRL)
+	// Status page — simple HTML dashboard, no auth required.
+	mux.HandleFunc("/status", statuspage.Handler(s.statusPageData))
+	// Replication between HA controllers; the peer presents an ha-peer certificate.
+	mux.HandleFunc("/ha/status", s.requireHAPeer(s.handleHAStatus))
+	mux.HandleFunc("/ha/snapshot", s.requireHAPeer(s.handleHASnapshot))
+	return s.standbyGuard(mux)
+}
+
 // StartProbeResponder starts a UDP probe responder for health checks.
 func (s *Server) StartProbeResponder() (string, error) {
 	addr := fmt.Sprintf(":%d", s.cfg.ProbePort)
@@ -276,6 +514,12 @@ func (s *Server) requireClientCert(next http.HandlerFunc) http.HandlerFunc {
 				http.Error(w, "client certificate required", http.StatusUnauthorized)
 				return
 			}
+			cert := r.TLS.PeerCertificates[0]
+			if s.certRevoked(cert) || s.revoked.IsRevoked(cert) {
+				http.Error(w, "client certificate revoked", http.StatusUnauthorized)
+				return
+			}
+			r = r.WithContext(withPeer(r.Context(), cert))
 		}
 		next(w, r)
 	}
@@ -298,13 +542,32 @@ func (s *Server) handleBootstrap(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate token.
-	if s.tokenStore == nil || !s.tokenStore.Validate(req.Token) {
-		writeJSONError(w, http.StatusUnauthorized, "invalid bootstrap token")
+	// The certificate CN is the node's identity on every later request, so
+	// it must be the name being enrolled.
+	cn, err := pki.CSRCommonName([]byte(req.CSR))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid csr: "+err.Error())
+		return
+	}
+	if cn != req.Name {
+		writeJSONError(w, http.StatusBadRequest, "csr common name must match name")
+		return
+	}
+
+	// Check the token, but only count the enrollment once nothing else can
+	// fail, so a rejected request does not spend a use.
+	if s.tokenStore == nil {
+		writeJSONError(w, http.StatusUnauthorized, pki.ErrTokenInvalid.Error())
+		return
+	}
+	tok, err := s.tokenStore.Check(req.Token, req.Name, time.Now())
+	if err != nil {
+		writeTokenError(w, err)
 		return
 	}
 
-	// Load CA and sign the CSR.
+	// Load CA and sign the CSR. The certificate is only recorded and handed
+	// out once the node is registered.
 	caKeyPath := filepath.Join(s.pkiDir, "ca.key")
 	caCertPath := filepath.Join(s.pkiDir, "ca.crt")
 	caCert, caKey, err := pki.LoadCA(caKeyPath, caCertPath)
@@ -332,82 +595,137 @@ func (s *Server) handleBootstrap(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Register the node in the registry (reuse registration logic).
-	nodeID, vpnIP := s.registerNodeLocked(req.Name, "" /* pubKey */, "" /* vpnIP */, "" /* endpoint */, 0 /* probePort */, "" /* publicAddr */, "" /* natType */)
+	// The name and address checks, the token use and the registration
+	// happen under one lock, so no other request can claim the address in
+	// between.
+	s.mu.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			s.mu.Unlock()
+		}
+	}()
+
+	if i := s.findNodeLocked(req.Name); i >= 0 {
+		if s.reg.Nodes[i].Disabled {
+			writeJSONError(w, http.StatusForbidden, "node disabled")
+			return
+		}
+		if s.reg.Nodes[i].ID != req.Name {
+			writeJSONError(w, http.StatusConflict, "name belongs to another node")
+			return
+		}
+	}
+	vpnIP := tok.VPNIP
+	if vpnIP != "" {
+		if owner := s.vpnIPOwnerLocked(vpnIP); owner != "" && owner != req.Name {
+			writeJSONError(w, http.StatusConflict, "token vpn_ip is in use by node "+owner)
+			return
+		}
+		if other := s.reservationOwnerLocked(vpnIP, req.Name); other != "" {
+			writeJSONError(w, http.StatusConflict, "token vpn_ip is reserved for "+other)
+			return
+		}
+	} else {
+		vpnIP, err = s.assignVPNIPLocked(req.Name, "")
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+	}
+
+	node, tagsChanged, err := s.registerNodeLocked(req.Name, vpnIP, tok)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+	s.mu.Unlock()
+	locked = false
+	tok.Uses++
+
+	// Keep a copy so the certificate can be revoked by serial later.
+	if err := pki.RecordIssued(s.issuedDir(), signedCert); err != nil {
+		slog.Warn("failed to record issued certificate", "node", req.Name, "err", err)
+	}
+	if tagsChanged {
+		slog.Info("node admin tags changed", "node", node.Name, "tags", node.AdminTags)
+		if err := s.syncFirewall(); err != nil {
+			slog.Warn("firewall sync failed", "err", err)
+		}
+	}
+	slog.Info("node enrolled", "node", node.ID, "token", pki.TokenID(tok.Hash), "uses", tok.Uses)
 
 	writeJSON(w, http.StatusOK, api.BootstrapResponse{
 		CACert:     string(caCertPEM),
 		ClientCert: string(signedCert),
-		NodeID:     nodeID,
-		VPNIP:      vpnIP,
+		NodeID:     node.ID,
+		VPNIP:      node.VPNIP,
+		Ephemeral:  node.Ephemeral,
 	})
 }
 
-// registerNodeLocked registers or updates a node in the registry, allocating a
-// VPN IP when one is not provided. It returns (nodeID, vpnIP). This method is
-// shared by handleRegister and handleBootstrap.
-func (s *Server) registerNodeLocked(name, pubKey, vpnIP, endpoint string, probePort int, publicAddr, natType string) (string, string) {
-	now := time.Now().UTC()
-	assignedVPNIP := vpnIP
-
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// writeTokenError answers a bootstrap request whose token was refused.
+func writeTokenError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, pki.ErrTokenNameNotAllowed):
+		writeJSONError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, pki.ErrTokenInvalid), errors.Is(err, pki.ErrTokenExpired), errors.Is(err, pki.ErrTokenUsedUp):
+		writeJSONError(w, http.StatusUnauthorized, err.Error())
+	default:
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+	}
+}
 
-	if assignedVPNIP == "" {
-		var err error
-		assignedVPNIP, err = allocateVPNIP(s.cfg.VPNCIDR, s.reg)
-		if err != nil {
-			return name, ""
+// registerNodeLocked registers the node enrolled by tok at vpnIP, or updates
+// it when it enrolls again. The token decides whether the node is ephemeral
+// and adds its admin tags. The token use is counted in the transaction that
+// stores the node, so a failed registration spends nothing; it fails with
+// pki.ErrTokenUsedUp when another enrollment took the last use. It returns
+// the stored node and whether its admin tags changed. Callers hold s.mu.
+func (s *Server) registerNodeLocked(name, vpnIP string, tok store.Token) (store.NodeInfo, bool, error) {
+	i := s.findNodeLocked(name)
+	var prev store.NodeInfo
+	node := store.NodeInfo{ID: name, Name: name}
+	if i >= 0 {
+		prev = s.reg.Nodes[i]
+		node = prev
+		node.AdminTags = slices.Clone(prev.AdminTags)
+		if node.ID == "" {
+			node.ID = name
 		}
 	}
-
-	var nodeID string
-	updated := false
-	for i := range s.reg.Nodes {
-		if s.reg.Nodes[i].Name == name {
-			if s.reg.Nodes[i].ID == "" {
-				s.reg.Nodes[i].ID = name
-			}
-			if pubKey != "" {
-				s.reg.Nodes[i].PubKey = pubKey
-			}
-			s.reg.Nodes[i].VPNIP = assignedVPNIP
-			if endpoint != "" {
-				s.reg.Nodes[i].Endpoint = endpoint
-			}
-			s.reg.Nodes[i].ProbePort = probePort
-			if publicAddr != "" {
-				s.reg.Nodes[i].PublicAddr = publicAddr
-			}
-			if natType != "" {
-				s.reg.Nodes[i].NATType = natType
-			}
-			s.reg.Nodes[i].LastSeenAt = now
-			s.reg.Nodes[i].Status = "online"
-			nodeID = s.reg.Nodes[i].ID
-			updated = true
-			break
+	node.VPNIP = vpnIP
+	node.ProbePort = 0
+	node.LastSeenAt = time.Now().UTC()
+	node.Status = store.StatusOnline
+	// Re-enrolling with a regular token makes the node permanent again.
+	node.Ephemeral = tok.Ephemeral
+	for _, tag := range tok.Tags {
+		if !slices.Contains(node.AdminTags, tag) {
+			node.AdminTags = append(node.AdminTags, tag)
 		}
 	}
 
-	if !updated {
-		nodeID = name
-		s.reg.Nodes = append(s.reg.Nodes, store.NodeInfo{
-			ID:         nodeID,
-			Name:       name,
-			PubKey:     pubKey,
-			VPNIP:      assignedVPNIP,
-			Endpoint:   endpoint,
-			ProbePort:  probePort,
-			PublicAddr: publicAddr,
-			NATType:    natType,
-			LastSeenAt: now,
-			Status:     "online",
-		})
+	err := s.db.Update(func(tx store.Tx) error {
+		ok, err := tx.UseToken(tok.Hash)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return pki.ErrTokenUsedUp
+		}
+		return tx.PutNode(node)
+	})
+	if err != nil {
+		return store.NodeInfo{}, false, err
 	}
-
-	_ = store.SaveRegistry(s.regPath, s.reg)
-	return nodeID, assignedVPNIP
+	if i >= 0 {
+		s.reg.Nodes[i] = node
+	} else {
+		s.reg.Nodes = append(s.reg.Nodes, node)
+	}
+	s.publishNodeChange(prev, i >= 0, node)
+	return node, len(node.AdminTags) != len(prev.AdminTags), nil
 }
 
 // updateMetrics refreshes Prometheus gauges based on current registry and directOK state.
@@ -419,7 +737,7 @@ func (s *Server) updateMetrics() {
 
 	online := 0
 	for _, n := range s.reg.Nodes {
-		if time.Since(n.LastSeenAt) < 60*time.Second {
+		if n.Status == store.StatusOnline {
 			online++
 		}
 	}
@@ -429,12 +747,13 @@ func (s *Server) updateMetrics() {
 	pairs := 0
 	for _, peers := range s.directOK {
 		for _, t := range peers {
-			if time.Since(t) < 2*time.Minute {
+			if time.Since(t) < p2pReadyTTL {
 				pairs++
 			}
 		}
 	}
 	metrics.P2PReadyPairs.Set(float64(pairs))
+	s.updateHubMetricsLocked()
 }
 
 func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
@@ -452,6 +771,24 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(w, http.StatusBadRequest, "name and pub_key are required")
 		return
 	}
+	for _, tag := range req.Tags {
+		if !config.ValidTag(tag) {
+			writeJSONError(w, http.StatusBadRequest, "invalid tag "+tag)
+			return
+		}
+	}
+	if len(req.Tags) == 0 {
+		req.Tags = nil
+	}
+	routes, err := normalizeRoutes(req.Routes)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !authorizeNode(w, r, req.Name) {
+		return
+	}
+	_, authenticated := peerCN(r)
 
 	now := time.Now().UTC()
 	assignedVPNIP := req.VPNIP
@@ -464,40 +801,119 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
+	existing := s.findNodeLocked(req.Name)
+	if existing >= 0 && s.reg.Nodes[existing].Disabled {
+		writeJSONError(w, http.StatusForbidden, "node disabled")
+		return
+	}
+	if existing >= 0 {
+		// A node changes keys through /rotate-key; mid-rotation it may
+		// already present the pending key, which stays pending here.
+		n := s.reg.Nodes[existing]
+		if n.PubKey != "" && req.PubKey != n.PubKey && req.PubKey != n.PendingPubKey {
+			writeJSONErrorCode(w, http.StatusConflict, api.ErrCodePubKeyMismatch, "pub_key does not match the registered key (use node rotate-key)")
+			return
+		}
+	}
+	if existing >= 0 && s.reg.Nodes[existing].VPNIP == "" && assignedVPNIP != "" {
+		// The address was reclaimed while the node was away; if someone else
+		// holds it now, the node gets a new one.
+		if owner := s.vpnIPOwnerLocked(assignedVPNIP); owner != "" && owner != req.Name {
+			assignedVPNIP = ""
+		}
+	}
+	if authenticated {
+		// The name may match another node's display name after a rename, and
+		// a claimed VPN IP must not belong to someone else.
+		if existing >= 0 && s.reg.Nodes[existing].ID != req.Name {
+			writeJSONError(w, http.StatusForbidden, "name belongs to another node")
+			return
+		}
+		if owner := s.vpnIPOwnerLocked(assignedVPNIP); owner != "" && owner != req.Name {
+			writeJSONErrorCode(w, http.StatusConflict, api.ErrCodeVPNIPConflict, "vpn_ip belongs to another node")
+			return
+		}
+	}
+	names := []string{req.Name}
+	if existing >= 0 {
+		names = append(names, s.reg.Nodes[existing].Name)
+	}
+	if other := s.reservationOwnerLocked(assignedVPNIP, names...); other != "" {
+		writeJSONErrorCode(w, http.StatusConflict, api.ErrCodeVPNIPConflict, "vpn_ip is reserved for "+other)
+		return
+	}
+
 	if assignedVPNIP == "" {
 		var err error
-		assignedVPNIP, err = allocateVPNIP(s.cfg.VPNCIDR, s.reg)
+		assignedVPNIP, err = s.assignVPNIPLocked(req.Name, "")
 		if err != nil {
 			// Important: never return while holding the registry lock.
 			writeJSONError(w, http.StatusBadRequest, err.Error())
 			return
 		}
+	} else if s.cfg.VPNCIDR != "" {
+		// Fill in a family the node has no address for yet, e.g. after an
+		// IPv6 prefix was added to vpn_cidr. The claimed address stays usable
+		// when that fails.
+		completed, err := s.assignVPNIPLocked(req.Name, assignedVPNIP)
+		if err != nil {
+			slog.Warn("vpn_ip completion failed", "node", req.Name, "vpn_ip", assignedVPNIP, "err", err)
+		} else {
+			assignedVPNIP = completed
+		}
+	}
+
+	// With several relay hubs, the node reports which one it is using so
+	// traffic to it is routed there.
+	activeHub := ""
+	if _, ok := s.findHub(req.Hub); ok && s.multiHub() {
+		activeHub = req.Hub
 	}
 
 	var nodeID string
+	var saved store.NodeInfo
 	updated := false
-	for i := range s.reg.Nodes {
-		if s.reg.Nodes[i].Name == req.Name {
-			if s.reg.Nodes[i].ID == "" {
-				s.reg.Nodes[i].ID = req.Name
-			}
+	var prev store.NodeInfo
+	if i := existing; i >= 0 {
+		prev = s.reg.Nodes[i]
+		if s.reg.Nodes[i].ID == "" {
+			s.reg.Nodes[i].ID = req.Name
+		}
+		if s.reg.Nodes[i].PubKey == "" {
 			s.reg.Nodes[i].PubKey = req.PubKey
-			s.reg.Nodes[i].VPNIP = assignedVPNIP
-			s.reg.Nodes[i].Endpoint = req.Endpoint
-			s.reg.Nodes[i].ProbePort = req.ProbePort
-			s.reg.Nodes[i].PublicAddr = req.PublicAddr
-			s.reg.Nodes[i].NATType = req.NATType
-			s.reg.Nodes[i].LastSeenAt = now
-			s.reg.Nodes[i].Status = "online"
-			nodeID = s.reg.Nodes[i].ID
-			updated = true
-			break
 		}
+		s.reg.Nodes[i].VPNIP = assignedVPNIP
+		s.reg.Nodes[i].Endpoint = req.Endpoint
+		s.reg.Nodes[i].ProbePort = req.ProbePort
+		s.reg.Nodes[i].PublicAddr = req.PublicAddr
+		s.reg.Nodes[i].NATType = req.NATType
+		if activeHub != "" && activeHub != s.reg.Nodes[i].ActiveHub {
+			slog.Info("node switched relay hub", "node", s.reg.Nodes[i].ID, "from", s.reg.Nodes[i].ActiveHub, "to", activeHub)
+			s.reg.Nodes[i].ActiveHub = activeHub
+		}
+		if !slices.Equal(req.Tags, s.reg.Nodes[i].Tags) {
+			slog.Info("node tags changed", "node", s.reg.Nodes[i].ID, "from", s.reg.Nodes[i].Tags, "to", req.Tags)
+			s.reg.Nodes[i].Tags = req.Tags
+		}
+		if !slices.Equal(routes, s.reg.Nodes[i].AdvertisedRoutes) {
+			slog.Info("node advertised routes changed", "node", s.reg.Nodes[i].ID, "from", s.reg.Nodes[i].AdvertisedRoutes, "to", routes)
+			s.reg.Nodes[i].AdvertisedRoutes = routes
+		}
+		if req.ExitNode != s.reg.Nodes[i].ExitNode || req.UseExitNode != s.reg.Nodes[i].UseExitNode {
+			slog.Info("node exit node settings changed", "node", s.reg.Nodes[i].ID, "exit_node", req.ExitNode, "use_exit_node", req.UseExitNode)
+			s.reg.Nodes[i].ExitNode = req.ExitNode
+			s.reg.Nodes[i].UseExitNode = req.UseExitNode
+		}
+		s.reg.Nodes[i].LastSeenAt = now
+		s.reg.Nodes[i].Status = store.StatusOnline
+		nodeID = s.reg.Nodes[i].ID
+		saved = s.reg.Nodes[i]
+		updated = true
 	}
 
 	if !updated {
 		nodeID = req.Name
-		s.reg.Nodes = append(s.reg.Nodes, store.NodeInfo{
+		saved = store.NodeInfo{
 			ID:         nodeID,
 			Name:       req.Name,
 			PubKey:     req.PubKey,
@@ -506,19 +922,41 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 			ProbePort:  req.ProbePort,
 			PublicAddr: req.PublicAddr,
 			NATType:    req.NATType,
+			ActiveHub:  activeHub,
+			Tags:       req.Tags,
 			LastSeenAt: now,
-			Status:     "online",
-		})
+			Status:     store.StatusOnline,
+			// Routes wait for an admin's approval.
+			AdvertisedRoutes: routes,
+
+			ExitNode:    req.ExitNode,
+			UseExitNode: req.UseExitNode,
+		}
+		s.reg.Nodes = append(s.reg.Nodes, saved)
 	}
 
-	if err := store.SaveRegistry(s.regPath, s.reg); err != nil {
-		s.mu.Unlock()
+	// Persist the node together with a check-in so fleet history counts
+	// keepalives as online time even when the node has no peers to measure.
+	err = s.db.Update(func(tx store.Tx) error {
+		if err := tx.PutNode(saved); err != nil {
+			return err
+		}
+		return tx.AddMetricBucket(store.MetricBucket{NodeID: nodeID, Start: now})
+	})
+	if err != nil {
 		writeJSONError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	s.publishNodeChange(prev, updated, saved)
+	routesChanged := !slices.Equal(activeRoutes(prev), activeRoutes(saved))
+	if routesChanged || prev.ExitNode != saved.ExitNode || prev.UseExitNode != saved.UseExitNode {
+		s.events.publish(api.Event{Type: api.EventRoutesChanged, NodeID: nodeID})
+	}
 
 	autoApply := s.cfg.WGApply
 	peers := s.peersForWGLocked()
+	// The hub's ACL rules are by address, subnet route and tag.
+	aclChanged := !updated || routesChanged || prev.VPNIP != saved.VPNIP || !slices.Equal(prev.Tags, saved.Tags)
 	resp := api.RegisterResponse{
 		NodeID: nodeID,
 		Peers:  s.peersLocked(nodeID),
@@ -532,7 +970,13 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	s.fillObservedEndpoints(resp.Peers)
 
 	if autoApply {
-		if err := applyWG(s.cfg, peers); err != nil {
+		if err := s.applyWG(peers); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if aclChanged {
+		if err := s.syncFirewall(); err != nil {
 			writeJSONError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
@@ -552,6 +996,9 @@ func (s *Server) handleCandidates(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(w, http.StatusBadRequest, "node_id required")
 		return
 	}
+	if !authorizeNode(w, r, nodeID) {
+		return
+	}
 
 	s.mu.Lock()
 	peers := s.peersLocked(nodeID)
@@ -574,6 +1021,17 @@ func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if !authorizeNode(w, r, req.NodeID) {
+		return
+	}
+	if _, ok := peerCN(r); ok {
+		for _, m := range req.Samples {
+			if m.NodeID != "" && m.NodeID != req.NodeID {
+				writeJSONError(w, http.StatusForbidden, "sample node_id does not match client certificate")
+				return
+			}
+		}
+	}
 	if len(req.Samples) == 0 {
 		w.WriteHeader(http.StatusNoContent)
 		return
@@ -598,6 +1056,41 @@ func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.mu.Lock()
+	for _, m := range req.Samples {
+		nodeID := m.NodeID
+		if nodeID == "" {
+			nodeID = req.NodeID
+		}
+		ts := m.Timestamp
+		if ts.IsZero() {
+			ts = time.Now().UTC()
+		}
+		s.recordLinkLocked(nodeID, m.PeerID, linkStat{Path: m.Path, RTTMs: m.RTTMs, LossPct: m.LossPct, UpdatedAt: ts})
+	}
+	s.mu.Unlock()
+
+	now := time.Now().UTC()
+	prune := now.Sub(s.lastHistoryPrune) >= historyPruneInterval
+	err := s.db.Update(func(tx store.Tx) error {
+		for _, b := range metricBuckets(req.NodeID, req.Samples) {
+			if err := tx.AddMetricBucket(b); err != nil {
+				return err
+			}
+		}
+		if prune {
+			return tx.PruneMetricBuckets(now.Add(-historyRetention))
+		}
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if prune {
+		s.lastHistoryPrune = now
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -616,24 +1109,28 @@ func (s *Server) handleNATProbe(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(w, http.StatusBadRequest, "node_id required")
 		return
 	}
+	if !authorizeNode(w, r, req.NodeID) {
+		return
+	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	for i := range s.reg.Nodes {
 		if s.reg.Nodes[i].ID == req.NodeID {
+			prev := s.reg.Nodes[i]
 			s.reg.Nodes[i].NATType = req.NATType
 			s.reg.Nodes[i].PublicAddr = req.PublicAddr
 			s.reg.Nodes[i].LastSeenAt = time.Now().UTC()
+			if err := s.saveNodeLocked(s.reg.Nodes[i]); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			s.publishNodeChange(prev, true, s.reg.Nodes[i])
 			break
 		}
 	}
 
-	if err := store.SaveRegistry(s.regPath, s.reg); err != nil {
-		writeJSONError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -648,18 +1145,47 @@ func (s *Server) handleDirectResult(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if !authorizeNode(w, r, req.NodeID) {
+		return
+	}
 
-	if req.NodeID != "" && req.PeerID != "" && req.Success {
+	now := time.Now().UTC()
+	if req.NodeID != "" && req.PeerID != "" {
 		s.mu.Lock()
-		m := s.directOK[req.NodeID]
-		if m == nil {
-			m = make(map[string]time.Time)
-			s.directOK[req.NodeID] = m
+		if req.Success {
+			m := s.directOK[req.NodeID]
+			if m == nil {
+				m = make(map[string]time.Time)
+				s.directOK[req.NodeID] = m
+			}
+			m[req.PeerID] = now
+		}
+		stat := linkStat{Path: "direct", RTTMs: req.RTTMs, UpdatedAt: now}
+		if !req.Success {
+			stat.RTTMs = 0
+			stat.LossPct = 100
 		}
-		m[req.PeerID] = time.Now().UTC()
+		s.recordLinkLocked(req.NodeID, req.PeerID, stat)
+		s.p2pTransitionsLocked()
 		s.mu.Unlock()
 	}
 
+	if req.NodeID != "" && req.PeerID != "" {
+		err := s.db.Update(func(tx store.Tx) error {
+			return tx.PutDirectResult(store.DirectResult{
+				NodeID:    req.NodeID,
+				PeerID:    req.PeerID,
+				Success:   req.Success,
+				RTTMs:     req.RTTMs,
+				Reason:    req.Reason,
+				CheckedAt: now,
+			})
+		})
+		if err != nil {
+			slog.Warn("persist direct result failed", "node", req.NodeID, "peer", req.PeerID, "err", err)
+		}
+	}
+
 	if req.NodeID != "" && req.PeerID != "" {
 		result := "success"
 		if !req.Success {
@@ -691,15 +1217,60 @@ func (s *Server) handleWGConfig(w http.ResponseWriter, r *http.Request) {
 		ServerKeepaliveSec: s.cfg.ServerKeepaliveSec,
 		ServerProbePort:    s.cfg.ProbePort,
 	}
+	if s.multiHub() {
+		nodeID := r.URL.Query().Get("node_id")
+		if !authorizeNode(w, r, nodeID) {
+			return
+		}
+		s.mu.Lock()
+		if i := s.findNodeLocked(nodeID); i >= 0 {
+			node := s.reg.Nodes[i]
+			resp.Hubs = s.assignHubsLocked(&node)
+			if prev := s.reg.Nodes[i]; node.PrimaryHub != prev.PrimaryHub || node.BackupHub != prev.BackupHub {
+				if err := s.saveNodeLocked(node); err != nil {
+					slog.Warn("persist hub assignment failed", "node", node.ID, "err", err)
+				}
+				slog.Info("node hubs assigned", "node", node.ID, "primary", node.PrimaryHub, "backup", node.BackupHub)
+				s.reg.Nodes[i] = node
+			}
+		} else {
+			resp.Hubs = s.rankHubsLocked(nodeID)
+		}
+		s.mu.Unlock()
+		primary := resp.Hubs[0]
+		resp.ServerPublicKey = primary.PublicKey
+		resp.ServerEndpoint = primary.Endpoint
+		resp.ServerProbePort = primary.ProbePort
+	}
 	writeJSON(w, http.StatusOK, resp)
 }
 
 func (s *Server) peersLocked(nodeID string) []api.PeerCandidate {
+	var self store.NodeInfo
+	if i := s.findNodeLocked(nodeID); i >= 0 {
+		self = s.reg.Nodes[i]
+	}
 	peers := make([]api.PeerCandidate, 0, len(s.reg.Nodes))
 	for _, node := range s.reg.Nodes {
 		if node.ID == nodeID {
 			continue
 		}
+		// Offline nodes stay in the registry (and on the hub) but agents
+		// shouldn't waste probes on them.
+		if node.Status == store.StatusOffline || node.Disabled {
+			continue
+		}
+		// Candidates are the nodes this one may reach. An exit node also
+		// gets its clients, whose internet traffic it sends back.
+		exitClient := self.Name != "" && (node.UseExitNode == self.Name || node.UseExitNode == self.ID)
+		reach := s.allowedLocked(self, node)
+		if !reach && !exitClient {
+			continue
+		}
+		// A direct tunnel carries both directions past the hub's firewall,
+		// so only pairs the policy allows both ways go direct. Traffic
+		// allowed one way only is relayed, and filtered, by the hub.
+		direct := reach && s.allowedLocked(node, self)
 		peers = append(peers, api.PeerCandidate{
 			ID:         node.ID,
 			Name:       node.Name,
@@ -709,15 +1280,20 @@ func (s *Server) peersLocked(nodeID string) []api.PeerCandidate {
 			PublicAddr: node.PublicAddr,
 			NATType:    node.NATType,
 			ProbePort:  node.ProbePort,
-			P2PReady:   s.p2pReadyLocked(nodeID, node.ID),
+			P2PReady:   direct && s.p2pReadyLocked(nodeID, node.ID),
+			Routes:     activeRoutes(node),
+			ExitNode:   node.ExitNode,
+			ExitClient: exitClient,
 		})
 	}
 	return peers
 }
 
+// p2pReadyTTL is how long a direct probe success counts towards P2P readiness.
+const p2pReadyTTL = 2 * time.Minute
+
 func (s *Server) p2pReadyLocked(a, b string) bool {
 	// Require mutual direct probe success within TTL.
-	const ttl = 2 * time.Minute
 	now := time.Now().UTC()
 
 	ab := s.directOK[a]
@@ -729,10 +1305,10 @@ func (s *Server) p2pReadyLocked(a, b string) bool {
 	t2, ok2 := ba[a]
 	switch strings.ToLower(strings.TrimSpace(s.cfg.P2PReadyMode)) {
 	case "either":
-		if ok1 && now.Sub(t1) <= ttl {
+		if ok1 && now.Sub(t1) <= p2pReadyTTL {
 			return true
 		}
-		if ok2 && now.Sub(t2) <= ttl {
+		if ok2 && now.Sub(t2) <= p2pReadyTTL {
 			return true
 		}
 		return false
@@ -740,7 +1316,7 @@ func (s *Server) p2pReadyLocked(a, b string) bool {
 		if !ok1 || !ok2 {
 			return false
 		}
-		if now.Sub(t1) > ttl || now.Sub(t2) > ttl {
+		if now.Sub(t1) > p2pReadyTTL || now.Sub(t2) > p2pReadyTTL {
 			return false
 		}
 		return true
@@ -773,15 +1349,20 @@ func (s *Server) handleFleetStatus(w http.ResponseWriter, r *http.Request) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	now := time.Now().UTC()
 	var nodes []api.FleetNodeStatus
 	for _, node := range s.reg.Nodes {
 		lastSeen := ""
 		if !node.LastSeenAt.IsZero() {
 			lastSeen = node.LastSeenAt.Format(time.RFC3339)
 		}
+		path, rtt, loss, _ := s.nodeLinkLocked(node.ID, now)
 		nodes = append(nodes, api.FleetNodeStatus{
 			Name:     node.Name,
 			VPNIP:    node.VPNIP,
+			Path:     path,
+			RTTMs:    rtt,
+			LossPct:  loss,
 			NATType:  node.NATType,
 			LastSeen: lastSeen,
 		})
@@ -790,17 +1371,31 @@ func (s *Server) handleFleetStatus(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleFleetHistory(w http.ResponseWriter, r *http.Request) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	window := DefaultHistoryWindow
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid window: "+v)
+			return
+		}
+		if d > historyRetention {
+			d = historyRetention
+		}
+		window = d
+	}
 
-	var nodes []api.FleetNodeHistory
-	for _, node := range s.reg.Nodes {
-		nodes = append(nodes, api.FleetNodeHistory{
-			Name:    node.Name,
-			Buckets: []api.FleetHistoryBucket{},
-		})
+	now := time.Now().UTC()
+	minutes, err := s.db.MetricBuckets(now.Add(-window - time.Minute))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
-	writeJSON(w, http.StatusOK, api.FleetHistoryResponse{Nodes: nodes})
+
+	s.mu.Lock()
+	nodes := append([]store.NodeInfo(nil), s.reg.Nodes...)
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, api.FleetHistoryResponse{Nodes: buildHistory(nodes, minutes, window, now)})
 }
 
 func decodeJSON(r *http.Request, v any) error {
@@ -820,107 +1415,56 @@ func writeJSONError(w http.ResponseWriter, status int, message string) {
 	writeJSON(w, status, map[string]string{"error": message})
 }
 
-func (s *Server) peersForWGLocked() []wireguard.Peer {
-	peers := make([]wireguard.Peer, 0, len(s.reg.Nodes))
-	for _, node := range s.reg.Nodes {
-		if node.PubKey == "" || node.VPNIP == "" {
-			continue
-		}
-		allowed := normalizeHostCIDR(node.VPNIP)
-		if allowed == "" {
-			continue
-		}
-		peers = append(peers, wireguard.Peer{
-			PublicKey:  node.PubKey,
-			AllowedIPs: []string{allowed},
-		})
-	}
-	return peers
+// writeJSONErrorCode is writeJSONError with one of the api.ErrCode
+// constants, for clients that act on the kind of error.
+func writeJSONErrorCode(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]string{"error": message, "code": code})
 }
 
-func normalizeHostCIDR(value string) string {
-	if value == "" {
-		return ""
-	}
-	if strings.Contains(value, "/") {
-		return value
-	}
-	return value + "/32"
+// peersForWGLocked returns the peers of the controller's own hub interface.
+func (s *Server) peersForWGLocked() []wireguard.Peer {
+	return s.hubPeersLocked(s.cfg.HubName)
 }
 
-func applyWG(cfg config.ControllerConfig, peers []wireguard.Peer) error {
+// applyWG configures the hub interface with peers.
+func (s *Server) applyWG(peers []wireguard.Peer) error {
 	serverCfg := wireguard.ServerConfig{
-		Interface:  cfg.WGInterface,
-		PrivateKey: cfg.WGPrivateKey,
-		Address:    cfg.WGAddress,
-		ListenPort: cfg.WGPort,
-		MTU:        cfg.MTU,
+		Interface:  s.cfg.WGInterface,
+		PrivateKey: s.cfg.WGPrivateKey,
+		Address:    s.cfg.WGAddress,
+		ListenPort: s.cfg.WGPort,
+		MTU:        s.cfg.MTU,
 	}
-	return wireguard.ApplyServer(serverCfg, peers)
+	return s.wg.ApplyServer(serverCfg, peers)
 }
 
-func allocateVPNIP(cidr string, reg *store.Registry) (string, error) {
-	if cidr == "" {
-		return "", fmt.Errorf("vpn_cidr is required for allocation")
-	}
-	prefix, err := netip.ParsePrefix(cidr)
-	if err != nil {
-		return "", err
-	}
-	if !prefix.Addr().Is4() {
-		return "", fmt.Errorf("vpn_cidr must be IPv4")
-	}
-
-	used := map[netip.Addr]bool{}
-	for _, node := range reg.Nodes {
-		if node.VPNIP == "" {
-			continue
-		}
-		p, err := netip.ParsePrefix(node.VPNIP)
-		if err == nil {
-			used[p.Addr()] = true
-			continue
-		}
-		addr, err := netip.ParseAddr(node.VPNIP)
-		if err == nil {
-			used[addr] = true
-		}
-	}
-
-	base := prefix.Masked().Addr()
-	ones, bits := prefix.Bits(), 32
-	size := 1 << uint(bits-ones)
-	// Defensive: avoid accidentally iterating millions of addresses due to misconfiguration.
-	// This controller is intended for small-ish overlays (tens to low thousands of nodes).
-	if size > 1_048_576 {
-		return "", fmt.Errorf("vpn_cidr %s is too large (size=%d)", cidr, size)
-	}
-	for i := 1; i < size-1; i++ { // skip network/broadcast
-		addr := addIPv4(base, uint32(i))
-		if !used[addr] {
-			return addr.String() + "/32", nil
-		}
-	}
-	return "", fmt.Errorf("no available vpn_ip in %s", cidr)
-}
-
-func addIPv4(base netip.Addr, offset uint32) netip.Addr {
-	v := base.As4()
-	val := uint32(v[0])<<24 | uint32(v[1])<<16 | uint32(v[2])<<8 | uint32(v[3])
-	val += offset
-	return netip.AddrFrom4([4]byte{byte(val >> 24), byte(val >> 16), byte(val >> 8), byte(val)})
+// removeWG takes the hub interface down.
+func removeWG(cfg config.ControllerConfig) error {
+	return wireguard.DownServer(cfg.WGInterface)
 }
 
 func (s *Server) statusPageData() statuspage.Data {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	now := time.Now().UTC()
 	data := statuspage.Data{Title: "vpnctl"}
 	for _, n := range s.reg.Nodes {
-		online := time.Since(n.LastSeenAt) < 60*time.Second
-		quality := "offline"
+		online := n.Status == store.StatusOnline
+		quality := n.Status
+		if quality == "" {
+			quality = store.StatusOffline
+		}
+		rttStr, lossStr := "-", "-"
 		if online {
 			quality = "good"
+			if _, rtt, loss, ok := s.nodeLinkLocked(n.ID, now); ok {
+				quality = monitor.ComputeQuality(rtt, loss, true, monitor.DefaultThresholds).String()
+				if rtt > 0 {
+					rttStr = fmt.Sprintf("%.1f", rtt)
+				}
+				lossStr = fmt.Sprintf("%.1f", loss)
+			}
 		}
 		lastSeen := "never"
 		if !n.LastSeenAt.IsZero() {
@@ -935,14 +1479,14 @@ func (s *Server) statusPageData() statuspage.Data {
 			}
 		}
 		data.Nodes = append(data.Nodes, statuspage.NodeStatus{
-			Name:    n.Name,
-			VPNIP:   n.VPNIP,
-			NATType: n.NATType,
+			Name:     n.Name,
+			VPNIP:    n.VPNIP,
+			NATType:  n.NATType,
 			LastSeen: lastSeen,
-			Online:  online,
-			Quality: quality,
-			RTTMs:   "-",
-			LossPct: "-",
+			Online:   online,
+			Quality:  quality,
+			RTTMs:    rttStr,
+			LossPct:  lossStr,
 		})
 		if online {
 			data.OnlineCount++
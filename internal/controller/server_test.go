@@ -5,18 +5,33 @@ package controller
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"vpnctl/internal/addrutil"
 	"vpnctl/internal/api"
 	"vpnctl/internal/config"
 	"vpnctl/internal/execx"
+	"vpnctl/internal/model"
+	"vpnctl/internal/pki"
 	"vpnctl/internal/store"
 	"vpnctl/internal/wireguard"
 )
@@ -67,16 +82,66 @@ func TestHandleRegister_AllocationError_DoesNotHoldLock(t *testing.T) {
 	}
 
 	// Registry persisted.
+	nodes, err := s.db.Nodes()
+	if err != nil {
+		t.Fatalf("Nodes: %v", err)
+	}
+	if len(nodes) != 1 {
+		t.Fatalf("nodes=%d", len(nodes))
+	}
+	if nodes[0].VPNIP != "10.7.0.2/32" {
+		t.Fatalf("vpn_ip=%q", nodes[0].VPNIP)
+	}
+}
+
+func TestHandleRegister_PersistError_ReleasesLockOnce(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewServer(config.ControllerConfig{DataDir: t.TempDir(), VPNCIDR: "10.7.0.0/24"})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	// Every write now fails; a double unlock would panic here.
+	_ = s.db.Close()
+
+	body, _ := json.Marshal(api.RegisterRequest{Name: "node-a", PubKey: "pub", VPNIP: "10.7.0.2/32"})
+	rec := httptest.NewRecorder()
+	s.handleRegister(rec, httptest.NewRequest(http.MethodPost, "/register", bytes.NewReader(body)))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	if !s.mu.TryLock() {
+		t.Fatal("registry lock still held")
+	}
+	s.mu.Unlock()
+}
+
+func TestNewServer_MigratesRegistryYAML(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
 	regPath := filepath.Join(tmp, "registry.yaml")
-	reg, err := store.LoadRegistry(regPath)
+	legacy := &store.Registry{Nodes: []store.NodeInfo{
+		{Name: "node-a", PubKey: "pub-a", VPNIP: "10.7.0.2/32"},
+	}}
+	if err := store.SaveRegistry(regPath, legacy); err != nil {
+		t.Fatalf("SaveRegistry: %v", err)
+	}
+
+	s, err := NewServer(config.ControllerConfig{DataDir: tmp, VPNCIDR: "10.7.0.0/24"})
 	if err != nil {
-		t.Fatalf("LoadRegistry: %v", err)
+		t.Fatalf("NewServer: %v", err)
 	}
-	if len(reg.Nodes) != 1 {
-		t.Fatalf("nodes=%d", len(reg.Nodes))
+	defer s.Close()
+
+	if len(s.reg.Nodes) != 1 || s.reg.Nodes[0].ID != "node-a" {
+		t.Fatalf("nodes=%+v", s.reg.Nodes)
+	}
+	if _, err := os.Stat(regPath); !os.IsNotExist(err) {
+		t.Fatalf("registry.yaml should be renamed after migration, stat err=%v", err)
 	}
-	if reg.Nodes[0].VPNIP != "10.7.0.2/32" {
-		t.Fatalf("vpn_ip=%q", reg.Nodes[0].VPNIP)
+	if _, err := os.Stat(regPath + ".migrated"); err != nil {
+		t.Fatalf("migrated file: %v", err)
 	}
 }
 
@@ -108,11 +173,82 @@ func TestAllocateVPNIP_RejectsHugeCIDR(t *testing.T) {
 	}
 }
 
+func TestAllocateVPNIP_DualStack(t *testing.T) {
+	t.Parallel()
+
+	reg := &store.Registry{
+		Nodes: []store.NodeInfo{
+			{Name: "a", VPNIP: "10.7.0.1/32,fd7a:115c:a1e0::1/128"},
+			{Name: "b", VPNIP: "10.7.0.2/32"},
+		},
+	}
+
+	ip, err := allocateVPNIP("10.7.0.0/24, fd7a:115c:a1e0::/64", reg)
+	if err != nil {
+		t.Fatalf("allocateVPNIP: %v", err)
+	}
+	if ip != "10.7.0.3/32,fd7a:115c:a1e0::2/128" {
+		t.Fatalf("ip=%q", ip)
+	}
+
+	// A node from before IPv6 was enabled keeps its address and gains one.
+	pool := addrPool{used: map[netip.Addr]bool{}}
+	for _, n := range reg.Nodes {
+		for _, addr := range addrutil.HostAddrs(n.VPNIP) {
+			pool.used[addr] = true
+		}
+	}
+	ip, err = completeVPNIP("10.7.0.0/24,fd7a:115c:a1e0::/64", "10.7.0.2/32", pool)
+	if err != nil {
+		t.Fatalf("completeVPNIP: %v", err)
+	}
+	if ip != "10.7.0.2/32,fd7a:115c:a1e0::2/128" {
+		t.Fatalf("completed ip=%q", ip)
+	}
+	ip, err = completeVPNIP("10.7.0.0/24,fd7a:115c:a1e0::/64", "10.7.0.1/32,fd7a:115c:a1e0::1/128", pool)
+	if err != nil || ip != "10.7.0.1/32,fd7a:115c:a1e0::1/128" {
+		t.Fatalf("complete ip=%q err=%v", ip, err)
+	}
+
+	// IPv6-only; a /64 is fine even though it can't be scanned in full.
+	ip, err = allocateVPNIP("fd7a:115c:a1e0::/64", reg)
+	if err != nil || ip != "fd7a:115c:a1e0::2/128" {
+		t.Fatalf("v6 ip=%q err=%v", ip, err)
+	}
+
+	if _, err := allocateVPNIP("10.7.0.0/24,10.8.0.0/24", reg); err == nil {
+		t.Fatal("expected error for two IPv4 prefixes")
+	}
+}
+
+func TestPeersForWG_DualStackAllowedIPs(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{reg: &store.Registry{Nodes: []store.NodeInfo{
+		{ID: "a", Name: "a", PubKey: "ka", VPNIP: "10.7.0.2/32,fd7a::2/128"},
+		{ID: "b", Name: "b", PubKey: "kb", VPNIP: "fd7a::3"},
+	}}}
+	peers := s.peersForWGLocked()
+	if len(peers) != 2 {
+		t.Fatalf("peers=%+v", peers)
+	}
+	if got := strings.Join(peers[0].AllowedIPs, ","); got != "10.7.0.2/32,fd7a::2/128" {
+		t.Fatalf("a allowed=%s", got)
+	}
+	if got := strings.Join(peers[1].AllowedIPs, ","); got != "fd7a::3/128" {
+		t.Fatalf("b allowed=%s", got)
+	}
+}
+
 type fakeRunner struct {
-	out map[string]string
+	out  map[string]string
+	runs []string
 }
 
-func (f *fakeRunner) Run(name string, args ...string) error { return nil }
+func (f *fakeRunner) Run(name string, args ...string) error {
+	f.runs = append(f.runs, name+" "+strings.Join(args, " "))
+	return nil
+}
 
 func (f *fakeRunner) Output(name string, args ...string) (string, error) {
 	k := name + " " + strings.Join(args, " ")
@@ -204,6 +340,49 @@ func TestP2PReadyLocked_EitherSuccess(t *testing.T) {
 	}
 }
 
+func TestNewServer_RestoresP2PReadiness(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	cfg := config.ControllerConfig{DataDir: tmp, P2PReadyMode: "mutual"}
+
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	for _, r := range []api.DirectResultRequest{
+		{NodeID: "a", PeerID: "b", Success: true, RTTMs: 5},
+		{NodeID: "b", PeerID: "a", Success: true, RTTMs: 5},
+		// A later failure must not erase the earlier success.
+		{NodeID: "b", PeerID: "a", Success: false, Reason: "timeout"},
+	} {
+		body, _ := json.Marshal(r)
+		rec := httptest.NewRecorder()
+		s.handleDirectResult(rec, httptest.NewRequest(http.MethodPost, "/direct-result", bytes.NewReader(body)))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("status=%d body=%s", rec.Code, rec.Body.String())
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	restarted, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer (restart): %v", err)
+	}
+	defer restarted.Close()
+	if !restarted.p2pReadyLocked("a", "b") {
+		t.Fatalf("expected readiness restored after restart, directOK=%v", restarted.directOK)
+	}
+
+	// The TTL still applies to restored state.
+	restarted.directOK["a"]["b"] = time.Now().UTC().Add(-p2pReadyTTL - time.Second)
+	if restarted.p2pReadyLocked("a", "b") {
+		t.Fatalf("expected stale restored success to be ignored")
+	}
+}
+
 func TestServer_ProbeResponder(t *testing.T) {
 	t.Parallel()
 
@@ -257,3 +436,1984 @@ func TestServer_ProbeResponder(t *testing.T) {
 		t.Fatalf("echo mismatch: got %q, want %q", got, string(msg))
 	}
 }
+
+func TestHandleFleetHistory_AggregatesMetrics(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewServer(config.ControllerConfig{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+	s.reg.Nodes = []store.NodeInfo{{ID: "node-a", Name: "node-a"}, {ID: "node-b", Name: "node-b"}}
+
+	now := time.Now().UTC()
+	body, _ := json.Marshal(api.MetricsRequest{
+		NodeID: "node-a",
+		Samples: []model.Metric{
+			{Timestamp: now, PeerID: "node-b", Path: "direct", RTTMs: 10, LossPct: 0},
+			{Timestamp: now, PeerID: "node-b", Path: "direct", RTTMs: 30, LossPct: 50},
+		},
+	})
+	rec := httptest.NewRecorder()
+	s.handleMetrics(rec, httptest.NewRequest(http.MethodPost, "/metrics", bytes.NewReader(body)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("metrics status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleFleetHistory(rec, httptest.NewRequest(http.MethodGet, "/fleet/history?window=12m", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("history status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var resp api.FleetHistoryResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if len(resp.Nodes) != 2 {
+		t.Fatalf("nodes=%d", len(resp.Nodes))
+	}
+	a := resp.Nodes[0]
+	if len(a.Buckets) != historyBuckets {
+		t.Fatalf("buckets=%d", len(a.Buckets))
+	}
+	// Samples land in the newest bucket, or the one before it if the minute
+	// rolled over between submit and query.
+	var got api.FleetHistoryBucket
+	for _, b := range a.Buckets {
+		if b.OnlinePct > 0 {
+			got = b
+		}
+	}
+	if got.OnlinePct != 100 || got.AvgRTTMs != 20 || got.LossPct != 25 {
+		t.Fatalf("bucket=%+v", got)
+	}
+	for _, b := range resp.Nodes[1].Buckets {
+		if b.OnlinePct != 0 {
+			t.Fatalf("node-b should be offline, bucket=%+v", b)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleFleetHistory(rec, httptest.NewRequest(http.MethodGet, "/fleet/history?window=bogus", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad window status=%d", rec.Code)
+	}
+}
+
+func TestHandleFleetStatus_ReportsLinkState(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewServer(config.ControllerConfig{DataDir: t.TempDir(), P2PReadyMode: "mutual"})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+	now := time.Now().UTC()
+	s.reg.Nodes = []store.NodeInfo{
+		{ID: "a", Name: "a", VPNIP: "10.7.0.2/32", LastSeenAt: now},
+		{ID: "b", Name: "b", VPNIP: "10.7.0.3/32", LastSeenAt: now},
+		{ID: "c", Name: "c", VPNIP: "10.7.0.4/32", LastSeenAt: now},
+	}
+
+	post := func(path string, v any, h http.HandlerFunc) {
+		t.Helper()
+		body, _ := json.Marshal(v)
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("%s status=%d body=%s", path, rec.Code, rec.Body.String())
+		}
+	}
+	post("/direct-result", api.DirectResultRequest{NodeID: "a", PeerID: "b", Success: true, RTTMs: 10}, s.handleDirectResult)
+	post("/direct-result", api.DirectResultRequest{NodeID: "b", PeerID: "a", Success: true, RTTMs: 12}, s.handleDirectResult)
+	post("/metrics", api.MetricsRequest{NodeID: "c", Samples: []model.Metric{
+		{Timestamp: now, NodeID: "c", PeerID: "a", Path: "relay", RTTMs: 80, LossPct: 10},
+	}}, s.handleMetrics)
+
+	rec := httptest.NewRecorder()
+	s.handleFleetStatus(rec, httptest.NewRequest(http.MethodGet, "/fleet/status", nil))
+	var resp api.FleetStatusResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	got := map[string]api.FleetNodeStatus{}
+	for _, n := range resp.Nodes {
+		got[n.Name] = n
+	}
+	if a := got["a"]; a.Path != "direct" || a.RTTMs != 10 || a.LossPct != 0 {
+		t.Fatalf("a=%+v", a)
+	}
+	if c := got["c"]; c.Path != "relay" || c.RTTMs != 80 || c.LossPct != 10 {
+		t.Fatalf("c=%+v", c)
+	}
+}
+
+func TestReapOnce_LivenessTransitions(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.ControllerConfig{DataDir: t.TempDir(), NodeStaleAfterSec: 60, NodeOfflineAfterSec: 300}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+
+	now := time.Now().UTC()
+	s.reg.Nodes = []store.NodeInfo{
+		{ID: "fresh", Name: "fresh", PubKey: "pub-f", VPNIP: "10.7.0.2/32", LastSeenAt: now.Add(-10 * time.Second), Status: store.StatusOnline},
+		{ID: "quiet", Name: "quiet", PubKey: "pub-q", VPNIP: "10.7.0.3/32", LastSeenAt: now.Add(-2 * time.Minute), Status: store.StatusOnline},
+		{ID: "gone", Name: "gone", PubKey: "pub-g", VPNIP: "10.7.0.4/32", LastSeenAt: now.Add(-10 * time.Minute), Status: store.StatusStale},
+	}
+
+	if err := s.reapOnce(now); err != nil {
+		t.Fatalf("reapOnce: %v", err)
+	}
+
+	want := map[string]string{"fresh": store.StatusOnline, "quiet": store.StatusStale, "gone": store.StatusOffline}
+	for _, n := range s.reg.Nodes {
+		if n.Status != want[n.ID] {
+			t.Fatalf("%s status=%q want %q", n.ID, n.Status, want[n.ID])
+		}
+	}
+
+	// Transitions are persisted.
+	nodes, err := s.db.Nodes()
+	if err != nil {
+		t.Fatalf("Nodes: %v", err)
+	}
+	persisted := map[string]string{}
+	for _, n := range nodes {
+		persisted[n.ID] = n.Status
+	}
+	if persisted["quiet"] != store.StatusStale || persisted["gone"] != store.StatusOffline {
+		t.Fatalf("persisted=%v", persisted)
+	}
+
+	// Offline nodes are no longer candidates; stale ones still are.
+	s.mu.Lock()
+	peers := s.peersLocked("fresh")
+	s.mu.Unlock()
+	if len(peers) != 1 || peers[0].ID != "quiet" {
+		t.Fatalf("peers=%+v", peers)
+	}
+}
+
+func TestHandleEvents_StreamsFleetChanges(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.ControllerConfig{DataDir: t.TempDir(), VPNCIDR: "10.7.0.0/24"}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.handleEvents)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan api.Event, 16)
+	go func() {
+		_ = api.NewClient(ts.URL).Events(ctx, "node-a", func(ev api.Event) { events <- ev })
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.events.mu.Lock()
+		n := len(s.events.subs)
+		s.events.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber never connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	next := func() api.Event {
+		t.Helper()
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for event")
+			return api.Event{}
+		}
+	}
+	post := func(h http.HandlerFunc, path string, body any) {
+		t.Helper()
+		payload, _ := json.Marshal(body)
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(payload)))
+		if rec.Code >= 300 {
+			t.Fatalf("%s status=%d body=%s", path, rec.Code, rec.Body.String())
+		}
+	}
+
+	post(s.handleRegister, "/register", api.RegisterRequest{Name: "node-a", PubKey: "pub-a", VPNIP: "10.7.0.2/32", Endpoint: "1.1.1.1:51820"})
+	post(s.handleRegister, "/register", api.RegisterRequest{Name: "node-b", PubKey: "pub-b", VPNIP: "10.7.0.3/32", Endpoint: "2.2.2.2:51820"})
+	for _, want := range []string{"node-a", "node-b"} {
+		if ev := next(); ev.Type != api.EventNodeJoined || ev.NodeID != want {
+			t.Fatalf("event=%+v want join %s", ev, want)
+		}
+	}
+
+	// A keepalive with nothing new is silent; a new endpoint is not.
+	post(s.handleRegister, "/register", api.RegisterRequest{Name: "node-a", PubKey: "pub-a", VPNIP: "10.7.0.2/32", Endpoint: "1.1.1.1:51820"})
+	post(s.handleRegister, "/register", api.RegisterRequest{Name: "node-a", PubKey: "pub-a", VPNIP: "10.7.0.2/32", Endpoint: "1.1.1.9:51820"})
+	if ev := next(); ev.Type != api.EventEndpointChanged || ev.NodeID != "node-a" {
+		t.Fatalf("event=%+v", ev)
+	}
+
+	// Mutual mode: readiness flips only once both directions succeeded.
+	post(s.handleDirectResult, "/direct-result", api.DirectResultRequest{NodeID: "node-a", PeerID: "node-b", Success: true})
+	post(s.handleDirectResult, "/direct-result", api.DirectResultRequest{NodeID: "node-b", PeerID: "node-a", Success: true})
+	ev := next()
+	if ev.Type != api.EventP2PReadyChanged || !ev.P2PReady || ev.NodeID != "node-a" || ev.PeerID != "node-b" {
+		t.Fatalf("event=%+v", ev)
+	}
+
+	// Going offline is reported as leaving.
+	if err := s.reapOnce(time.Now().UTC().Add(time.Hour)); err != nil {
+		t.Fatalf("reapOnce: %v", err)
+	}
+	left := map[string]bool{}
+	for range 2 {
+		ev := next()
+		if ev.Type != api.EventNodeLeft {
+			t.Fatalf("event=%+v", ev)
+		}
+		left[ev.NodeID] = true
+	}
+	if !left["node-a"] || !left["node-b"] {
+		t.Fatalf("left=%v", left)
+	}
+}
+
+func TestAdminNodes_RemoveRenameDisable(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.ControllerConfig{DataDir: t.TempDir(), VPNCIDR: "10.7.0.0/24"}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+
+	now := time.Now().UTC()
+	for _, n := range []store.NodeInfo{
+		{ID: "node-a", Name: "node-a", PubKey: "pub-a", VPNIP: "10.7.0.2/32", LastSeenAt: now, Status: store.StatusOnline},
+		{ID: "node-b", Name: "node-b", PubKey: "pub-b", VPNIP: "10.7.0.3/32", LastSeenAt: now, Status: store.StatusOnline},
+		{ID: "node-c", Name: "node-c", PubKey: "pub-c", VPNIP: "10.7.0.4/32", LastSeenAt: now, Status: store.StatusOnline},
+	} {
+		s.reg.Nodes = append(s.reg.Nodes, n)
+		if err := s.saveNodeLocked(n); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+	s.directOK["node-a"] = map[string]time.Time{"node-b": now}
+	s.directOK["node-b"] = map[string]time.Time{"node-a": now}
+
+	post := func(h http.HandlerFunc, body any) int {
+		t.Helper()
+		payload, _ := json.Marshal(body)
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodPost, "/admin", bytes.NewReader(payload)))
+		return rec.Code
+	}
+
+	// Remove: gone from registry, database and probe state; old certs rejected.
+	if code := post(s.handleRemoveNode, api.RemoveNodeRequest{Name: "node-b"}); code != http.StatusNoContent {
+		t.Fatalf("remove status=%d", code)
+	}
+	if code := post(s.handleRemoveNode, api.RemoveNodeRequest{Name: "node-b"}); code != http.StatusNotFound {
+		t.Fatalf("second remove status=%d", code)
+	}
+	if _, ok := s.directOK["node-b"]; ok {
+		t.Fatal("directOK still has node-b")
+	}
+	if _, ok := s.directOK["node-a"]["node-b"]; ok {
+		t.Fatal("directOK[node-a] still has node-b")
+	}
+	nodes, err := s.db.Nodes()
+	if err != nil {
+		t.Fatalf("Nodes: %v", err)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("persisted nodes=%+v", nodes)
+	}
+	oldCert := &x509.Certificate{Subject: pkix.Name{CommonName: "node-b"}, NotBefore: now.Add(-time.Hour)}
+	newCert := &x509.Certificate{Subject: pkix.Name{CommonName: "node-b"}, NotBefore: now.Add(time.Hour)}
+	if !s.certRevoked(oldCert) || s.certRevoked(newCert) {
+		t.Fatal("revocation cutoff not applied")
+	}
+
+	// Rename keeps the ID, rejects collisions, and the agent can still
+	// register under its original name.
+	if code := post(s.handleRenameNode, api.RenameNodeRequest{Name: "node-a", NewName: "node-c"}); code != http.StatusConflict {
+		t.Fatalf("rename collision status=%d", code)
+	}
+	events := s.events.subscribe()
+	defer s.events.unsubscribe(events)
+	if code := post(s.handleRenameNode, api.RenameNodeRequest{Name: "node-a", NewName: "web-1"}); code != http.StatusNoContent {
+		t.Fatalf("rename status=%d", code)
+	}
+	select {
+	case ev := <-events:
+		if ev.Type != api.EventNodeRenamed || ev.NodeID != "node-a" {
+			t.Fatalf("rename event=%+v", ev)
+		}
+	default:
+		t.Fatal("rename published no event")
+	}
+	if code := post(s.handleRegister, api.RegisterRequest{Name: "node-a", PubKey: "pub-a", VPNIP: "10.7.0.2/32"}); code != http.StatusOK {
+		t.Fatalf("register status=%d", code)
+	}
+	if len(s.reg.Nodes) != 2 || s.reg.Nodes[s.findNodeLocked("web-1")].ID != "node-a" {
+		t.Fatalf("nodes=%+v", s.reg.Nodes)
+	}
+
+	// Disable removes the node from candidates and the hub and refuses registration.
+	if code := post(s.handleDisableNode, api.DisableNodeRequest{Name: "node-c", Disabled: true}); code != http.StatusNoContent {
+		t.Fatalf("disable status=%d", code)
+	}
+	s.mu.Lock()
+	peers := s.peersLocked("node-a")
+	wgPeers := s.peersForWGLocked()
+	s.mu.Unlock()
+	if len(peers) != 0 || len(wgPeers) != 1 {
+		t.Fatalf("peers=%+v wg=%+v", peers, wgPeers)
+	}
+	if code := post(s.handleRegister, api.RegisterRequest{Name: "node-c", PubKey: "pub-c", VPNIP: "10.7.0.4/32"}); code != http.StatusForbidden {
+		t.Fatalf("disabled register status=%d", code)
+	}
+	if code := post(s.handleDisableNode, api.DisableNodeRequest{Name: "node-c", Disabled: false}); code != http.StatusNoContent {
+		t.Fatalf("enable status=%d", code)
+	}
+	if code := post(s.handleRegister, api.RegisterRequest{Name: "node-c", PubKey: "pub-c", VPNIP: "10.7.0.4/32"}); code != http.StatusOK {
+		t.Fatalf("re-enabled register status=%d", code)
+	}
+}
+
+func TestRequireClientCert_BindsNodeIdentity(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.ControllerConfig{DataDir: t.TempDir(), VPNCIDR: "10.7.0.0/24", PKI: &config.PKIConfig{}}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+	s.pkiDir = "pki"
+
+	now := time.Now().UTC()
+	s.reg.Nodes = []store.NodeInfo{
+		{ID: "node-a", Name: "node-a", PubKey: "pub-a", VPNIP: "10.7.0.2/32", LastSeenAt: now, Status: store.StatusOnline},
+		{ID: "node-b", Name: "node-b", PubKey: "pub-b", VPNIP: "10.7.0.3/32", LastSeenAt: now, Status: store.StatusOnline},
+	}
+
+	// as sends body to h through requireClientCert with a certificate for cn.
+	as := func(cn string, h http.HandlerFunc, body any) int {
+		t.Helper()
+		payload, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: cn}, NotBefore: now}}}
+		rec := httptest.NewRecorder()
+		s.requireClientCert(h)(rec, req)
+		return rec.Code
+	}
+
+	cases := []struct {
+		name string
+		h    http.HandlerFunc
+		body any
+		want int
+	}{
+		{"register other name", s.handleRegister, api.RegisterRequest{Name: "node-a", PubKey: "evil", VPNIP: "10.7.0.2/32"}, http.StatusForbidden},
+		{"register other vpn ip", s.handleRegister, api.RegisterRequest{Name: "node-b", PubKey: "pub-b", VPNIP: "10.7.0.2/32"}, http.StatusConflict},
+		{"register self", s.handleRegister, api.RegisterRequest{Name: "node-b", PubKey: "pub-b", VPNIP: "10.7.0.3/32"}, http.StatusOK},
+		{"nat probe other", s.handleNATProbe, api.NATProbeRequest{NodeID: "node-a", PublicAddr: "6.6.6.6:1"}, http.StatusForbidden},
+		{"nat probe self", s.handleNATProbe, api.NATProbeRequest{NodeID: "node-b", PublicAddr: "2.2.2.2:1"}, http.StatusNoContent},
+		{"direct result other", s.handleDirectResult, api.DirectResultRequest{NodeID: "node-a", PeerID: "node-b", Success: true}, http.StatusForbidden},
+		{"metrics other", s.handleMetrics, api.MetricsRequest{NodeID: "node-a", Samples: []model.Metric{{NodeID: "node-a"}}}, http.StatusForbidden},
+		{"metrics sample for other", s.handleMetrics, api.MetricsRequest{NodeID: "node-b", Samples: []model.Metric{{NodeID: "node-a"}}}, http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		if got := as("node-b", tc.h, tc.body); got != tc.want {
+			t.Errorf("%s: status=%d want %d", tc.name, got, tc.want)
+		}
+	}
+
+	if s.reg.Nodes[0].PubKey != "pub-a" || s.reg.Nodes[0].PublicAddr != "" {
+		t.Fatalf("node-a modified: %+v", s.reg.Nodes[0])
+	}
+	if _, ok := s.directOK["node-a"]; ok {
+		t.Fatal("direct result recorded for node-a")
+	}
+}
+
+func TestRequireAdmin_RejectsNodeCertificates(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.ControllerConfig{DataDir: t.TempDir(), PKI: &config.PKIConfig{}}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+	s.pkiDir = "pki"
+
+	call := func(ou []string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/fleet/status", nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{
+			Subject:   pkix.Name{CommonName: "alice", OrganizationalUnit: ou},
+			NotBefore: time.Now(),
+		}}}
+		rec := httptest.NewRecorder()
+		s.requireAdmin(s.handleFleetStatus)(rec, req)
+		return rec.Code
+	}
+
+	if code := call(nil); code != http.StatusForbidden {
+		t.Fatalf("legacy cert status=%d", code)
+	}
+	if code := call([]string{pki.RoleNode}); code != http.StatusForbidden {
+		t.Fatalf("node cert status=%d", code)
+	}
+	if code := call([]string{pki.RoleAdmin}); code != http.StatusOK {
+		t.Fatalf("admin cert status=%d", code)
+	}
+}
+
+func TestHASnapshot_RequiresHAPeerCertificate(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	s, err := NewServer(config.ControllerConfig{DataDir: dir, PKI: &config.PKIConfig{}})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+	s.pkiDir = filepath.Join(dir, "pki")
+	if err := os.MkdirAll(s.pkiDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{"ca.crt": "ca-cert", "ca.key": "ca-key"} {
+		if err := os.WriteFile(filepath.Join(s.pkiDir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	call := func(ou []string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/ha/snapshot", nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{
+			Subject:   pkix.Name{CommonName: "ctrl-2", OrganizationalUnit: ou},
+			NotBefore: time.Now(),
+		}}}
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, ou := range [][]string{nil, {pki.RoleNode}, {pki.RoleAdmin}} {
+		if rec := call(ou); rec.Code != http.StatusForbidden || strings.Contains(rec.Body.String(), "ca-key") {
+			t.Fatalf("%v cert: status=%d body=%s", ou, rec.Code, rec.Body.String())
+		}
+	}
+	rec := call([]string{pki.RoleHAPeer})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ha-peer cert status=%d: %s", rec.Code, rec.Body.String())
+	}
+	var snap api.HASnapshot
+	if err := json.Unmarshal(rec.Body.Bytes(), &snap); err != nil || snap.CAKey != "ca-key" {
+		t.Fatalf("snapshot=%+v err=%v", snap, err)
+	}
+}
+
+func TestRelayPeers_RequiresRelayCertificateForItsHub(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewServer(config.ControllerConfig{
+		DataDir: t.TempDir(),
+		PKI:     &config.PKIConfig{},
+		HubName: "main",
+		Hubs: []config.HubConfig{
+			{Name: "eu", PublicKey: "pub-eu", Endpoint: "203.0.113.2:51820", Address: "10.7.0.250/32"},
+			{Name: "us", PublicKey: "pub-us", Endpoint: "203.0.113.3:51820", Address: "10.7.0.251/32"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+	s.pkiDir = "pki"
+
+	call := func(path, cn string, ou []string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{
+			Subject:   pkix.Name{CommonName: cn, OrganizationalUnit: ou},
+			NotBefore: time.Now(),
+		}}}
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	cases := []struct {
+		name string
+		path string
+		cn   string
+		ou   []string
+		want int
+	}{
+		{"relay own hub", "/relay/peers?hub=eu", "eu", []string{pki.RoleRelay}, http.StatusOK},
+		{"relay other hub", "/relay/peers?hub=us", "eu", []string{pki.RoleRelay}, http.StatusForbidden},
+		{"admin", "/relay/peers?hub=eu", "eu", []string{pki.RoleAdmin}, http.StatusForbidden},
+		{"node", "/relay/peers?hub=eu", "eu", nil, http.StatusForbidden},
+		{"relay fleet status", "/fleet/status", "eu", []string{pki.RoleRelay}, http.StatusForbidden},
+		{"relay candidates", "/candidates?node_id=eu", "eu", []string{pki.RoleRelay}, http.StatusForbidden},
+		{"relay snapshot", "/ha/snapshot", "eu", []string{pki.RoleRelay}, http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		if got := call(tc.path, tc.cn, tc.ou); got != tc.want {
+			t.Errorf("%s: status=%d want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestIPAM_ReservationsAndReclaim(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.ControllerConfig{
+		DataDir:             t.TempDir(),
+		VPNCIDR:             "10.7.0.0/24",
+		NodeStaleAfterSec:   60,
+		NodeOfflineAfterSec: 300,
+		IPAM: &config.IPAMConfig{
+			Reserved:     []string{"10.7.0.1-10.7.0.9"},
+			Reservations: []config.IPReservation{{Name: "db-1", VPNIP: "10.7.0.50"}},
+			ReclaimAfter: "1h",
+		},
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+
+	post := func(h http.HandlerFunc, body any) *httptest.ResponseRecorder {
+		t.Helper()
+		payload, _ := json.Marshal(body)
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodPost, "/admin/ipam", bytes.NewReader(payload)))
+		return rec
+	}
+	register := func(name, vpnIP string) api.RegisterResponse {
+		t.Helper()
+		rec := post(s.handleRegister, api.RegisterRequest{Name: name, PubKey: "pub-" + name, VPNIP: vpnIP})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("register %s status=%d body=%s", name, rec.Code, rec.Body.String())
+		}
+		var resp api.RegisterResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp
+	}
+
+	// Allocation skips the reserved range; a config reservation is pinned.
+	if got := register("web-1", "").VPNIP; got != "10.7.0.10/32" {
+		t.Fatalf("web-1 vpn_ip=%q", got)
+	}
+	if got := register("db-1", "").VPNIP; got != "10.7.0.50/32" {
+		t.Fatalf("db-1 vpn_ip=%q", got)
+	}
+
+	// API reservations reject addresses outside the prefix or held by others.
+	if rec := post(s.handleIPAMReserve, api.ReserveIPRequest{Name: "cache-1", VPNIP: "10.8.0.5"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("outside reserve status=%d", rec.Code)
+	}
+	if rec := post(s.handleIPAMReserve, api.ReserveIPRequest{Name: "cache-1", VPNIP: "10.7.0.10"}); rec.Code != http.StatusConflict {
+		t.Fatalf("in-use reserve status=%d", rec.Code)
+	}
+	if rec := post(s.handleIPAMReserve, api.ReserveIPRequest{Name: "db-1", VPNIP: "10.7.0.60"}); rec.Code != http.StatusConflict {
+		t.Fatalf("config-owned reserve status=%d", rec.Code)
+	}
+	if rec := post(s.handleIPAMReserve, api.ReserveIPRequest{Name: "cache-1", VPNIP: "10.7.0.20"}); rec.Code != http.StatusOK {
+		t.Fatalf("reserve status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	// Another node cannot claim a reserved address; the owner gets it.
+	if rec := post(s.handleRegister, api.RegisterRequest{Name: "rogue", PubKey: "pub-rogue", VPNIP: "10.7.0.20/32"}); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), api.ErrCodeVPNIPConflict) {
+		t.Fatalf("reserved claim status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	if got := register("cache-1", "").VPNIP; got != "10.7.0.20/32" {
+		t.Fatalf("cache-1 vpn_ip=%q", got)
+	}
+
+	// Reservations survive a restart.
+	restarted, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer restart: %v", err)
+	}
+	restarted.mu.Lock()
+	reservations := restarted.reservationsLocked()
+	restarted.mu.Unlock()
+	restarted.Close()
+	if len(reservations) != 2 || reservations[0].Source != reservationFromConfig || reservations[1].VPNIP != "10.7.0.20/32" {
+		t.Fatalf("reservations=%+v", reservations)
+	}
+
+	// Nodes offline past reclaim_after lose their address unless reserved.
+	s.mu.Lock()
+	old := time.Now().UTC().Add(-2 * time.Hour)
+	for i := range s.reg.Nodes {
+		s.reg.Nodes[i].LastSeenAt = old
+	}
+	s.mu.Unlock()
+	if err := s.reapOnce(time.Now().UTC()); err != nil {
+		t.Fatalf("reapOnce: %v", err)
+	}
+	want := map[string]string{"web-1": "", "db-1": "10.7.0.50/32", "cache-1": "10.7.0.20/32"}
+	for _, n := range s.reg.Nodes {
+		if n.VPNIP != want[n.Name] {
+			t.Fatalf("%s vpn_ip=%q want %q", n.Name, n.VPNIP, want[n.Name])
+		}
+	}
+
+	// Releasing an API reservation frees it; config ones are read-only.
+	if rec := post(s.handleIPAMRelease, api.ReleaseIPRequest{Name: "db-1"}); rec.Code != http.StatusConflict {
+		t.Fatalf("config release status=%d", rec.Code)
+	}
+	if rec := post(s.handleIPAMRelease, api.ReleaseIPRequest{VPNIP: "10.7.0.20"}); rec.Code != http.StatusNoContent {
+		t.Fatalf("release status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := post(s.handleIPAMRelease, api.ReleaseIPRequest{Name: "cache-1"}); rec.Code != http.StatusNotFound {
+		t.Fatalf("second release status=%d", rec.Code)
+	}
+
+	// A returning node whose address was reclaimed gets a fresh one.
+	if got := register("web-1", "10.7.0.10/32").VPNIP; got == "" {
+		t.Fatal("web-1 not re-allocated")
+	}
+}
+
+func TestParseAddrRange(t *testing.T) {
+	cases := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: "10.7.0.1-10.7.0.9", want: "10.7.0.1-10.7.0.9"},
+		{in: "10.7.0.16/30", want: "10.7.0.16-10.7.0.19"},
+		{in: "fd7a::1", want: "fd7a::1"},
+		{in: "10.7.0.9-10.7.0.1", wantErr: true},
+		{in: "10.7.0.1-fd7a::1", wantErr: true},
+		{in: "nope", wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := parseAddrRange(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s: err=%v", tc.in, err)
+		}
+		if err == nil && got.String() != tc.want {
+			t.Fatalf("%s: got %s want %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestRotateKey_PendingUntilConfirmed(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.ControllerConfig{DataDir: t.TempDir(), VPNCIDR: "10.7.0.0/24", WGInterface: "wg0"}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+
+	post := func(h http.HandlerFunc, body any) int {
+		t.Helper()
+		payload, _ := json.Marshal(body)
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodPost, "/rotate-key", bytes.NewReader(payload)))
+		return rec.Code
+	}
+	hubKeys := func() map[string]int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		out := map[string]int{}
+		for _, p := range s.peersForWGLocked() {
+			out[p.PublicKey] = len(p.AllowedIPs)
+		}
+		return out
+	}
+
+	for _, n := range []string{"node-a", "node-b"} {
+		if code := post(s.handleRegister, api.RegisterRequest{Name: n, PubKey: "pub-" + n}); code != http.StatusOK {
+			t.Fatalf("register %s status=%d", n, code)
+		}
+	}
+
+	// Registering a different key no longer replaces it silently.
+	if code := post(s.handleRegister, api.RegisterRequest{Name: "node-a", PubKey: "pub-other"}); code != http.StatusConflict {
+		t.Fatalf("key change via register status=%d", code)
+	}
+	if code := post(s.handleRotateKey, api.RotateKeyRequest{Name: "node-a", PubKey: "pub-node-b"}); code != http.StatusConflict {
+		t.Fatalf("rotate to foreign key status=%d", code)
+	}
+
+	// The pending key joins the hub without AllowedIPs; the old key keeps
+	// routing and stays the one P2P peers see.
+	if code := post(s.handleRotateKey, api.RotateKeyRequest{Name: "node-a", PubKey: "pub-next"}); code != http.StatusNoContent {
+		t.Fatalf("rotate status=%d", code)
+	}
+	if keys := hubKeys(); keys["pub-node-a"] != 1 || keys["pub-next"] != 0 || len(keys) != 3 {
+		t.Fatalf("hub peers=%v", keys)
+	}
+	s.mu.Lock()
+	peers := s.peersLocked("node-b")
+	s.mu.Unlock()
+	if len(peers) != 1 || peers[0].PubKey != "pub-node-a" {
+		t.Fatalf("candidates=%+v", peers)
+	}
+	if code := post(s.handleRegister, api.RegisterRequest{Name: "node-a", PubKey: "pub-next"}); code != http.StatusOK {
+		t.Fatalf("mid-rotation register status=%d", code)
+	}
+
+	// Confirmation needs the pending key, and a hub handshake when the
+	// controller manages the hub.
+	if code := post(s.handleConfirmKey, api.RotateKeyRequest{Name: "node-a", PubKey: "pub-other"}); code != http.StatusConflict {
+		t.Fatalf("confirm wrong key status=%d", code)
+	}
+	s.wg = wireguard.NewManager(&fakeRunner{out: map[string]string{
+		"wg show wg0 dump": "wg0\t(priv)\t(pub)\t51820\toff\n" +
+			"pub-next\t(psk)\t39.1.2.3:51820\t(none)\t0\t0\t0\toff\n",
+	}})
+	s.cfg.WGApply = true
+	if code := post(s.handleConfirmKey, api.RotateKeyRequest{Name: "node-a", PubKey: "pub-next"}); code != http.StatusConflict {
+		t.Fatalf("confirm without handshake status=%d", code)
+	}
+	s.cfg.WGApply = false
+	if code := post(s.handleConfirmKey, api.RotateKeyRequest{Name: "node-a", PubKey: "pub-next"}); code != http.StatusNoContent {
+		t.Fatalf("confirm status=%d", code)
+	}
+
+	// The old key is retired everywhere.
+	if keys := hubKeys(); keys["pub-next"] != 1 || len(keys) != 2 {
+		t.Fatalf("hub peers=%v", keys)
+	}
+	nodes, err := s.db.Nodes()
+	if err != nil {
+		t.Fatalf("Nodes: %v", err)
+	}
+	if nodes[0].PubKey != "pub-next" || nodes[0].PendingPubKey != "" {
+		t.Fatalf("persisted=%+v", nodes[0])
+	}
+	if code := post(s.handleRegister, api.RegisterRequest{Name: "node-a", PubKey: "pub-node-a"}); code != http.StatusConflict {
+		t.Fatalf("retired key register status=%d", code)
+	}
+}
+
+func TestReconcileOnce_RepairsOnlyDriftedPeers(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.ControllerConfig{DataDir: t.TempDir(), WGApply: true, WGInterface: "wg0", WGPrivateKey: "priv", WGPort: 51820}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+
+	s.reg.Nodes = []store.NodeInfo{
+		{ID: "a", Name: "a", PubKey: "pub-a", VPNIP: "10.7.0.2/32,fd7a::2/128"},
+		{ID: "b", Name: "b", PubKey: "pub-b", VPNIP: "10.7.0.3/32"},
+		{ID: "c", Name: "c", PubKey: "pub-c", VPNIP: "10.7.0.4/32"},
+	}
+	runner := &fakeRunner{out: map[string]string{
+		"wg show wg0 dump": "priv\tpub\t51820\toff\n" +
+			"pub-a\t(none)\t(none)\tfd7a::2/128,10.7.0.2/32\t0\t0\t0\toff\n" +
+			"pub-b\t(none)\t(none)\t10.7.0.9/32\t0\t0\t0\toff\n" +
+			"pub-x\t(none)\t(none)\t10.7.0.5/32\t0\t0\t0\toff\n",
+	}}
+	s.wg = wireguard.NewManager(runner)
+
+	if err := s.reconcileOnce(); err != nil {
+		t.Fatalf("reconcileOnce: %v", err)
+	}
+	want := []string{
+		"wg set wg0 peer pub-c allowed-ips 10.7.0.4/32",
+		"wg set wg0 peer pub-b allowed-ips 10.7.0.3/32",
+		"wg set wg0 peer pub-x remove",
+	}
+	if strings.Join(runner.runs, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("runs=%q", runner.runs)
+	}
+}
+
+func TestHA_StandbyReplicatesAndTakesOver(t *testing.T) {
+	t.Parallel()
+
+	active, err := NewServer(config.ControllerConfig{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewServer active: %v", err)
+	}
+	defer active.Close()
+	active.reg.Nodes = []store.NodeInfo{
+		{ID: "a", Name: "a", PubKey: "pub-a", VPNIP: "10.7.0.2/32"},
+		{ID: "b", Name: "b", PubKey: "pub-b", VPNIP: "10.7.0.3/32"},
+	}
+	if err := active.db.PutToken(store.Token{Hash: "tok-1"}); err != nil {
+		t.Fatalf("PutToken: %v", err)
+	}
+	ts := httptest.NewServer(active.routes())
+
+	standby, err := NewServer(config.ControllerConfig{
+		DataDir: t.TempDir(),
+		HA:      &config.HAConfig{Role: api.HARoleStandby, Peer: ts.URL, HeartbeatIntervalSec: 1, FailoverAfterSec: 3},
+	})
+	if err != nil {
+		t.Fatalf("NewServer standby: %v", err)
+	}
+	defer standby.Close()
+	if err := standby.PrepareHA(context.Background()); err != nil {
+		t.Fatalf("PrepareHA: %v", err)
+	}
+	if !standby.standby.Load() {
+		t.Fatal("expected standby role")
+	}
+	if len(standby.reg.Nodes) != 2 {
+		t.Fatalf("expected 2 replicated nodes, got %+v", standby.reg.Nodes)
+	}
+
+	rec := httptest.NewRecorder()
+	standby.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/candidates?node_id=a", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 from standby, got %d", rec.Code)
+	}
+
+	// Removals on the active are mirrored on the next heartbeat.
+	active.mu.Lock()
+	active.reg.Nodes = active.reg.Nodes[:1]
+	active.mu.Unlock()
+	if err := active.db.PutToken(store.Token{Hash: "tok-2"}); err != nil {
+		t.Fatalf("PutToken: %v", err)
+	}
+	now := time.Now()
+	if standby.haTick(now) {
+		t.Fatal("unexpected takeover while the active answers")
+	}
+	nodes, err := standby.db.Nodes()
+	if err != nil || len(nodes) != 1 || nodes[0].ID != "a" {
+		t.Fatalf("expected only node a in standby db, got %+v (err %v)", nodes, err)
+	}
+	tokens, err := standby.db.ListTokens()
+	if err != nil || len(tokens) != 2 {
+		t.Fatalf("expected 2 replicated tokens, got %v (err %v)", tokens, err)
+	}
+
+	ts.Close()
+	if standby.haTick(now.Add(time.Second)) {
+		t.Fatal("took over before failover_after_sec")
+	}
+	if !standby.haTick(now.Add(4 * time.Second)) {
+		t.Fatal("expected takeover after failover_after_sec")
+	}
+	standby.promote()
+	rec = httptest.NewRecorder()
+	standby.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/candidates?node_id=a", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 after takeover, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHA_StepsDownAfterPartitionHeals(t *testing.T) {
+	t.Parallel()
+
+	// partitioned makes both controllers unreachable to each other.
+	var partitioned atomic.Bool
+	serve := func(s *Server) *httptest.Server {
+		h := s.routes()
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if partitioned.Load() {
+				http.Error(w, "unreachable", http.StatusBadGateway)
+				return
+			}
+			h.ServeHTTP(w, r)
+		}))
+	}
+	newServer := func(role string) *Server {
+		s, err := NewServer(config.ControllerConfig{
+			DataDir: t.TempDir(),
+			HA:      &config.HAConfig{Role: role, HeartbeatIntervalSec: 1, FailoverAfterSec: 3},
+		})
+		if err != nil {
+			t.Fatalf("NewServer %s: %v", role, err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	a, b := newServer(api.HARoleActive), newServer(api.HARoleStandby)
+	tsA, tsB := serve(a), serve(b)
+	defer tsA.Close()
+	defer tsB.Close()
+	a.cfg.HA.Peer, b.cfg.HA.Peer = tsB.URL, tsA.URL
+	a.reg.Nodes = []store.NodeInfo{{ID: "a", Name: "a", PubKey: "pub-a", VPNIP: "10.7.0.2/32"}}
+
+	if err := b.PrepareHA(context.Background()); err != nil {
+		t.Fatalf("PrepareHA b: %v", err)
+	}
+	if err := a.PrepareHA(context.Background()); err != nil {
+		t.Fatalf("PrepareHA a: %v", err)
+	}
+	if a.standby.Load() || !b.standby.Load() {
+		t.Fatalf("roles: a standby=%v b standby=%v", a.standby.Load(), b.standby.Load())
+	}
+	if a.haPeerTookOver() {
+		t.Fatal("active stepped down for a standby peer")
+	}
+
+	// b loses a and takes over; a keeps serving on its side of the partition.
+	partitioned.Store(true)
+	now := time.Now()
+	b.haLastHeartbeat = now
+	if !b.haTick(now.Add(4 * time.Second)) {
+		t.Fatal("expected takeover after failover_after_sec")
+	}
+	b.promote()
+	if a.haPeerTookOver() {
+		t.Fatal("active stepped down for an unreachable peer")
+	}
+	b.mu.Lock()
+	b.reg.Nodes = append(b.reg.Nodes, store.NodeInfo{ID: "b", Name: "b", PubKey: "pub-b", VPNIP: "10.7.0.3/32"})
+	b.mu.Unlock()
+
+	// Once the partition heals, the older epoch yields and follows the newer.
+	partitioned.Store(false)
+	if b.haPeerTookOver() {
+		t.Fatal("promoted controller stepped down")
+	}
+	if !a.haPeerTookOver() {
+		t.Fatal("expected the old active to yield to the newer epoch")
+	}
+	a.demote(now)
+	if !a.standby.Load() || b.standby.Load() {
+		t.Fatalf("roles after heal: a standby=%v b standby=%v", a.standby.Load(), b.standby.Load())
+	}
+	if a.haTick(now.Add(5 * time.Second)) {
+		t.Fatal("demoted controller took over while the peer answers")
+	}
+	if len(a.reg.Nodes) != 2 || a.haEpoch.Load() != b.haEpoch.Load() {
+		t.Fatalf("after sync: nodes=%+v epoch a=%d b=%d", a.reg.Nodes, a.haEpoch.Load(), b.haEpoch.Load())
+	}
+	rec := httptest.NewRecorder()
+	a.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/candidates?node_id=a", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 from the demoted controller, got %d", rec.Code)
+	}
+}
+
+func TestHubs_AssignByRTTAndRouteThroughActiveHub(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewServer(config.ControllerConfig{
+		DataDir:         t.TempDir(),
+		HubName:         "main",
+		WGAddress:       "10.7.0.1/24",
+		ServerPublicKey: "pub-main",
+		ServerEndpoint:  "203.0.113.1:51820",
+		Hubs: []config.HubConfig{
+			{Name: "eu", PublicKey: "pub-eu", Endpoint: "203.0.113.2:51820", Address: "10.7.0.250/32"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+	s.reg.Nodes = []store.NodeInfo{
+		{ID: "a", Name: "a", PubKey: "pub-a", VPNIP: "10.7.0.2/32"},
+		{ID: "b", Name: "b", PubKey: "pub-b", VPNIP: "10.7.0.3/32"},
+	}
+
+	body := `{"node_id":"a","results":[{"hub":"main","success":true,"rtt_ms":40},{"hub":"eu","success":true,"rtt_ms":10},{"hub":"gone","success":true,"rtt_ms":1}]}`
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/hub-rtt", strings.NewReader(body)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("hub-rtt: expected 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ordered := s.assignHubsLocked(&s.reg.Nodes[0])
+	if len(ordered) != 2 || ordered[0].Name != "eu" || ordered[1].Name != "main" {
+		t.Fatalf("expected eu then main, got %+v", ordered)
+	}
+	if n := s.reg.Nodes[0]; n.PrimaryHub != "eu" || n.BackupHub != "main" {
+		t.Fatalf("expected primary eu and backup main, got %q/%q", n.PrimaryHub, n.BackupHub)
+	}
+
+	// A slightly faster hub does not move the primary.
+	s.hubRTT["a"]["main"] = 9
+	s.assignHubsLocked(&s.reg.Nodes[0])
+	if s.reg.Nodes[0].PrimaryHub != "eu" {
+		t.Fatalf("expected primary to stay on eu, got %q", s.reg.Nodes[0].PrimaryHub)
+	}
+
+	// Until a assumes eu, the controller's hub carries its traffic and eu
+	// only pre-installs it.
+	s.assignHubsLocked(&s.reg.Nodes[1])
+	s.reg.Nodes[0].ActiveHub = "main"
+	eu := s.hubPeersLocked("eu")
+	if got := peerAllowed(eu, "pub-a"); got != "" {
+		t.Fatalf("expected a on eu without allowed ips, got %q", got)
+	}
+	if got := peerAllowed(eu, "pub-main"); got != "10.7.0.1/32,10.7.0.2/32,10.7.0.3/32" {
+		t.Fatalf("expected eu to route a and b via main, got %q", got)
+	}
+
+	s.reg.Nodes[0].ActiveHub = "eu"
+	local := s.hubPeersLocked("main")
+	if got := peerAllowed(local, "pub-eu"); got != "10.7.0.250/32,10.7.0.2/32" {
+		t.Fatalf("expected main to route a via eu, got %q", got)
+	}
+	if got := peerAllowed(local, "pub-a"); got != "" {
+		t.Fatalf("expected a on main without allowed ips, got %q", got)
+	}
+	if got := peerAllowed(local, "pub-b"); got != "10.7.0.3/32" {
+		t.Fatalf("expected b routed through main, got %q", got)
+	}
+}
+
+// peerAllowed returns the comma-joined AllowedIPs of the peer with key, or
+// "missing" when there is none.
+func peerAllowed(peers []wireguard.Peer, key string) string {
+	for _, p := range peers {
+		if p.PublicKey == key {
+			return strings.Join(p.AllowedIPs, ",")
+		}
+	}
+	return "missing"
+}
+
+func TestACL_FiltersCandidatesAndEnforcesOnHub(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	policyPath := filepath.Join(dir, "acl.yaml")
+	if err := os.WriteFile(policyPath, []byte("acls:\n  - from: [laptop]\n    to: [server]\n"), 0o600); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	s, err := NewServer(config.ControllerConfig{
+		DataDir: dir, ACLFile: policyPath, WGApply: true, WGInterface: "wg0",
+		WGAddress: "10.7.0.1/24", WGPrivateKey: "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+	runner := &fakeRunner{}
+	s.wg = wireguard.NewManager(runner)
+	s.reg.Nodes = []store.NodeInfo{
+		{ID: "a", Name: "a", PubKey: "pub-a", VPNIP: "10.7.0.2/32", Tags: []string{"laptop"}},
+		{ID: "b", Name: "b", PubKey: "pub-b", VPNIP: "10.7.0.3/32", Tags: []string{"server"}},
+		{ID: "c", Name: "c", PubKey: "pub-c", VPNIP: "10.7.0.4/32"},
+	}
+
+	candidateIDs := func(nodeID string) []string {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var ids []string
+		for _, p := range s.peersLocked(nodeID) {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+	if got := candidateIDs("a"); !slices.Equal(got, []string{"b"}) {
+		t.Fatalf("candidates of a: %v", got)
+	}
+	// The server may not open connections to the laptop, so it does not
+	// get it as a peer and the pair never goes direct: the hub relays and
+	// filters their traffic.
+	if got := candidateIDs("b"); len(got) != 0 {
+		t.Fatalf("candidates of b: %v", got)
+	}
+	now := time.Now().UTC()
+	s.directOK["a"] = map[string]time.Time{"b": now}
+	s.directOK["b"] = map[string]time.Time{"a": now}
+	s.mu.Lock()
+	peers := s.peersLocked("a")
+	s.mu.Unlock()
+	if len(peers) != 1 || peers[0].P2PReady {
+		t.Fatalf("one-way pair offered as direct: %+v", peers)
+	}
+	if got := candidateIDs("c"); len(got) != 0 {
+		t.Fatalf("candidates of untagged c: %v", got)
+	}
+
+	// Retagging tells agents to refresh their peers.
+	events := s.events.subscribe()
+	defer s.events.unsubscribe(events)
+	expectUpdated := func(nodeID string) {
+		t.Helper()
+		select {
+		case ev := <-events:
+			if ev.Type != api.EventNodeUpdated || ev.NodeID != nodeID {
+				t.Fatalf("tag change event=%+v", ev)
+			}
+		default:
+			t.Fatalf("tag change of %s published no event", nodeID)
+		}
+	}
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/nodes/tags", strings.NewReader(`{"name":"c","tags":["server"]}`)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("tag-node: expected 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+	expectUpdated("c")
+	if got := candidateIDs("a"); !slices.Equal(got, []string{"b", "c"}) {
+		t.Fatalf("candidates of a after tagging c: %v", got)
+	}
+	if len(runner.runs) != 1 || !strings.HasPrefix(runner.runs[0], "nft -f ") {
+		t.Fatalf("expected one nft apply, got %v", runner.runs)
+	}
+
+	s.mu.Lock()
+	rules := s.firewallRulesLocked()
+	s.mu.Unlock()
+	if len(rules) != 1 || len(rules[0].Src) != 1 || len(rules[0].Dst) != 2 || rules[0].Src[0].String() != "10.7.0.2/32" {
+		t.Fatalf("unexpected hub rules: %+v", rules)
+	}
+
+	// So does a node changing its own tags.
+	rec = httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(`{"name":"b","pub_key":"pub-b","vpn_ip":"10.7.0.3/32"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("register b: status=%d %s", rec.Code, rec.Body.String())
+	}
+	expectUpdated("b")
+	if got := candidateIDs("a"); !slices.Equal(got, []string{"c"}) {
+		t.Fatalf("candidates of a after b dropped its tag: %v", got)
+	}
+
+	// An exit node gets its clients even when it may not reach them.
+	s.mu.Lock()
+	s.reg.Nodes[0].UseExitNode = "b"
+	peers = s.peersLocked("b")
+	s.mu.Unlock()
+	if len(peers) != 1 || peers[0].ID != "a" || !peers[0].ExitClient || peers[0].P2PReady {
+		t.Fatalf("candidates of exit node b: %+v", peers)
+	}
+}
+
+func TestRoutes_ApprovalConflictsAndDistribution(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewServer(config.ControllerConfig{DataDir: t.TempDir(), VPNCIDR: "10.7.0.0/24"})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+	s.reg.Nodes = []store.NodeInfo{
+		{ID: "a", Name: "a", PubKey: "pub-a", VPNIP: "10.7.0.2/32", AdvertisedRoutes: []string{"192.168.1.0/24"}},
+		{ID: "b", Name: "b", PubKey: "pub-b", VPNIP: "10.7.0.3/32", AdvertisedRoutes: []string{"192.168.1.128/25", "10.7.0.0/16"}},
+	}
+
+	approve := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/routes/approve", strings.NewReader(body)))
+		return rec
+	}
+	if rec := approve(`{"name":"a","route":"192.168.2.0/24","approve":true}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("unadvertised route: expected 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := approve(`{"name":"a","route":"192.168.1.0/24","approve":true}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("approve: expected 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := approve(`{"name":"b","route":"192.168.1.128/25","approve":true}`); rec.Code != http.StatusConflict {
+		t.Fatalf("overlapping route: expected 409, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := approve(`{"name":"b","route":"10.7.0.0/16","approve":true}`); rec.Code != http.StatusConflict {
+		t.Fatalf("overlay route: expected 409, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/routes", nil))
+	var list api.RoutesResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("decode routes: %v", err)
+	}
+	if len(list.Routes) != 3 || !list.Routes[0].Approved || list.Routes[1].Conflict == "" {
+		t.Fatalf("unexpected routes: %+v", list.Routes)
+	}
+
+	s.mu.Lock()
+	peers := s.peersLocked("b")
+	hub := s.peersForWGLocked()
+	s.mu.Unlock()
+	if len(peers) != 1 || !slices.Equal(peers[0].Routes, []string{"192.168.1.0/24"}) {
+		t.Fatalf("expected b to see a's route, got %+v", peers)
+	}
+	if got := peerAllowed(hub, "pub-a"); got != "10.7.0.2/32,192.168.1.0/24" {
+		t.Fatalf("expected the hub to route 192.168.1.0/24 to a, got %q", got)
+	}
+
+	// A route a stops advertising is no longer used, though it stays approved.
+	s.mu.Lock()
+	s.reg.Nodes[0].AdvertisedRoutes = nil
+	hub = s.peersForWGLocked()
+	s.mu.Unlock()
+	if got := peerAllowed(hub, "pub-a"); got != "10.7.0.2/32" {
+		t.Fatalf("expected withdrawn route off the hub, got %q", got)
+	}
+}
+
+func TestExitNode_CandidatesPairClientsWithExitNode(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewServer(config.ControllerConfig{DataDir: t.TempDir(), VPNCIDR: "10.7.0.0/24"})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+
+	register := func(body string) {
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("register: expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+	register(`{"name":"gw","pub_key":"pub-gw","exit_node":true}`)
+	register(`{"name":"laptop","pub_key":"pub-laptop","use_exit_node":"gw"}`)
+	register(`{"name":"desk","pub_key":"pub-desk"}`)
+
+	check := func(exitName string) {
+		t.Helper()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, p := range s.peersLocked("laptop") {
+			if p.ExitNode != (p.Name == exitName) || p.ExitClient {
+				t.Fatalf("laptop candidate %+v", p)
+			}
+		}
+		for _, p := range s.peersLocked("gw") {
+			if p.ExitClient != (p.Name == "laptop") || p.ExitNode {
+				t.Fatalf("gw candidate %+v", p)
+			}
+		}
+	}
+	check("gw")
+
+	// The client selects gw by its ID, which a rename keeps.
+	rename := func(name, newName string) int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/nodes/rename", strings.NewReader(`{"name":"`+name+`","new_name":"`+newName+`"}`)))
+		return rec.Code
+	}
+	if code := rename("gw", "egress"); code != http.StatusNoContent {
+		t.Fatalf("rename gw: status=%d", code)
+	}
+	check("egress")
+
+	// A client selecting the exit node by its display name would lose it.
+	register(`{"name":"laptop","pub_key":"pub-laptop","use_exit_node":"egress"}`)
+	if code := rename("egress", "egress-2"); code != http.StatusConflict {
+		t.Fatalf("rename exit node used by name: status=%d", code)
+	}
+	check("egress")
+}
+
+func TestEphemeral_RemovedOnLeaveAndWhenUnseen(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewServer(config.ControllerConfig{DataDir: t.TempDir(), VPNCIDR: "10.7.0.0/24", EphemeralRemoveAfterSec: 600})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+
+	post := func(path, body string) int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return rec.Code
+	}
+	for _, name := range []string{"ci-1", "ci-2", "desk"} {
+		if code := post("/register", `{"name":"`+name+`","pub_key":"pub-`+name+`"}`); code != http.StatusOK {
+			t.Fatalf("register %s: status=%d", name, code)
+		}
+	}
+	s.mu.Lock()
+	for _, id := range []string{"ci-1", "ci-2"} {
+		s.reg.Nodes[s.findNodeLocked(id)].Ephemeral = true
+	}
+	s.mu.Unlock()
+
+	// A clean shutdown removes an ephemeral node at once and leaves others.
+	if code := post("/leave", `{"node_id":"ci-1"}`); code != http.StatusNoContent {
+		t.Fatalf("leave ci-1: status=%d", code)
+	}
+	if code := post("/leave", `{"node_id":"desk"}`); code != http.StatusNoContent {
+		t.Fatalf("leave desk: status=%d", code)
+	}
+	s.mu.Lock()
+	gone, kept := s.findNodeLocked("ci-1"), s.findNodeLocked("desk")
+	s.mu.Unlock()
+	if gone >= 0 || kept < 0 {
+		t.Fatalf("after leave nodes=%+v", s.reg.Nodes)
+	}
+	if !s.certRevoked(&x509.Certificate{Subject: pkix.Name{CommonName: "ci-1"}, NotBefore: time.Now().Add(-time.Hour)}) {
+		t.Fatal("ci-1 certificate not revoked")
+	}
+
+	// Unseen past ephemeral_remove_after_sec: only the ephemeral node goes.
+	if err := s.reapOnce(time.Now().UTC().Add(11 * time.Minute)); err != nil {
+		t.Fatalf("reapOnce: %v", err)
+	}
+	nodes, err := s.db.Nodes()
+	if err != nil {
+		t.Fatalf("Nodes: %v", err)
+	}
+	if len(nodes) != 1 || nodes[0].ID != "desk" || len(s.reg.Nodes) != 1 {
+		t.Fatalf("persisted=%+v registry=%+v", nodes, s.reg.Nodes)
+	}
+}
+
+func TestEphemeral_RemovalUpdatesHubFirewall(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	policyPath := filepath.Join(dir, "acl.yaml")
+	if err := os.WriteFile(policyPath, []byte("acls:\n  - from: [ci]\n    to: [server]\n"), 0o600); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	s, err := NewServer(config.ControllerConfig{
+		DataDir: dir, ACLFile: policyPath, VPNCIDR: "10.7.0.0/24", EphemeralRemoveAfterSec: 600,
+		WGApply: true, WGInterface: "wg0", WGAddress: "10.7.0.1/24", WGPrivateKey: "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+	runner := &fakeRunner{}
+	s.wg = wireguard.NewManager(runner)
+	now := time.Now().UTC()
+	s.reg.Nodes = []store.NodeInfo{
+		{ID: "ci-1", Name: "ci-1", PubKey: "pub-ci-1", VPNIP: "10.7.0.2/32", Tags: []string{"ci"}, Ephemeral: true, LastSeenAt: now},
+		{ID: "ci-2", Name: "ci-2", PubKey: "pub-ci-2", VPNIP: "10.7.0.3/32", Tags: []string{"ci"}, Ephemeral: true, LastSeenAt: now},
+		{ID: "srv", Name: "srv", PubKey: "pub-srv", VPNIP: "10.7.0.4/32", Tags: []string{"server"}, LastSeenAt: now},
+	}
+
+	ruleSources := func() []string {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var srcs []string
+		for _, r := range s.firewallRulesLocked() {
+			for _, p := range r.Src {
+				srcs = append(srcs, p.String())
+			}
+		}
+		return srcs
+	}
+	nftRuns := func() int {
+		n := 0
+		for _, run := range runner.runs {
+			if strings.HasPrefix(run, "nft -f ") {
+				n++
+			}
+		}
+		return n
+	}
+	if got := ruleSources(); !slices.Equal(got, []string{"10.7.0.2/32", "10.7.0.3/32"}) {
+		t.Fatalf("rule sources=%v", got)
+	}
+
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/leave", strings.NewReader(`{"node_id":"ci-1"}`)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("leave ci-1: status=%d %s", rec.Code, rec.Body.String())
+	}
+	if got := ruleSources(); !slices.Equal(got, []string{"10.7.0.3/32"}) || nftRuns() != 1 {
+		t.Fatalf("after leave: rule sources=%v runs=%v", got, runner.runs)
+	}
+
+	if err := s.reapOnce(now.Add(11 * time.Minute)); err != nil {
+		t.Fatalf("reapOnce: %v", err)
+	}
+	if got := ruleSources(); len(got) != 0 || nftRuns() != 2 {
+		t.Fatalf("after reap: rule sources=%v runs=%v", got, runner.runs)
+	}
+}
+
+func TestRevokeCert_ListsIssuedCertsAndServesCRL(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.ControllerConfig{
+		DataDir: t.TempDir(),
+		VPNCIDR: "10.7.0.0/24",
+		PKI:     &config.PKIConfig{CAExpiry: "24h", ServerExpiry: "24h", ServerSANs: []string{"127.0.0.1"}},
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+	if _, err := s.InitPKI(); err != nil {
+		t.Fatalf("InitPKI: %v", err)
+	}
+
+	caCert, caKey, err := pki.LoadCA(filepath.Join(s.pkiDir, "ca.key"), filepath.Join(s.pkiDir, "ca.crt"))
+	if err != nil {
+		t.Fatalf("LoadCA: %v", err)
+	}
+	issue := func(cn string) *x509.Certificate {
+		t.Helper()
+		csrPEM, _, err := pki.GenerateCSR(cn, pki.DefaultKeyAlgorithm)
+		if err != nil {
+			t.Fatalf("GenerateCSR: %v", err)
+		}
+		certPEM, err := pki.SignCSR(caCert, caKey, csrPEM, time.Hour)
+		if err != nil {
+			t.Fatalf("SignCSR: %v", err)
+		}
+		if err := pki.RecordIssued(s.issuedDir(), certPEM); err != nil {
+			t.Fatalf("RecordIssued: %v", err)
+		}
+		issued, err := pki.IssuedCerts(s.issuedDir(), cn)
+		if err != nil || len(issued) == 0 {
+			t.Fatalf("IssuedCerts: %v %v", issued, err)
+		}
+		return issued[len(issued)-1]
+	}
+	dbCert, webCert := issue("db-1"), issue("web-1")
+
+	post := func(body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.handleRevokeCert(rec, httptest.NewRequest(http.MethodPost, "/admin/certs/revoke", strings.NewReader(body)))
+		return rec
+	}
+	rec := post(`{"node":"db-1"}`)
+	var resp api.RevokeCertResponse
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil || resp.Revoked != 1 {
+		t.Fatalf("revoke: status=%d body=%s", rec.Code, rec.Body)
+	}
+	if !s.revoked.IsRevoked(dbCert) || s.revoked.IsRevoked(webCert) {
+		t.Fatal("wrong certificates revoked")
+	}
+	if rec := post(`{"node":"db-1"}`); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"revoked":0`) {
+		t.Fatalf("revoke again: status=%d body=%s", rec.Code, rec.Body)
+	}
+
+	// The list survives a restart of the PKI.
+	reopened, err := pki.OpenRevocationList(filepath.Join(s.pkiDir, "revoked.json"))
+	if err != nil || !reopened.IsRevoked(dbCert) {
+		t.Fatalf("reopened list: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/crl", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("crl: status=%d", rec.Code)
+	}
+	crl, err := x509.ParseRevocationList(rec.Body.Bytes())
+	if err != nil {
+		t.Fatalf("ParseRevocationList: %v", err)
+	}
+	if err := crl.CheckSignatureFrom(caCert); err != nil {
+		t.Fatalf("CRL signature: %v", err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(dbCert.SerialNumber) != 0 {
+		t.Fatalf("CRL entries=%+v", crl.RevokedCertificateEntries)
+	}
+}
+
+func TestRemoveNode_PutsIssuedCertsOnCRL(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.ControllerConfig{
+		DataDir: t.TempDir(),
+		VPNCIDR: "10.7.0.0/24",
+		PKI:     &config.PKIConfig{CAExpiry: "24h", ServerExpiry: "24h", ServerSANs: []string{"127.0.0.1"}},
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+	if _, err := s.InitPKI(); err != nil {
+		t.Fatalf("InitPKI: %v", err)
+	}
+	s.reg.Nodes = []store.NodeInfo{
+		{ID: "db-1", Name: "db-renamed", PubKey: "pub-a", VPNIP: "10.7.0.2/32"},
+		{ID: "web-1", Name: "web-1", PubKey: "pub-b", VPNIP: "10.7.0.3/32"},
+	}
+
+	caCert, caKey, err := pki.LoadCA(filepath.Join(s.pkiDir, "ca.key"), filepath.Join(s.pkiDir, "ca.crt"))
+	if err != nil {
+		t.Fatalf("LoadCA: %v", err)
+	}
+	for _, cn := range []string{"db-1", "web-1"} {
+		csrPEM, _, err := pki.GenerateCSR(cn, pki.DefaultKeyAlgorithm)
+		if err != nil {
+			t.Fatalf("GenerateCSR: %v", err)
+		}
+		certPEM, err := pki.SignCSR(caCert, caKey, csrPEM, time.Hour)
+		if err != nil {
+			t.Fatalf("SignCSR: %v", err)
+		}
+		if err := pki.RecordIssued(s.issuedDir(), certPEM); err != nil {
+			t.Fatalf("RecordIssued: %v", err)
+		}
+	}
+	dbCerts, err := pki.IssuedCerts(s.issuedDir(), "db-1")
+	if err != nil || len(dbCerts) != 1 {
+		t.Fatalf("IssuedCerts: %v %v", dbCerts, err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleRemoveNode(rec, httptest.NewRequest(http.MethodPost, "/admin/nodes/remove", strings.NewReader(`{"name":"db-renamed"}`)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("remove: status=%d body=%s", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/crl", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("crl: status=%d", rec.Code)
+	}
+	crl, err := x509.ParseRevocationList(rec.Body.Bytes())
+	if err != nil {
+		t.Fatalf("ParseRevocationList: %v", err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(dbCerts[0].SerialNumber) != 0 {
+		t.Fatalf("CRL entries=%+v", crl.RevokedCertificateEntries)
+	}
+}
+
+func TestRenewCert_SignsOnlyForTheCallingNode(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.ControllerConfig{
+		DataDir: t.TempDir(),
+		VPNCIDR: "10.7.0.0/24",
+		PKI:     &config.PKIConfig{CAExpiry: "24h", ServerExpiry: "24h", ClientExpiry: "1h", ServerSANs: []string{"127.0.0.1"}},
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+	if _, err := s.InitPKI(); err != nil {
+		t.Fatalf("InitPKI: %v", err)
+	}
+	now := time.Now().UTC()
+	s.reg.Nodes = []store.NodeInfo{
+		{ID: "node-a", Name: "node-a", PubKey: "pub-a", VPNIP: "10.7.0.2/32", LastSeenAt: now},
+		{ID: "node-b", Name: "node-b", PubKey: "pub-b", VPNIP: "10.7.0.3/32", LastSeenAt: now, Disabled: true},
+	}
+
+	renew := func(cn, ou, nodeID, csrCN string) *httptest.ResponseRecorder {
+		t.Helper()
+		csrPEM, _, err := pki.GenerateCSR(csrCN, pki.DefaultKeyAlgorithm)
+		if err != nil {
+			t.Fatalf("GenerateCSR: %v", err)
+		}
+		body, _ := json.Marshal(api.RenewRequest{NodeID: nodeID, CSR: string(csrPEM)})
+		req := httptest.NewRequest(http.MethodPost, "/renew", bytes.NewReader(body))
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{
+			Subject:   pkix.Name{CommonName: cn, OrganizationalUnit: []string{ou}},
+			NotBefore: now,
+		}}}
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	cases := []struct {
+		name                  string
+		cn, ou, nodeID, csrCN string
+		want                  int
+	}{
+		{"other node", "node-a", pki.RoleNode, "node-b", "node-b", http.StatusForbidden},
+		{"csr for other node", "node-a", pki.RoleNode, "node-a", "node-b", http.StatusBadRequest},
+		{"admin certificate", "node-a", pki.RoleAdmin, "node-a", "node-a", http.StatusForbidden},
+		{"disabled node", "node-b", pki.RoleNode, "node-b", "node-b", http.StatusForbidden},
+		{"unknown node", "node-c", pki.RoleNode, "node-c", "node-c", http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		if rec := renew(tc.cn, tc.ou, tc.nodeID, tc.csrCN); rec.Code != tc.want {
+			t.Errorf("%s: status=%d want %d body=%s", tc.name, rec.Code, tc.want, rec.Body)
+		}
+	}
+
+	rec := renew("node-a", pki.RoleNode, "node-a", "node-a")
+	var resp api.RenewResponse
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil {
+		t.Fatalf("renew: status=%d body=%s", rec.Code, rec.Body)
+	}
+	issued, err := pki.IssuedCerts(s.issuedDir(), "node-a")
+	if err != nil || len(issued) != 1 {
+		t.Fatalf("issued=%v err=%v", issued, err)
+	}
+	cert := issued[0]
+	if pki.CertRole(cert) != pki.RoleNode || cert.NotAfter.Sub(cert.NotBefore) != time.Hour {
+		t.Fatalf("renewed cert: ou=%v lifetime=%v", cert.Subject.OrganizationalUnit, cert.NotAfter.Sub(cert.NotBefore))
+	}
+	if !strings.Contains(resp.ClientCert, "BEGIN CERTIFICATE") {
+		t.Fatalf("client_cert=%q", resp.ClientCert)
+	}
+}
+
+func TestRotateCA_DualTrustUntilRetired(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.ControllerConfig{
+		DataDir: t.TempDir(),
+		VPNCIDR: "10.7.0.0/24",
+		PKI:     &config.PKIConfig{CAExpiry: "24h", ServerExpiry: "24h", ClientExpiry: "24h", ServerSANs: []string{"127.0.0.1"}},
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+	if _, err := s.InitPKI(); err != nil {
+		t.Fatalf("InitPKI: %v", err)
+	}
+	if err := s.loadTLSConfig(); err != nil {
+		t.Fatalf("loadTLSConfig: %v", err)
+	}
+	s.reg.Nodes = []store.NodeInfo{{ID: "node-a", Name: "node-a", PubKey: "pub-a", VPNIP: "10.7.0.2/32", LastSeenAt: time.Now().UTC()}}
+
+	srv := httptest.NewUnstartedServer(s.routes())
+	srv.TLS = &tls.Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) { return s.tlsConfig.Load(), nil }}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// A node enrolled under the first CA, trusting only that CA.
+	oldCAPath := filepath.Join(t.TempDir(), "old-ca.crt")
+	oldCAPEM, _ := os.ReadFile(filepath.Join(s.pkiDir, "ca.crt"))
+	if err := os.WriteFile(oldCAPath, oldCAPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	caCert, caKey, err := pki.LoadCA(filepath.Join(s.pkiDir, "ca.key"), filepath.Join(s.pkiDir, "ca.crt"))
+	if err != nil {
+		t.Fatalf("LoadCA: %v", err)
+	}
+	csrPEM, keyPEM, err := pki.GenerateCSR("node-a", pki.DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("GenerateCSR: %v", err)
+	}
+	certPEM, err := pki.SignCSR(caCert, caKey, csrPEM, time.Hour)
+	if err != nil {
+		t.Fatalf("SignCSR: %v", err)
+	}
+	nodeCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair: %v", err)
+	}
+
+	get := func(caPath, path string) (*http.Response, error) {
+		t.Helper()
+		tlsCfg, err := pki.ClientTLSConfig(caPath, "", "")
+		if err != nil {
+			t.Fatalf("ClientTLSConfig: %v", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{nodeCert}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+		return client.Get(srv.URL + path)
+	}
+	candidates := func(caPath string) error {
+		t.Helper()
+		resp, err := get(caPath, "/candidates?node_id=node-a")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("candidates: status=%d", resp.StatusCode)
+		}
+		return nil
+	}
+	if err := candidates(oldCAPath); err != nil {
+		t.Fatalf("before rotation: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleRotateCA(rec, httptest.NewRequest(http.MethodPost, "/admin/ca/rotate", strings.NewReader(`{"grace_sec":3600}`)))
+	var rotated api.RotateCAResponse
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &rotated) != nil {
+		t.Fatalf("rotate: status=%d body=%s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	s.handleRotateCA(rec, httptest.NewRequest(http.MethodPost, "/admin/ca/rotate", strings.NewReader(`{"grace_sec":3600}`)))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("second rotate: status=%d", rec.Code)
+	}
+
+	// During the grace period the old node still connects, and the bundle
+	// it fetches holds both CAs.
+	if err := candidates(oldCAPath); err != nil {
+		t.Fatalf("during grace period: %v", err)
+	}
+	resp, err := get(oldCAPath, "/ca")
+	if err != nil {
+		t.Fatalf("GET /ca: %v", err)
+	}
+	bundle, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if n := strings.Count(string(bundle), "BEGIN CERTIFICATE"); n != 2 || !strings.HasSuffix(string(bundle), string(oldCAPEM)) {
+		t.Fatalf("bundle has %d certificates:\n%s", n, bundle)
+	}
+	bundlePath := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(bundlePath, bundle, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once retired, neither the old CA nor certificates it issued work.
+	if err := s.retireCA(rotated.RetireAt.Add(-time.Second)); err != nil {
+		t.Fatalf("retireCA early: %v", err)
+	}
+	if err := candidates(oldCAPath); err != nil {
+		t.Fatalf("retired before the grace period ended: %v", err)
+	}
+	if err := s.retireCA(rotated.RetireAt); err != nil {
+		t.Fatalf("retireCA: %v", err)
+	}
+	if err := candidates(oldCAPath); err == nil {
+		t.Fatal("server still verifies against the retired CA")
+	}
+	if err := candidates(bundlePath); err == nil {
+		t.Fatal("client certificate from the retired CA accepted")
+	}
+}
+
+func TestBootstrap_EnforcesTokenLimits(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.ControllerConfig{
+		DataDir: t.TempDir(),
+		VPNCIDR: "10.7.0.0/24",
+		PKI:     &config.PKIConfig{CAExpiry: "24h", ServerExpiry: "24h", ClientExpiry: "24h", ServerSANs: []string{"127.0.0.1"}},
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+	if _, err := s.InitPKI(); err != nil {
+		t.Fatalf("InitPKI: %v", err)
+	}
+
+	create := func(req api.TokenCreateRequest) (int, api.TokenCreateResponse) {
+		t.Helper()
+		body, _ := json.Marshal(req)
+		rec := httptest.NewRecorder()
+		s.handleTokens(rec, httptest.NewRequest(http.MethodPost, "/admin/tokens", bytes.NewReader(body)))
+		var resp api.TokenCreateResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+	bootstrap := func(token, name string) (int, api.BootstrapResponse) {
+		t.Helper()
+		csrPEM, _, err := pki.GenerateCSR(name, pki.DefaultKeyAlgorithm)
+		if err != nil {
+			t.Fatalf("GenerateCSR: %v", err)
+		}
+		body, _ := json.Marshal(api.BootstrapRequest{Token: token, Name: name, CSR: string(csrPEM)})
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/bootstrap", bytes.NewReader(body)))
+		var resp api.BootstrapResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	if code, _ := create(api.TokenCreateRequest{VPNIP: "10.7.0.50", MaxUses: 2}); code != http.StatusBadRequest {
+		t.Fatalf("vpn_ip with max_uses 2: status=%d", code)
+	}
+	code, ci := create(api.TokenCreateRequest{Description: "ci", MaxUses: 2, NamePattern: "ci-*", Tags: []string{"ci"}, TTLSec: 3600})
+	if code != http.StatusOK || ci.Info.State != api.TokenActive || ci.Info.ExpiresAt.IsZero() {
+		t.Fatalf("create: status=%d info=%+v", code, ci.Info)
+	}
+	_, db := create(api.TokenCreateRequest{VPNIP: "10.7.0.50"})
+
+	if code, _ := bootstrap(ci.Token, "web-1"); code != http.StatusForbidden {
+		t.Fatalf("name outside pattern: status=%d", code)
+	}
+	for _, name := range []string{"ci-1", "ci-2"} {
+		if code, _ := bootstrap(ci.Token, name); code != http.StatusOK {
+			t.Fatalf("bootstrap %s: status=%d", name, code)
+		}
+	}
+	if code, _ := bootstrap(ci.Token, "ci-3"); code != http.StatusUnauthorized {
+		t.Fatalf("token used up: status=%d", code)
+	}
+	if i := s.findNodeLocked("ci-1"); i < 0 || !slices.Equal(s.reg.Nodes[i].AdminTags, []string{"ci"}) {
+		t.Fatalf("ci-1 not enrolled with the token's tags: %+v", s.reg.Nodes)
+	}
+	if code, resp := bootstrap(db.Token, "db-1"); code != http.StatusOK || resp.VPNIP != "10.7.0.50/32" {
+		t.Fatalf("bootstrap db-1: status=%d vpn_ip=%q", code, resp.VPNIP)
+	}
+
+	// A refused enrollment does not spend a use.
+	_, app := create(api.TokenCreateRequest{VPNIP: "10.7.0.60"})
+	s.mu.Lock()
+	s.reg.Nodes = append(s.reg.Nodes, store.NodeInfo{ID: "squatter", Name: "squatter", VPNIP: "10.7.0.60/32"})
+	s.mu.Unlock()
+	if code, _ := bootstrap(app.Token, "app-1"); code != http.StatusConflict {
+		t.Fatalf("pinned address taken: status=%d", code)
+	}
+	for _, tok := range s.tokenStore.List() {
+		if pki.TokenID(tok.Hash) == app.Info.ID && tok.Uses != 0 {
+			t.Fatalf("refused enrollment counted: uses=%d", tok.Uses)
+		}
+	}
+	s.mu.Lock()
+	s.reg.Nodes = s.reg.Nodes[:len(s.reg.Nodes)-1]
+	s.mu.Unlock()
+	if code, resp := bootstrap(app.Token, "app-1"); code != http.StatusOK || resp.VPNIP != "10.7.0.60/32" {
+		t.Fatalf("bootstrap app-1: status=%d vpn_ip=%q", code, resp.VPNIP)
+	}
+
+	// Listings show metadata, never the secrets.
+	rec := httptest.NewRecorder()
+	s.handleTokens(rec, httptest.NewRequest(http.MethodGet, "/admin/tokens", nil))
+	if strings.Contains(rec.Body.String(), ci.Token) {
+		t.Fatal("token list contains a secret")
+	}
+	var list api.TokenListResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("decode list: %v", err)
+	}
+	states := map[string]string{}
+	for _, info := range list.Tokens {
+		states[info.ID] = info.State
+	}
+	if len(list.Tokens) != 4 || states[ci.Info.ID] != api.TokenUsedUp || states[db.Info.ID] != api.TokenUsedUp || states[app.Info.ID] != api.TokenUsedUp {
+		t.Fatalf("tokens=%+v", list.Tokens)
+	}
+}
+
+func TestTokenVPNIP_HeldFromAllocation(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewServer(config.ControllerConfig{
+		DataDir: t.TempDir(),
+		VPNCIDR: "10.7.0.0/24",
+		PKI:     &config.PKIConfig{CAExpiry: "24h", ServerExpiry: "24h", ClientExpiry: "24h"},
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+	if _, err := s.InitPKI(); err != nil {
+		t.Fatalf("InitPKI: %v", err)
+	}
+
+	create := func(vpnIP string) int {
+		t.Helper()
+		body, _ := json.Marshal(api.TokenCreateRequest{VPNIP: vpnIP})
+		rec := httptest.NewRecorder()
+		s.handleTokens(rec, httptest.NewRequest(http.MethodPost, "/admin/tokens", bytes.NewReader(body)))
+		return rec.Code
+	}
+	assign := func(name string) string {
+		t.Helper()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		ip, err := s.assignVPNIPLocked(name, "")
+		if err != nil {
+			t.Fatalf("assignVPNIPLocked(%s): %v", name, err)
+		}
+		return ip
+	}
+
+	next := assign("web-1")
+	if code := create(strings.TrimSuffix(next, "/32")); code != http.StatusOK {
+		t.Fatalf("pin %s: status=%d", next, code)
+	}
+	if got := assign("web-1"); got == next {
+		t.Fatalf("allocation handed out pinned address %s", got)
+	}
+
+	// An address that is already taken cannot be pinned.
+	if code := create(next); code != http.StatusConflict {
+		t.Fatalf("pin twice: status=%d", code)
+	}
+	s.mu.Lock()
+	s.reg.Nodes = append(s.reg.Nodes, store.NodeInfo{ID: "db-1", Name: "db-1", VPNIP: "10.7.0.40/32"})
+	s.mu.Unlock()
+	if code := create("10.7.0.40"); code != http.StatusConflict {
+		t.Fatalf("pin node address: status=%d", code)
+	}
+}
+
+func TestBootstrap_PinnedAddressRacesReservation(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewServer(config.ControllerConfig{
+		DataDir: t.TempDir(),
+		VPNCIDR: "10.7.0.0/24",
+		PKI:     &config.PKIConfig{CAExpiry: "24h", ServerExpiry: "24h", ClientExpiry: "24h"},
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+	if _, err := s.InitPKI(); err != nil {
+		t.Fatalf("InitPKI: %v", err)
+	}
+
+	post := func(handler http.HandlerFunc, path string, req any) int {
+		body, _ := json.Marshal(req)
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+		return rec.Code
+	}
+
+	// Whichever request takes the address first, the other is refused, and
+	// a refused enrollment leaves the token unused.
+	for i := range 10 {
+		vpnIP := fmt.Sprintf("10.7.0.%d", 50+i)
+		secret, tok, err := s.tokenStore.Issue(pki.TokenOptions{VPNIP: vpnIP + "/32", MaxUses: 1})
+		if err != nil {
+			t.Fatalf("Issue: %v", err)
+		}
+		name := fmt.Sprintf("app-%d", i)
+		csrPEM, _, err := pki.GenerateCSR(name, pki.DefaultKeyAlgorithm)
+		if err != nil {
+			t.Fatalf("GenerateCSR: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		var enrolled, reserved int
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			enrolled = post(s.handleBootstrap, "/bootstrap", api.BootstrapRequest{Token: secret, Name: name, CSR: string(csrPEM)})
+		}()
+		go func() {
+			defer wg.Done()
+			reserved = post(s.handleIPAMReserve, "/admin/ipam/reserve", api.ReserveIPRequest{Name: fmt.Sprintf("cache-%d", i), VPNIP: vpnIP})
+		}()
+		wg.Wait()
+
+		if (enrolled == http.StatusOK) == (reserved == http.StatusOK) {
+			t.Fatalf("round %d: bootstrap=%d reserve=%d, want exactly one to succeed", i, enrolled, reserved)
+		}
+		checked, err := s.tokenStore.Check(secret, name, time.Now())
+		if enrolled == http.StatusOK && !errors.Is(err, pki.ErrTokenUsedUp) {
+			t.Fatalf("round %d: token not spent: %v", i, err)
+		}
+		if enrolled != http.StatusOK && (err != nil || checked.Uses != 0) {
+			t.Fatalf("round %d: refused enrollment spent token %s: uses=%d err=%v", i, pki.TokenID(tok.Hash), checked.Uses, err)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+// Package magicdns answers DNS queries for VPN node names under a suffix
+// (e.g. "db-1.vpn") and forwards everything else to upstream resolvers.
+package magicdns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"vpnctl/internal/execx"
+)
+
+const (
+	// recordTTL is kept short since nodes come and go.
+	recordTTL = 60
+	// upstreamTimeout bounds each upstream attempt.
+	upstreamTimeout = 2 * time.Second
+)
+
+// Server is a DNS responder on UDP and TCP.
+type Server struct {
+	suffix    string
+	upstreams []string
+	udp       *net.UDPConn
+	tcp       net.Listener
+
+	mu      sync.RWMutex
+	records map[string][]netip.Addr
+}
+
+// Start listens on addr (UDP and TCP, same port) and answers names under
+// suffix from the records set with SetRecords. Other queries go to the
+// upstreams ("ip" or "ip:port"), tried in order.
+func Start(addr, suffix string, upstreams []string) (*Server, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	// With port 0 the kernel picked one; serve TCP on the same.
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		_ = udp.Close()
+		return nil, err
+	}
+
+	s := &Server{
+		suffix: strings.ToLower(strings.Trim(suffix, ".")),
+		udp:    udp,
+		tcp:    tcp,
+	}
+	for _, u := range upstreams {
+		if _, _, err := net.SplitHostPort(u); err != nil {
+			u = net.JoinHostPort(u, "53")
+		}
+		s.upstreams = append(s.upstreams, u)
+	}
+	go s.serveUDP()
+	go s.serveTCP()
+	return s, nil
+}
+
+// LocalAddr returns the address the server listens on.
+func (s *Server) LocalAddr() string {
+	if s == nil || s.udp == nil {
+		return ""
+	}
+	return s.udp.LocalAddr().String()
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	if s == nil {
+		return nil
+	}
+	_ = s.tcp.Close()
+	return s.udp.Close()
+}
+
+// SetRecords replaces the answered names. Keys are node names without the
+// suffix; they are matched case-insensitively.
+func (s *Server) SetRecords(records map[string][]netip.Addr) {
+	m := make(map[string][]netip.Addr, len(records))
+	for name, addrs := range records {
+		m[strings.ToLower(name)] = addrs
+	}
+	s.mu.Lock()
+	s.records = m
+	s.mu.Unlock()
+}
+
+func (s *Server) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		// Forwarding may take a while; don't hold up other clients.
+		go func() {
+			if resp := s.handle(query, false); resp != nil {
+				_, _ = s.udp.WriteToUDP(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn answers length-prefixed queries on a TCP connection until the
+// client closes it or stays idle.
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		resp := s.handle(query, true)
+		if resp == nil || writeTCPMessage(conn, resp) != nil {
+			return
+		}
+	}
+}
+
+// handle returns the response to query, or nil to drop it.
+func (s *Server) handle(query []byte, tcp bool) []byte {
+	if len(query) < headerLen || query[2]&0x80 != 0 {
+		// Too short to answer, or a response; never answer those.
+		return nil
+	}
+	if opcode(query) != 0 {
+		return buildResponse(query, question{}, rcodeNotImp, nil, 0)
+	}
+	q, err := parseQuery(query)
+	if err != nil {
+		return buildResponse(query, question{}, rcodeFormErr, nil, 0)
+	}
+	if !s.local(q.name) {
+		return s.forward(query, tcp)
+	}
+
+	host := strings.TrimSuffix(strings.TrimSuffix(q.name, s.suffix), ".")
+	if host == "" {
+		// The suffix itself exists but has no addresses.
+		return buildResponse(query, q, 0, nil, 0)
+	}
+	s.mu.RLock()
+	addrs, ok := s.records[host]
+	s.mu.RUnlock()
+	if !ok || q.qclass != classIN {
+		return buildResponse(query, q, rcodeNXDomain, nil, 0)
+	}
+	var answers []netip.Addr
+	for _, a := range addrs {
+		if q.qtype == typeANY || (q.qtype == typeA && a.Is4()) || (q.qtype == typeAAAA && a.Is6()) {
+			answers = append(answers, a)
+		}
+	}
+	return buildResponse(query, q, 0, answers, recordTTL)
+}
+
+// local reports whether name is answered from the records.
+func (s *Server) local(name string) bool {
+	return s.suffix != "" && (name == s.suffix || strings.HasSuffix(name, "."+s.suffix))
+}
+
+// forward relays query to the first upstream that answers, over the same
+// transport it arrived on, and returns SERVFAIL when none does.
+func (s *Server) forward(query []byte, tcp bool) []byte {
+	for _, upstream := range s.upstreams {
+		resp, err := exchange(upstream, query, tcp)
+		if err == nil {
+			return resp
+		}
+		slog.Debug("dns upstream failed", "upstream", upstream, "err", err)
+	}
+	q, _ := parseQuery(query)
+	return buildResponse(query, q, rcodeServFail, nil, 0)
+}
+
+func exchange(upstream string, query []byte, tcp bool) ([]byte, error) {
+	network := "udp"
+	if tcp {
+		network = "tcp"
+	}
+	conn, err := net.DialTimeout(network, upstream, upstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(upstreamTimeout))
+
+	if tcp {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Skip stray datagrams that don't answer this query.
+		if n >= headerLen && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
+
+// ResolvConfServers returns the nameservers listed in a resolv.conf file,
+// or nothing when it cannot be read.
+func ResolvConfServers(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var servers []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		// Zone suffixes (fe80::1%eth0) are not usable in a dial address.
+		if a, err := netip.ParseAddr(fields[1]); err == nil && a.Zone() == "" {
+			servers = append(servers, a.String())
+		}
+	}
+	return servers
+}
+
+// RegisterResolved makes systemd-resolved send queries for suffix, and only
+// those, to the server at addr through iface.
+func RegisterResolved(r execx.Runner, iface, addr, suffix string) error {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return err
+	}
+	server := ap.String()
+	if ap.Port() == 53 {
+		server = ap.Addr().String()
+	}
+	for _, args := range [][]string{
+		{"dns", iface, server},
+		{"domain", iface, "~" + strings.Trim(suffix, ".")},
+		// Keep other queries off the VPN link.
+		{"default-route", iface, "false"},
+	} {
+		if err := r.Run("resolvectl", args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnregisterResolved drops the settings made by RegisterResolved.
+func UnregisterResolved(r execx.Runner, iface string) error {
+	return r.Run("resolvectl", "revert", iface)
+}
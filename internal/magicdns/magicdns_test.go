@@ -0,0 +1,250 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package magicdns
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_AnswersNodeNames(t *testing.T) {
+	t.Parallel()
+
+	srv, err := Start("127.0.0.1:0", "vpn", nil)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer srv.Close()
+	srv.SetRecords(map[string][]netip.Addr{
+		"db-1": {netip.MustParseAddr("10.7.0.5"), netip.MustParseAddr("fd00::5")},
+	})
+
+	resp := udpQuery(t, srv.LocalAddr(), "DB-1.vpn.", typeA)
+	if rcode(resp) != 0 || !slices.Equal(answers(t, resp), []netip.Addr{netip.MustParseAddr("10.7.0.5")}) {
+		t.Fatalf("A: rcode=%d answers=%v", rcode(resp), answers(t, resp))
+	}
+	resp = udpQuery(t, srv.LocalAddr(), "db-1.vpn", typeAAAA)
+	if rcode(resp) != 0 || !slices.Equal(answers(t, resp), []netip.Addr{netip.MustParseAddr("fd00::5")}) {
+		t.Fatalf("AAAA: rcode=%d answers=%v", rcode(resp), answers(t, resp))
+	}
+	resp = udpQuery(t, srv.LocalAddr(), "web.vpn", typeA)
+	if rcode(resp) != rcodeNXDomain {
+		t.Fatalf("unknown name: rcode=%d, want NXDOMAIN", rcode(resp))
+	}
+
+	// A node that left stops resolving.
+	srv.SetRecords(nil)
+	resp = udpQuery(t, srv.LocalAddr(), "db-1.vpn", typeA)
+	if rcode(resp) != rcodeNXDomain {
+		t.Fatalf("removed name: rcode=%d, want NXDOMAIN", rcode(resp))
+	}
+}
+
+func TestServer_NoAddressOfType(t *testing.T) {
+	t.Parallel()
+
+	srv, err := Start("127.0.0.1:0", "vpn", nil)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer srv.Close()
+	srv.SetRecords(map[string][]netip.Addr{"db-1": {netip.MustParseAddr("10.7.0.5")}})
+
+	// The name exists, so this is NOERROR with no answers, not NXDOMAIN.
+	resp := udpQuery(t, srv.LocalAddr(), "db-1.vpn", typeAAAA)
+	if rcode(resp) != 0 || len(answers(t, resp)) != 0 {
+		t.Fatalf("rcode=%d answers=%v", rcode(resp), answers(t, resp))
+	}
+}
+
+func TestServer_ForwardsOtherNames(t *testing.T) {
+	t.Parallel()
+
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := upstream.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			q, _ := parseQuery(buf[:n])
+			resp := buildResponse(buf[:n], q, 0, []netip.Addr{netip.MustParseAddr("192.0.2.1")}, 300)
+			_, _ = upstream.WriteToUDP(resp, addr)
+		}
+	}()
+
+	srv, err := Start("127.0.0.1:0", "vpn", []string{upstream.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer srv.Close()
+
+	resp := udpQuery(t, srv.LocalAddr(), "example.com", typeA)
+	if rcode(resp) != 0 || !slices.Equal(answers(t, resp), []netip.Addr{netip.MustParseAddr("192.0.2.1")}) {
+		t.Fatalf("rcode=%d answers=%v", rcode(resp), answers(t, resp))
+	}
+}
+
+func TestServer_UpstreamFailure(t *testing.T) {
+	t.Parallel()
+
+	srv, err := Start("127.0.0.1:0", "vpn", nil)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer srv.Close()
+
+	resp := udpQuery(t, srv.LocalAddr(), "example.com", typeA)
+	if rcode(resp) != rcodeServFail {
+		t.Fatalf("rcode=%d, want SERVFAIL", rcode(resp))
+	}
+}
+
+func TestServer_TCP(t *testing.T) {
+	t.Parallel()
+
+	srv, err := Start("127.0.0.1:0", "vpn", nil)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer srv.Close()
+	srv.SetRecords(map[string][]netip.Addr{"db-1": {netip.MustParseAddr("10.7.0.5")}})
+
+	conn, err := net.DialTimeout("tcp", srv.LocalAddr(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := writeTCPMessage(conn, query(7, "db-1.vpn", typeA)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	resp, err := readTCPMessage(conn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if rcode(resp) != 0 || !slices.Equal(answers(t, resp), []netip.Addr{netip.MustParseAddr("10.7.0.5")}) {
+		t.Fatalf("rcode=%d answers=%v", rcode(resp), answers(t, resp))
+	}
+}
+
+func TestResolvConfServers(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	data := "# generated\nnameserver 1.1.1.1\nnameserver fe80::1%eth0\nsearch example.com\nnameserver 2001:db8::53\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got := ResolvConfServers(path)
+	if want := []string{"1.1.1.1", "2001:db8::53"}; !slices.Equal(got, want) {
+		t.Fatalf("servers=%v want=%v", got, want)
+	}
+	if got := ResolvConfServers(filepath.Join(t.TempDir(), "missing")); got != nil {
+		t.Fatalf("missing file: %v", got)
+	}
+}
+
+func TestRegisterResolved(t *testing.T) {
+	t.Parallel()
+
+	r := &recordRunner{}
+	if err := RegisterResolved(r, "wg0", "10.7.0.5:53", "vpn"); err != nil {
+		t.Fatalf("RegisterResolved: %v", err)
+	}
+	want := []string{
+		"resolvectl dns wg0 10.7.0.5",
+		"resolvectl domain wg0 ~vpn",
+		"resolvectl default-route wg0 false",
+	}
+	if !slices.Equal(r.cmds, want) {
+		t.Fatalf("cmds=%v want=%v", r.cmds, want)
+	}
+}
+
+type recordRunner struct {
+	cmds []string
+}
+
+func (r *recordRunner) Run(name string, args ...string) error {
+	r.cmds = append(r.cmds, strings.Join(append([]string{name}, args...), " "))
+	return nil
+}
+
+func (r *recordRunner) Output(name string, args ...string) (string, error) {
+	return "", r.Run(name, args...)
+}
+
+// query builds a standard recursive query for name.
+func query(id uint16, name string, qtype uint16) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0)
+	for _, label := range strings.Split(strings.Trim(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	return binary.BigEndian.AppendUint16(msg, classIN)
+}
+
+func udpQuery(t *testing.T, addr, name string, qtype uint16) []byte {
+	t.Helper()
+	conn, err := net.DialTimeout("udp", addr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(query(42, name, qtype)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if binary.BigEndian.Uint16(buf[0:2]) != 42 || buf[2]&0x80 == 0 {
+		t.Fatalf("not a response to the query: % x", buf[:n])
+	}
+	return buf[:n]
+}
+
+func rcode(msg []byte) byte {
+	return msg[3] & 0x0F
+}
+
+// answers returns the addresses in msg's answer section, which follows a
+// single question and uses a compressed name.
+func answers(t *testing.T, msg []byte) []netip.Addr {
+	t.Helper()
+	off := headerLen
+	for msg[off] != 0 {
+		off += int(msg[off]) + 1
+	}
+	off += 5
+	var out []netip.Addr
+	for range binary.BigEndian.Uint16(msg[6:8]) {
+		rdlen := int(binary.BigEndian.Uint16(msg[off+10 : off+12]))
+		a, ok := netip.AddrFromSlice(msg[off+12 : off+12+rdlen])
+		if !ok {
+			t.Fatalf("bad rdata at %d", off)
+		}
+		out = append(out, a)
+		off += 12 + rdlen
+	}
+	return out
+}
@@ -0,0 +1,113 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package magicdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"strings"
+)
+
+// DNS wire format constants (RFC 1035, RFC 3596).
+const (
+	headerLen = 12
+
+	typeA    = 1
+	typeAAAA = 28
+	typeANY  = 255
+	classIN  = 1
+
+	rcodeFormErr  = 1
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeNotImp   = 4
+)
+
+var errMalformed = errors.New("malformed dns message")
+
+// question is the first question of a query. end is the offset just past
+// it in the message.
+type question struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	end    int
+}
+
+// parseQuery returns the question of a standard query. The name is
+// lowercased and has no trailing dot.
+func parseQuery(msg []byte) (question, error) {
+	if len(msg) < headerLen || msg[2]&0x80 != 0 || binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return question{}, errMalformed
+	}
+	var labels []string
+	off, total := headerLen, 0
+	for {
+		if off >= len(msg) {
+			return question{}, errMalformed
+		}
+		n := int(msg[off])
+		off++
+		if n == 0 {
+			break
+		}
+		// Questions are never compressed; pointers would only appear in
+		// crafted messages.
+		if n&0xC0 != 0 || off+n > len(msg) {
+			return question{}, errMalformed
+		}
+		total += n + 1
+		if total > 255 {
+			return question{}, errMalformed
+		}
+		labels = append(labels, string(msg[off:off+n]))
+		off += n
+	}
+	if off+4 > len(msg) {
+		return question{}, errMalformed
+	}
+	return question{
+		name:   strings.ToLower(strings.Join(labels, ".")),
+		qtype:  binary.BigEndian.Uint16(msg[off : off+2]),
+		qclass: binary.BigEndian.Uint16(msg[off+2 : off+4]),
+		end:    off + 4,
+	}, nil
+}
+
+// opcode returns the query's opcode; only 0 (QUERY) is answered.
+func opcode(msg []byte) byte {
+	return (msg[2] >> 3) & 0x0F
+}
+
+// buildResponse answers query with rcode and one record per address. The
+// question is echoed when q was parsed.
+func buildResponse(query []byte, q question, rcode byte, addrs []netip.Addr, ttl uint32) []byte {
+	out := make([]byte, headerLen, 512)
+	copy(out[0:2], query[0:2])
+	// QR and AA set, opcode and RD copied from the query; RA set.
+	out[2] = 0x80 | 0x04 | (query[2] & 0x79)
+	out[3] = 0x80 | rcode&0x0F
+	if q.end == 0 {
+		return out
+	}
+	binary.BigEndian.PutUint16(out[4:6], 1)
+	binary.BigEndian.PutUint16(out[6:8], uint16(len(addrs)))
+	out = append(out, query[headerLen:q.end]...)
+	for _, a := range addrs {
+		rrType := uint16(typeA)
+		if a.Is6() {
+			rrType = typeAAAA
+		}
+		// Name: a pointer to the question name at offset 12.
+		out = append(out, 0xC0, headerLen)
+		out = binary.BigEndian.AppendUint16(out, rrType)
+		out = binary.BigEndian.AppendUint16(out, classIN)
+		out = binary.BigEndian.AppendUint32(out, ttl)
+		raw := a.AsSlice()
+		out = binary.BigEndian.AppendUint16(out, uint16(len(raw)))
+		out = append(out, raw...)
+	}
+	return out
+}
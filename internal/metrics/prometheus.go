@@ -16,7 +16,7 @@ var (
 
 	NodesOnline = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "vpnctl_nodes_online",
-		Help: "Number of online nodes (seen within last 60s)",
+		Help: "Number of nodes in the online liveness state",
 	})
 
 	DirectProbesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
@@ -29,6 +29,46 @@ var (
 		Help: "Number of peer pairs with P2P readiness confirmed",
 	})
 
+	HubPeerDrift = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vpnctl_hub_peer_drift",
+		Help: "Hub WireGuard peers that differed from the registry in the last reconcile pass",
+	}, []string{"kind"})
+
+	HubPeerRepairsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vpnctl_hub_peer_repairs_total",
+		Help: "Hub WireGuard peer changes made by the reconciler",
+	}, []string{"action"})
+
+	HubReconcileErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vpnctl_hub_reconcile_errors_total",
+		Help: "Hub reconcile passes that failed",
+	})
+
+	HubNodes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vpnctl_hub_nodes",
+		Help: "Online nodes routed through each relay hub",
+	}, []string{"hub"})
+
+	HAStandby = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "vpnctl_ha_standby",
+		Help: "Whether this controller is the HA standby (1) or active (0)",
+	})
+
+	HASyncErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vpnctl_ha_sync_errors_total",
+		Help: "Failed pulls of the active controller's state by the standby",
+	})
+
+	HAFailoversTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vpnctl_ha_failovers_total",
+		Help: "Times this controller took over as active",
+	})
+
+	HADemotionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vpnctl_ha_demotions_total",
+		Help: "Times this controller stepped down after its peer took over",
+	})
+
 	// Node-side metrics (used by monitor)
 	ProbeRTTSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "vpnctl_probe_rtt_seconds",
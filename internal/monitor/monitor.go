@@ -9,6 +9,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -171,7 +172,7 @@ func (m *Monitor) probeAll(ctx context.Context) {
 // It uses a 2-second per-probe timeout. The parent context can cancel early.
 // On any error, it returns (0, false).
 func probePeer(ctx context.Context, peer peersource.Peer) (rttUs int64, success bool) {
-	addr := fmt.Sprintf("%s:%d", peer.VPNIP, peer.ProbePort)
+	addr := net.JoinHostPort(peer.VPNIP, strconv.Itoa(peer.ProbePort))
 
 	// Create a per-probe context with a 2-second timeout, derived from the
 	// parent so it also cancels when the parent does.
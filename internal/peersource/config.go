@@ -5,8 +5,8 @@ package peersource
 
 import (
 	"context"
-	"strings"
 
+	"vpnctl/internal/addrutil"
 	"vpnctl/internal/api"
 	"vpnctl/internal/config"
 )
@@ -68,11 +68,9 @@ func (cs *ConfigSource) Discover() ([]Peer, error) {
 
 	peers := make([]Peer, 0, len(resp.Peers))
 	for _, c := range resp.Peers {
-		vpnIP := c.VPNIP
-		// Strip /mask suffix if present (e.g. "10.7.0.2/24" → "10.7.0.2").
-		if idx := strings.Index(vpnIP, "/"); idx >= 0 {
-			vpnIP = vpnIP[:idx]
-		}
+		// Strip /mask suffixes and pick one address of a dual-stack list
+		// (e.g. "10.7.0.2/32,fd7a::2/128" → "10.7.0.2").
+		vpnIP := addrutil.PrimaryIP(c.VPNIP)
 		peers = append(peers, Peer{
 			PublicKey: c.PubKey,
 			VPNIP:     vpnIP,
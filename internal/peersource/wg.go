@@ -150,11 +150,11 @@ func isValidEndpoint(ep string) bool {
 }
 
 // extractVPNIP picks the host address from a comma-separated list of AllowedIPs.
-// It prefers entries with a /32 prefix; if none exists it falls back to the first entry.
+// It prefers entries with a /32 prefix, then /128; if none exists it falls back to the first entry.
 func extractVPNIP(allowedIPs string) string {
 	entries := strings.Split(allowedIPs, ",")
 
-	var first string
+	var first, host6 string
 	for _, cidr := range entries {
 		cidr = strings.TrimSpace(cidr)
 		if cidr == "" {
@@ -174,6 +174,12 @@ func extractVPNIP(allowedIPs string) string {
 		if prefix == "32" {
 			return host
 		}
+		if prefix == "128" && host6 == "" {
+			host6 = host
+		}
+	}
+	if host6 != "" {
+		return host6
 	}
 	return first
 }
@@ -5,104 +5,260 @@ package pki
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path"
+	"slices"
+	"strings"
 	"sync"
+	"time"
+
+	"vpnctl/internal/store"
 )
 
+// ephemeralTokenPrefix marks tokens whose nodes are removed automatically
+// once they go away.
+const ephemeralTokenPrefix = "vpnctl-ephemeral-"
+
 // GenerateToken returns a bootstrap token with format "vpnctl-bootstrap-" + 16 random hex bytes.
 func GenerateToken() string {
-	b := make([]byte, 16)
+	return "vpnctl-bootstrap-" + randomHex(16)
+}
+
+// GenerateEphemeralToken returns a bootstrap token for ephemeral nodes, with
+// format "vpnctl-ephemeral-" + 16 random hex bytes.
+func GenerateEphemeralToken() string {
+	return ephemeralTokenPrefix + randomHex(16)
+}
+
+// IsEphemeralToken reports whether token was made by GenerateEphemeralToken.
+func IsEphemeralToken(token string) bool {
+	return strings.HasPrefix(token, ephemeralTokenPrefix)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
 	_, _ = rand.Read(b)
-	return "vpnctl-bootstrap-" + hex.EncodeToString(b)
+	return hex.EncodeToString(b)
 }
 
-// TokenStore manages active bootstrap tokens with persistence.
+// HashToken returns the hex SHA-256 of a bootstrap token, the form in which
+// tokens are stored.
+func HashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenID returns the short identifier of a stored token, shown in listings
+// and accepted by Revoke in place of the secret.
+func TokenID(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+// Reasons Use refuses a token.
+var (
+	ErrTokenInvalid        = errors.New("invalid bootstrap token")
+	ErrTokenExpired        = errors.New("bootstrap token expired")
+	ErrTokenUsedUp         = errors.New("bootstrap token has no uses left")
+	ErrTokenNameNotAllowed = errors.New("bootstrap token does not allow this node name")
+)
+
+// ErrTokenNotFound is returned by Revoke when no token matches.
+var ErrTokenNotFound = errors.New("token not found")
+
+// TokenOptions restrict what a new bootstrap token may enroll. The zero
+// value makes a token that never expires and enrolls any number of nodes.
+type TokenOptions struct {
+	Description string
+	TTL         time.Duration // zero: never expires
+	MaxUses     int           // zero: unlimited
+	// NamePattern restricts node names, in path.Match syntax.
+	NamePattern string
+	// Tags are admin tags and VPNIP the address given to enrolled nodes.
+	Tags      []string
+	VPNIP     string
+	Ephemeral bool
+}
+
+// TokenBackend persists bootstrap tokens somewhere other than a JSON file,
+// such as the controller database.
+type TokenBackend interface {
+	ListTokens() ([]store.Token, error)
+	PutToken(t store.Token) error
+	DeleteToken(hash string) error
+}
+
+// TokenStore manages bootstrap tokens. It only keeps their hashes; the
+// secret is returned once, when the token is created.
 type TokenStore struct {
-	mu     sync.Mutex
-	path   string
-	tokens map[string]bool
+	backend TokenBackend
+}
+
+// NewTokenStore returns a store that reads and writes tokens through b.
+// Reads go to the backend every time, so tokens created by another process
+// (e.g. `vpnctl controller token create`) are honoured immediately.
+func NewTokenStore(b TokenBackend) *TokenStore {
+	return &TokenStore{backend: b}
 }
 
-// OpenTokenStore loads tokens from file or creates an empty store if file doesn't exist.
+// OpenTokenStore loads tokens from file or creates an empty store if file
+// doesn't exist. A legacy file holding a list of plaintext tokens is read
+// as tokens without limits and rewritten hashed on the next change.
 func OpenTokenStore(path string) (*TokenStore, error) {
-	store := &TokenStore{
-		path:   path,
-		tokens: make(map[string]bool),
-	}
+	b := &fileTokenBackend{path: path}
 
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return store, nil
+			return NewTokenStore(b), nil
 		}
 		return nil, err
 	}
 
-	var tokenList []string
-	if err := json.Unmarshal(data, &tokenList); err != nil {
-		return nil, err
+	if err := json.Unmarshal(data, &b.tokens); err != nil {
+		var legacy []string
+		if json.Unmarshal(data, &legacy) != nil {
+			return nil, err
+		}
+		b.tokens = b.tokens[:0]
+		for _, secret := range legacy {
+			b.tokens = append(b.tokens, store.Token{Hash: HashToken(secret), Ephemeral: IsEphemeralToken(secret)})
+		}
 	}
 
-	for _, token := range tokenList {
-		store.tokens[token] = true
+	return NewTokenStore(b), nil
+}
+
+// Issue generates a token restricted by opts and stores it. It returns the
+// secret, which is not kept, and the stored token.
+func (ts *TokenStore) Issue(opts TokenOptions) (string, store.Token, error) {
+	if opts.TTL < 0 || opts.MaxUses < 0 {
+		return "", store.Token{}, errors.New("ttl and max uses must not be negative")
+	}
+	if _, err := path.Match(opts.NamePattern, ""); err != nil {
+		return "", store.Token{}, fmt.Errorf("name pattern: %w", err)
 	}
 
-	return store, nil
+	secret := GenerateToken()
+	if opts.Ephemeral {
+		secret = GenerateEphemeralToken()
+	}
+	now := time.Now().UTC()
+	tok := store.Token{
+		Hash:        HashToken(secret),
+		Description: opts.Description,
+		CreatedAt:   now,
+		MaxUses:     opts.MaxUses,
+		NamePattern: opts.NamePattern,
+		Tags:        opts.Tags,
+		VPNIP:       opts.VPNIP,
+		Ephemeral:   opts.Ephemeral,
+	}
+	if opts.TTL > 0 {
+		tok.ExpiresAt = now.Add(opts.TTL)
+	}
+	if err := ts.backend.PutToken(tok); err != nil {
+		return "", store.Token{}, err
+	}
+	return secret, tok, nil
 }
 
-// Create generates a token, adds it to the active set, saves to file, and returns the token.
-func (ts *TokenStore) Create() string {
-	ts.mu.Lock()
-	defer ts.mu.Unlock()
-
-	token := GenerateToken()
-	ts.tokens[token] = true
-	_ = ts.save()
-	return token
+// Check reports whether a token may enroll the node called name at now,
+// without counting a use. The controller counts it with store.Tx.UseToken
+// in the transaction that registers the node.
+func (ts *TokenStore) Check(secret, name string, now time.Time) (store.Token, error) {
+	tok, ok := ts.find(HashToken(secret))
+	if !ok {
+		return store.Token{}, ErrTokenInvalid
+	}
+	if tok.Expired(now) {
+		return store.Token{}, ErrTokenExpired
+	}
+	if tok.UsedUp() {
+		return store.Token{}, ErrTokenUsedUp
+	}
+	if tok.NamePattern != "" {
+		if match, _ := path.Match(tok.NamePattern, name); !match {
+			return store.Token{}, ErrTokenNameNotAllowed
+		}
+	}
+	return tok, nil
 }
 
-// Validate checks if a token is in the active set.
-func (ts *TokenStore) Validate(token string) bool {
-	ts.mu.Lock()
-	defer ts.mu.Unlock()
+// Revoke removes the token given by its secret, its ID or its hash.
+func (ts *TokenStore) Revoke(ref string) error {
+	tokens, err := ts.backend.ListTokens()
+	if err != nil {
+		return err
+	}
+	hash := HashToken(ref)
+	for _, t := range tokens {
+		if t.Hash == hash || t.Hash == ref || TokenID(t.Hash) == ref {
+			return ts.backend.DeleteToken(t.Hash)
+		}
+	}
+	return ErrTokenNotFound
+}
 
-	return ts.tokens[token]
+// List returns all tokens, including expired and used up ones.
+func (ts *TokenStore) List() []store.Token {
+	tokens, _ := ts.backend.ListTokens()
+	return tokens
 }
 
-// Revoke removes a token from the active set and saves.
-func (ts *TokenStore) Revoke(token string) {
-	ts.mu.Lock()
-	defer ts.mu.Unlock()
+func (ts *TokenStore) find(hash string) (store.Token, bool) {
+	tokens, err := ts.backend.ListTokens()
+	if err != nil {
+		return store.Token{}, false
+	}
+	for _, t := range tokens {
+		if t.Hash == hash {
+			return t, true
+		}
+	}
+	return store.Token{}, false
+}
 
-	delete(ts.tokens, token)
-	_ = ts.save()
+// fileTokenBackend keeps tokens in a JSON file written with mode 0600 on
+// every change.
+type fileTokenBackend struct {
+	mu     sync.Mutex
+	path   string
+	tokens []store.Token
 }
 
-// List returns all active tokens.
-func (ts *TokenStore) List() []string {
-	ts.mu.Lock()
-	defer ts.mu.Unlock()
+func (b *fileTokenBackend) ListTokens() ([]store.Token, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.tokens), nil
+}
 
-	tokens := make([]string, 0, len(ts.tokens))
-	for token := range ts.tokens {
-		tokens = append(tokens, token)
-	}
-	return tokens
+func (b *fileTokenBackend) PutToken(t store.Token) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = slices.DeleteFunc(b.tokens, func(e store.Token) bool { return e.Hash == t.Hash })
+	b.tokens = append(b.tokens, t)
+	return b.save()
 }
 
-// save marshals active tokens as JSON array and writes to file with mode 0600.
-func (ts *TokenStore) save() error {
-	tokenList := make([]string, 0, len(ts.tokens))
-	for token := range ts.tokens {
-		tokenList = append(tokenList, token)
-	}
+func (b *fileTokenBackend) DeleteToken(hash string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = slices.DeleteFunc(b.tokens, func(e store.Token) bool { return e.Hash == hash })
+	return b.save()
+}
 
-	data, err := json.Marshal(tokenList)
+func (b *fileTokenBackend) save() error {
+	data, err := json.Marshal(b.tokens)
 	if err != nil {
 		return err
 	}
-
-	return os.WriteFile(ts.path, data, 0o600)
+	return os.WriteFile(b.path, data, 0o600)
 }
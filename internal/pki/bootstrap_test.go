@@ -4,12 +4,31 @@
 package pki_test
 
 import (
+	"errors"
 	"os"
 	"testing"
+	"time"
 
 	"vpnctl/internal/pki"
+	"vpnctl/internal/store"
 )
 
+// issue returns the secret of a new token issued by ts with opts.
+func issue(t *testing.T, ts *pki.TokenStore, opts pki.TokenOptions) string {
+	t.Helper()
+	secret, _, err := ts.Issue(opts)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	return secret
+}
+
+// usable reports whether ts accepts secret to enroll a node.
+func usable(ts *pki.TokenStore, secret string) bool {
+	_, err := ts.Check(secret, "node-a", time.Now())
+	return err == nil
+}
+
 func TestGenerateToken(t *testing.T) {
 	token := pki.GenerateToken()
 
@@ -23,7 +42,25 @@ func TestGenerateToken(t *testing.T) {
 	}
 }
 
-func TestTokenStore_CreateAndValidate(t *testing.T) {
+func TestEphemeralToken(t *testing.T) {
+	store, err := pki.OpenTokenStore(t.TempDir() + "/tokens.json")
+	if err != nil {
+		t.Fatalf("OpenTokenStore failed: %v", err)
+	}
+
+	token := issue(t, store, pki.TokenOptions{Ephemeral: true})
+	if !usable(store, token) {
+		t.Error("expected ephemeral token to validate")
+	}
+	if !pki.IsEphemeralToken(token) {
+		t.Errorf("expected %q to be ephemeral", token)
+	}
+	if pki.IsEphemeralToken(issue(t, store, pki.TokenOptions{})) {
+		t.Error("expected regular token not to be ephemeral")
+	}
+}
+
+func TestTokenStore_IssueAndCheck(t *testing.T) {
 	dir := t.TempDir()
 	path := dir + "/tokens.json"
 
@@ -32,14 +69,14 @@ func TestTokenStore_CreateAndValidate(t *testing.T) {
 		t.Fatalf("OpenTokenStore failed: %v", err)
 	}
 
-	token := store.Create()
+	token := issue(t, store, pki.TokenOptions{})
 
-	if !store.Validate(token) {
-		t.Error("expected Validate(token) to return true")
+	if !usable(store, token) {
+		t.Error("expected token to be usable")
 	}
 
-	if store.Validate("bogus-token") {
-		t.Error("expected Validate(bogus-token) to return false")
+	if usable(store, "bogus-token") {
+		t.Error("expected bogus-token to be unusable")
 	}
 }
 
@@ -52,16 +89,16 @@ func TestTokenStore_Revoke(t *testing.T) {
 		t.Fatalf("OpenTokenStore failed: %v", err)
 	}
 
-	token := store.Create()
+	token := issue(t, store, pki.TokenOptions{})
 
-	if !store.Validate(token) {
-		t.Error("expected Validate(token) to return true before revoke")
+	if !usable(store, token) {
+		t.Error("expected token to be usable before revoke")
 	}
 
 	store.Revoke(token)
 
-	if store.Validate(token) {
-		t.Error("expected Validate(token) to return false after revoke")
+	if usable(store, token) {
+		t.Error("expected token to be unusable after revoke")
 	}
 }
 
@@ -74,10 +111,10 @@ func TestTokenStore_Persistence(t *testing.T) {
 		t.Fatalf("OpenTokenStore failed: %v", err)
 	}
 
-	token := store1.Create()
+	token := issue(t, store1, pki.TokenOptions{})
 
-	if !store1.Validate(token) {
-		t.Error("expected Validate(token) to return true in store1")
+	if !usable(store1, token) {
+		t.Error("expected token to be usable in store1")
 	}
 
 	store2, err := pki.OpenTokenStore(path)
@@ -85,8 +122,8 @@ func TestTokenStore_Persistence(t *testing.T) {
 		t.Fatalf("OpenTokenStore (store2) failed: %v", err)
 	}
 
-	if !store2.Validate(token) {
-		t.Error("expected Validate(token) to return true in store2 (loaded from file)")
+	if !usable(store2, token) {
+		t.Error("expected token to be usable in store2 (loaded from file)")
 	}
 
 	stat, err := os.Stat(path)
@@ -109,8 +146,8 @@ func TestTokenStore_List(t *testing.T) {
 		t.Fatalf("OpenTokenStore failed: %v", err)
 	}
 
-	token1 := store.Create()
-	token2 := store.Create()
+	token1 := issue(t, store, pki.TokenOptions{})
+	token2 := issue(t, store, pki.TokenOptions{})
 
 	tokens := store.List()
 
@@ -118,11 +155,16 @@ func TestTokenStore_List(t *testing.T) {
 		t.Errorf("expected 2 tokens, got %d", len(tokens))
 	}
 
+	// Listings carry hashes, never the secrets.
 	tokenMap := make(map[string]bool)
 	for _, token := range tokens {
-		tokenMap[token] = true
+		tokenMap[token.Hash] = true
 	}
 
+	if tokenMap[token1] || tokenMap[token2] {
+		t.Error("expected list not to contain secrets")
+	}
+	token1, token2 = pki.HashToken(token1), pki.HashToken(token2)
 	if !tokenMap[token1] {
 		t.Error("expected token1 in list")
 	}
@@ -130,3 +172,111 @@ func TestTokenStore_List(t *testing.T) {
 		t.Error("expected token2 in list")
 	}
 }
+
+type memTokenBackend struct {
+	tokens map[string]store.Token
+}
+
+func (m *memTokenBackend) ListTokens() ([]store.Token, error) {
+	var out []store.Token
+	for _, t := range m.tokens {
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+func (m *memTokenBackend) PutToken(t store.Token) error {
+	m.tokens[t.Hash] = t
+	return nil
+}
+
+func (m *memTokenBackend) DeleteToken(hash string) error {
+	delete(m.tokens, hash)
+	return nil
+}
+
+func TestTokenStore_Backend(t *testing.T) {
+	backend := &memTokenBackend{tokens: map[string]store.Token{}}
+	_ = backend.PutToken(store.Token{Hash: pki.HashToken("preexisting")})
+	store := pki.NewTokenStore(backend)
+
+	// Tokens written by another process are visible without reopening.
+	if !usable(store, "preexisting") {
+		t.Error("expected backend token to validate")
+	}
+
+	token := issue(t, store, pki.TokenOptions{})
+	if _, ok := backend.tokens[pki.HashToken(token)]; !ok {
+		t.Error("expected Issue to write through to backend")
+	}
+
+	if err := store.Revoke(token); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if usable(store, token) {
+		t.Error("expected revoked token to be invalid")
+	}
+	if len(store.List()) != 1 {
+		t.Errorf("expected 1 token, got %d", len(store.List()))
+	}
+}
+
+func TestTokenStore_CheckEnforcesLimits(t *testing.T) {
+	backend := &memTokenBackend{tokens: map[string]store.Token{}}
+	ts := pki.NewTokenStore(backend)
+	secret, tok, err := ts.Issue(pki.TokenOptions{TTL: time.Hour, MaxUses: 2, NamePattern: "ci-*", Tags: []string{"ci"}})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	now := time.Now()
+
+	if _, err := ts.Check(secret, "web-1", now); !errors.Is(err, pki.ErrTokenNameNotAllowed) {
+		t.Fatalf("Check(web-1) err=%v, want ErrTokenNameNotAllowed", err)
+	}
+	if _, err := ts.Check(secret, "ci-1", tok.ExpiresAt); !errors.Is(err, pki.ErrTokenExpired) {
+		t.Fatalf("Check after expiry err=%v, want ErrTokenExpired", err)
+	}
+	if _, err := ts.Check("vpnctl-bootstrap-bogus", "ci-1", now); !errors.Is(err, pki.ErrTokenInvalid) {
+		t.Fatalf("Check(bogus) err=%v, want ErrTokenInvalid", err)
+	}
+	for i := 1; i <= 2; i++ {
+		checked, err := ts.Check(secret, "ci-1", now)
+		if err != nil || checked.Uses != i-1 || len(checked.Tags) != 1 {
+			t.Fatalf("Check #%d = %+v, %v", i, checked, err)
+		}
+		checked.Uses++
+		_ = backend.PutToken(checked)
+	}
+	if _, err := ts.Check(secret, "ci-2", now); !errors.Is(err, pki.ErrTokenUsedUp) {
+		t.Fatalf("Check when used up err=%v, want ErrTokenUsedUp", err)
+	}
+	if usable(ts, secret) {
+		t.Error("expected used up token not to validate")
+	}
+
+	// Revoke accepts the ID shown by listings.
+	if err := ts.Revoke(pki.TokenID(tok.Hash)); err != nil {
+		t.Fatalf("Revoke by ID: %v", err)
+	}
+	if err := ts.Revoke(secret); !errors.Is(err, pki.ErrTokenNotFound) {
+		t.Fatalf("second Revoke err=%v, want ErrTokenNotFound", err)
+	}
+}
+
+func TestOpenTokenStore_ReadsLegacyFile(t *testing.T) {
+	path := t.TempDir() + "/tokens.json"
+	if err := os.WriteFile(path, []byte(`["vpnctl-bootstrap-a","vpnctl-ephemeral-b"]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ts, err := pki.OpenTokenStore(path)
+	if err != nil {
+		t.Fatalf("OpenTokenStore: %v", err)
+	}
+	if !usable(ts, "vpnctl-bootstrap-a") || !usable(ts, "vpnctl-ephemeral-b") {
+		t.Fatal("expected legacy tokens to validate")
+	}
+	tok, err := ts.Check("vpnctl-ephemeral-b", "n1", time.Now())
+	if err != nil || !tok.Ephemeral {
+		t.Fatalf("Check = %+v, %v; want an ephemeral token", tok, err)
+	}
+}
@@ -4,8 +4,7 @@
 package pki
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
+	"crypto"
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -22,14 +21,13 @@ func randomSerial() (*big.Int, error) {
 	return rand.Int(rand.Reader, max)
 }
 
-// writeKeyPEM writes an ECDSA private key as PEM to path with mode 0600.
-func writeKeyPEM(path string, key *ecdsa.PrivateKey) error {
-	der, err := x509.MarshalECPrivateKey(key)
+// writeKeyPEM writes a private key as PKCS#8 PEM to path with mode 0600.
+func writeKeyPEM(path string, key crypto.Signer) error {
+	data, err := marshalKeyPEM(key)
 	if err != nil {
 		return err
 	}
-	block := &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
-	return os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+	return os.WriteFile(path, data, 0600)
 }
 
 // writeCertPEM writes a DER-encoded certificate as PEM to path with mode 0644.
@@ -38,10 +36,11 @@ func writeCertPEM(path string, derBytes []byte) error {
 	return os.WriteFile(path, pem.EncodeToMemory(block), 0644)
 }
 
-// GenerateCA generates an ECDSA P-256 CA keypair and self-signed certificate,
-// writing the key (0600) and cert (0644) PEM files to keyPath and certPath.
-func GenerateCA(keyPath, certPath string, expiry time.Duration) error {
-	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+// GenerateCA generates a CA keypair of the given algorithm (see GenerateKey)
+// and a self-signed certificate, writing the key (0600) and cert (0644) PEM
+// files to keyPath and certPath.
+func GenerateCA(keyPath, certPath string, expiry time.Duration, algorithm string) error {
+	key, err := GenerateKey(algorithm)
 	if err != nil {
 		return err
 	}
@@ -64,7 +63,7 @@ func GenerateCA(keyPath, certPath string, expiry time.Duration) error {
 		BasicConstraintsValid: true,
 	}
 
-	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
 	if err != nil {
 		return err
 	}
@@ -76,7 +75,8 @@ func GenerateCA(keyPath, certPath string, expiry time.Duration) error {
 }
 
 // LoadCA reads and parses the CA certificate and private key from PEM files.
-func LoadCA(keyPath, certPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+// The key may be of any algorithm GenerateKey supports.
+func LoadCA(keyPath, certPath string) (*x509.Certificate, crypto.Signer, error) {
 	certPEMData, err := os.ReadFile(certPath)
 	if err != nil {
 		return nil, nil, err
@@ -94,11 +94,7 @@ func LoadCA(keyPath, certPath string) (*x509.Certificate, *ecdsa.PrivateKey, err
 	if err != nil {
 		return nil, nil, err
 	}
-	keyBlock, _ := pem.Decode(keyPEMData)
-	if keyBlock == nil {
-		return nil, nil, &pemError{path: keyPath}
-	}
-	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	key, err := parseKeyPEM(keyPEMData, keyPath)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -138,17 +134,21 @@ func (e *pemError) Error() string {
 	return "pki: failed to decode PEM from " + e.path
 }
 
-// GenerateServerCert generates an ECDSA P-256 server certificate signed by the
-// given CA. SANs that parse as IP addresses are added to IPAddresses; others
-// are added to DNSNames. The key (0600) and cert (0644) PEM files are written
-// to keyPath and certPath.
-func GenerateServerCert(ca, caKey, keyPath, certPath string, sans []string, expiry time.Duration) error {
+// GenerateServerCert generates a server certificate signed by the given CA,
+// with a key of algorithm, or of the CA's algorithm when it is empty. SANs
+// that parse as IP addresses are added to IPAddresses; others are added to
+// DNSNames. The key (0600) and cert (0644) PEM files are written to keyPath
+// and certPath.
+func GenerateServerCert(ca, caKey, keyPath, certPath string, sans []string, expiry time.Duration, algorithm string) error {
 	caCert, caPrivKey, err := LoadCA(caKey, ca)
 	if err != nil {
 		return err
 	}
 
-	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if algorithm == "" {
+		algorithm = KeyAlgorithmOf(caCert.PublicKey)
+	}
+	key, err := GenerateKey(algorithm)
 	if err != nil {
 		return err
 	}
@@ -182,7 +182,7 @@ func GenerateServerCert(ca, caKey, keyPath, certPath string, sans []string, expi
 		DNSNames:     dnsNames,
 	}
 
-	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caPrivKey)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, key.Public(), caPrivKey)
 	if err != nil {
 		return err
 	}
@@ -193,10 +193,11 @@ func GenerateServerCert(ca, caKey, keyPath, certPath string, sans []string, expi
 	return writeCertPEM(certPath, der)
 }
 
-// GenerateCSR generates an ECDSA P-256 keypair and a Certificate Signing
-// Request with the given Common Name. It returns the PEM-encoded CSR and key.
-func GenerateCSR(cn string) (csrPEM, keyPEM []byte, err error) {
-	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+// GenerateCSR generates a keypair of the given algorithm (see GenerateKey)
+// and a Certificate Signing Request with the given Common Name. It returns
+// the PEM-encoded CSR and key.
+func GenerateCSR(cn, algorithm string) (csrPEM, keyPEM []byte, err error) {
+	key, err := GenerateKey(algorithm)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -214,18 +215,39 @@ func GenerateCSR(cn string) (csrPEM, keyPEM []byte, err error) {
 
 	csrPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
 
-	keyDER, err := x509.MarshalECPrivateKey(key)
+	keyPEM, err = marshalKeyPEM(key)
 	if err != nil {
 		return nil, nil, err
 	}
-	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
 
 	return csrPEM, keyPEM, nil
 }
 
+// Certificate roles, carried in the Subject OrganizationalUnit of client
+// certificates.
+const (
+	// RoleNode is the default role: a node agent.
+	RoleNode = "node"
+	// RoleAdmin may call fleet, token and node-management endpoints.
+	RoleAdmin = "admin"
+	// RoleHAPeer is the other controller of an HA pair. Only it may fetch
+	// the replicated state, which includes the CA key.
+	RoleHAPeer = "ha-peer"
+	// RoleRelay is a relay hub, with the hub name as CN. It may only fetch
+	// its own peers.
+	RoleRelay = "relay"
+)
+
 // SignCSR parses and verifies the PEM-encoded CSR, then signs it with the CA,
-// returning a PEM-encoded client certificate with ExtKeyUsage=ClientAuth.
-func SignCSR(ca *x509.Certificate, caKey *ecdsa.PrivateKey, csrPEM []byte, expiry time.Duration) ([]byte, error) {
+// returning a PEM-encoded client certificate with ExtKeyUsage=ClientAuth and
+// the node role.
+func SignCSR(ca *x509.Certificate, caKey crypto.Signer, csrPEM []byte, expiry time.Duration) ([]byte, error) {
+	return SignCSRWithRole(ca, caKey, csrPEM, expiry, RoleNode)
+}
+
+// SignCSRWithRole is SignCSR for the given role. Only the CSR's Common Name
+// is copied into the certificate, so a requester cannot choose its own role.
+func SignCSRWithRole(ca *x509.Certificate, caKey crypto.Signer, csrPEM []byte, expiry time.Duration, role string) ([]byte, error) {
 	block, _ := pem.Decode(csrPEM)
 	if block == nil {
 		return nil, &pemError{path: "<csr>"}
@@ -247,11 +269,14 @@ func SignCSR(ca *x509.Certificate, caKey *ecdsa.PrivateKey, csrPEM []byte, expir
 	now := time.Now()
 	tmpl := &x509.Certificate{
 		SerialNumber: serial,
-		Subject:      csr.Subject,
-		NotBefore:    now,
-		NotAfter:     now.Add(expiry),
-		KeyUsage:     x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		Subject: pkix.Name{
+			CommonName:         csr.Subject.CommonName,
+			OrganizationalUnit: []string{role},
+		},
+		NotBefore:   now,
+		NotAfter:    now.Add(expiry),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 	}
 
 	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, csr.PublicKey, caKey)
@@ -261,3 +286,28 @@ func SignCSR(ca *x509.Certificate, caKey *ecdsa.PrivateKey, csrPEM []byte, expir
 
 	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
 }
+
+// CertRole returns the role of a client certificate. Certificates without a
+// role (issued before roles existed) are node certificates.
+func CertRole(cert *x509.Certificate) string {
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		switch ou {
+		case RoleAdmin, RoleHAPeer, RoleRelay:
+			return ou
+		}
+	}
+	return RoleNode
+}
+
+// CSRCommonName returns the Subject Common Name of a PEM-encoded CSR.
+func CSRCommonName(csrPEM []byte) (string, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil {
+		return "", &pemError{path: "<csr>"}
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	return csr.Subject.CommonName, nil
+}
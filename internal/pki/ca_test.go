@@ -4,7 +4,11 @@
 package pki_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
 	"testing"
 	"time"
@@ -17,7 +21,7 @@ func TestGenerateCA(t *testing.T) {
 	keyPath := dir + "/ca.key"
 	certPath := dir + "/ca.crt"
 
-	if err := pki.GenerateCA(keyPath, certPath, 24*time.Hour); err != nil {
+	if err := pki.GenerateCA(keyPath, certPath, 24*time.Hour, pki.DefaultKeyAlgorithm); err != nil {
 		t.Fatalf("GenerateCA failed: %v", err)
 	}
 
@@ -39,7 +43,7 @@ func TestSignServerCert(t *testing.T) {
 	caKeyPath := dir + "/ca.key"
 	caCertPath := dir + "/ca.crt"
 
-	if err := pki.GenerateCA(caKeyPath, caCertPath, 24*time.Hour); err != nil {
+	if err := pki.GenerateCA(caKeyPath, caCertPath, 24*time.Hour, pki.DefaultKeyAlgorithm); err != nil {
 		t.Fatalf("GenerateCA failed: %v", err)
 	}
 
@@ -47,7 +51,7 @@ func TestSignServerCert(t *testing.T) {
 	srvCertPath := dir + "/server.crt"
 	sans := []string{"127.0.0.1", "0.0.0.0"}
 
-	err := pki.GenerateServerCert(caCertPath, caKeyPath, srvKeyPath, srvCertPath, sans, 24*time.Hour)
+	err := pki.GenerateServerCert(caCertPath, caKeyPath, srvKeyPath, srvCertPath, sans, 24*time.Hour, "")
 	if err != nil {
 		t.Fatalf("GenerateServerCert failed: %v", err)
 	}
@@ -77,7 +81,7 @@ func TestSignCSR(t *testing.T) {
 	caKeyPath := dir + "/ca.key"
 	caCertPath := dir + "/ca.crt"
 
-	if err := pki.GenerateCA(caKeyPath, caCertPath, 24*time.Hour); err != nil {
+	if err := pki.GenerateCA(caKeyPath, caCertPath, 24*time.Hour, pki.DefaultKeyAlgorithm); err != nil {
 		t.Fatalf("GenerateCA failed: %v", err)
 	}
 
@@ -86,7 +90,7 @@ func TestSignCSR(t *testing.T) {
 		t.Fatalf("LoadCA failed: %v", err)
 	}
 
-	csrPEM, _, err := pki.GenerateCSR("test-node")
+	csrPEM, _, err := pki.GenerateCSR("test-node", pki.DefaultKeyAlgorithm)
 	if err != nil {
 		t.Fatalf("GenerateCSR failed: %v", err)
 	}
@@ -119,3 +123,93 @@ func TestSignCSR(t *testing.T) {
 		t.Errorf("cert verification against CA pool failed: %v", err)
 	}
 }
+
+func TestCSRCommonName(t *testing.T) {
+	csrPEM, _, err := pki.GenerateCSR("node-a", pki.DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("GenerateCSR failed: %v", err)
+	}
+	cn, err := pki.CSRCommonName(csrPEM)
+	if err != nil {
+		t.Fatalf("CSRCommonName failed: %v", err)
+	}
+	if cn != "node-a" {
+		t.Errorf("expected CN=node-a, got %s", cn)
+	}
+	if _, err := pki.CSRCommonName([]byte("not a csr")); err == nil {
+		t.Error("expected error for invalid PEM")
+	}
+}
+
+func TestSignCSRWithRole(t *testing.T) {
+	dir := t.TempDir()
+	caKeyPath := dir + "/ca.key"
+	caCertPath := dir + "/ca.crt"
+
+	if err := pki.GenerateCA(caKeyPath, caCertPath, 24*time.Hour, pki.DefaultKeyAlgorithm); err != nil {
+		t.Fatalf("GenerateCA failed: %v", err)
+	}
+	caCert, caKey, err := pki.LoadCA(caKeyPath, caCertPath)
+	if err != nil {
+		t.Fatalf("LoadCA failed: %v", err)
+	}
+
+	parse := func(certPEM []byte) *x509.Certificate {
+		t.Helper()
+		block, _ := pem.Decode(certPEM)
+		if block == nil {
+			t.Fatal("failed to decode cert PEM")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("ParseCertificate failed: %v", err)
+		}
+		return cert
+	}
+
+	csrPEM, _, err := pki.GenerateCSR("alice", pki.DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("GenerateCSR failed: %v", err)
+	}
+	adminPEM, err := pki.SignCSRWithRole(caCert, caKey, csrPEM, time.Hour, pki.RoleAdmin)
+	if err != nil {
+		t.Fatalf("SignCSRWithRole failed: %v", err)
+	}
+	if role := pki.CertRole(parse(adminPEM)); role != pki.RoleAdmin {
+		t.Errorf("expected admin role, got %s", role)
+	}
+	peerPEM, err := pki.SignCSRWithRole(caCert, caKey, csrPEM, time.Hour, pki.RoleHAPeer)
+	if err != nil {
+		t.Fatalf("SignCSRWithRole failed: %v", err)
+	}
+	if role := pki.CertRole(parse(peerPEM)); role != pki.RoleHAPeer {
+		t.Errorf("expected ha-peer role, got %s", role)
+	}
+	relayPEM, err := pki.SignCSRWithRole(caCert, caKey, csrPEM, time.Hour, pki.RoleRelay)
+	if err != nil {
+		t.Fatalf("SignCSRWithRole failed: %v", err)
+	}
+	if role := pki.CertRole(parse(relayPEM)); role != pki.RoleRelay {
+		t.Errorf("expected relay role, got %s", role)
+	}
+
+	// A CSR asking for the admin OU still gets a node certificate from SignCSR.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "mallory", OrganizationalUnit: []string{pki.RoleAdmin}},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	nodePEM, err := pki.SignCSR(caCert, caKey, forged, time.Hour)
+	if err != nil {
+		t.Fatalf("SignCSR failed: %v", err)
+	}
+	if role := pki.CertRole(parse(nodePEM)); role != pki.RoleNode {
+		t.Errorf("expected node role, got %s", role)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package pki
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCertRevoked is returned by VerifyPeerCertificate for a revoked client
+// certificate.
+var ErrCertRevoked = errors.New("client certificate revoked")
+
+// RevokedCert is one entry of the revocation list.
+type RevokedCert struct {
+	Serial     string    `json:"serial"` // hex
+	CommonName string    `json:"common_name"`
+	RevokedAt  time.Time `json:"revoked_at"`
+	// NotAfter is the certificate's expiry; expired entries are left out of
+	// the CRL.
+	NotAfter time.Time `json:"not_after"`
+}
+
+// RevocationList holds revoked client certificates by serial number,
+// persisted as a JSON array at path.
+type RevocationList struct {
+	mu      sync.Mutex
+	path    string
+	entries []RevokedCert
+}
+
+// OpenRevocationList loads the list at path, or starts an empty one if the
+// file doesn't exist.
+func OpenRevocationList(path string) (*RevocationList, error) {
+	l := &RevocationList{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return l, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &l.entries); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Revoke adds certs to the list and saves it. It returns how many were not
+// revoked already.
+func (l *RevocationList) Revoke(certs []*x509.Certificate, now time.Time) (int, error) {
+	entries := make([]RevokedCert, 0, len(certs))
+	for _, c := range certs {
+		entries = append(entries, RevokedCert{
+			Serial:     serialHex(c.SerialNumber),
+			CommonName: c.Subject.CommonName,
+			RevokedAt:  now,
+			NotAfter:   c.NotAfter,
+		})
+	}
+	return l.Merge(entries)
+}
+
+// Merge adds entries whose serial is not on the list yet and saves it. It
+// returns how many were added.
+func (l *RevocationList) Merge(entries []RevokedCert) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	added := 0
+	for _, e := range entries {
+		if l.indexLocked(e.Serial) >= 0 {
+			continue
+		}
+		l.entries = append(l.entries, e)
+		added++
+	}
+	if added == 0 {
+		return 0, nil
+	}
+	return added, l.save()
+}
+
+// IsRevoked reports whether cert's serial is on the list.
+func (l *RevocationList) IsRevoked(cert *x509.Certificate) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.indexLocked(serialHex(cert.SerialNumber)) >= 0
+}
+
+// Entries returns a copy of the list.
+func (l *RevocationList) Entries() []RevokedCert {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]RevokedCert(nil), l.entries...)
+}
+
+// VerifyPeerCertificate is a tls.Config hook that rejects a revoked client
+// certificate during the handshake.
+func (l *RevocationList) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	if l.IsRevoked(cert) {
+		return ErrCertRevoked
+	}
+	return nil
+}
+
+func (l *RevocationList) indexLocked(serial string) int {
+	for i, e := range l.entries {
+		if e.Serial == serial {
+			return i
+		}
+	}
+	return -1
+}
+
+func (l *RevocationList) save() error {
+	data, err := json.Marshal(l.entries)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(l.path, data, 0o644)
+}
+
+// CreateCRL returns a DER-encoded CRL signed by the CA listing the entries
+// that have not expired yet. It is valid for validity from now.
+func CreateCRL(ca *x509.Certificate, caKey crypto.Signer, entries []RevokedCert, now time.Time, validity time.Duration) ([]byte, error) {
+	tmpl := &x509.RevocationList{
+		// CRL numbers must increase; the issue time does.
+		Number:     big.NewInt(now.UnixNano()),
+		ThisUpdate: now,
+		NextUpdate: now.Add(validity),
+	}
+	for _, e := range entries {
+		if !e.NotAfter.IsZero() && e.NotAfter.Before(now) {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(e.Serial, 16)
+		if !ok {
+			continue
+		}
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: e.RevokedAt,
+		})
+	}
+	return x509.CreateRevocationList(rand.Reader, tmpl, ca, caKey)
+}
+
+// RecordIssued saves a copy of a signed certificate in dir, named by its
+// serial, so it can be revoked later.
+func RecordIssued(dir string, certPEM []byte) error {
+	cert, err := ParseCertPEM(certPEM)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, serialHex(cert.SerialNumber)+".crt"), certPEM, 0o644)
+}
+
+// IssuedCerts returns the certificates recorded in dir for commonName.
+func IssuedCerts(dir, commonName string) ([]*x509.Certificate, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var out []*x509.Certificate
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".crt") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		cert, err := ParseCertPEM(data)
+		if err != nil {
+			return nil, err
+		}
+		if cert.Subject.CommonName == commonName {
+			out = append(out, cert)
+		}
+	}
+	return out, nil
+}
+
+// ParseCertPEM parses the first certificate of PEM data, such as a CA bundle.
+func ParseCertPEM(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, &pemError{path: "<cert>"}
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func serialHex(n *big.Int) string {
+	return n.Text(16)
+}
@@ -0,0 +1,91 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package pki_test
+
+import (
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"vpnctl/internal/pki"
+)
+
+func TestRevocationList_PersistsAndBuildsCRL(t *testing.T) {
+	dir := t.TempDir()
+	caKeyPath, caCertPath := filepath.Join(dir, "ca.key"), filepath.Join(dir, "ca.crt")
+	if err := pki.GenerateCA(caKeyPath, caCertPath, 24*time.Hour, pki.DefaultKeyAlgorithm); err != nil {
+		t.Fatalf("GenerateCA failed: %v", err)
+	}
+	caCert, caKey, err := pki.LoadCA(caKeyPath, caCertPath)
+	if err != nil {
+		t.Fatalf("LoadCA failed: %v", err)
+	}
+
+	// Two certificates for the laptop and one for another node, recorded
+	// as the controller does at enrollment.
+	issuedDir := filepath.Join(dir, "issued")
+	for _, cn := range []string{"laptop", "laptop", "desk"} {
+		csrPEM, _, err := pki.GenerateCSR(cn, pki.DefaultKeyAlgorithm)
+		if err != nil {
+			t.Fatalf("GenerateCSR failed: %v", err)
+		}
+		certPEM, err := pki.SignCSR(caCert, caKey, csrPEM, time.Hour)
+		if err != nil {
+			t.Fatalf("SignCSR failed: %v", err)
+		}
+		if err := pki.RecordIssued(issuedDir, certPEM); err != nil {
+			t.Fatalf("RecordIssued failed: %v", err)
+		}
+	}
+	laptop, err := pki.IssuedCerts(issuedDir, "laptop")
+	if err != nil || len(laptop) != 2 {
+		t.Fatalf("IssuedCerts: %d certs, err=%v", len(laptop), err)
+	}
+	desk, err := pki.IssuedCerts(issuedDir, "desk")
+	if err != nil || len(desk) != 1 {
+		t.Fatalf("IssuedCerts: %d certs, err=%v", len(desk), err)
+	}
+
+	path := filepath.Join(dir, "revoked.json")
+	list, err := pki.OpenRevocationList(path)
+	if err != nil {
+		t.Fatalf("OpenRevocationList failed: %v", err)
+	}
+	now := time.Now()
+	if n, err := list.Revoke(laptop, now); err != nil || n != 2 {
+		t.Fatalf("Revoke: n=%d err=%v", n, err)
+	}
+	if n, err := list.Revoke(laptop, now); err != nil || n != 0 {
+		t.Fatalf("second Revoke: n=%d err=%v", n, err)
+	}
+
+	// Reopened from disk, the list still rejects the laptop only.
+	list, err = pki.OpenRevocationList(path)
+	if err != nil {
+		t.Fatalf("OpenRevocationList failed: %v", err)
+	}
+	if !list.IsRevoked(laptop[0]) || !list.IsRevoked(laptop[1]) || list.IsRevoked(desk[0]) {
+		t.Fatal("revocation not persisted")
+	}
+
+	der, err := pki.CreateCRL(caCert, caKey, list.Entries(), now, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("CreateCRL failed: %v", err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatalf("ParseRevocationList failed: %v", err)
+	}
+	if err := crl.CheckSignatureFrom(caCert); err != nil {
+		t.Fatalf("CRL signature: %v", err)
+	}
+	revoked := map[string]bool{}
+	for _, e := range crl.RevokedCertificateEntries {
+		revoked[e.SerialNumber.String()] = true
+	}
+	if len(revoked) != 2 || !revoked[laptop[0].SerialNumber.String()] || !revoked[laptop[1].SerialNumber.String()] {
+		t.Fatalf("CRL entries=%v", revoked)
+	}
+}
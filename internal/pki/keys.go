@@ -0,0 +1,96 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+// Key algorithms, as named by controller.pki.key_algorithm.
+const (
+	KeyECDSAP256 = "ecdsa-p256"
+	KeyECDSAP384 = "ecdsa-p384"
+	KeyEd25519   = "ed25519"
+	KeyRSA3072   = "rsa-3072"
+)
+
+// DefaultKeyAlgorithm is used when no algorithm is given.
+const DefaultKeyAlgorithm = KeyECDSAP256
+
+// GenerateKey returns a new private key for algorithm, or for
+// DefaultKeyAlgorithm when it is empty.
+func GenerateKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case "", KeyECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case KeyRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	default:
+		return nil, fmt.Errorf("pki: unsupported key algorithm %q", algorithm)
+	}
+}
+
+// KeyAlgorithmOf returns the algorithm name of a public key, so new keys can
+// match an existing certificate's. RSA keys of any size map to KeyRSA3072,
+// other unknown keys to DefaultKeyAlgorithm.
+func KeyAlgorithmOf(pub crypto.PublicKey) string {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P384() {
+			return KeyECDSAP384
+		}
+	case ed25519.PublicKey:
+		return KeyEd25519
+	case *rsa.PublicKey:
+		return KeyRSA3072
+	}
+	return DefaultKeyAlgorithm
+}
+
+// marshalKeyPEM encodes key as a PKCS#8 "PRIVATE KEY" PEM block.
+func marshalKeyPEM(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// parseKeyPEM decodes a private key written by marshalKeyPEM, or an older
+// "EC PRIVATE KEY" (SEC 1) or "RSA PRIVATE KEY" (PKCS#1) file. path is only
+// used in errors.
+func parseKeyPEM(data []byte, path string) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, &pemError{path: path}
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("pki: unsupported private key type %T in %s", key, path)
+	}
+	return signer, nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package pki_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"vpnctl/internal/pki"
+)
+
+func TestKeyAlgorithms_EndToEnd(t *testing.T) {
+	for _, alg := range []string{pki.KeyECDSAP256, pki.KeyECDSAP384, pki.KeyEd25519, pki.KeyRSA3072} {
+		t.Run(alg, func(t *testing.T) {
+			t.Parallel()
+			caCertPath, srvCertPath, srvKeyPath, clientCertPath, clientKeyPath := setupTestPKIWithAlgorithm(t, alg)
+
+			// Every key in the chain uses the algorithm.
+			for _, path := range []string{caCertPath, srvCertPath, clientCertPath} {
+				cert, err := pki.LoadCert(path)
+				if err != nil {
+					t.Fatalf("LoadCert(%s): %v", filepath.Base(path), err)
+				}
+				if got := pki.KeyAlgorithmOf(cert.PublicKey); got != alg {
+					t.Errorf("%s: key algorithm %s", filepath.Base(path), got)
+				}
+			}
+
+			serverTLS, err := pki.ServerTLSConfig(caCertPath, srvCertPath, srvKeyPath, nil)
+			if err != nil {
+				t.Fatalf("ServerTLSConfig: %v", err)
+			}
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			srv.TLS = serverTLS
+			srv.StartTLS()
+			defer srv.Close()
+			clientTLS, err := pki.ClientTLSConfig(caCertPath, clientCertPath, clientKeyPath)
+			if err != nil {
+				t.Fatalf("ClientTLSConfig: %v", err)
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Fatalf("mTLS handshake: %v", err)
+			}
+			resp.Body.Close()
+
+			caCert, caKey, err := pki.LoadCA(filepath.Join(filepath.Dir(caCertPath), "ca.key"), caCertPath)
+			if err != nil {
+				t.Fatalf("LoadCA: %v", err)
+			}
+			der, err := pki.CreateCRL(caCert, caKey, nil, time.Now(), time.Hour)
+			if err != nil {
+				t.Fatalf("CreateCRL: %v", err)
+			}
+			crl, err := x509.ParseRevocationList(der)
+			if err != nil || crl.CheckSignatureFrom(caCert) != nil {
+				t.Fatalf("CRL not signed by the CA: %v", err)
+			}
+		})
+	}
+}
+
+func TestGenerateKey_RejectsUnknownAlgorithm(t *testing.T) {
+	if _, err := pki.GenerateKey("dsa-1024"); err == nil {
+		t.Fatal("expected an error for an unsupported algorithm")
+	}
+}
+
+func TestLoadCA_ReadsSEC1Key(t *testing.T) {
+	// CA keys written before PKCS#8 are "EC PRIVATE KEY" blocks.
+	dir := t.TempDir()
+	keyPath, certPath := dir+"/ca.key", dir+"/ca.crt"
+	if err := pki.GenerateCA(keyPath, certPath, time.Hour, pki.KeyECDSAP256); err != nil {
+		t.Fatalf("GenerateCA: %v", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, loaded, err := pki.LoadCA(keyPath, certPath)
+	if err != nil {
+		t.Fatalf("LoadCA: %v", err)
+	}
+	if !key.Equal(loaded) {
+		t.Fatal("loaded key differs from the SEC 1 key on disk")
+	}
+}
+
+func TestRotateCA_SwitchesKeyAlgorithm(t *testing.T) {
+	dir := t.TempDir()
+	if err := pki.GenerateCA(filepath.Join(dir, "ca.key"), filepath.Join(dir, "ca.crt"), 24*time.Hour, pki.KeyRSA3072); err != nil {
+		t.Fatalf("GenerateCA: %v", err)
+	}
+	old, err := pki.LoadCert(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatalf("LoadCert: %v", err)
+	}
+	if err := pki.RotateCA(dir, 24*time.Hour, time.Hour, time.Now(), pki.KeyEd25519); err != nil {
+		t.Fatalf("RotateCA: %v", err)
+	}
+
+	current, err := pki.LoadCert(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatalf("LoadCert: %v", err)
+	}
+	if got := pki.KeyAlgorithmOf(current.PublicKey); got != pki.KeyEd25519 {
+		t.Fatalf("new CA key algorithm %s", got)
+	}
+	// The cross-signed copy links the new key to the old CA.
+	cross, err := pki.LoadCert(filepath.Join(dir, pki.CrossCAFile))
+	if err != nil {
+		t.Fatalf("LoadCert: %v", err)
+	}
+	if err := cross.CheckSignatureFrom(old); err != nil {
+		t.Fatalf("cross cert not signed by the old CA: %v", err)
+	}
+	if pki.KeyAlgorithmOf(cross.PublicKey) != pki.KeyEd25519 {
+		t.Fatal("cross cert does not carry the new key")
+	}
+}
+
+func TestGenerateServerCert_UsesGivenKeyAlgorithm(t *testing.T) {
+	dir := t.TempDir()
+	caKeyPath, caCertPath := filepath.Join(dir, "ca.key"), filepath.Join(dir, "ca.crt")
+	if err := pki.GenerateCA(caKeyPath, caCertPath, 24*time.Hour, pki.KeyECDSAP256); err != nil {
+		t.Fatalf("GenerateCA: %v", err)
+	}
+	for alg, want := range map[string]string{"": pki.KeyECDSAP256, pki.KeyEd25519: pki.KeyEd25519} {
+		certPath := filepath.Join(dir, "server-"+want+".crt")
+		if err := pki.GenerateServerCert(caCertPath, caKeyPath, filepath.Join(dir, "server-"+want+".key"), certPath, []string{"127.0.0.1"}, time.Hour, alg); err != nil {
+			t.Fatalf("GenerateServerCert(%q): %v", alg, err)
+		}
+		cert, err := pki.LoadCert(certPath)
+		if err != nil {
+			t.Fatalf("LoadCert: %v", err)
+		}
+		if got := pki.KeyAlgorithmOf(cert.PublicKey); got != want {
+			t.Fatalf("GenerateServerCert(%q) key algorithm %s, want %s", alg, got, want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package pki
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ClientCert is a client certificate and key loaded from disk that can be
+// swapped while connections use it. Plug GetClientCertificate into a
+// tls.Config so new handshakes pick up the current pair.
+type ClientCert struct {
+	certPath string
+	keyPath  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+// LoadClientCert loads the key pair at certPath and keyPath. If an earlier
+// SaveClientCert was interrupted between its two renames, the swap is
+// finished first.
+func LoadClientCert(certPath, keyPath string) (*ClientCert, error) {
+	c := &ClientCert{certPath: certPath, keyPath: keyPath}
+	if err := c.Reload(); err != nil {
+		if _, statErr := os.Stat(certPath + ".new"); statErr != nil {
+			return nil, err
+		}
+		if err := os.Rename(certPath+".new", certPath); err != nil {
+			return nil, err
+		}
+		if err := c.Reload(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Reload reads the key pair from disk again.
+func (c *ClientCert) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+// GetClientCertificate is a tls.Config hook returning the current pair.
+func (c *ClientCert) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// NotAfter returns when the current certificate expires.
+func (c *ClientCert) NotAfter() time.Time {
+	return c.cert.Load().Leaf.NotAfter
+}
+
+// IssuedBy reports whether the current certificate was signed by ca.
+func (c *ClientCert) IssuedBy(ca *x509.Certificate) bool {
+	return c.cert.Load().Leaf.CheckSignatureFrom(ca) == nil
+}
+
+// NeedsRenewal reports whether the current certificate is within before of
+// expiring. With before <= 0 the window is the last third of the
+// certificate's lifetime.
+func (c *ClientCert) NeedsRenewal(now time.Time, before time.Duration) bool {
+	leaf := c.cert.Load().Leaf
+	if before <= 0 {
+		before = leaf.NotAfter.Sub(leaf.NotBefore) / 3
+	}
+	return !now.Before(leaf.NotAfter.Add(-before))
+}
+
+// SaveClientCert replaces the key pair at certPath and keyPath. Each file is
+// written next to its target and renamed over it, the key first, so a reader
+// never sees a partly written file; LoadClientCert repairs a crash between
+// the two renames.
+func SaveClientCert(certPath, keyPath string, certPEM, keyPEM []byte) error {
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return err
+	}
+	if err := writeFileSync(certPath+".new", certPEM, 0o644); err != nil {
+		return err
+	}
+	if err := writeFileSync(keyPath+".new", keyPEM, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(keyPath+".new", keyPath); err != nil {
+		return err
+	}
+	return os.Rename(certPath+".new", certPath)
+}
+
+func writeFileSync(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,137 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package pki_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"vpnctl/internal/pki"
+)
+
+func TestClientCert_RenewSwapsCertificate(t *testing.T) {
+	caCertPath, srvCertPath, srvKeyPath, clientCertPath, clientKeyPath := setupTestPKI(t)
+	caCert, caKey, err := pki.LoadCA(filepath.Join(filepath.Dir(caCertPath), "ca.key"), caCertPath)
+	if err != nil {
+		t.Fatalf("LoadCA failed: %v", err)
+	}
+
+	cert, err := pki.LoadClientCert(clientCertPath, clientKeyPath)
+	if err != nil {
+		t.Fatalf("LoadClientCert failed: %v", err)
+	}
+	now := time.Now()
+	if cert.NeedsRenewal(now, 0) {
+		t.Fatal("fresh 24h certificate needs renewal")
+	}
+	if !cert.NeedsRenewal(now.Add(17*time.Hour), 0) {
+		t.Fatal("certificate in its last third does not need renewal")
+	}
+	if !cert.NeedsRenewal(now, 25*time.Hour) {
+		t.Fatal("certificate within the configured window does not need renewal")
+	}
+
+	serverTLS, err := pki.ServerTLSConfig(caCertPath, srvCertPath, srvKeyPath, nil)
+	if err != nil {
+		t.Fatalf("ServerTLSConfig failed: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].NotAfter.UTC().Format(time.RFC3339)))
+	}))
+	srv.TLS = serverTLS
+	srv.StartTLS()
+	defer srv.Close()
+
+	clientTLS, err := pki.ClientTLSConfig(caCertPath, "", "")
+	if err != nil {
+		t.Fatalf("ClientTLSConfig failed: %v", err)
+	}
+	clientTLS.GetClientCertificate = cert.GetClientCertificate
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+	presented := func() time.Time {
+		t.Helper()
+		client.CloseIdleConnections()
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var buf [64]byte
+		n, _ := resp.Body.Read(buf[:])
+		got, err := time.Parse(time.RFC3339, string(buf[:n]))
+		if err != nil {
+			t.Fatalf("parse %q: %v", buf[:n], err)
+		}
+		return got
+	}
+	before := presented()
+
+	csrPEM, keyPEM, err := pki.GenerateCSR("test-client", pki.DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("GenerateCSR failed: %v", err)
+	}
+	certPEM, err := pki.SignCSR(caCert, caKey, csrPEM, 48*time.Hour)
+	if err != nil {
+		t.Fatalf("SignCSR failed: %v", err)
+	}
+	if err := pki.SaveClientCert(clientCertPath, clientKeyPath, certPEM, []byte("not a key")); err == nil {
+		t.Fatal("SaveClientCert accepted a mismatched key")
+	}
+	if err := pki.SaveClientCert(clientCertPath, clientKeyPath, certPEM, keyPEM); err != nil {
+		t.Fatalf("SaveClientCert failed: %v", err)
+	}
+	if err := cert.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	after := presented()
+	if !after.After(before.Add(23*time.Hour)) || !after.Equal(cert.NotAfter().UTC().Truncate(time.Second)) {
+		t.Fatalf("presented NotAfter before=%v after=%v", before, after)
+	}
+	if info, err := os.Stat(clientKeyPath); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("key file mode: %v %v", info, err)
+	}
+}
+
+func TestLoadClientCert_FinishesInterruptedSwap(t *testing.T) {
+	caCertPath, _, _, clientCertPath, clientKeyPath := setupTestPKI(t)
+	caCert, caKey, err := pki.LoadCA(filepath.Join(filepath.Dir(caCertPath), "ca.key"), caCertPath)
+	if err != nil {
+		t.Fatalf("LoadCA failed: %v", err)
+	}
+	csrPEM, keyPEM, err := pki.GenerateCSR("test-client", pki.DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("GenerateCSR failed: %v", err)
+	}
+	certPEM, err := pki.SignCSR(caCert, caKey, csrPEM, time.Hour)
+	if err != nil {
+		t.Fatalf("SignCSR failed: %v", err)
+	}
+
+	// The key was renamed into place but the certificate was not.
+	if err := os.WriteFile(clientKeyPath, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(clientCertPath+".new", certPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath); err == nil {
+		t.Fatal("pair unexpectedly consistent")
+	}
+
+	cert, err := pki.LoadClientCert(clientCertPath, clientKeyPath)
+	if err != nil {
+		t.Fatalf("LoadClientCert failed: %v", err)
+	}
+	if d := time.Until(cert.NotAfter()); d > time.Hour || d < 50*time.Minute {
+		t.Fatalf("loaded certificate expires in %v", d)
+	}
+	if _, err := os.Stat(clientCertPath + ".new"); !os.IsNotExist(err) {
+		t.Fatalf("leftover .new file: %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package pki
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Files of a CA rotation in the PKI directory, next to ca.crt and ca.key.
+const (
+	// PreviousCAFile is the CA certificate that ca.crt replaced. It is
+	// trusted until the rotation's grace period ends.
+	PreviousCAFile = "ca-previous.crt"
+	// CrossCAFile is the current CA certificate signed by the previous CA.
+	// Servers send it with their certificate so clients that only trust the
+	// previous CA still accept them. It expires when the grace period ends.
+	CrossCAFile = "ca-cross.crt"
+)
+
+// ErrRotationInProgress is returned by RotateCA while an earlier rotation's
+// previous CA is still trusted.
+var ErrRotationInProgress = errors.New("previous CA not retired yet")
+
+// RotateCA replaces the CA in dir with a new one valid for expiry, with a
+// key of the given algorithm, which may differ from the old CA's. The old
+// CA certificate is kept as PreviousCAFile, and a cross-signed copy of the
+// new one as CrossCAFile, both until now+grace. Certificates issued by the
+// old CA stay valid during that time; afterwards RetireCA drops it.
+func RotateCA(dir string, expiry, grace time.Duration, now time.Time, algorithm string) error {
+	if _, err := os.Stat(filepath.Join(dir, PreviousCAFile)); err == nil {
+		return ErrRotationInProgress
+	}
+	keyPath, certPath := filepath.Join(dir, "ca.key"), filepath.Join(dir, "ca.crt")
+	oldCert, oldKey, err := LoadCA(keyPath, certPath)
+	if err != nil {
+		return err
+	}
+	if err := GenerateCA(keyPath+".new", certPath+".new", expiry, algorithm); err != nil {
+		return err
+	}
+	newCert, _, err := LoadCA(keyPath+".new", certPath+".new")
+	if err != nil {
+		return err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	notAfter := now.Add(grace)
+	if notAfter.After(oldCert.NotAfter) {
+		notAfter = oldCert.NotAfter
+	}
+	cross := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               newCert.Subject,
+		SubjectKeyId:          newCert.SubjectKeyId,
+		NotBefore:             now,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              newCert.KeyUsage,
+		BasicConstraintsValid: true,
+	}
+	crossDER, err := x509.CreateCertificate(rand.Reader, cross, oldCert, newCert.PublicKey, oldKey)
+	if err != nil {
+		return err
+	}
+
+	if err := writeCertPEM(filepath.Join(dir, CrossCAFile), crossDER); err != nil {
+		return err
+	}
+	if err := writeCertPEM(filepath.Join(dir, PreviousCAFile), oldCert.Raw); err != nil {
+		return err
+	}
+	if err := os.Rename(keyPath+".new", keyPath); err != nil {
+		return err
+	}
+	return os.Rename(certPath+".new", certPath)
+}
+
+// RotationRetireAt returns when the previous CA in dir stops being trusted,
+// or the zero time when no rotation is in progress.
+func RotationRetireAt(dir string) (time.Time, error) {
+	cross, err := LoadCert(filepath.Join(dir, CrossCAFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return cross.NotAfter, nil
+}
+
+// RetireCA removes the previous CA from dir, ending a rotation.
+func RetireCA(dir string) error {
+	for _, name := range []string{CrossCAFile, PreviousCAFile} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// CABundle returns the PEM certificates of the CAs trusted in dir: the
+// current one first, then the previous one during a rotation.
+func CABundle(dir string) ([]byte, error) {
+	bundle, err := os.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	prev, err := os.ReadFile(filepath.Join(dir, PreviousCAFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return bundle, nil
+		}
+		return nil, err
+	}
+	return append(bundle, prev...), nil
+}
+
+// RootStore is a CA bundle loaded from disk for verifying the controller,
+// which can be replaced while connections use it. Set VerifyConnection as a
+// tls.Config hook together with InsecureSkipVerify; the standard check
+// would use a fixed RootCAs pool.
+type RootStore struct {
+	path    string
+	pool    atomic.Pointer[x509.CertPool]
+	current atomic.Pointer[x509.Certificate]
+}
+
+// LoadRootStore loads the CA bundle at path.
+func LoadRootStore(path string) (*RootStore, error) {
+	s := &RootStore{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.set(data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Update replaces the bundle with bundlePEM, on disk and in memory, and
+// reports whether it changed.
+func (s *RootStore) Update(bundlePEM []byte) (bool, error) {
+	if existing, err := os.ReadFile(s.path); err == nil && bytes.Equal(existing, bundlePEM) {
+		return false, nil
+	}
+	if err := s.set(bundlePEM); err != nil {
+		return false, err
+	}
+	if err := writeFileSync(s.path+".new", bundlePEM, 0o644); err != nil {
+		return false, err
+	}
+	return true, os.Rename(s.path+".new", s.path)
+}
+
+// Current returns the first CA of the bundle, which signs new certificates.
+func (s *RootStore) Current() *x509.Certificate {
+	return s.current.Load()
+}
+
+// VerifyConnection verifies the server's certificate chain against the
+// current bundle.
+func (s *RootStore) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("pki: server presented no certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         s.pool.Load(),
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+func (s *RootStore) set(bundlePEM []byte) error {
+	pool := x509.NewCertPool()
+	var first *x509.Certificate
+	for rest := bundlePEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		pool.AddCert(cert)
+		if first == nil {
+			first = cert
+		}
+	}
+	if first == nil {
+		return &pemError{path: s.path}
+	}
+	s.pool.Store(pool)
+	s.current.Store(first)
+	return nil
+}
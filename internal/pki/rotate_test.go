@@ -0,0 +1,132 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package pki_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"vpnctl/internal/pki"
+)
+
+func TestRotateCA_CrossSignsAndRetires(t *testing.T) {
+	dir := t.TempDir()
+	caCertPath := filepath.Join(dir, "ca.crt")
+	if err := pki.GenerateCA(filepath.Join(dir, "ca.key"), caCertPath, 24*time.Hour, pki.DefaultKeyAlgorithm); err != nil {
+		t.Fatalf("GenerateCA failed: %v", err)
+	}
+	oldPEM, _ := os.ReadFile(caCertPath)
+	oldCA, err := pki.LoadCert(caCertPath)
+	if err != nil {
+		t.Fatalf("LoadCert failed: %v", err)
+	}
+
+	now := time.Now()
+	if err := pki.RotateCA(dir, 48*time.Hour, time.Hour, now, pki.DefaultKeyAlgorithm); err != nil {
+		t.Fatalf("RotateCA failed: %v", err)
+	}
+	if err := pki.RotateCA(dir, 48*time.Hour, time.Hour, now, pki.DefaultKeyAlgorithm); !errors.Is(err, pki.ErrRotationInProgress) {
+		t.Fatalf("second RotateCA err=%v, want ErrRotationInProgress", err)
+	}
+	newCA, err := pki.LoadCert(caCertPath)
+	if err != nil {
+		t.Fatalf("LoadCert failed: %v", err)
+	}
+	if newCA.Equal(oldCA) {
+		t.Fatal("ca.crt not replaced")
+	}
+	retireAt, err := pki.RotationRetireAt(dir)
+	if err != nil || retireAt.Sub(now) > time.Hour || retireAt.Sub(now) < 59*time.Minute {
+		t.Fatalf("RotationRetireAt=%v err=%v", retireAt, err)
+	}
+
+	// A server certificate from the new CA, sent with the cross-signed CA,
+	// verifies against the old CA and against the new one.
+	if err := pki.GenerateServerCert(caCertPath, filepath.Join(dir, "ca.key"), filepath.Join(dir, "server.key"), filepath.Join(dir, "server.crt"), []string{"127.0.0.1"}, time.Hour, ""); err != nil {
+		t.Fatalf("GenerateServerCert failed: %v", err)
+	}
+	leaf, _ := pki.LoadCert(filepath.Join(dir, "server.crt"))
+	cross, err := pki.LoadCert(filepath.Join(dir, pki.CrossCAFile))
+	if err != nil {
+		t.Fatalf("load cross cert: %v", err)
+	}
+	for name, root := range map[string]*x509.Certificate{"old": oldCA, "new": newCA} {
+		roots, inter := x509.NewCertPool(), x509.NewCertPool()
+		roots.AddCert(root)
+		inter.AddCert(cross)
+		if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: inter, DNSName: "127.0.0.1"}); err != nil {
+			t.Errorf("verify against %s CA: %v", name, err)
+		}
+	}
+
+	bundle, err := pki.CABundle(dir)
+	if err != nil {
+		t.Fatalf("CABundle failed: %v", err)
+	}
+	newPEM, _ := os.ReadFile(caCertPath)
+	if !bytes.Equal(bundle, append(newPEM, oldPEM...)) {
+		t.Fatalf("bundle is not new CA then old CA:\n%s", bundle)
+	}
+
+	if err := pki.RetireCA(dir); err != nil {
+		t.Fatalf("RetireCA failed: %v", err)
+	}
+	if bundle, _ := pki.CABundle(dir); !bytes.Equal(bundle, newPEM) {
+		t.Fatal("bundle still holds the previous CA after RetireCA")
+	}
+	if retireAt, err := pki.RotationRetireAt(dir); err != nil || !retireAt.IsZero() {
+		t.Fatalf("RotationRetireAt after retire=%v err=%v", retireAt, err)
+	}
+}
+
+func TestRootStore_UpdateReplacesTrust(t *testing.T) {
+	caCertPath, srvCertPath, _, _, _ := setupTestPKI(t)
+	leaf, err := pki.LoadCert(srvCertPath)
+	if err != nil {
+		t.Fatalf("LoadCert failed: %v", err)
+	}
+	state := tls.ConnectionState{ServerName: "127.0.0.1", PeerCertificates: []*x509.Certificate{leaf}}
+
+	otherDir := t.TempDir()
+	if err := pki.GenerateCA(filepath.Join(otherDir, "ca.key"), filepath.Join(otherDir, "ca.crt"), time.Hour, pki.DefaultKeyAlgorithm); err != nil {
+		t.Fatalf("GenerateCA failed: %v", err)
+	}
+	otherPEM, _ := os.ReadFile(filepath.Join(otherDir, "ca.crt"))
+	caPEM, _ := os.ReadFile(caCertPath)
+
+	storePath := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(storePath, otherPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	roots, err := pki.LoadRootStore(storePath)
+	if err != nil {
+		t.Fatalf("LoadRootStore failed: %v", err)
+	}
+	if err := roots.VerifyConnection(state); err == nil {
+		t.Fatal("server verified against an unrelated CA")
+	}
+
+	changed, err := roots.Update(append(otherPEM, caPEM...))
+	if err != nil || !changed {
+		t.Fatalf("Update changed=%v err=%v", changed, err)
+	}
+	if err := roots.VerifyConnection(state); err != nil {
+		t.Fatalf("VerifyConnection after update: %v", err)
+	}
+	if got, _ := pki.LoadCert(storePath); !got.Equal(roots.Current()) {
+		t.Fatal("Current is not the first CA of the bundle on disk")
+	}
+	if changed, err := roots.Update(append(otherPEM, caPEM...)); err != nil || changed {
+		t.Fatalf("same bundle: changed=%v err=%v", changed, err)
+	}
+	if _, err := roots.Update([]byte("garbage")); err == nil {
+		t.Fatal("Update accepted an invalid bundle")
+	}
+}
@@ -12,7 +12,8 @@ import (
 // ServerTLSConfig builds a *tls.Config for a mutual-TLS server.
 // It loads the CA certificate into ClientCAs, loads the server certificate and
 // key, requires and verifies a client certificate, and enforces TLS 1.3.
-func ServerTLSConfig(caCertPath, serverCertPath, serverKeyPath string) (*tls.Config, error) {
+// Client certificates on revoked, if non-nil, fail the handshake.
+func ServerTLSConfig(caCertPath, serverCertPath, serverKeyPath string, revoked *RevocationList) (*tls.Config, error) {
 	caPEM, err := os.ReadFile(caCertPath)
 	if err != nil {
 		return nil, err
@@ -28,12 +29,16 @@ func ServerTLSConfig(caCertPath, serverCertPath, serverKeyPath string) (*tls.Con
 		return nil, err
 	}
 
-	return &tls.Config{
+	cfg := &tls.Config{
 		ClientCAs:    caPool,
 		ClientAuth:   tls.RequireAndVerifyClientCert,
 		Certificates: []tls.Certificate{cert},
 		MinVersion:   tls.VersionTLS13,
-	}, nil
+	}
+	if revoked != nil {
+		cfg.VerifyPeerCertificate = revoked.VerifyPeerCertificate
+	}
+	return cfg, nil
 }
 
 // ClientTLSConfig builds a *tls.Config for a mutual-TLS client.
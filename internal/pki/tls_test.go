@@ -4,6 +4,7 @@
 package pki_test
 
 import (
+	"crypto/x509"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -17,19 +18,25 @@ import (
 // setupTestPKI creates a CA, server cert, and client cert in a temp dir.
 // Returns paths to the CA cert, server cert/key, client cert/key.
 func setupTestPKI(t *testing.T) (caCertPath, srvCertPath, srvKeyPath, clientCertPath, clientKeyPath string) {
+	t.Helper()
+	return setupTestPKIWithAlgorithm(t, pki.DefaultKeyAlgorithm)
+}
+
+// setupTestPKIWithAlgorithm is setupTestPKI with keys of the given algorithm.
+func setupTestPKIWithAlgorithm(t *testing.T, algorithm string) (caCertPath, srvCertPath, srvKeyPath, clientCertPath, clientKeyPath string) {
 	t.Helper()
 	dir := t.TempDir()
 
 	caKeyPath := dir + "/ca.key"
 	caCertPath = dir + "/ca.crt"
 
-	if err := pki.GenerateCA(caKeyPath, caCertPath, 24*time.Hour); err != nil {
+	if err := pki.GenerateCA(caKeyPath, caCertPath, 24*time.Hour, algorithm); err != nil {
 		t.Fatalf("GenerateCA failed: %v", err)
 	}
 
 	srvKeyPath = dir + "/server.key"
 	srvCertPath = dir + "/server.crt"
-	if err := pki.GenerateServerCert(caCertPath, caKeyPath, srvKeyPath, srvCertPath, []string{"127.0.0.1"}, 24*time.Hour); err != nil {
+	if err := pki.GenerateServerCert(caCertPath, caKeyPath, srvKeyPath, srvCertPath, []string{"127.0.0.1"}, 24*time.Hour, ""); err != nil {
 		t.Fatalf("GenerateServerCert failed: %v", err)
 	}
 
@@ -38,7 +45,7 @@ func setupTestPKI(t *testing.T) (caCertPath, srvCertPath, srvKeyPath, clientCert
 		t.Fatalf("LoadCA failed: %v", err)
 	}
 
-	csrPEM, keyPEM, err := pki.GenerateCSR("test-client")
+	csrPEM, keyPEM, err := pki.GenerateCSR("test-client", algorithm)
 	if err != nil {
 		t.Fatalf("GenerateCSR failed: %v", err)
 	}
@@ -64,7 +71,7 @@ func setupTestPKI(t *testing.T) (caCertPath, srvCertPath, srvKeyPath, clientCert
 func TestMTLSHandshake(t *testing.T) {
 	caCertPath, srvCertPath, srvKeyPath, clientCertPath, clientKeyPath := setupTestPKI(t)
 
-	serverTLS, err := pki.ServerTLSConfig(caCertPath, srvCertPath, srvKeyPath)
+	serverTLS, err := pki.ServerTLSConfig(caCertPath, srvCertPath, srvKeyPath, nil)
 	if err != nil {
 		t.Fatalf("ServerTLSConfig failed: %v", err)
 	}
@@ -103,7 +110,7 @@ func TestMTLSHandshake(t *testing.T) {
 func TestMTLS_RejectsNoClientCert(t *testing.T) {
 	caCertPath, srvCertPath, srvKeyPath, _, _ := setupTestPKI(t)
 
-	serverTLS, err := pki.ServerTLSConfig(caCertPath, srvCertPath, srvKeyPath)
+	serverTLS, err := pki.ServerTLSConfig(caCertPath, srvCertPath, srvKeyPath, nil)
 	if err != nil {
 		t.Fatalf("ServerTLSConfig failed: %v", err)
 	}
@@ -129,3 +136,40 @@ func TestMTLS_RejectsNoClientCert(t *testing.T) {
 		t.Fatal("expected TLS handshake error when no client cert is presented, but got nil")
 	}
 }
+
+func TestMTLS_RejectsRevokedCert(t *testing.T) {
+	caCertPath, srvCertPath, srvKeyPath, clientCertPath, clientKeyPath := setupTestPKI(t)
+
+	revoked, err := pki.OpenRevocationList(t.TempDir() + "/revoked.json")
+	if err != nil {
+		t.Fatalf("OpenRevocationList failed: %v", err)
+	}
+	clientCert, err := pki.LoadCert(clientCertPath)
+	if err != nil {
+		t.Fatalf("LoadCert failed: %v", err)
+	}
+	if _, err := revoked.Revoke([]*x509.Certificate{clientCert}, time.Now()); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+
+	serverTLS, err := pki.ServerTLSConfig(caCertPath, srvCertPath, srvKeyPath, revoked)
+	if err != nil {
+		t.Fatalf("ServerTLSConfig failed: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	srv.TLS = serverTLS
+	srv.StartTLS()
+	defer srv.Close()
+
+	clientTLS, err := pki.ClientTLSConfig(caCertPath, clientCertPath, clientKeyPath)
+	if err != nil {
+		t.Fatalf("ClientTLSConfig failed: %v", err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+	if resp, err := client.Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected TLS handshake error for a revoked client cert, but got nil")
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+// Package relay runs an additional relay hub: a WireGuard interface whose
+// peers are kept in sync with the controller's registry.
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"vpnctl/internal/api"
+	"vpnctl/internal/config"
+	"vpnctl/internal/direct"
+	"vpnctl/internal/pki"
+	"vpnctl/internal/wireguard"
+)
+
+// Run answers health probes and syncs the hub's peers from the controller
+// every SyncIntervalSec until ctx is done.
+func Run(ctx context.Context, cfg config.RelayConfig) error {
+	client, err := newClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	resp, err := direct.StartResponder(fmt.Sprintf(":%d", cfg.ProbePort))
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	slog.Info("relay hub probe responder listening", "hub", cfg.Name, "addr", resp.LocalAddr())
+
+	return newSyncer(cfg, client, wireguard.DefaultManager()).run(ctx)
+}
+
+// peerClient fetches a relay hub's peers; *api.Client implements it.
+type peerClient interface {
+	RelayPeers(ctx context.Context, hub string) (api.RelayPeersResponse, error)
+}
+
+// syncer applies the peers and ACL rules the controller hands out for one
+// hub, skipping the commands when nothing changed.
+type syncer struct {
+	name      string
+	iface     string
+	serverCfg wireguard.ServerConfig
+	interval  time.Duration
+	client    peerClient
+	wg        *wireguard.Manager
+
+	applied []wireguard.Peer
+	// appliedFirewall is the last nft script applied, "" when the hub has
+	// no firewall table.
+	appliedFirewall string
+}
+
+func newSyncer(cfg config.RelayConfig, client peerClient, wg *wireguard.Manager) *syncer {
+	return &syncer{
+		name:  cfg.Name,
+		iface: cfg.WGInterface,
+		serverCfg: wireguard.ServerConfig{
+			Interface:  cfg.WGInterface,
+			PrivateKey: cfg.WGPrivateKey,
+			Address:    cfg.WGAddress,
+			ListenPort: cfg.WGPort,
+			MTU:        cfg.MTU,
+		},
+		interval: time.Duration(cfg.SyncIntervalSec) * time.Second,
+		client:   client,
+		wg:       wg,
+	}
+}
+
+// run calls sync every interval until ctx is done.
+func (s *syncer) run(ctx context.Context) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.sync(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync fetches the hub's peers and applies them, then the ACL rules. Errors
+// are logged and retried on the next call.
+func (s *syncer) sync(ctx context.Context) {
+	resp, err := s.client.RelayPeers(ctx, s.name)
+	if err != nil {
+		slog.Warn("relay peer sync failed", "hub", s.name, "err", err)
+		return
+	}
+	peers := relayPeers(resp)
+	if s.applied == nil || !slices.EqualFunc(peers, s.applied, peerEqual) {
+		if err := s.wg.ApplyServer(s.serverCfg, peers); err != nil {
+			slog.Warn("relay peer apply failed", "hub", s.name, "err", err)
+		} else {
+			s.applied = peers
+			slog.Info("relay peers applied", "hub", s.name, "peers", len(peers))
+		}
+	}
+
+	// The controller's ACL policy applies to traffic relayed here too. When
+	// the policy goes away, so does the table.
+	if !resp.ACL {
+		if s.appliedFirewall != "" {
+			if err := s.wg.RemoveFirewall(); err != nil {
+				slog.Warn("relay firewall removal failed", "hub", s.name, "err", err)
+			} else {
+				s.appliedFirewall = ""
+			}
+		}
+		return
+	}
+	rules := firewallRules(resp.ACLRules)
+	if script := wireguard.RenderFirewall(s.iface, rules); script != s.appliedFirewall {
+		if err := s.wg.ApplyFirewall(s.iface, rules); err != nil {
+			slog.Warn("relay firewall apply failed", "hub", s.name, "err", err)
+		} else {
+			s.appliedFirewall = script
+		}
+	}
+}
+
+// newClient returns a controller client. With a pki_dir it presents the
+// relay certificate from `controller relay-cert`.
+func newClient(cfg config.RelayConfig) (*api.Client, error) {
+	addr := strings.TrimPrefix(strings.TrimPrefix(cfg.Controller, "http://"), "https://")
+	if cfg.PKIDir == "" {
+		return api.NewClient("http://" + addr), nil
+	}
+	dir := cfg.PKIDir
+	tlsCfg, err := pki.ClientTLSConfig(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "relay.crt"), filepath.Join(dir, "relay.key"))
+	if err != nil {
+		return nil, err
+	}
+	return api.NewTLSClient("https://"+addr, tlsCfg), nil
+}
+
+func relayPeers(resp api.RelayPeersResponse) []wireguard.Peer {
+	peers := make([]wireguard.Peer, 0, len(resp.Peers))
+	for _, p := range resp.Peers {
+		peers = append(peers, wireguard.Peer{
+			PublicKey:  p.PublicKey,
+			Endpoint:   p.Endpoint,
+			AllowedIPs: p.AllowedIPs,
+		})
+	}
+	return peers
+}
+
+func firewallRules(acl []api.ACLRule) []wireguard.FirewallRule {
+	rules := make([]wireguard.FirewallRule, 0, len(acl))
+	for _, r := range acl {
+		rules = append(rules, wireguard.FirewallRule{Src: parsePrefixes(r.Src), Dst: parsePrefixes(r.Dst)})
+	}
+	return rules
+}
+
+func parsePrefixes(values []string) []netip.Prefix {
+	out := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		if p, err := netip.ParsePrefix(v); err == nil {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func peerEqual(a, b wireguard.Peer) bool {
+	return a.PublicKey == b.PublicKey && a.Endpoint == b.Endpoint && slices.Equal(a.AllowedIPs, b.AllowedIPs)
+}
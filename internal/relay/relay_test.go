@@ -0,0 +1,152 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package relay
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"vpnctl/internal/api"
+	"vpnctl/internal/config"
+	"vpnctl/internal/execx"
+	"vpnctl/internal/wireguard"
+)
+
+// fakeRunner records commands instead of running them.
+type fakeRunner struct {
+	runs []string
+}
+
+func (f *fakeRunner) Run(name string, args ...string) error {
+	f.runs = append(f.runs, name+" "+strings.Join(args, " "))
+	return nil
+}
+
+func (f *fakeRunner) Output(name string, args ...string) (string, error) {
+	return "", nil
+}
+
+var _ execx.Runner = (*fakeRunner)(nil)
+
+// fakeClient returns resp, or err when set.
+type fakeClient struct {
+	hub  string
+	resp api.RelayPeersResponse
+	err  error
+}
+
+func (f *fakeClient) RelayPeers(_ context.Context, hub string) (api.RelayPeersResponse, error) {
+	f.hub = hub
+	return f.resp, f.err
+}
+
+func TestParsePrefixes_SkipsInvalid(t *testing.T) {
+	got := parsePrefixes([]string{"10.7.0.2/32", "bogus", "fd00::/64", "10.7.0.3"})
+	want := []netip.Prefix{netip.MustParsePrefix("10.7.0.2/32"), netip.MustParsePrefix("fd00::/64")}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got := parsePrefixes(nil); got == nil || len(got) != 0 {
+		t.Fatalf("nil input: got %#v", got)
+	}
+}
+
+func TestFirewallRules_ConvertsACLRules(t *testing.T) {
+	rules := firewallRules([]api.ACLRule{
+		{Src: []string{"10.7.0.2/32"}, Dst: []string{"10.7.0.3/32", "192.168.1.0/24"}},
+		{Src: []string{"bad"}, Dst: []string{"10.7.0.4/32"}},
+	})
+	if len(rules) != 2 {
+		t.Fatalf("rules=%+v", rules)
+	}
+	if !slices.Equal(rules[0].Src, []netip.Prefix{netip.MustParsePrefix("10.7.0.2/32")}) ||
+		!slices.Equal(rules[0].Dst, []netip.Prefix{netip.MustParsePrefix("10.7.0.3/32"), netip.MustParsePrefix("192.168.1.0/24")}) {
+		t.Fatalf("rule 0=%+v", rules[0])
+	}
+	if len(rules[1].Src) != 0 || len(rules[1].Dst) != 1 {
+		t.Fatalf("rule 1=%+v", rules[1])
+	}
+}
+
+func TestSyncer_AppliesChangesAndRemovesFirewall(t *testing.T) {
+	runner := &fakeRunner{}
+	client := &fakeClient{resp: api.RelayPeersResponse{
+		Peers: []api.RelayPeer{{PublicKey: "pub-a", Endpoint: "198.51.100.1:51820", AllowedIPs: []string{"10.7.0.2/32"}}},
+		ACL:   true,
+		ACLRules: []api.ACLRule{
+			{Src: []string{"10.7.0.2/32"}, Dst: []string{"10.7.0.3/32"}},
+		},
+	}}
+	s := newSyncer(config.RelayConfig{
+		Name: "eu", WGInterface: "wg-eu", WGAddress: "10.7.0.250/32",
+		WGPrivateKey: "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+	}, client, wireguard.NewManager(runner))
+
+	count := func(prefix string) int {
+		n := 0
+		for _, run := range runner.runs {
+			if strings.HasPrefix(run, prefix) {
+				n++
+			}
+		}
+		return n
+	}
+
+	s.sync(context.Background())
+	if client.hub != "eu" {
+		t.Fatalf("fetched peers of hub %q", client.hub)
+	}
+	if count("wg syncconf wg-eu ") != 1 || count("nft -f ") != 1 {
+		t.Fatalf("first sync runs=%v", runner.runs)
+	}
+	if s.appliedFirewall == "" {
+		t.Fatal("firewall not recorded as applied")
+	}
+
+	// Nothing changed: no commands.
+	runner.runs = nil
+	s.sync(context.Background())
+	if len(runner.runs) != 0 {
+		t.Fatalf("unchanged sync runs=%v", runner.runs)
+	}
+
+	// A failed fetch keeps the hub as it is.
+	client.err = errors.New("controller unreachable")
+	s.sync(context.Background())
+	if len(runner.runs) != 0 {
+		t.Fatalf("failed fetch runs=%v", runner.runs)
+	}
+	client.err = nil
+
+	// A new peer is applied; the rules are unchanged.
+	client.resp.Peers = append(client.resp.Peers, api.RelayPeer{PublicKey: "pub-b", AllowedIPs: []string{"10.7.0.3/32"}})
+	s.sync(context.Background())
+	if count("wg syncconf wg-eu ") != 1 || count("nft -f ") != 0 {
+		t.Fatalf("peer change runs=%v", runner.runs)
+	}
+
+	// Dropping the policy deletes the table once.
+	runner.runs = nil
+	client.resp.ACL, client.resp.ACLRules = false, nil
+	s.sync(context.Background())
+	if count("nft -f ") != 1 || s.appliedFirewall != "" {
+		t.Fatalf("policy removal runs=%v applied=%q", runner.runs, s.appliedFirewall)
+	}
+	runner.runs = nil
+	s.sync(context.Background())
+	if len(runner.runs) != 0 {
+		t.Fatalf("sync without policy runs=%v", runner.runs)
+	}
+
+	// A policy that comes back is applied again.
+	client.resp.ACL = true
+	s.sync(context.Background())
+	if count("nft -f ") != 1 || s.appliedFirewall == "" {
+		t.Fatalf("policy restore runs=%v", runner.runs)
+	}
+}
@@ -29,7 +29,7 @@ type NodeStatus struct {
 	NATType string
 	LastSeen string
 	Online  bool
-	Quality string // good, degraded, poor, offline
+	Quality string // good, degraded, poor, stale, offline
 	RTTMs   string
 	LossPct string
 }
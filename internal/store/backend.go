@@ -0,0 +1,123 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package store
+
+import "time"
+
+// Backend is the controller's persistent state: registered nodes, bootstrap
+// tokens and direct-probe results. Writes are grouped with Update so callers
+// can change several records atomically.
+type Backend interface {
+	// Nodes returns all registered nodes ordered by name.
+	Nodes() ([]NodeInfo, error)
+	// ListTokens returns all bootstrap tokens, including expired and used
+	// up ones.
+	ListTokens() ([]Token, error)
+	// PutToken creates or replaces the bootstrap token with t.Hash.
+	PutToken(t Token) error
+	// DeleteToken removes the bootstrap token with the given hash. Missing
+	// tokens are ignored.
+	DeleteToken(hash string) error
+	// UseToken counts one enrollment against the token with the given hash
+	// and reports whether it was allowed: false when the token is missing or
+	// has no uses left.
+	UseToken(hash string) (bool, error)
+	// DirectResults returns the latest direct-probe result for every node/peer pair.
+	DirectResults() ([]DirectResult, error)
+	// MetricBuckets returns per-minute metric aggregates starting at or after since.
+	MetricBuckets(since time.Time) ([]MetricBucket, error)
+	// CertRevocations returns, per client certificate common name, the time
+	// before which certificates issued to that name are rejected.
+	CertRevocations() (map[string]time.Time, error)
+	// IPReservations returns VPN IP reservations made through the admin API,
+	// ordered by name.
+	IPReservations() ([]IPReservation, error)
+	// Update runs fn inside a single transaction. If fn returns an error,
+	// nothing it wrote is persisted.
+	Update(fn func(tx Tx) error) error
+	Close() error
+}
+
+// Tx is the write side of a Backend transaction.
+type Tx interface {
+	PutNode(node NodeInfo) error
+	DeleteNode(id string) error
+	PutToken(t Token) error
+	DeleteToken(hash string) error
+	UseToken(hash string) (bool, error)
+	PutDirectResult(r DirectResult) error
+	// AddMetricBucket adds b's counters to the stored bucket for the same
+	// node and minute, creating it if needed.
+	AddMetricBucket(b MetricBucket) error
+	// PruneMetricBuckets deletes buckets that start before the given time.
+	PruneMetricBuckets(before time.Time) error
+	// PutCertRevocation rejects client certificates for commonName issued
+	// before the given time. An existing later cutoff is kept.
+	PutCertRevocation(commonName string, before time.Time) error
+	// PutIPReservation creates or replaces the reservation for r.Name.
+	PutIPReservation(r IPReservation) error
+	// DeleteIPReservation removes the reservation for name. Missing names are ignored.
+	DeleteIPReservation(name string) error
+}
+
+// DirectResult is the latest direct-probe outcome reported by NodeID towards PeerID.
+type DirectResult struct {
+	NodeID    string
+	PeerID    string
+	Success   bool
+	RTTMs     float64
+	Reason    string
+	CheckedAt time.Time
+	// LastSuccessAt is the time of the most recent successful probe, which
+	// may be older than CheckedAt when the latest attempt failed.
+	LastSuccessAt time.Time
+}
+
+// Token is a bootstrap token. Only a hash of its secret is kept, so a
+// listing cannot leak a usable token.
+type Token struct {
+	Hash        string // hex SHA-256 of the secret
+	Description string
+	CreatedAt   time.Time
+	ExpiresAt   time.Time // zero: never expires
+	MaxUses     int       // zero: unlimited
+	Uses        int
+	// NamePattern restricts the node names the token enrolls, in path.Match
+	// syntax. Empty allows any name.
+	NamePattern string
+	// Tags are admin tags given to nodes enrolled with the token, and VPNIP
+	// the address given to the node it enrolls.
+	Tags      []string
+	VPNIP     string
+	Ephemeral bool
+}
+
+// Expired reports whether t can no longer be used at now.
+func (t Token) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+// UsedUp reports whether t has enrolled as many nodes as it may.
+func (t Token) UsedUp() bool {
+	return t.MaxUses > 0 && t.Uses >= t.MaxUses
+}
+
+// IPReservation pins a VPN IP to a node name, whether or not the node has
+// registered yet.
+type IPReservation struct {
+	Name      string
+	VPNIP     string
+	CreatedAt time.Time
+}
+
+// MetricBucket aggregates everything a node reported during one minute.
+// A bucket with zero samples still records that the node checked in.
+type MetricBucket struct {
+	NodeID     string
+	Start      time.Time // truncated to the minute
+	Samples    int
+	RTTSamples int     // samples that carried an RTT
+	RTTSumMs   float64 // sum of RTTMs over RTTSamples
+	LossSum    float64 // sum of LossPct over Samples
+}
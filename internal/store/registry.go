@@ -17,6 +17,13 @@ type Registry struct {
 	Nodes     []NodeInfo `yaml:"nodes"`
 }
 
+// Node liveness states stored in NodeInfo.Status.
+const (
+	StatusOnline  = "online"
+	StatusStale   = "stale"
+	StatusOffline = "offline"
+)
+
 // NodeInfo is a minimal snapshot for controller persistence.
 type NodeInfo struct {
 	ID         string    `yaml:"id"`
@@ -29,6 +36,33 @@ type NodeInfo struct {
 	Status     string    `yaml:"status"`
 	NATType    string    `yaml:"nat_type"`
 	PublicAddr string    `yaml:"public_addr"`
+	// Disabled nodes keep their registration and VPN IP but are excluded
+	// from the hub and from peer candidates until re-enabled.
+	Disabled bool `yaml:"disabled,omitempty"`
+	// PendingPubKey is a WireGuard key registered by `node rotate-key` that
+	// is not yet confirmed. PubKey stays authoritative until it is.
+	PendingPubKey string `yaml:"pending_pub_key,omitempty"`
+	// PrimaryHub and BackupHub are the relay hubs assigned to the node;
+	// ActiveHub is the one it last reported using. Empty means the
+	// controller's own hub.
+	PrimaryHub string `yaml:"primary_hub,omitempty"`
+	BackupHub  string `yaml:"backup_hub,omitempty"`
+	ActiveHub  string `yaml:"active_hub,omitempty"`
+	// Tags are the ones the node reports from its config; AdminTags are set
+	// with `controller tag-node`. ACL policy matches either.
+	Tags      []string `yaml:"tags,omitempty"`
+	AdminTags []string `yaml:"admin_tags,omitempty"`
+	// AdvertisedRoutes are LAN prefixes the node offers to route for the
+	// mesh; only those also in ApprovedRoutes (set by an admin) are used.
+	AdvertisedRoutes []string `yaml:"advertised_routes,omitempty"`
+	ApprovedRoutes   []string `yaml:"approved_routes,omitempty"`
+	// ExitNode is set when the node offers to route internet traffic, and
+	// UseExitNode names the exit node the node sends its own through.
+	ExitNode    bool   `yaml:"exit_node,omitempty"`
+	UseExitNode string `yaml:"use_exit_node,omitempty"`
+	// Ephemeral nodes enrolled with an ephemeral bootstrap token and are
+	// removed once they leave or stay unseen for long enough.
+	Ephemeral bool `yaml:"ephemeral,omitempty"`
 }
 
 // LoadRegistry loads the registry from disk. If the file is missing, returns an empty registry.
@@ -99,3 +133,47 @@ func atomicWriteFile(path string, data []byte, perm os.FileMode) error {
 
 	return os.Rename(tmpName, path)
 }
+
+// MigrateRegistry imports nodes from a legacy registry.yaml at path into b in a
+// single transaction and renames the file to path+".migrated" so the import
+// runs only once. It returns the number of imported nodes; a missing file is
+// not an error.
+func MigrateRegistry(b Backend, path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	reg, err := LoadRegistry(path)
+	if err != nil {
+		return 0, err
+	}
+
+	err = b.Update(func(tx Tx) error {
+		for _, node := range reg.Nodes {
+			// Older registries might not have IDs; keep them stable by name.
+			if node.ID == "" {
+				node.ID = node.Name
+			}
+			if node.Name == "" {
+				node.Name = node.ID
+			}
+			if node.ID == "" {
+				continue
+			}
+			if err := tx.PutNode(node); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(path, path+".migrated"); err != nil {
+		return 0, err
+	}
+	return len(reg.Nodes), nil
+}
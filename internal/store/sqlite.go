@@ -0,0 +1,634 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package store
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// migrations are applied in order; PRAGMA user_version records how many ran.
+// Never edit an existing entry — append a new one instead.
+var migrations = []string{
+	`
+CREATE TABLE nodes (
+    id           TEXT PRIMARY KEY,
+    name         TEXT NOT NULL,
+    pub_key      TEXT NOT NULL DEFAULT '',
+    vpn_ip       TEXT NOT NULL DEFAULT '',
+    endpoint     TEXT NOT NULL DEFAULT '',
+    probe_port   INTEGER NOT NULL DEFAULT 0,
+    last_seen_at INTEGER NOT NULL DEFAULT 0,
+    status       TEXT NOT NULL DEFAULT '',
+    nat_type     TEXT NOT NULL DEFAULT '',
+    public_addr  TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX idx_nodes_name ON nodes(name);
+CREATE TABLE tokens (
+    token      TEXT PRIMARY KEY,
+    created_at INTEGER NOT NULL
+);
+CREATE TABLE direct_results (
+    node_id         TEXT NOT NULL,
+    peer_id         TEXT NOT NULL,
+    success         INTEGER NOT NULL,
+    rtt_ms          REAL NOT NULL DEFAULT 0,
+    reason          TEXT NOT NULL DEFAULT '',
+    checked_at      INTEGER NOT NULL,
+    last_success_at INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (node_id, peer_id)
+);
+`,
+	`
+CREATE TABLE metric_buckets (
+    node_id     TEXT NOT NULL,
+    start       INTEGER NOT NULL,
+    samples     INTEGER NOT NULL DEFAULT 0,
+    rtt_samples INTEGER NOT NULL DEFAULT 0,
+    rtt_sum_ms  REAL NOT NULL DEFAULT 0,
+    loss_sum    REAL NOT NULL DEFAULT 0,
+    PRIMARY KEY (node_id, start)
+);
+CREATE INDEX idx_metric_buckets_start ON metric_buckets(start);
+`,
+	`
+ALTER TABLE nodes ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0;
+CREATE TABLE cert_revocations (
+    common_name TEXT PRIMARY KEY,
+    before_at   INTEGER NOT NULL
+);
+`,
+	`
+CREATE TABLE ip_reservations (
+    name       TEXT PRIMARY KEY,
+    vpn_ip     TEXT NOT NULL,
+    created_at INTEGER NOT NULL
+);
+`,
+	`
+ALTER TABLE nodes ADD COLUMN pending_pub_key TEXT NOT NULL DEFAULT '';
+`,
+	`
+ALTER TABLE nodes ADD COLUMN primary_hub TEXT NOT NULL DEFAULT '';
+ALTER TABLE nodes ADD COLUMN backup_hub TEXT NOT NULL DEFAULT '';
+ALTER TABLE nodes ADD COLUMN active_hub TEXT NOT NULL DEFAULT '';
+`,
+	`
+ALTER TABLE nodes ADD COLUMN tags TEXT NOT NULL DEFAULT '';
+ALTER TABLE nodes ADD COLUMN admin_tags TEXT NOT NULL DEFAULT '';
+`,
+	`
+ALTER TABLE nodes ADD COLUMN advertised_routes TEXT NOT NULL DEFAULT '';
+ALTER TABLE nodes ADD COLUMN approved_routes TEXT NOT NULL DEFAULT '';
+`,
+	`
+ALTER TABLE nodes ADD COLUMN exit_node INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE nodes ADD COLUMN use_exit_node TEXT NOT NULL DEFAULT '';
+`,
+	`
+ALTER TABLE nodes ADD COLUMN ephemeral INTEGER NOT NULL DEFAULT 0;
+`,
+	// Tokens are kept hashed from here on; hashLegacyTokens moves the
+	// plaintext rows of the tokens table over and drops it.
+	`
+CREATE TABLE bootstrap_tokens (
+    hash         TEXT PRIMARY KEY,
+    description  TEXT NOT NULL DEFAULT '',
+    created_at   INTEGER NOT NULL,
+    expires_at   INTEGER NOT NULL DEFAULT 0,
+    max_uses     INTEGER NOT NULL DEFAULT 0,
+    uses         INTEGER NOT NULL DEFAULT 0,
+    name_pattern TEXT NOT NULL DEFAULT '',
+    tags         TEXT NOT NULL DEFAULT '',
+    vpn_ip       TEXT NOT NULL DEFAULT '',
+    ephemeral    INTEGER NOT NULL DEFAULT 0
+);
+`,
+}
+
+// SQLite is a Backend stored in a single SQLite database file.
+type SQLite struct {
+	db *sql.DB
+}
+
+var _ Backend = (*SQLite)(nil)
+
+// OpenSQLite opens or creates the controller database at path and brings its
+// schema up to date.
+func OpenSQLite(path string) (*SQLite, error) {
+	// The CLI (token and node commands) may open the database while the
+	// controller is running, so wait for locks instead of failing immediately.
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// A single connection serializes writers in-process and avoids SQLITE_BUSY
+	// between our own goroutines.
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(db); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("migrate %s: %w", path, err)
+	}
+	if err := hashLegacyTokens(db); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("migrate %s: %w", path, err)
+	}
+	return &SQLite{db: db}, nil
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		// PRAGMA does not accept bound parameters.
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashLegacyTokens moves plaintext tokens from the old tokens table into
+// bootstrap_tokens, keyed by the same hash as pki.HashToken, and drops the
+// old table. Legacy tokens never expire and have no use limit.
+func hashLegacyTokens(db *sql.DB) error {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'tokens'`).Scan(&n); err != nil || n == 0 {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.Query(`SELECT token, created_at FROM tokens`)
+	if err != nil {
+		return err
+	}
+	var legacy []Token
+	for rows.Next() {
+		var token string
+		var created int64
+		if err := rows.Scan(&token, &created); err != nil {
+			rows.Close()
+			return err
+		}
+		sum := sha256.Sum256([]byte(token))
+		legacy = append(legacy, Token{
+			Hash:      hex.EncodeToString(sum[:]),
+			CreatedAt: fromMicro(created),
+			Ephemeral: strings.HasPrefix(token, "vpnctl-ephemeral-"),
+		})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	stx := &sqliteTx{tx: tx}
+	for _, t := range legacy {
+		if err := stx.PutToken(t); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DROP TABLE tokens`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close closes the underlying database connection.
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+// Nodes returns all registered nodes ordered by name.
+func (s *SQLite) Nodes() ([]NodeInfo, error) {
+	rows, err := s.db.Query(
+		`SELECT id, name, pub_key, vpn_ip, endpoint, probe_port, last_seen_at, status, nat_type, public_addr, disabled, pending_pub_key,
+		        primary_hub, backup_hub, active_hub, tags, admin_tags, advertised_routes, approved_routes,
+		        exit_node, use_exit_node, ephemeral
+		 FROM nodes ORDER BY name, id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nodes []NodeInfo
+	for rows.Next() {
+		var n NodeInfo
+		var lastSeen int64
+		var disabled, exitNode, ephemeral int
+		var tags, adminTags, advertised, approved string
+		if err := rows.Scan(&n.ID, &n.Name, &n.PubKey, &n.VPNIP, &n.Endpoint, &n.ProbePort,
+			&lastSeen, &n.Status, &n.NATType, &n.PublicAddr, &disabled, &n.PendingPubKey,
+			&n.PrimaryHub, &n.BackupHub, &n.ActiveHub, &tags, &adminTags, &advertised, &approved,
+			&exitNode, &n.UseExitNode, &ephemeral); err != nil {
+			return nil, err
+		}
+		n.LastSeenAt = fromMicro(lastSeen)
+		n.Disabled = disabled != 0
+		n.Tags = splitList(tags)
+		n.AdminTags = splitList(adminTags)
+		n.AdvertisedRoutes = splitList(advertised)
+		n.ApprovedRoutes = splitList(approved)
+		n.ExitNode = exitNode != 0
+		n.Ephemeral = ephemeral != 0
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
+
+// ListTokens returns all bootstrap tokens in creation order.
+func (s *SQLite) ListTokens() ([]Token, error) {
+	rows, err := s.db.Query(
+		`SELECT hash, description, created_at, expires_at, max_uses, uses, name_pattern, tags, vpn_ip, ephemeral
+		 FROM bootstrap_tokens ORDER BY created_at, hash`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []Token
+	for rows.Next() {
+		var t Token
+		var created, expires int64
+		var tags string
+		var ephemeral int
+		if err := rows.Scan(&t.Hash, &t.Description, &created, &expires, &t.MaxUses, &t.Uses,
+			&t.NamePattern, &tags, &t.VPNIP, &ephemeral); err != nil {
+			return nil, err
+		}
+		t.CreatedAt = fromMicro(created)
+		t.ExpiresAt = fromMicro(expires)
+		t.Tags = splitList(tags)
+		t.Ephemeral = ephemeral != 0
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// PutToken creates or replaces a bootstrap token.
+func (s *SQLite) PutToken(t Token) error {
+	return s.Update(func(tx Tx) error { return tx.PutToken(t) })
+}
+
+// DeleteToken removes a bootstrap token.
+func (s *SQLite) DeleteToken(hash string) error {
+	return s.Update(func(tx Tx) error { return tx.DeleteToken(hash) })
+}
+
+// UseToken counts one use of a bootstrap token if it has any left.
+func (s *SQLite) UseToken(hash string) (bool, error) {
+	var ok bool
+	err := s.Update(func(tx Tx) error {
+		var err error
+		ok, err = tx.UseToken(hash)
+		return err
+	})
+	return ok, err
+}
+
+// DirectResults returns the latest direct-probe result for every node/peer pair.
+func (s *SQLite) DirectResults() ([]DirectResult, error) {
+	rows, err := s.db.Query(
+		`SELECT node_id, peer_id, success, rtt_ms, reason, checked_at, last_success_at
+		 FROM direct_results ORDER BY node_id, peer_id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []DirectResult
+	for rows.Next() {
+		var r DirectResult
+		var success int
+		var checked, lastSuccess int64
+		if err := rows.Scan(&r.NodeID, &r.PeerID, &success, &r.RTTMs, &r.Reason, &checked, &lastSuccess); err != nil {
+			return nil, err
+		}
+		r.Success = success != 0
+		r.CheckedAt = fromMicro(checked)
+		r.LastSuccessAt = fromMicro(lastSuccess)
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// MetricBuckets returns all per-minute metric aggregates starting at or after since.
+func (s *SQLite) MetricBuckets(since time.Time) ([]MetricBucket, error) {
+	rows, err := s.db.Query(
+		`SELECT node_id, start, samples, rtt_samples, rtt_sum_ms, loss_sum
+		 FROM metric_buckets WHERE start >= ? ORDER BY node_id, start`,
+		since.Truncate(time.Minute).UnixMicro(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []MetricBucket
+	for rows.Next() {
+		var b MetricBucket
+		var start int64
+		if err := rows.Scan(&b.NodeID, &start, &b.Samples, &b.RTTSamples, &b.RTTSumMs, &b.LossSum); err != nil {
+			return nil, err
+		}
+		b.Start = fromMicro(start)
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// CertRevocations returns, per certificate common name, the time before which
+// certificates issued to that name are no longer accepted.
+func (s *SQLite) CertRevocations() (map[string]time.Time, error) {
+	rows, err := s.db.Query(`SELECT common_name, before_at FROM cert_revocations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[string]time.Time)
+	for rows.Next() {
+		var cn string
+		var before int64
+		if err := rows.Scan(&cn, &before); err != nil {
+			return nil, err
+		}
+		out[cn] = fromMicro(before)
+	}
+	return out, rows.Err()
+}
+
+// IPReservations returns API-made VPN IP reservations ordered by name.
+func (s *SQLite) IPReservations() ([]IPReservation, error) {
+	rows, err := s.db.Query(`SELECT name, vpn_ip, created_at FROM ip_reservations ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []IPReservation
+	for rows.Next() {
+		var r IPReservation
+		var created int64
+		if err := rows.Scan(&r.Name, &r.VPNIP, &created); err != nil {
+			return nil, err
+		}
+		r.CreatedAt = fromMicro(created)
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// Update runs fn inside a single transaction.
+func (s *SQLite) Update(fn func(tx Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(&sqliteTx{tx: tx}); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type sqliteTx struct {
+	tx *sql.Tx
+}
+
+func (t *sqliteTx) PutNode(n NodeInfo) error {
+	if n.ID == "" {
+		return fmt.Errorf("node id is required")
+	}
+	_, err := t.tx.Exec(
+		`INSERT INTO nodes (id, name, pub_key, vpn_ip, endpoint, probe_port, last_seen_at, status, nat_type, public_addr, disabled, pending_pub_key,
+		                    primary_hub, backup_hub, active_hub, tags, admin_tags, advertised_routes, approved_routes,
+		                    exit_node, use_exit_node, ephemeral)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT(id) DO UPDATE SET
+		    name = excluded.name,
+		    pub_key = excluded.pub_key,
+		    vpn_ip = excluded.vpn_ip,
+		    endpoint = excluded.endpoint,
+		    probe_port = excluded.probe_port,
+		    last_seen_at = excluded.last_seen_at,
+		    status = excluded.status,
+		    nat_type = excluded.nat_type,
+		    public_addr = excluded.public_addr,
+		    disabled = excluded.disabled,
+		    pending_pub_key = excluded.pending_pub_key,
+		    primary_hub = excluded.primary_hub,
+		    backup_hub = excluded.backup_hub,
+		    active_hub = excluded.active_hub,
+		    tags = excluded.tags,
+		    admin_tags = excluded.admin_tags,
+		    advertised_routes = excluded.advertised_routes,
+		    approved_routes = excluded.approved_routes,
+		    exit_node = excluded.exit_node,
+		    use_exit_node = excluded.use_exit_node,
+		    ephemeral = excluded.ephemeral`,
+		n.ID, n.Name, n.PubKey, n.VPNIP, n.Endpoint, n.ProbePort,
+		toMicro(n.LastSeenAt), n.Status, n.NATType, n.PublicAddr, boolInt(n.Disabled), n.PendingPubKey,
+		n.PrimaryHub, n.BackupHub, n.ActiveHub, strings.Join(n.Tags, ","), strings.Join(n.AdminTags, ","),
+		strings.Join(n.AdvertisedRoutes, ","), strings.Join(n.ApprovedRoutes, ","),
+		boolInt(n.ExitNode), n.UseExitNode, boolInt(n.Ephemeral),
+	)
+	return err
+}
+
+// splitList parses a comma-joined list column; "" is an empty list.
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+func (t *sqliteTx) DeleteNode(id string) error {
+	if _, err := t.tx.Exec(`DELETE FROM nodes WHERE id = ?`, id); err != nil {
+		return err
+	}
+	_, err := t.tx.Exec(`DELETE FROM direct_results WHERE node_id = ? OR peer_id = ?`, id, id)
+	return err
+}
+
+func (t *sqliteTx) PutCertRevocation(commonName string, before time.Time) error {
+	if commonName == "" {
+		return fmt.Errorf("common name is required")
+	}
+	_, err := t.tx.Exec(
+		`INSERT INTO cert_revocations (common_name, before_at) VALUES (?, ?)
+		 ON CONFLICT(common_name) DO UPDATE SET before_at = MAX(cert_revocations.before_at, excluded.before_at)`,
+		commonName, before.UnixMicro(),
+	)
+	return err
+}
+
+func (t *sqliteTx) PutIPReservation(r IPReservation) error {
+	if r.Name == "" || r.VPNIP == "" {
+		return fmt.Errorf("name and vpn ip are required")
+	}
+	created := r.CreatedAt
+	if created.IsZero() {
+		created = time.Now().UTC()
+	}
+	_, err := t.tx.Exec(
+		`INSERT INTO ip_reservations (name, vpn_ip, created_at) VALUES (?, ?, ?)
+		 ON CONFLICT(name) DO UPDATE SET vpn_ip = excluded.vpn_ip`,
+		r.Name, r.VPNIP, created.UnixMicro(),
+	)
+	return err
+}
+
+func (t *sqliteTx) DeleteIPReservation(name string) error {
+	_, err := t.tx.Exec(`DELETE FROM ip_reservations WHERE name = ?`, name)
+	return err
+}
+
+func (t *sqliteTx) PutToken(tok Token) error {
+	if tok.Hash == "" {
+		return fmt.Errorf("token hash is required")
+	}
+	created := tok.CreatedAt
+	if created.IsZero() {
+		created = time.Now().UTC()
+	}
+	_, err := t.tx.Exec(
+		`INSERT INTO bootstrap_tokens (hash, description, created_at, expires_at, max_uses, uses, name_pattern, tags, vpn_ip, ephemeral)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT(hash) DO UPDATE SET
+		    description = excluded.description,
+		    expires_at = excluded.expires_at,
+		    max_uses = excluded.max_uses,
+		    uses = excluded.uses,
+		    name_pattern = excluded.name_pattern,
+		    tags = excluded.tags,
+		    vpn_ip = excluded.vpn_ip,
+		    ephemeral = excluded.ephemeral`,
+		tok.Hash, tok.Description, created.UnixMicro(), toMicro(tok.ExpiresAt), tok.MaxUses, tok.Uses,
+		tok.NamePattern, strings.Join(tok.Tags, ","), tok.VPNIP, boolInt(tok.Ephemeral),
+	)
+	return err
+}
+
+func (t *sqliteTx) DeleteToken(hash string) error {
+	_, err := t.tx.Exec(`DELETE FROM bootstrap_tokens WHERE hash = ?`, hash)
+	return err
+}
+
+func (t *sqliteTx) UseToken(hash string) (bool, error) {
+	res, err := t.tx.Exec(
+		`UPDATE bootstrap_tokens SET uses = uses + 1 WHERE hash = ? AND (max_uses = 0 OR uses < max_uses)`,
+		hash,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (t *sqliteTx) PutDirectResult(r DirectResult) error {
+	if r.NodeID == "" || r.PeerID == "" {
+		return fmt.Errorf("node id and peer id are required")
+	}
+	checked := r.CheckedAt
+	if checked.IsZero() {
+		checked = time.Now().UTC()
+	}
+	success := 0
+	lastSuccess := toMicro(r.LastSuccessAt)
+	if r.Success {
+		success = 1
+		lastSuccess = checked.UnixMicro()
+	}
+	// A failed probe keeps the previous last_success_at so readiness history
+	// survives intermittent failures.
+	_, err := t.tx.Exec(
+		`INSERT INTO direct_results (node_id, peer_id, success, rtt_ms, reason, checked_at, last_success_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT(node_id, peer_id) DO UPDATE SET
+		    success = excluded.success,
+		    rtt_ms = excluded.rtt_ms,
+		    reason = excluded.reason,
+		    checked_at = excluded.checked_at,
+		    last_success_at = CASE WHEN excluded.success = 1
+		        THEN excluded.last_success_at
+		        ELSE MAX(direct_results.last_success_at, excluded.last_success_at) END`,
+		r.NodeID, r.PeerID, success, r.RTTMs, r.Reason, checked.UnixMicro(), lastSuccess,
+	)
+	return err
+}
+
+func (t *sqliteTx) AddMetricBucket(b MetricBucket) error {
+	if b.NodeID == "" {
+		return fmt.Errorf("node id is required")
+	}
+	start := b.Start.UTC().Truncate(time.Minute).UnixMicro()
+	_, err := t.tx.Exec(
+		`INSERT INTO metric_buckets (node_id, start, samples, rtt_samples, rtt_sum_ms, loss_sum)
+		 VALUES (?, ?, ?, ?, ?, ?)
+		 ON CONFLICT(node_id, start) DO UPDATE SET
+		    samples = metric_buckets.samples + excluded.samples,
+		    rtt_samples = metric_buckets.rtt_samples + excluded.rtt_samples,
+		    rtt_sum_ms = metric_buckets.rtt_sum_ms + excluded.rtt_sum_ms,
+		    loss_sum = metric_buckets.loss_sum + excluded.loss_sum`,
+		b.NodeID, start, b.Samples, b.RTTSamples, b.RTTSumMs, b.LossSum,
+	)
+	return err
+}
+
+func (t *sqliteTx) PruneMetricBuckets(before time.Time) error {
+	_, err := t.tx.Exec(`DELETE FROM metric_buckets WHERE start < ?`, before.UnixMicro())
+	return err
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func toMicro(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMicro()
+}
+
+func fromMicro(v int64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.UnixMicro(v).UTC()
+}
@@ -0,0 +1,274 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package store
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func openTestDB(t *testing.T) *SQLite {
+	t.Helper()
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "controller.db"))
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestSQLite_NodesRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	db := openTestDB(t)
+	seen := time.Now().UTC().Truncate(time.Microsecond)
+	in := NodeInfo{ID: "n1", Name: "n1", PubKey: "pub", VPNIP: "10.7.0.2/32", ProbePort: 51900, LastSeenAt: seen, Status: "online"}
+	if err := db.Update(func(tx Tx) error { return tx.PutNode(in) }); err != nil {
+		t.Fatalf("PutNode: %v", err)
+	}
+
+	// Upsert replaces the existing row.
+	in.Endpoint = "1.2.3.4:51820"
+	in.Disabled = true
+	in.PendingPubKey = "pub-next"
+	in.PrimaryHub, in.BackupHub, in.ActiveHub = "eu", "us", "us"
+	in.Tags, in.AdminTags = []string{"web", "prod"}, []string{"db"}
+	in.AdvertisedRoutes, in.ApprovedRoutes = []string{"192.168.50.0/24", "192.168.51.0/24"}, []string{"192.168.50.0/24"}
+	in.ExitNode, in.UseExitNode = true, "gw-2"
+	in.Ephemeral = true
+	if err := db.Update(func(tx Tx) error { return tx.PutNode(in) }); err != nil {
+		t.Fatalf("PutNode: %v", err)
+	}
+
+	nodes, err := db.Nodes()
+	if err != nil {
+		t.Fatalf("Nodes: %v", err)
+	}
+	if len(nodes) != 1 {
+		t.Fatalf("nodes=%d", len(nodes))
+	}
+	if !reflect.DeepEqual(nodes[0], in) {
+		t.Fatalf("node=%+v want %+v", nodes[0], in)
+	}
+}
+
+func TestSQLite_UpdateRollsBackOnError(t *testing.T) {
+	t.Parallel()
+
+	db := openTestDB(t)
+	err := db.Update(func(tx Tx) error {
+		if err := tx.PutNode(NodeInfo{ID: "n1", Name: "n1"}); err != nil {
+			return err
+		}
+		return errors.New("boom")
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	nodes, err := db.Nodes()
+	if err != nil {
+		t.Fatalf("Nodes: %v", err)
+	}
+	if len(nodes) != 0 {
+		t.Fatalf("nodes=%d, want 0 after rollback", len(nodes))
+	}
+}
+
+func TestSQLite_Tokens(t *testing.T) {
+	t.Parallel()
+
+	db := openTestDB(t)
+	created := time.Now().UTC().Truncate(time.Microsecond)
+	limited := Token{
+		Hash: "b", Description: "ci runners", CreatedAt: created, ExpiresAt: created.Add(time.Hour),
+		MaxUses: 2, NamePattern: "ci-*", Tags: []string{"ci", "linux"}, VPNIP: "10.7.0.9/32", Ephemeral: true,
+	}
+	if err := db.PutToken(Token{Hash: "a", CreatedAt: created.Add(-time.Minute)}); err != nil {
+		t.Fatalf("PutToken: %v", err)
+	}
+	if err := db.PutToken(limited); err != nil {
+		t.Fatalf("PutToken: %v", err)
+	}
+	if err := db.DeleteToken("a"); err != nil {
+		t.Fatalf("DeleteToken: %v", err)
+	}
+
+	// Uses are counted up to the limit.
+	for i, want := range []bool{true, true, false} {
+		ok, err := db.UseToken("b")
+		if err != nil || ok != want {
+			t.Fatalf("UseToken #%d = %v, %v; want %v", i+1, ok, err, want)
+		}
+	}
+	if ok, err := db.UseToken("a"); err != nil || ok {
+		t.Fatalf("UseToken(deleted) = %v, %v", ok, err)
+	}
+
+	tokens, err := db.ListTokens()
+	if err != nil {
+		t.Fatalf("ListTokens: %v", err)
+	}
+	limited.Uses = 2
+	if len(tokens) != 1 || !reflect.DeepEqual(tokens[0], limited) {
+		t.Fatalf("tokens=%+v, want %+v", tokens, limited)
+	}
+}
+
+func TestOpenSQLite_HashesLegacyTokens(t *testing.T) {
+	t.Parallel()
+
+	// A database from before tokens were hashed.
+	path := filepath.Join(t.TempDir(), "controller.db")
+	raw, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations[:10] {
+		if _, err := raw.Exec(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := raw.Exec(`PRAGMA user_version = 10;
+		INSERT INTO tokens (token, created_at) VALUES ('vpnctl-bootstrap-1', 1), ('vpnctl-ephemeral-2', 2)`); err != nil {
+		t.Fatal(err)
+	}
+	_ = raw.Close()
+
+	db, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	defer db.Close()
+	tokens, err := db.ListTokens()
+	if err != nil {
+		t.Fatalf("ListTokens: %v", err)
+	}
+	sum := sha256.Sum256([]byte("vpnctl-bootstrap-1"))
+	if len(tokens) != 2 || tokens[0].Hash != hex.EncodeToString(sum[:]) || tokens[0].Ephemeral || !tokens[1].Ephemeral {
+		t.Fatalf("tokens=%+v", tokens)
+	}
+}
+
+func TestSQLite_DirectResultKeepsLastSuccess(t *testing.T) {
+	t.Parallel()
+
+	db := openTestDB(t)
+	ok := time.Now().UTC().Add(-time.Minute).Truncate(time.Microsecond)
+	fail := ok.Add(30 * time.Second)
+	put := func(r DirectResult) {
+		t.Helper()
+		if err := db.Update(func(tx Tx) error { return tx.PutDirectResult(r) }); err != nil {
+			t.Fatalf("PutDirectResult: %v", err)
+		}
+	}
+	put(DirectResult{NodeID: "a", PeerID: "b", Success: true, RTTMs: 12, CheckedAt: ok})
+	put(DirectResult{NodeID: "a", PeerID: "b", Success: false, Reason: "timeout", CheckedAt: fail})
+
+	results, err := db.DirectResults()
+	if err != nil {
+		t.Fatalf("DirectResults: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("results=%d", len(results))
+	}
+	r := results[0]
+	if r.Success || r.Reason != "timeout" || !r.CheckedAt.Equal(fail) {
+		t.Fatalf("result=%+v", r)
+	}
+	if !r.LastSuccessAt.Equal(ok) {
+		t.Fatalf("last_success_at=%v want %v", r.LastSuccessAt, ok)
+	}
+}
+
+func TestSQLite_CertRevocationsKeepLatest(t *testing.T) {
+	t.Parallel()
+
+	db := openTestDB(t)
+	early := time.Now().UTC().Truncate(time.Microsecond)
+	late := early.Add(time.Hour)
+	err := db.Update(func(tx Tx) error {
+		if err := tx.PutCertRevocation("node-a", late); err != nil {
+			return err
+		}
+		return tx.PutCertRevocation("node-a", early)
+	})
+	if err != nil {
+		t.Fatalf("PutCertRevocation: %v", err)
+	}
+
+	got, err := db.CertRevocations()
+	if err != nil {
+		t.Fatalf("CertRevocations: %v", err)
+	}
+	if len(got) != 1 || !got["node-a"].Equal(late) {
+		t.Fatalf("revocations=%v", got)
+	}
+}
+
+func TestSQLite_IPReservations(t *testing.T) {
+	t.Parallel()
+
+	db := openTestDB(t)
+	err := db.Update(func(tx Tx) error {
+		if err := tx.PutIPReservation(IPReservation{Name: "db-1", VPNIP: "10.7.0.10/32"}); err != nil {
+			return err
+		}
+		if err := tx.PutIPReservation(IPReservation{Name: "db-1", VPNIP: "10.7.0.11/32"}); err != nil {
+			return err
+		}
+		return tx.PutIPReservation(IPReservation{Name: "cache", VPNIP: "10.7.0.12/32"})
+	})
+	if err != nil {
+		t.Fatalf("PutIPReservation: %v", err)
+	}
+	if err := db.Update(func(tx Tx) error { return tx.DeleteIPReservation("cache") }); err != nil {
+		t.Fatalf("DeleteIPReservation: %v", err)
+	}
+
+	got, err := db.IPReservations()
+	if err != nil {
+		t.Fatalf("IPReservations: %v", err)
+	}
+	if len(got) != 1 || got[0].Name != "db-1" || got[0].VPNIP != "10.7.0.11/32" || got[0].CreatedAt.IsZero() {
+		t.Fatalf("reservations=%+v", got)
+	}
+}
+
+func TestMigrateRegistry(t *testing.T) {
+	t.Parallel()
+
+	db := openTestDB(t)
+	path := filepath.Join(t.TempDir(), "registry.yaml")
+	legacy := &Registry{Nodes: []NodeInfo{{Name: "n1", VPNIP: "10.7.0.2/32"}, {ID: "n2", VPNIP: "10.7.0.3/32"}}}
+	if err := SaveRegistry(path, legacy); err != nil {
+		t.Fatalf("SaveRegistry: %v", err)
+	}
+
+	n, err := MigrateRegistry(db, path)
+	if err != nil {
+		t.Fatalf("MigrateRegistry: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("migrated=%d", n)
+	}
+	nodes, err := db.Nodes()
+	if err != nil {
+		t.Fatalf("Nodes: %v", err)
+	}
+	if len(nodes) != 2 || nodes[0].ID != "n1" || nodes[1].Name != "n2" {
+		t.Fatalf("nodes=%+v", nodes)
+	}
+
+	// Second run is a no-op because the file was renamed.
+	n, err = MigrateRegistry(db, path)
+	if err != nil || n != 0 {
+		t.Fatalf("second run n=%d err=%v", n, err)
+	}
+}
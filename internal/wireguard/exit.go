@@ -0,0 +1,36 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package wireguard
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MasqueradeTable is the nftables table of an exit node's NAT rule.
+const MasqueradeTable = "vpnctl_exit"
+
+// RenderMasquerade renders an nft -f script that replaces MasqueradeTable
+// with a rule masquerading traffic from iface's peers that leaves through
+// another interface.
+func RenderMasquerade(iface string) string {
+	var b strings.Builder
+	// Declaring the table first lets the delete succeed when it is missing.
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", MasqueradeTable, MasqueradeTable)
+	fmt.Fprintf(&b, "table inet %s {\n\tchain postrouting {\n", MasqueradeTable)
+	b.WriteString("\t\ttype nat hook postrouting priority srcnat; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tiifname %q oifname != %q masquerade\n", iface, iface)
+	b.WriteString("\t}\n}\n")
+	return b.String()
+}
+
+// ApplyMasquerade installs an exit node's NAT rule for iface.
+func ApplyMasquerade(iface string) error {
+	return DefaultManager().ApplyMasquerade(iface)
+}
+
+// RemoveMasquerade removes an exit node's NAT rule.
+func RemoveMasquerade() error {
+	return DefaultManager().RemoveMasquerade()
+}
@@ -5,7 +5,9 @@ package wireguard
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // PeerEndpoints returns a map of peer public key -> endpoint as currently observed by WireGuard.
@@ -51,3 +53,102 @@ func ParseWgDumpEndpoints(dump string) map[string]string {
 	}
 	return endpoints
 }
+
+// PeerHandshakes returns a map of peer public key -> time of the latest handshake.
+// Peers that never completed a handshake are omitted.
+func (m *Manager) PeerHandshakes(iface string) (map[string]time.Time, error) {
+	if iface == "" {
+		return nil, fmt.Errorf("wg_interface is required")
+	}
+	out, err := m.output("wg", "show", iface, "dump")
+	if err != nil {
+		return nil, err
+	}
+	return ParseWgDumpHandshakes(out), nil
+}
+
+func ParseWgDumpHandshakes(dump string) map[string]time.Time {
+	handshakes := map[string]time.Time{}
+	lines := strings.Split(strings.TrimSpace(dump), "\n")
+	if len(lines) == 0 {
+		return handshakes
+	}
+	// First line is interface info.
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		sec, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil || sec <= 0 {
+			continue
+		}
+		handshakes[fields[0]] = time.Unix(sec, 0).UTC()
+	}
+	return handshakes
+}
+
+// InterfaceDump is the state of an interface as reported by `wg show dump`.
+type InterfaceDump struct {
+	PrivateKey string
+	ListenPort int
+	// Peers maps public key -> peer, with AllowedIPs as WireGuard reports them.
+	Peers map[string]Peer
+}
+
+// Dump returns the current peers and interface keys of iface.
+func (m *Manager) Dump(iface string) (InterfaceDump, error) {
+	if iface == "" {
+		return InterfaceDump{}, fmt.Errorf("wg_interface is required")
+	}
+	out, err := m.output("wg", "show", iface, "dump")
+	if err != nil {
+		return InterfaceDump{}, err
+	}
+	return ParseWgDump(out), nil
+}
+
+func ParseWgDump(dump string) InterfaceDump {
+	d := InterfaceDump{Peers: map[string]Peer{}}
+	lines := strings.Split(strings.TrimSpace(dump), "\n")
+	if len(lines) == 0 {
+		return d
+	}
+	if fields := strings.Fields(lines[0]); len(fields) >= 3 {
+		if fields[0] != "(none)" {
+			d.PrivateKey = fields[0]
+		}
+		d.ListenPort, _ = strconv.Atoi(fields[2])
+	}
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		peer := Peer{PublicKey: fields[0]}
+		if fields[2] != "(none)" {
+			peer.Endpoint = fields[2]
+		}
+		if fields[3] != "(none)" {
+			peer.AllowedIPs = strings.Split(fields[3], ",")
+		}
+		d.Peers[peer.PublicKey] = peer
+	}
+	return d
+}
+
+// SetPeer adds peer to iface, or replaces its AllowedIPs (and endpoint, when
+// set) if it exists. Other peers are left untouched.
+func (m *Manager) SetPeer(iface string, peer Peer) error {
+	args := []string{"set", iface, "peer", peer.PublicKey}
+	if peer.Endpoint != "" {
+		args = append(args, "endpoint", peer.Endpoint)
+	}
+	args = append(args, "allowed-ips", strings.Join(peer.AllowedIPs, ","))
+	return m.run("wg", args...)
+}
+
+// RemovePeer removes a single peer from iface.
+func (m *Manager) RemovePeer(iface, publicKey string) error {
+	return m.run("wg", "set", iface, "peer", publicKey, "remove")
+}
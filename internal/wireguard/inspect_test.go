@@ -3,7 +3,10 @@
 
 package wireguard
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestParseWgDumpEndpoints(t *testing.T) {
 	t.Parallel()
@@ -25,3 +28,40 @@ func TestParseWgDumpEndpoints(t *testing.T) {
 		t.Fatalf("pubc=%q", got)
 	}
 }
+
+func TestParseWgDumpHandshakes(t *testing.T) {
+	t.Parallel()
+
+	dump := "" +
+		"wg0\t(priv)\t(pub)\t51820\toff\n" +
+		"puba\t(psk)\t39.1.2.3:12345\t10.7.0.2/32\t1700000000\t10\t20\toff\n" +
+		"pubb\t(psk)\t(none)\t(none)\t0\t0\t0\toff\n"
+
+	m := ParseWgDumpHandshakes(dump)
+	if got := m["puba"]; !got.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("puba=%v", got)
+	}
+	if _, ok := m["pubb"]; ok {
+		t.Fatalf("expected pubb to be missing")
+	}
+}
+
+func TestParseWgDump(t *testing.T) {
+	t.Parallel()
+
+	dump := "" +
+		"privkey\tpubkey\t51820\toff\n" +
+		"puba\t(none)\t39.1.2.3:12345\t10.7.0.2/32,fd7a::2/128\t1700000000\t10\t20\toff\n" +
+		"pubb\t(none)\t(none)\t(none)\t0\t0\t0\toff\n"
+
+	d := ParseWgDump(dump)
+	if d.PrivateKey != "privkey" || d.ListenPort != 51820 {
+		t.Fatalf("interface=%+v", d)
+	}
+	if got := d.Peers["puba"]; got.Endpoint != "39.1.2.3:12345" || len(got.AllowedIPs) != 2 || got.AllowedIPs[1] != "fd7a::2/128" {
+		t.Fatalf("puba=%+v", got)
+	}
+	if got, ok := d.Peers["pubb"]; !ok || got.Endpoint != "" || got.AllowedIPs != nil {
+		t.Fatalf("pubb=%+v ok=%v", got, ok)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2025 Jonghyeok Kang
+// SPDX-License-Identifier: Apache-2.0
+
+package wireguard
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+)
+
+// GenerateKeyPair returns a new base64-encoded Curve25519 key pair, the same
+// format `wg genkey | wg pubkey` produces.
+func GenerateKeyPair() (privateKey, publicKey string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	enc := base64.StdEncoding
+	return enc.EncodeToString(key.Bytes()), enc.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// SetPrivateKey replaces the private key of a running interface. Peers are
+// kept, but every session has to handshake again.
+func (m *Manager) SetPrivateKey(iface, privateKey string) error {
+	if iface == "" {
+		return fmt.Errorf("wg_interface is required")
+	}
+	tmp, err := os.CreateTemp("", "vpnctl-wg-*.key")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.WriteString(privateKey + "\n"); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return m.run("wg", "set", iface, "private-key", tmp.Name())
+}
@@ -5,11 +5,15 @@ package wireguard
 
 import (
 	"fmt"
+	"net"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 
+	"vpnctl/internal/addrutil"
 	"vpnctl/internal/config"
 	"vpnctl/internal/execx"
 )
@@ -43,8 +47,10 @@ func (m *Manager) Up(cfg config.NodeConfig, setConf string) error {
 	if err := m.ensureInterface(cfg.WGInterface); err != nil {
 		return err
 	}
-	if err := m.run("ip", "address", "replace", cfg.VPNIP, "dev", cfg.WGInterface); err != nil {
-		return err
+	for _, addr := range addrutil.SplitList(cfg.VPNIP) {
+		if err := m.run("ip", "address", "replace", addr, "dev", cfg.WGInterface); err != nil {
+			return err
+		}
 	}
 	if cfg.MTU > 0 {
 		if err := m.run("ip", "link", "set", "dev", cfg.WGInterface, "mtu", fmt.Sprintf("%d", cfg.MTU)); err != nil {
@@ -79,13 +85,30 @@ func (m *Manager) Up(cfg config.NodeConfig, setConf string) error {
 // Down removes the WireGuard interface.
 func (m *Manager) Down(cfg config.NodeConfig) error {
 	if config.PolicyRoutingEnabled(&cfg) {
-		_ = m.flushPolicyTable(cfg.PolicyRoutingTable)
+		_ = m.flushPolicyTable(cfg.PolicyRoutingTable, cfg.PolicyRoutingCIDR)
 		_ = m.deletePolicyRule(cfg.PolicyRoutingPriority, cfg.PolicyRoutingTable, cfg.PolicyRoutingCIDR)
+		_ = m.syncExitRules(cfg, nil)
+	}
+	if cfg.AdvertiseExitNode {
+		_ = m.RemoveMasquerade()
 	}
 	if cfg.WGInterface == "" {
 		return fmt.Errorf("wg_interface is required")
 	}
-	err := m.run("ip", "link", "del", "dev", cfg.WGInterface)
+	return m.deleteInterface(cfg.WGInterface)
+}
+
+// DownServer removes the hub interface, e.g. when an HA controller steps
+// down. A missing interface is not an error.
+func (m *Manager) DownServer(iface string) error {
+	if iface == "" {
+		return fmt.Errorf("wg_interface is required")
+	}
+	return m.deleteInterface(iface)
+}
+
+func (m *Manager) deleteInterface(iface string) error {
+	err := m.run("ip", "link", "del", "dev", iface)
 	if err == nil {
 		return nil
 	}
@@ -133,7 +156,7 @@ func (m *Manager) ApplyPeers(cfg config.NodeConfig, peers []Peer) error {
 		if err := m.ensurePolicyRule(cfg.PolicyRoutingPriority, cfg.PolicyRoutingTable, cfg.PolicyRoutingCIDR); err != nil {
 			return err
 		}
-		if err := m.flushPolicyTable(cfg.PolicyRoutingTable); err != nil {
+		if err := m.flushPolicyTable(cfg.PolicyRoutingTable, cfg.PolicyRoutingCIDR); err != nil {
 			return err
 		}
 		if err := m.installPolicyBaselineRoutes(cfg); err != nil {
@@ -146,10 +169,163 @@ func (m *Manager) ApplyPeers(cfg config.NodeConfig, peers []Peer) error {
 				}
 			}
 		}
+		if err := m.syncExitRules(cfg, peers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncExitRules sends traffic without a more specific route through the
+// policy table while a peer carries a default route, i.e. is the node's exit
+// node. WireGuard endpoints are exempt so the tunnels themselves keep using
+// the host's default route. The rules take the three preferences after
+// PolicyRoutingPriority and are removed when no peer is an exit node.
+func (m *Manager) syncExitRules(cfg config.NodeConfig, peers []Peer) error {
+	exempt := map[string][]netip.Addr{}
+	exit := map[string]bool{}
+	endpoints := []string{cfg.ServerEndpoint}
+	for _, peer := range peers {
+		endpoints = append(endpoints, peer.Endpoint)
+		for _, cidr := range peer.AllowedIPs {
+			switch cidr {
+			case "0.0.0.0/0":
+				exit["-4"] = true
+			case "::/0":
+				exit["-6"] = true
+			}
+		}
+	}
+	for _, ep := range endpoints {
+		for _, a := range endpointAddrs(ep) {
+			family := "-4"
+			if a.Is6() {
+				family = "-6"
+			}
+			if !slices.Contains(exempt[family], a) {
+				exempt[family] = append(exempt[family], a)
+			}
+		}
+	}
+
+	table := strconv.Itoa(cfg.PolicyRoutingTable)
+	exemptPref := strconv.Itoa(cfg.PolicyRoutingPriority + 1)
+	mainPref := strconv.Itoa(cfg.PolicyRoutingPriority + 2)
+	exitPref := strconv.Itoa(cfg.PolicyRoutingPriority + 3)
+	for _, family := range []string{"-4", "-6"} {
+		want := exempt[family]
+		if !exit[family] {
+			want = nil
+		}
+		out, err := m.output("ip", family, "rule", "show", "pref", exemptPref)
+		if err != nil {
+			return err
+		}
+		for _, a := range ruleDestinations(out) {
+			if slices.Contains(want, a) {
+				continue
+			}
+			if err := ignoreMissing(m.run("ip", family, "rule", "del", "pref", exemptPref, "to", a.String(), "lookup", "main")); err != nil {
+				return err
+			}
+		}
+		if !exit[family] {
+			if err := ignoreMissing(m.run("ip", family, "rule", "del", "pref", exitPref, "lookup", table)); err != nil {
+				return err
+			}
+			if err := ignoreMissing(m.run("ip", family, "rule", "del", "pref", mainPref, "lookup", "main", "suppress_prefixlength", "0")); err != nil {
+				return err
+			}
+			continue
+		}
+		rules := [][]string{{"pref", mainPref, "lookup", "main", "suppress_prefixlength", "0"}, {"pref", exitPref, "lookup", table}}
+		for _, a := range want {
+			rules = append(rules, []string{"pref", exemptPref, "to", a.String(), "lookup", "main"})
+		}
+		for _, rule := range rules {
+			err := m.run("ip", append([]string{family, "rule", "add"}, rule...)...)
+			if err != nil && !strings.Contains(err.Error(), "File exists") {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
+// endpointAddrs resolves a WireGuard endpoint ("host:port") to addresses.
+func endpointAddrs(endpoint string) []netip.Addr {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil || host == "" {
+		return nil
+	}
+	if a, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{a.Unmap()}
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil
+	}
+	var out []netip.Addr
+	for _, ip := range ips {
+		if a, ok := netip.AddrFromSlice(ip); ok {
+			out = append(out, a.Unmap())
+		}
+	}
+	return out
+}
+
+// ruleDestinations parses the "to" addresses of `ip rule show` output.
+func ruleDestinations(out string) []netip.Addr {
+	var addrs []netip.Addr
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		i := slices.Index(fields, "to")
+		if i < 0 || i+1 >= len(fields) {
+			continue
+		}
+		if a, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimSuffix(fields[i+1], "/32"), "/128")); err == nil {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// ApplyRoutes moves the node from prev's hub AllowedIPs and policy CIDRs to
+// next's, e.g. when subnet routes behind other nodes change, and re-applies
+// peers.
+func (m *Manager) ApplyRoutes(prev, next config.NodeConfig, peers []Peer) error {
+	if err := m.ApplyPeers(next, peers); err != nil {
+		return err
+	}
+	for _, cidr := range next.ServerAllowedIPs {
+		if err := m.run("ip", "route", "replace", cidr, "dev", next.WGInterface); err != nil {
+			return err
+		}
+	}
+	for _, cidr := range prev.ServerAllowedIPs {
+		if slices.Contains(next.ServerAllowedIPs, cidr) {
+			continue
+		}
+		if err := ignoreMissing(m.run("ip", "route", "del", cidr, "dev", next.WGInterface)); err != nil {
+			return err
+		}
+	}
+	if !config.PolicyRoutingEnabled(&next) {
+		return nil
+	}
+	keep := addrutil.SplitList(next.PolicyRoutingCIDR)
+	var stale []string
+	for _, cidr := range addrutil.SplitList(prev.PolicyRoutingCIDR) {
+		if !slices.Contains(keep, cidr) {
+			stale = append(stale, cidr)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	return m.deletePolicyRule(next.PolicyRoutingPriority, next.PolicyRoutingTable, strings.Join(stale, ","))
+}
+
 func (m *Manager) installPolicyBaselineRoutes(cfg config.NodeConfig) error {
 	if cfg.PolicyRoutingTable <= 0 {
 		return fmt.Errorf("invalid policy routing settings")
@@ -177,8 +353,10 @@ func (m *Manager) ApplyServer(cfg ServerConfig, peers []Peer) error {
 	if err := m.ensureInterface(cfg.Interface); err != nil {
 		return err
 	}
-	if err := m.run("ip", "address", "replace", cfg.Address, "dev", cfg.Interface); err != nil {
-		return err
+	for _, addr := range addrutil.SplitList(cfg.Address) {
+		if err := m.run("ip", "address", "replace", addr, "dev", cfg.Interface); err != nil {
+			return err
+		}
 	}
 	if cfg.MTU > 0 {
 		if err := m.run("ip", "link", "set", "dev", cfg.Interface, "mtu", fmt.Sprintf("%d", cfg.MTU)); err != nil {
@@ -193,7 +371,101 @@ func (m *Manager) ApplyServer(cfg ServerConfig, peers []Peer) error {
 	if err != nil {
 		return err
 	}
-	return m.syncConf(cfg.Interface, setConf)
+	if err := m.syncConf(cfg.Interface, setConf); err != nil {
+		return err
+	}
+	return m.syncServerRoutes(cfg, peers)
+}
+
+// syncServerRoutes routes peer AllowedIPs outside the interface's own
+// prefixes (subnet routes behind nodes, or node addresses on a relay with a
+// host address) to the interface and removes the ones no longer needed.
+// They are installed as proto static to tell them apart from other routes.
+func (m *Manager) syncServerRoutes(cfg ServerConfig, peers []Peer) error {
+	var local []netip.Prefix
+	for _, addr := range addrutil.SplitList(cfg.Address) {
+		if p, err := netip.ParsePrefix(addr); err == nil {
+			local = append(local, p.Masked())
+		}
+	}
+	want := map[netip.Prefix]bool{}
+	var routes []netip.Prefix
+	for _, peer := range peers {
+		for _, cidr := range peer.AllowedIPs {
+			p, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				continue
+			}
+			p = p.Masked()
+			if want[p] || slices.ContainsFunc(local, func(l netip.Prefix) bool { return l.Bits() <= p.Bits() && l.Contains(p.Addr()) }) {
+				continue
+			}
+			want[p] = true
+			routes = append(routes, p)
+		}
+	}
+
+	for _, family := range []string{"-4", "-6"} {
+		out, err := m.output("ip", family, "route", "show", "dev", cfg.Interface, "proto", "static")
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			// ip prints host routes without a prefix length.
+			p, err := netip.ParsePrefix(fields[0])
+			if err != nil {
+				a, aerr := netip.ParseAddr(fields[0])
+				if aerr != nil {
+					continue
+				}
+				p = netip.PrefixFrom(a, a.BitLen())
+			}
+			if want[p] {
+				continue
+			}
+			if err := ignoreMissing(m.run("ip", family, "route", "del", p.String(), "dev", cfg.Interface, "proto", "static")); err != nil {
+				return err
+			}
+		}
+	}
+	for _, p := range routes {
+		if err := m.run("ip", familyArgs(p.String(), "route", "replace", p.String(), "dev", cfg.Interface, "proto", "static")...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyFirewall atomically replaces the hub's nftables ACL table.
+func (m *Manager) ApplyFirewall(iface string, rules []FirewallRule) error {
+	if iface == "" {
+		return fmt.Errorf("wg_interface is required")
+	}
+	return m.runWithFile("vpnctl-nft-*.nft", RenderFirewall(iface, rules), "nft", "-f")
+}
+
+// RemoveFirewall deletes the table installed by ApplyFirewall, so relayed
+// traffic is no longer filtered.
+func (m *Manager) RemoveFirewall() error {
+	return m.runWithFile("vpnctl-nft-*.nft", fmt.Sprintf("table inet %s\ndelete table inet %s\n", FirewallTable, FirewallTable), "nft", "-f")
+}
+
+// ApplyMasquerade NATs traffic from iface's peers leaving through another
+// interface, so the node can serve as an exit node.
+func (m *Manager) ApplyMasquerade(iface string) error {
+	if iface == "" {
+		return fmt.Errorf("wg_interface is required")
+	}
+	return m.runWithFile("vpnctl-nft-*.nft", RenderMasquerade(iface), "nft", "-f")
+}
+
+// RemoveMasquerade deletes the table installed by ApplyMasquerade.
+func (m *Manager) RemoveMasquerade() error {
+	return m.runWithFile("vpnctl-nft-*.nft", fmt.Sprintf("table inet %s\ndelete table inet %s\n", MasqueradeTable, MasqueradeTable), "nft", "-f")
 }
 
 func (m *Manager) ensureInterface(iface string) error {
@@ -217,7 +489,13 @@ func (m *Manager) interfaceExists(iface string) bool {
 }
 
 func (m *Manager) syncConf(iface string, content string) error {
-	tmp, err := os.CreateTemp("", "vpnctl-wg-*.conf")
+	return m.runWithFile("vpnctl-wg-*.conf", content, "wg", "syncconf", iface)
+}
+
+// runWithFile writes content to a temporary file and runs the command with
+// the file's path appended to args.
+func (m *Manager) runWithFile(pattern, content, name string, args ...string) error {
+	tmp, err := os.CreateTemp("", pattern)
 	if err != nil {
 		return err
 	}
@@ -231,49 +509,80 @@ func (m *Manager) syncConf(iface string, content string) error {
 	if err := tmp.Close(); err != nil {
 		return err
 	}
-	return m.run("wg", "syncconf", iface, tmp.Name())
+	return m.run(name, append(args, tmp.Name())...)
 }
 
-func (m *Manager) ensurePolicyRule(priority int, table int, cidr string) error {
+// ensurePolicyRule installs one "to <cidr> lookup <table>" rule per entry of
+// the comma-separated cidrs, using the matching address family.
+func (m *Manager) ensurePolicyRule(priority int, table int, cidrs string) error {
 	if priority <= 0 || table <= 0 {
 		return fmt.Errorf("invalid policy routing settings")
 	}
-	if cidr == "" || cidr == "0.0.0.0/0" || cidr == "::/0" {
+	list := addrutil.SplitList(cidrs)
+	if len(list) == 0 {
 		return fmt.Errorf("policy_routing_cidr is required and must be scoped")
 	}
-	err := m.run("ip", "rule", "add", "pref", strconv.Itoa(priority), "to", cidr, "lookup", strconv.Itoa(table))
-	if err == nil {
-		return nil
+	for _, cidr := range list {
+		if cidr == "0.0.0.0/0" || cidr == "::/0" {
+			return fmt.Errorf("policy_routing_cidr is required and must be scoped")
+		}
 	}
-	if strings.Contains(err.Error(), "File exists") {
-		return nil
+	for _, cidr := range list {
+		err := m.run("ip", familyArgs(cidr, "rule", "add", "pref", strconv.Itoa(priority), "to", cidr, "lookup", strconv.Itoa(table))...)
+		if err != nil && !strings.Contains(err.Error(), "File exists") {
+			return err
+		}
 	}
-	return err
+	return nil
 }
 
-func (m *Manager) deletePolicyRule(priority int, table int, cidr string) error {
+func (m *Manager) deletePolicyRule(priority int, table int, cidrs string) error {
 	if priority <= 0 || table <= 0 {
 		return nil
 	}
-	args := []string{"rule", "del", "pref", strconv.Itoa(priority), "lookup", strconv.Itoa(table)}
-	if cidr != "" {
-		args = []string{"rule", "del", "pref", strconv.Itoa(priority), "to", cidr, "lookup", strconv.Itoa(table)}
+	list := addrutil.SplitList(cidrs)
+	if len(list) == 0 {
+		return ignoreMissing(m.run("ip", "rule", "del", "pref", strconv.Itoa(priority), "lookup", strconv.Itoa(table)))
 	}
-	err := m.run("ip", args...)
-	if err == nil {
-		return nil
+	for _, cidr := range list {
+		if err := ignoreMissing(m.run("ip", familyArgs(cidr, "rule", "del", "pref", strconv.Itoa(priority), "to", cidr, "lookup", strconv.Itoa(table))...)); err != nil {
+			return err
+		}
 	}
-	if strings.Contains(err.Error(), "No such file") {
+	return nil
+}
+
+func ignoreMissing(err error) error {
+	if err != nil && (strings.Contains(err.Error(), "No such file") || strings.Contains(err.Error(), "No such process")) {
 		return nil
 	}
 	return err
 }
 
-func (m *Manager) flushPolicyTable(table int) error {
+// flushPolicyTable flushes the IPv4 routes of table, and its IPv6 routes
+// when cidrs includes an IPv6 prefix (ip defaults to IPv4 for flush).
+func (m *Manager) flushPolicyTable(table int, cidrs string) error {
 	if table <= 0 {
 		return nil
 	}
-	return m.run("ip", "route", "flush", "table", strconv.Itoa(table))
+	if err := m.run("ip", "route", "flush", "table", strconv.Itoa(table)); err != nil {
+		return err
+	}
+	for _, cidr := range addrutil.SplitList(cidrs) {
+		if addrutil.IsIPv6CIDR(cidr) {
+			return m.run("ip", "-6", "route", "flush", "table", strconv.Itoa(table))
+		}
+	}
+	return nil
+}
+
+// familyArgs prefixes args with "-6" when cidr is an IPv6 prefix; ip rule
+// otherwise assumes IPv4.
+func familyArgs(cidr string, args ...string) []string {
+	if addrutil.IsIPv6CIDR(cidr) {
+		return append([]string{"-6"}, args...)
+	}
+	return args
 }
 
 func (m *Manager) run(name string, args ...string) error {
@@ -13,6 +13,8 @@ import (
 
 type recordRunner struct {
 	cmds []string
+	// out maps a command line to its output.
+	out map[string]string
 }
 
 func (r *recordRunner) Run(name string, args ...string) error {
@@ -20,7 +22,9 @@ func (r *recordRunner) Run(name string, args ...string) error {
 	return nil
 }
 
-func (r *recordRunner) Output(name string, args ...string) (string, error) { return "", nil }
+func (r *recordRunner) Output(name string, args ...string) (string, error) {
+	return r.out[name+" "+strings.Join(args, " ")], nil
+}
 
 var _ execx.Runner = (*recordRunner)(nil)
 
@@ -59,3 +63,145 @@ func TestManagerUp_InstallsPolicyBaselineRoute(t *testing.T) {
 		t.Fatalf("missing baseline route command; cmds=%v", rr.cmds)
 	}
 }
+
+func TestManagerApplyPeers_DualStackPolicyRouting(t *testing.T) {
+	t.Parallel()
+
+	rr := &recordRunner{}
+	m := NewManager(rr)
+
+	enabled := true
+	cfg := config.NodeConfig{
+		WGInterface:           "wg0",
+		WGPrivateKey:          "priv",
+		VPNIP:                 "10.7.0.2/32,fd7a::2/128",
+		ServerPublicKey:       "hub",
+		ServerEndpoint:        "1.2.3.4:51820",
+		ServerAllowedIPs:      []string{"10.7.0.0/24", "fd7a::/64"},
+		PolicyRoutingEnabled:  &enabled,
+		PolicyRoutingTable:    51820,
+		PolicyRoutingPriority: 1000,
+		PolicyRoutingCIDR:     "10.7.0.0/24,fd7a::/64",
+	}
+
+	if err := m.Up(cfg, "[Interface]\nPrivateKey = x\n"); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	peers := []Peer{{PublicKey: "p1", Endpoint: "5.6.7.8:51820", AllowedIPs: []string{"10.7.0.3/32", "fd7a::3/128"}}}
+	if err := m.ApplyPeers(cfg, peers); err != nil {
+		t.Fatalf("ApplyPeers: %v", err)
+	}
+
+	for _, want := range []string{
+		"ip address replace 10.7.0.2/32 dev wg0",
+		"ip address replace fd7a::2/128 dev wg0",
+		"ip rule add pref 1000 to 10.7.0.0/24 lookup 51820",
+		"ip -6 rule add pref 1000 to fd7a::/64 lookup 51820",
+		"ip -6 route flush table 51820",
+		"ip route replace fd7a::/64 dev wg0 table 51820",
+		"ip route replace fd7a::3/128 dev wg0 table 51820",
+	} {
+		found := false
+		for _, c := range rr.cmds {
+			if c == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("missing %q; cmds=%v", want, rr.cmds)
+		}
+	}
+}
+
+func TestManagerApplyServer_SyncsSubnetRoutes(t *testing.T) {
+	t.Parallel()
+
+	rr := &recordRunner{out: map[string]string{
+		"ip -4 route show dev wg0 proto static": "192.168.9.0/24 scope link \n192.168.1.0/24 scope link \n",
+	}}
+	m := NewManager(rr)
+
+	cfg := ServerConfig{Interface: "wg0", PrivateKey: "priv", Address: "10.7.0.1/24", ListenPort: 51820}
+	peers := []Peer{
+		{PublicKey: "a", AllowedIPs: []string{"10.7.0.2/32", "192.168.1.0/24"}},
+		{PublicKey: "b", AllowedIPs: []string{"10.7.0.3/32", "fd00:1::/64"}},
+	}
+	if err := m.ApplyServer(cfg, peers); err != nil {
+		t.Fatalf("ApplyServer: %v", err)
+	}
+
+	want := []string{
+		"ip -4 route del 192.168.9.0/24 dev wg0 proto static",
+		"ip route replace 192.168.1.0/24 dev wg0 proto static",
+		"ip -6 route replace fd00:1::/64 dev wg0 proto static",
+	}
+	var got []string
+	for _, c := range rr.cmds {
+		if strings.HasPrefix(c, "ip -4 route") || strings.HasPrefix(c, "ip -6 route") || strings.HasPrefix(c, "ip route") {
+			got = append(got, c)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("route commands:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestManagerApplyPeers_ExitNodeRules(t *testing.T) {
+	t.Parallel()
+
+	rr := &recordRunner{out: map[string]string{
+		"ip -4 rule show pref 1001": "1001:\tfrom all to 9.9.9.9 lookup main",
+	}}
+	m := NewManager(rr)
+
+	enabled := true
+	cfg := config.NodeConfig{
+		WGInterface:           "wg0",
+		WGPrivateKey:          "priv",
+		ServerPublicKey:       "hub",
+		ServerEndpoint:        "1.2.3.4:51820",
+		ServerAllowedIPs:      []string{"10.7.0.0/24"},
+		PolicyRoutingEnabled:  &enabled,
+		PolicyRoutingTable:    51820,
+		PolicyRoutingPriority: 1000,
+		PolicyRoutingCIDR:     "10.7.0.0/24",
+	}
+	peers := []Peer{{PublicKey: "gw", Endpoint: "5.6.7.8:51820", AllowedIPs: []string{"10.7.0.3/32", "0.0.0.0/0"}}}
+	if err := m.ApplyPeers(cfg, peers); err != nil {
+		t.Fatalf("ApplyPeers: %v", err)
+	}
+
+	has := func(want string) bool {
+		for _, c := range rr.cmds {
+			if c == want {
+				return true
+			}
+		}
+		return false
+	}
+	for _, want := range []string{
+		"ip route replace 0.0.0.0/0 dev wg0 table 51820",
+		"ip -4 rule del pref 1001 to 9.9.9.9 lookup main",
+		"ip -4 rule add pref 1001 to 1.2.3.4 lookup main",
+		"ip -4 rule add pref 1001 to 5.6.7.8 lookup main",
+		"ip -4 rule add pref 1002 lookup main suppress_prefixlength 0",
+		"ip -4 rule add pref 1003 lookup 51820",
+	} {
+		if !has(want) {
+			t.Errorf("missing %q; cmds=%v", want, rr.cmds)
+		}
+	}
+	if has("ip -6 rule add pref 1003 lookup 51820") {
+		t.Errorf("unexpected IPv6 exit rule; cmds=%v", rr.cmds)
+	}
+
+	// Without an exit node peer the rules go away.
+	rr.cmds = nil
+	if err := m.ApplyPeers(cfg, nil); err != nil {
+		t.Fatalf("ApplyPeers: %v", err)
+	}
+	if !has("ip -4 rule del pref 1003 lookup 51820") || has("ip -4 rule add pref 1003 lookup 51820") {
+		t.Fatalf("expected the exit rule removed; cmds=%v", rr.cmds)
+	}
+}
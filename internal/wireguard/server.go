@@ -5,6 +5,7 @@ package wireguard
 
 import (
 	"fmt"
+	"net/netip"
 	"strings"
 )
 
@@ -33,16 +34,20 @@ func RenderServerSetConf(cfg ServerConfig, peers []Peer) (string, error) {
 	}
 
 	for _, peer := range peers {
-		if peer.PublicKey == "" || len(peer.AllowedIPs) == 0 {
+		if peer.PublicKey == "" {
 			continue
 		}
 		b.WriteString("\n[Peer]\n")
 		b.WriteString("PublicKey = ")
 		b.WriteString(peer.PublicKey)
 		b.WriteString("\n")
-		b.WriteString("AllowedIPs = ")
-		b.WriteString(strings.Join(peer.AllowedIPs, ", "))
-		b.WriteString("\n")
+		// A peer without AllowedIPs (a node's pending rotated key) can
+		// handshake but receives no traffic.
+		if len(peer.AllowedIPs) > 0 {
+			b.WriteString("AllowedIPs = ")
+			b.WriteString(strings.Join(peer.AllowedIPs, ", "))
+			b.WriteString("\n")
+		}
 		if peer.Endpoint != "" {
 			b.WriteString("Endpoint = ")
 			b.WriteString(peer.Endpoint)
@@ -60,3 +65,68 @@ func RenderServerSetConf(cfg ServerConfig, peers []Peer) (string, error) {
 func ApplyServer(cfg ServerConfig, peers []Peer) error {
 	return DefaultManager().ApplyServer(cfg, peers)
 }
+
+// DownServer removes the hub interface.
+func DownServer(iface string) error {
+	return DefaultManager().DownServer(iface)
+}
+
+// FirewallTable is the nftables table holding a hub's ACL rules.
+const FirewallTable = "vpnctl"
+
+// FirewallRule allows connections from any Src prefix to any Dst prefix.
+type FirewallRule struct {
+	Src []netip.Prefix
+	Dst []netip.Prefix
+}
+
+// RenderFirewall renders an nft -f script that replaces FirewallTable with a
+// forward chain for traffic the hub relays between its peers on iface: replies
+// and connections allowed by rules pass, anything else is dropped. Traffic
+// to or from the hub itself is not filtered.
+func RenderFirewall(iface string, rules []FirewallRule) string {
+	match := fmt.Sprintf("iifname %q oifname %q", iface, iface)
+
+	var b strings.Builder
+	// Declaring the table first lets the delete succeed when it is missing.
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", FirewallTable, FirewallTable)
+	fmt.Fprintf(&b, "table inet %s {\n\tchain forward {\n", FirewallTable)
+	b.WriteString("\t\ttype filter hook forward priority filter; policy accept;\n")
+	fmt.Fprintf(&b, "\t\t%s ct state established,related accept\n", match)
+	for _, rule := range rules {
+		src4, src6 := splitFamilies(rule.Src)
+		dst4, dst6 := splitFamilies(rule.Dst)
+		if len(src4) > 0 && len(dst4) > 0 {
+			fmt.Fprintf(&b, "\t\t%s ip saddr { %s } ip daddr { %s } accept\n", match, src4, dst4)
+		}
+		if len(src6) > 0 && len(dst6) > 0 {
+			fmt.Fprintf(&b, "\t\t%s ip6 saddr { %s } ip6 daddr { %s } accept\n", match, src6, dst6)
+		}
+	}
+	fmt.Fprintf(&b, "\t\t%s drop\n", match)
+	b.WriteString("\t}\n}\n")
+	return b.String()
+}
+
+// splitFamilies returns prefixes as comma-separated IPv4 and IPv6 lists,
+// writing host prefixes as plain addresses.
+func splitFamilies(prefixes []netip.Prefix) (v4, v6 string) {
+	var four, six []string
+	for _, p := range prefixes {
+		s := p.String()
+		if p.IsSingleIP() {
+			s = p.Addr().String()
+		}
+		if p.Addr().Is4() {
+			four = append(four, s)
+		} else {
+			six = append(six, s)
+		}
+	}
+	return strings.Join(four, ", "), strings.Join(six, ", ")
+}
+
+// ApplyFirewall installs the hub's ACL rules for iface.
+func ApplyFirewall(iface string, rules []FirewallRule) error {
+	return DefaultManager().ApplyFirewall(iface, rules)
+}
@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"vpnctl/internal/addrutil"
 	"vpnctl/internal/config"
 )
 
@@ -21,6 +22,8 @@ type Peer struct {
 }
 
 // RenderNode renders a WireGuard config for a node using hub-only topology.
+// A dual-stack vpn_ip ("10.7.0.2/32,fd7a::2/128") yields one Address line
+// listing both.
 func RenderNode(cfg config.NodeConfig) (string, error) {
 	if cfg.WGPrivateKey == "" {
 		return "", fmt.Errorf("wg_private_key is required")
@@ -44,7 +47,7 @@ func RenderNode(cfg config.NodeConfig) (string, error) {
 	b.WriteString(cfg.WGPrivateKey)
 	b.WriteString("\n")
 	b.WriteString("Address = ")
-	b.WriteString(cfg.VPNIP)
+	b.WriteString(strings.Join(addrutil.SplitList(cfg.VPNIP), ", "))
 	b.WriteString("\n")
 	if cfg.MTU > 0 {
 		fmt.Fprintf(&b, "MTU = %d\n", cfg.MTU)
@@ -109,16 +112,20 @@ func RenderSetConf(cfg config.NodeConfig, peers []Peer) (string, error) {
 	}
 
 	for _, peer := range peers {
-		if peer.PublicKey == "" || peer.Endpoint == "" || len(peer.AllowedIPs) == 0 {
+		if peer.PublicKey == "" || len(peer.AllowedIPs) == 0 {
 			continue
 		}
 		b.WriteString("\n[Peer]\n")
 		b.WriteString("PublicKey = ")
 		b.WriteString(peer.PublicKey)
 		b.WriteString("\n")
-		b.WriteString("Endpoint = ")
-		b.WriteString(peer.Endpoint)
-		b.WriteString("\n")
+		// An exit node may not know the endpoint of a client behind NAT; it
+		// learns it from the client's handshake.
+		if peer.Endpoint != "" {
+			b.WriteString("Endpoint = ")
+			b.WriteString(peer.Endpoint)
+			b.WriteString("\n")
+		}
 		b.WriteString("AllowedIPs = ")
 		b.WriteString(strings.Join(peer.AllowedIPs, ", "))
 		b.WriteString("\n")
@@ -157,3 +164,8 @@ func Status(iface string) (string, error) {
 func ApplyPeers(cfg config.NodeConfig, peers []Peer) error {
 	return DefaultManager().ApplyPeers(cfg, peers)
 }
+
+// ApplyRoutes moves the hub peer's routes from prev to next.
+func ApplyRoutes(prev, next config.NodeConfig, peers []Peer) error {
+	return DefaultManager().ApplyRoutes(prev, next, peers)
+}
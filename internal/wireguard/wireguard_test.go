@@ -4,6 +4,9 @@
 package wireguard
 
 import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"net/netip"
 	"strings"
 	"testing"
 
@@ -41,6 +44,29 @@ func TestRenderNode_IncludesMTUAndListenPort(t *testing.T) {
 	}
 }
 
+func TestRenderNode_DualStackAddress(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.NodeConfig{
+		WGPrivateKey:     "priv",
+		VPNIP:            "10.7.0.2/32,fd7a::2/128",
+		ServerPublicKey:  "serverpub",
+		ServerEndpoint:   "1.2.3.4:51820",
+		ServerAllowedIPs: []string{"10.7.0.0/24", "fd7a::/64"},
+	}
+
+	out, err := RenderNode(cfg)
+	if err != nil {
+		t.Fatalf("RenderNode: %v", err)
+	}
+	if !strings.Contains(out, "Address = 10.7.0.2/32, fd7a::2/128\n") {
+		t.Fatalf("missing dual-stack address: %s", out)
+	}
+	if !strings.Contains(out, "AllowedIPs = 10.7.0.0/24, fd7a::/64\n") {
+		t.Fatalf("missing dual-stack allowed ips: %s", out)
+	}
+}
+
 func TestRenderSetConf_RendersPeers(t *testing.T) {
 	t.Parallel()
 
@@ -61,3 +87,73 @@ func TestRenderSetConf_RendersPeers(t *testing.T) {
 		t.Fatalf("missing peer: %s", out)
 	}
 }
+
+func TestRenderServerSetConf_PendingKeyPeer(t *testing.T) {
+	t.Parallel()
+
+	out, err := RenderServerSetConf(ServerConfig{PrivateKey: "priv", ListenPort: 51820}, []Peer{
+		{PublicKey: "old", AllowedIPs: []string{"10.7.0.2/32"}},
+		{PublicKey: "new"},
+	})
+	if err != nil {
+		t.Fatalf("RenderServerSetConf: %v", err)
+	}
+	if !strings.Contains(out, "PublicKey = new\n") || strings.Count(out, "AllowedIPs") != 1 {
+		t.Fatalf("unexpected conf: %s", out)
+	}
+}
+
+func TestRenderFirewall_DualStackRules(t *testing.T) {
+	t.Parallel()
+
+	out := RenderFirewall("wg0", []FirewallRule{{
+		Src: []netip.Prefix{netip.MustParsePrefix("10.7.0.2/32"), netip.MustParsePrefix("fd7a::2/128")},
+		Dst: []netip.Prefix{netip.MustParsePrefix("10.7.0.3/32"), netip.MustParsePrefix("192.168.50.0/24")},
+	}})
+	for _, want := range []string{
+		"delete table inet vpnctl\n",
+		`iifname "wg0" oifname "wg0" ct state established,related accept`,
+		`iifname "wg0" oifname "wg0" ip saddr { 10.7.0.2 } ip daddr { 10.7.0.3, 192.168.50.0/24 } accept`,
+		`iifname "wg0" oifname "wg0" drop`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+	// The IPv6 source has no IPv6 destination to reach.
+	if strings.Contains(out, "ip6 saddr") {
+		t.Fatalf("unexpected ip6 rule:\n%s", out)
+	}
+}
+
+func TestRenderMasquerade(t *testing.T) {
+	t.Parallel()
+
+	out := RenderMasquerade("wg0")
+	if !strings.HasPrefix(out, "table inet vpnctl_exit\ndelete table inet vpnctl_exit\n") {
+		t.Fatalf("expected the table to be replaced: %s", out)
+	}
+	if !strings.Contains(out, "type nat hook postrouting priority srcnat;") || !strings.Contains(out, `iifname "wg0" oifname != "wg0" masquerade`) {
+		t.Fatalf("missing masquerade rule: %s", out)
+	}
+}
+
+func TestGenerateKeyPair(t *testing.T) {
+	t.Parallel()
+
+	priv, pub, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair: %v", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(priv)
+	if err != nil || len(raw) != 32 {
+		t.Fatalf("private key %q: %v", priv, err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		t.Fatalf("NewPrivateKey: %v", err)
+	}
+	if got := base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()); got != pub {
+		t.Fatalf("public key %q does not match private key (%q)", pub, got)
+	}
+}